@@ -1473,3 +1473,319 @@ func TestEventReportsGetDelete(t *testing.T) {
 		})
 	})
 }
+
+// adminTestServer is a roomserver and userapi with the client API routes on
+// top, and an admin user who is logged in.
+type adminTestServer struct {
+	routers     httputil.Routers
+	rsAPI       api.RoomserverInternalAPI
+	accessToken string
+}
+
+// newAdminTestServer starts an adminTestServer for the given database type, in
+// which the events of the room have been sent by the admin. The config can be
+// changed with configure before anything is started.
+func newAdminTestServer(t *testing.T, dbType test.DBType, admin *test.User, room *test.Room, configure func(cfg *config.Dendrite)) *adminTestServer {
+	t.Helper()
+	ctx := context.Background()
+	cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+	t.Cleanup(close)
+	if configure != nil {
+		configure(cfg)
+	}
+	caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+	natsInstance := jetstream.NATSInstance{}
+
+	routers := httputil.NewRouters()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+	rsAPI.SetFederationAPI(nil, nil)
+
+	userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+	rsAPI.SetUserAPI(userAPI)
+
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", api.DoNotSendToOtherServers, nil, false); err != nil {
+		t.Fatalf("failed to send events: %v", err)
+	}
+
+	// We mostly need the rsAPI for these tests, so nil for other APIs/caches etc.
+	AddPublicRoutes(processCtx, routers, cfg, &natsInstance, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, caching.DisableMetrics)
+
+	accessTokens := map[*test.User]userDevice{
+		admin: {},
+	}
+	createAccessTokens(t, accessTokens, userAPI, ctx, routers)
+
+	return &adminTestServer{
+		routers:     routers,
+		rsAPI:       rsAPI,
+		accessToken: accessTokens[admin].accessToken,
+	}
+}
+
+// doRequest sends a request as the admin to the router, failing the test if the
+// response doesn't have the wanted status code, and returns the response body.
+func (s *adminTestServer) doRequest(t *testing.T, router http.Handler, method, path string, body map[string]interface{}, wantCode int) gjson.Result {
+	t.Helper()
+	var req *http.Request
+	if body != nil {
+		req = test.NewRequest(t, method, path, test.WithJSONBody(t, body))
+	} else {
+		req = test.NewRequest(t, method, path)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.accessToken)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != wantCode {
+		t.Fatalf("expected http status %d, got %d: %s", wantCode, rec.Code, rec.Body.String())
+	}
+	return gjson.ParseBytes(rec.Body.Bytes())
+}
+
+func TestAdminRoomDetails(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin, test.RoomPreset(test.PresetPublicChat))
+
+	// Join Bob
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	room.CreateAndInsert(t, aliceAdmin, "m.room.encryption", map[string]interface{}{
+		"algorithm": "m.megolm.v1.aes-sha2",
+	}, test.WithStateKey(""))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		srv := newAdminTestServer(t, dbType, aliceAdmin, room, nil)
+		doRequest := func(t *testing.T, path string, wantCode int) gjson.Result {
+			t.Helper()
+			return srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodGet, "/_dendrite/admin/rooms/"+path, nil, wantCode)
+		}
+
+		t.Run("details", func(t *testing.T) {
+			res := doRequest(t, room.ID, http.StatusOK)
+			for path, want := range map[string]string{
+				"room_id":                room.ID,
+				"room_version":           string(room.Version),
+				"creator":                aliceAdmin.ID,
+				"join_rules":             spec.Public,
+				"encryption":             "m.megolm.v1.aes-sha2",
+				"member_counts.join":     "2",
+				"joined_local_members.#": "2",
+				"public":                 "false",
+				"forward_extremities":    "1",
+			} {
+				if got := res.Get(path).String(); got != want {
+					t.Errorf("expected %s to be %q, got %q", path, want, got)
+				}
+			}
+		})
+
+		t.Run("members", func(t *testing.T) {
+			res := doRequest(t, room.ID+"/members?membership=join", http.StatusOK)
+			if total := res.Get("total").Int(); total != 2 {
+				t.Fatalf("expected 2 members, got %d", total)
+			}
+			for _, member := range res.Get("members").Array() {
+				if !member.Get("local").Bool() {
+					t.Errorf("expected %s to be local", member.Get("user_id").Str)
+				}
+			}
+		})
+
+		t.Run("state", func(t *testing.T) {
+			res := doRequest(t, room.ID+"/state", http.StatusOK)
+			var stateEvents int
+			for _, ev := range room.Events() {
+				if ev.StateKey() != nil {
+					stateEvents++
+				}
+			}
+			if total := res.Get("total").Int(); total != int64(stateEvents) {
+				t.Fatalf("expected %d state events, got %d", stateEvents, total)
+			}
+			if got := res.Get("state.0.type").Str; got != "m.room.create" {
+				t.Fatalf("expected the state to be sorted by type, got %q first", got)
+			}
+		})
+
+		t.Run("forward extremities", func(t *testing.T) {
+			res := doRequest(t, room.ID+"/forwardExtremities?limit=1", http.StatusOK)
+			lastEvent := room.Events()[len(room.Events())-1]
+			if got := res.Get("forward_extremities.0").Str; got != lastEvent.EventID() {
+				t.Fatalf("expected forward extremity %s, got %s", lastEvent.EventID(), got)
+			}
+			if res.Get("next_token").Exists() {
+				t.Fatalf("expected no next_token, got %s", res.Get("next_token").Raw)
+			}
+		})
+
+		t.Run("unknown room", func(t *testing.T) {
+			doRequest(t, "!doesnotexist:localhost", http.StatusNotFound)
+			doRequest(t, "!doesnotexist:localhost/state", http.StatusNotFound)
+		})
+
+		t.Run("invalid room ID", func(t *testing.T) {
+			doRequest(t, "@doesnotexist:localhost", http.StatusBadRequest)
+		})
+	})
+}
+
+func TestAdminBlockAndDeleteRoom(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		srv := newAdminTestServer(t, dbType, aliceAdmin, room, nil)
+		doRequest := func(t *testing.T, method, path string, body map[string]interface{}, wantCode int) gjson.Result {
+			t.Helper()
+			return srv.doRequest(t, srv.routers.DendriteAdmin, method, "/_dendrite/admin/"+path, body, wantCode)
+		}
+
+		t.Run("block", func(t *testing.T) {
+			// Unknown rooms can be blocked too.
+			res := doRequest(t, http.MethodGet, "rooms/!unknown:test/block", nil, http.StatusOK)
+			if res.Get("block").Bool() {
+				t.Fatalf("expected room not to be blocked")
+			}
+			doRequest(t, http.MethodPut, "rooms/!unknown:test/block", map[string]interface{}{}, http.StatusBadRequest)
+			res = doRequest(t, http.MethodPut, "rooms/!unknown:test/block", map[string]interface{}{"block": true}, http.StatusOK)
+			if !res.Get("block").Bool() || res.Get("user_id").Str != aliceAdmin.ID {
+				t.Fatalf("expected room to be blocked by %s, got %s", aliceAdmin.ID, res.Raw)
+			}
+			res = doRequest(t, http.MethodPut, "rooms/!unknown:test/block", map[string]interface{}{"block": false}, http.StatusOK)
+			if res.Get("block").Bool() {
+				t.Fatalf("expected room to be unblocked")
+			}
+		})
+
+		t.Run("delete", func(t *testing.T) {
+			doRequest(t, http.MethodPost, "rooms/!unknown:test/delete", map[string]interface{}{}, http.StatusNotFound)
+			doRequest(t, http.MethodGet, "deleteRoomStatus/unknown", nil, http.StatusNotFound)
+
+			res := doRequest(t, http.MethodPost, "rooms/"+room.ID+"/delete", map[string]interface{}{
+				"block":            true,
+				"purge":            false,
+				"new_room_user_id": aliceAdmin.ID,
+			}, http.StatusOK)
+			deleteID := res.Get("delete_id").Str
+			for i := 0; i < 100; i++ {
+				res = doRequest(t, http.MethodGet, "deleteRoomStatus/"+deleteID, nil, http.StatusOK)
+				if res.Get("status").Str != api.DeleteRoomStatusActive {
+					break
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			if status := res.Get("status").Str; status != api.DeleteRoomStatusComplete {
+				t.Fatalf("expected delete to complete, got %s", res.Raw)
+			}
+			if kicked := res.Get("kicked_users.#").Int(); kicked != 2 {
+				t.Fatalf("expected 2 kicked users, got %d", kicked)
+			}
+			if res.Get("new_room_id").Str == "" {
+				t.Fatalf("expected a new room to be created")
+			}
+
+			res = doRequest(t, http.MethodGet, "rooms/"+room.ID+"/block", nil, http.StatusOK)
+			if !res.Get("block").Bool() {
+				t.Fatalf("expected room to be blocked")
+			}
+		})
+	})
+}
+
+func TestAdminRoomDirectory(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	room := test.NewRoom(t, aliceAdmin, test.RoomPreset(test.PresetPublicChat))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		srv := newAdminTestServer(t, dbType, aliceAdmin, room, func(cfg *config.Dendrite) {
+			cfg.RoomServer.RoomDirectory.PublicationPolicy = config.PublicationPolicyApproval
+		})
+
+		// Publishing the room queues it for approval.
+		srv.doRequest(t, srv.routers.Client, http.MethodPut, "/_matrix/client/v3/directory/list/room/"+room.ID, map[string]interface{}{
+			"visibility": "public",
+		}, http.StatusForbidden)
+		res := srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodGet, "/_dendrite/admin/roomDirectory", nil, http.StatusOK)
+		if n := res.Get("rooms.#").Int(); n != 0 {
+			t.Fatalf("expected no published rooms, got %s", res.Raw)
+		}
+		res = srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodGet, "/_dendrite/admin/roomDirectory/requests", nil, http.StatusOK)
+		if res.Get("requests.#").Int() != 1 || res.Get("requests.0.room_id").Str != room.ID || res.Get("requests.0.requested_by").Str != aliceAdmin.ID {
+			t.Fatalf("expected a publication request for %s, got %s", room.ID, res.Raw)
+		}
+
+		srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodPost, "/_dendrite/admin/roomDirectory/requests/!unknown:test/approve", nil, http.StatusNotFound)
+		srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodPost, "/_dendrite/admin/roomDirectory/requests/"+room.ID+"/approve", nil, http.StatusOK)
+		srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodPost, "/_dendrite/admin/roomDirectory/requests/"+room.ID+"/reject", nil, http.StatusNotFound)
+
+		res = srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodGet, "/_dendrite/admin/roomDirectory", nil, http.StatusOK)
+		if res.Get("rooms.#").Int() != 1 || res.Get("rooms.0.room_id").Str != room.ID || res.Get("rooms.0.published_by").Str != aliceAdmin.ID {
+			t.Fatalf("expected %s to be published by %s, got %s", room.ID, aliceAdmin.ID, res.Raw)
+		}
+
+		srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodDelete, "/_dendrite/admin/roomDirectory/"+room.ID, nil, http.StatusOK)
+		res = srv.doRequest(t, srv.routers.DendriteAdmin, http.MethodGet, "/_dendrite/admin/roomDirectory", nil, http.StatusOK)
+		if n := res.Get("rooms.#").Int(); n != 0 {
+			t.Fatalf("expected no published rooms, got %s", res.Raw)
+		}
+	})
+}
+
+func TestAdminRedactUserEvents(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, aliceAdmin, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	spam := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "spam"})
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		srv := newAdminTestServer(t, dbType, aliceAdmin, room, nil)
+		doRequest := func(t *testing.T, method, path string, body map[string]interface{}, wantCode int) gjson.Result {
+			t.Helper()
+			return srv.doRequest(t, srv.routers.DendriteAdmin, method, path, body, wantCode)
+		}
+
+		doRequest(t, http.MethodPost, "/_dendrite/admin/redactUserEvents/bob", map[string]interface{}{}, http.StatusBadRequest)
+		for _, rateLimit := range []float64{-1, 1e-300, 1e6} {
+			doRequest(t, http.MethodPost, "/_dendrite/admin/redactUserEvents/"+bob.ID, map[string]interface{}{
+				"rate_limit": rateLimit,
+			}, http.StatusBadRequest)
+		}
+		doRequest(t, http.MethodGet, "/_dendrite/admin/redactUserEventsStatus/unknown", nil, http.StatusNotFound)
+
+		res := doRequest(t, http.MethodPost, "/_dendrite/admin/redactUserEvents/"+bob.ID, map[string]interface{}{
+			"room_ids":   []string{room.ID},
+			"reason":     "spam",
+			"rate_limit": 100,
+		}, http.StatusOK)
+		jobID := res.Get("job_id").Str
+		for i := 0; i < 100; i++ {
+			res = doRequest(t, http.MethodGet, "/_dendrite/admin/redactUserEventsStatus/"+jobID, nil, http.StatusOK)
+			if res.Get("status").Str != api.RedactUserEventsStatusActive {
+				break
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		if res.Get("status").Str != api.RedactUserEventsStatusComplete || res.Get("events_redacted").Int() != 1 {
+			t.Fatalf("expected one event to be redacted, got %s", res.Raw)
+		}
+
+		queryRes := &api.QueryEventsByIDResponse{}
+		err := srv.rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{RoomID: room.ID, EventIDs: []string{spam.EventID()}}, queryRes)
+		if err != nil || len(queryRes.Events) != 1 {
+			t.Fatalf("failed to query events: %v", err)
+		}
+		if !gjson.GetBytes(queryRes.Events[0].Unsigned(), "redacted_because").Exists() {
+			t.Fatalf("expected %s to be redacted", spam.EventID())
+		}
+	})
+}
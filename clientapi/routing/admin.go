@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -328,6 +329,76 @@ func AdminPurgeRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI)
 	}
 }
 
+func AdminPurgeHistory(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	var request struct {
+		EventID           string         `json:"event_id"`
+		TS                spec.Timestamp `json:"ts"`
+		DeleteLocalEvents bool           `json:"delete_local_events"`
+	}
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	if (request.EventID == "") == (request.TS == 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Exactly one of event_id or ts must be given"),
+		}
+	}
+
+	purgeID, err := rsAPI.PerformAdminPurgeHistory(req.Context(), &roomserverAPI.PerformPurgeHistoryRequest{
+		RoomID:            vars["roomID"],
+		BeforeEventID:     request.EventID,
+		BeforeTS:          request.TS,
+		DeleteLocalEvents: request.DeleteLocalEvents,
+	})
+	if err != nil {
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		}
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]string{
+			"purge_id": purgeID,
+		},
+	}
+}
+
+func AdminPurgeHistoryStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	status, err := rsAPI.QueryAdminPurgeHistoryStatus(req.Context(), vars["purgeID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if status == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("purge: %s not found", vars["purgeID"])),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: status,
+	}
+}
+
 func AdminResetPassword(req *http.Request, cfg *config.ClientAPI, device *api.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
 	if req.Body == nil {
 		return util.JSONResponse{
@@ -602,3 +673,176 @@ func parseUint64OrDefault(input string, defaultValue uint64) uint64 {
 	}
 	return v
 }
+
+func AdminCompressState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	var request struct {
+		RoomID string `json:"room_id"`
+	}
+	// The body is optional, as leaving out the room compresses every room.
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+
+	jobID, err := rsAPI.PerformAdminCompressState(req.Context(), request.RoomID)
+	if err != nil {
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		}
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]string{
+			"job_id": jobID,
+		},
+	}
+}
+
+func AdminCompressStateStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	status, err := rsAPI.QueryAdminCompressStateStatus(req.Context(), vars["jobID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if status == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("job: %s not found", vars["jobID"])),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: status,
+	}
+}
+
+func AdminCheckIntegrity(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	var request struct {
+		RoomID string `json:"room_id"`
+	}
+	// The body is optional, as leaving out the room checks every room.
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+
+	jobID, err := rsAPI.PerformAdminCheckIntegrity(req.Context(), request.RoomID)
+	if err != nil {
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		}
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]string{
+			"job_id": jobID,
+		},
+	}
+}
+
+func AdminCheckIntegrityStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	status, err := rsAPI.QueryAdminCheckIntegrityStatus(req.Context(), vars["jobID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if status == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("job: %s not found", vars["jobID"])),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: status,
+	}
+}
+
+func AdminRedactUserEvents(req *http.Request, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	var request struct {
+		RoomIDs   []string       `json:"room_ids"`
+		Since     spec.Timestamp `json:"since_ts"`
+		Until     spec.Timestamp `json:"until_ts"`
+		Reason    string         `json:"reason"`
+		RateLimit float64        `json:"rate_limit"`
+	}
+	// The body is optional, as leaving it out redacts everything the user sent.
+	if err = json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+
+	jobID, err := rsAPI.PerformAdminRedactUserEvents(req.Context(), &roomserverAPI.PerformRedactUserEventsRequest{
+		UserID:      vars["userID"],
+		RequestedBy: device.UserID,
+		RoomIDs:     request.RoomIDs,
+		Since:       request.Since,
+		Until:       request.Until,
+		Reason:      request.Reason,
+		RateLimit:   request.RateLimit,
+	})
+	if err != nil {
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: map[string]string{
+			"job_id": jobID,
+		},
+	}
+}
+
+func AdminRedactUserEventsStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	status, err := rsAPI.QueryAdminRedactUserEventsStatus(req.Context(), vars["jobID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if status == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("job: %s not found", vars["jobID"])),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: 200,
+		JSON: status,
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	federationAPI "github.com/element-hq/dendrite/federationapi/api"
+	"github.com/element-hq/dendrite/internal/fedcapture"
+	"github.com/element-hq/dendrite/internal/fedcheck"
+	"github.com/element-hq/dendrite/internal/httputil"
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+// destinationFromRequest extracts and validates the destination server name
+// from the request path.
+func destinationFromRequest(req *http.Request) (spec.ServerName, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	serverName := spec.ServerName(vars["serverName"])
+	if _, _, ok := spec.ParseAndValidateServerName(serverName); !ok {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid server name."),
+		}
+	}
+	return serverName, nil
+}
+
+func AdminListFederationDestinations(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	destinations, err := fsAPI.QueryDestinations(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query federation destinations")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"destinations": destinations,
+			"total":        len(destinations),
+		},
+	}
+}
+
+func AdminGetFederationDestination(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	destination, err := fsAPI.QueryDestination(req.Context(), serverName)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to query federation destination")
+		return util.ErrorResponse(err)
+	}
+	if destination == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown destination."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: destination,
+	}
+}
+
+func AdminResetFederationBackoff(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	if err := fsAPI.PerformResetBackoff(req.Context(), serverName); err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to reset federation backoff")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func AdminUnblacklistFederationDestination(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	wasBlacklisted, err := fsAPI.PerformUnblacklist(req.Context(), serverName)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to unblacklist federation destination")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"was_blacklisted": wasBlacklisted,
+		},
+	}
+}
+
+func AdminPurgeFederationQueue(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	pdus, edus, err := fsAPI.PerformPurgeDestinationQueue(req.Context(), serverName)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to purge federation queue")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"purged_pdus": pdus,
+			"purged_edus": edus,
+		},
+	}
+}
+
+func AdminListServerSigningKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	var serverName spec.ServerName
+	if _, ok := mux.Vars(req)["serverName"]; ok {
+		var resErr *util.JSONResponse
+		if serverName, resErr = destinationFromRequest(req); resErr != nil {
+			return *resErr
+		}
+	}
+	keys, err := fsAPI.QueryServerSigningKeys(req.Context(), serverName)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to query server signing keys")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"keys":  keys,
+			"total": len(keys),
+		},
+	}
+}
+
+func AdminDeleteServerSigningKeys(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	keyID := gomatrixserverlib.KeyID(req.URL.Query().Get("key_id"))
+	deleted, err := fsAPI.PerformDeleteServerSigningKeys(req.Context(), serverName, keyID)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to delete server signing keys")
+		return util.ErrorResponse(err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"deleted": deleted,
+		},
+	}
+}
+
+func AdminExpireServerSigningKey(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	serverName, resErr := destinationFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	var body struct {
+		KeyID     gomatrixserverlib.KeyID `json:"key_id"`
+		ExpiredTS spec.Timestamp          `json:"expired_ts"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	if body.KeyID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting a key_id."),
+		}
+	}
+	if body.ExpiredTS == 0 {
+		body.ExpiredTS = spec.AsTimestamp(time.Now())
+	}
+	found, err := fsAPI.PerformExpireServerSigningKey(req.Context(), serverName, body.KeyID, body.ExpiredTS)
+	if err != nil {
+		logrus.WithError(err).WithField("serverName", serverName).Error("Failed to expire server signing key")
+		return util.ErrorResponse(err)
+	}
+	if !found {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Server signing key not found."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"expired_ts": body.ExpiredTS,
+		},
+	}
+}
+
+func AdminFederationSelfCheck(req *http.Request, cfg *config.Dendrite) util.JSONResponse {
+	serverName := cfg.Global.ServerName
+	if name := req.URL.Query().Get("server_name"); name != "" {
+		serverName = spec.ServerName(name)
+	}
+	checker, err := fedcheck.NewLocalChecker(cfg, serverName)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("The server name isn't one of ours."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: checker.Check(req.Context(), serverName),
+	}
+}
+
+// captureRecorder returns the federation capture recorder, or an error
+// response if capturing isn't enabled.
+func captureRecorder(fsAPI federationAPI.ClientFederationAPI) (*fedcapture.Recorder, *util.JSONResponse) {
+	recorder := fsAPI.FederationCapture()
+	if recorder == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Federation capture is not enabled."),
+		}
+	}
+	return recorder, nil
+}
+
+func AdminGetFederationCapture(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	recorder, resErr := captureRecorder(fsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	exchanges := recorder.Exchanges()
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"servers":   recorder.Servers(),
+			"exchanges": exchanges,
+			"total":     len(exchanges),
+		},
+	}
+}
+
+func AdminSetFederationCaptureServers(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	recorder, resErr := captureRecorder(fsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	var body struct {
+		Servers []string `json:"servers"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	for _, server := range body.Servers {
+		if _, _, ok := spec.ParseAndValidateServerName(spec.ServerName(server)); !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("Invalid server name " + server + "."),
+			}
+		}
+	}
+	recorder.SetServers(body.Servers)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"servers": recorder.Servers(),
+		},
+	}
+}
+
+func AdminClearFederationCapture(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	recorder, resErr := captureRecorder(fsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	recorder.Clear()
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func AdminExportFederationCapture(req *http.Request, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	recorder, resErr := captureRecorder(fsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	id, err := strconv.ParseInt(mux.Vars(req)["exchangeID"], 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid exchange ID."),
+		}
+	}
+	exchange, ok := recorder.Exchange(id)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Exchange not found, it may have been evicted from the buffer."),
+		}
+	}
+	if exchange.RequestTruncated {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("The request body was truncated when captured, so it can't be replayed."),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: exchange.Replay(),
+	}
+}
@@ -0,0 +1,586 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/internal/httputil"
+	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/syncapi/synctypes"
+	userapi "github.com/element-hq/dendrite/userapi/api"
+)
+
+// adminRoomDetailsState is the current state that is looked up for the room
+// details endpoint.
+var adminRoomDetailsState = []gomatrixserverlib.StateKeyTuple{
+	{EventType: spec.MRoomCreate, StateKey: ""},
+	{EventType: spec.MRoomName, StateKey: ""},
+	{EventType: spec.MRoomTopic, StateKey: ""},
+	{EventType: spec.MRoomCanonicalAlias, StateKey: ""},
+	{EventType: spec.MRoomJoinRules, StateKey: ""},
+	{EventType: spec.MRoomHistoryVisibility, StateKey: ""},
+	{EventType: spec.MRoomGuestAccess, StateKey: ""},
+	{EventType: "m.room.encryption", StateKey: ""},
+}
+
+// AdminRoomDetails is the response of the room details endpoint.
+type AdminRoomDetails struct {
+	RoomID             string         `json:"room_id"`
+	RoomVersion        string         `json:"room_version"`
+	Creator            string         `json:"creator"`
+	Name               string         `json:"name,omitempty"`
+	Topic              string         `json:"topic,omitempty"`
+	CanonicalAlias     string         `json:"canonical_alias,omitempty"`
+	Aliases            []string       `json:"aliases"`
+	JoinRule           string         `json:"join_rules,omitempty"`
+	HistoryVisibility  string         `json:"history_visibility,omitempty"`
+	GuestAccess        string         `json:"guest_access,omitempty"`
+	Encryption         string         `json:"encryption,omitempty"`
+	Public             bool           `json:"public"`
+	MemberCounts       map[string]int `json:"member_counts"`
+	JoinedLocalMembers []string       `json:"joined_local_members"`
+	ForwardExtremities int            `json:"forward_extremities"`
+	Depth              int64          `json:"depth"`
+}
+
+// AdminRoomMember is a single membership returned by the room members endpoint.
+type AdminRoomMember struct {
+	UserID      string `json:"user_id"`
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+	Local       bool   `json:"local"`
+}
+
+// roomIDFromRequest extracts and validates the room ID from the request path.
+func roomIDFromRequest(req *http.Request) (*spec.RoomID, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	roomID, err := spec.NewRoomID(vars["roomID"])
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Invalid room ID."),
+		}
+	}
+	return roomID, nil
+}
+
+// queryAdminRoom returns the latest events of the room, along with the
+// current state for the given tuples, or all of the current state if none
+// are given. Returns an error response if the room is not known.
+func queryAdminRoom(
+	ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, roomID spec.RoomID,
+	stateToFetch []gomatrixserverlib.StateKeyTuple,
+) (*roomserverAPI.QueryLatestEventsAndStateResponse, *util.JSONResponse) {
+	res := &roomserverAPI.QueryLatestEventsAndStateResponse{}
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &roomserverAPI.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID.String(),
+		StateToFetch: stateToFetch,
+	}, res); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query room")
+		return nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !res.RoomExists {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("room %s not found", roomID.String())),
+		}
+	}
+	return res, nil
+}
+
+func AdminGetRoomDetails(req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, resErr := roomIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	latestRes, resErr := queryAdminRoom(ctx, rsAPI, *roomID, []gomatrixserverlib.StateKeyTuple{
+		{EventType: spec.MRoomCreate, StateKey: ""},
+	})
+	if resErr != nil {
+		return *resErr
+	}
+
+	stateRes := &roomserverAPI.QueryCurrentStateResponse{}
+	if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+		RoomID:      roomID.String(),
+		StateTuples: adminRoomDetailsState,
+	}, stateRes); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query current state")
+		return util.ErrorResponse(err)
+	}
+	stateContent := func(eventType, path string) string {
+		ev, ok := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]
+		if !ok {
+			return ""
+		}
+		return gjson.GetBytes(ev.Content(), path).Str
+	}
+
+	details := AdminRoomDetails{
+		RoomID:             roomID.String(),
+		RoomVersion:        string(latestRes.RoomVersion),
+		Name:               stateContent(spec.MRoomName, "name"),
+		Topic:              stateContent(spec.MRoomTopic, "topic"),
+		CanonicalAlias:     stateContent(spec.MRoomCanonicalAlias, "alias"),
+		Aliases:            []string{},
+		JoinRule:           stateContent(spec.MRoomJoinRules, "join_rule"),
+		HistoryVisibility:  stateContent(spec.MRoomHistoryVisibility, "history_visibility"),
+		GuestAccess:        stateContent(spec.MRoomGuestAccess, "guest_access"),
+		Encryption:         stateContent("m.room.encryption", "algorithm"),
+		MemberCounts:       map[string]int{},
+		JoinedLocalMembers: []string{},
+		ForwardExtremities: len(latestRes.LatestEvents),
+		Depth:              latestRes.Depth,
+	}
+	if createEvent, ok := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCreate, StateKey: ""}]; ok {
+		details.Creator = string(createEvent.SenderID())
+		if creator, err := rsAPI.QueryUserIDForSender(ctx, *roomID, createEvent.SenderID()); err == nil && creator != nil {
+			details.Creator = creator.String()
+		}
+	}
+
+	members, err := queryAdminRoomMembers(ctx, cfg, rsAPI, *roomID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query room members")
+		return util.ErrorResponse(err)
+	}
+	for _, member := range members {
+		details.MemberCounts[member.Membership]++
+		if member.Local && member.Membership == spec.Join {
+			details.JoinedLocalMembers = append(details.JoinedLocalMembers, member.UserID)
+		}
+	}
+
+	publishedRes := &roomserverAPI.QueryPublishedRoomsResponse{}
+	if err = rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{
+		RoomID: roomID.String(),
+	}, publishedRes); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query published rooms")
+		return util.ErrorResponse(err)
+	}
+	details.Public = len(publishedRes.RoomIDs) > 0
+
+	aliasesRes := &roomserverAPI.GetAliasesForRoomIDResponse{}
+	if err = rsAPI.GetAliasesForRoomID(ctx, &roomserverAPI.GetAliasesForRoomIDRequest{
+		RoomID: roomID.String(),
+	}, aliasesRes); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query room aliases")
+		return util.ErrorResponse(err)
+	}
+	if len(aliasesRes.Aliases) > 0 {
+		details.Aliases = aliasesRes.Aliases
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: details,
+	}
+}
+
+func AdminGetRoomMembers(req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, resErr := roomIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	if _, resErr = queryAdminRoom(req.Context(), rsAPI, *roomID, []gomatrixserverlib.StateKeyTuple{
+		{EventType: spec.MRoomCreate, StateKey: ""},
+	}); resErr != nil {
+		return *resErr
+	}
+	members, err := queryAdminRoomMembers(req.Context(), cfg, rsAPI, *roomID)
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query room members")
+		return util.ErrorResponse(err)
+	}
+
+	// Optionally only return the members with the given membership.
+	if membership := req.URL.Query().Get("membership"); membership != "" {
+		filtered := members[:0]
+		for _, member := range members {
+			if member.Membership == membership {
+				filtered = append(filtered, member)
+			}
+		}
+		members = filtered
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"members": members,
+			"total":   len(members),
+		},
+	}
+}
+
+// queryAdminRoomMembers returns every user with a membership in the room,
+// sorted by user ID.
+func queryAdminRoomMembers(
+	ctx context.Context, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, roomID spec.RoomID,
+) ([]AdminRoomMember, error) {
+	res := &roomserverAPI.QueryMembershipsForRoomResponse{}
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID: roomID.String(),
+	}, res); err != nil {
+		return nil, err
+	}
+	members := make([]AdminRoomMember, 0, len(res.JoinEvents))
+	for _, ev := range res.JoinEvents {
+		if ev.StateKey == nil {
+			continue
+		}
+		member := AdminRoomMember{
+			UserID:      *ev.StateKey,
+			Membership:  gjson.GetBytes(ev.Content, "membership").Str,
+			DisplayName: gjson.GetBytes(ev.Content, "displayname").Str,
+		}
+		if userID, err := spec.NewUserID(member.UserID, true); err == nil {
+			member.Local = cfg.Matrix.IsLocalServerName(userID.Domain())
+		}
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+	return members, nil
+}
+
+func AdminGetRoomState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, resErr := roomIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	ctx := req.Context()
+	// Not giving any tuples returns all of the current state.
+	latestRes, resErr := queryAdminRoom(ctx, rsAPI, *roomID, nil)
+	if resErr != nil {
+		return *resErr
+	}
+
+	stateEvents := make([]*types.HeaderedEvent, len(latestRes.StateEvents))
+	copy(stateEvents, latestRes.StateEvents)
+	sort.Slice(stateEvents, func(i, j int) bool {
+		if stateEvents[i].Type() != stateEvents[j].Type() {
+			return stateEvents[i].Type() < stateEvents[j].Type()
+		}
+		return *stateEvents[i].StateKey() < *stateEvents[j].StateKey()
+	})
+	state := make([]synctypes.ClientEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		state = append(state, synctypes.ToClientEventDefault(func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+		}, ev))
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"state": state,
+			"total": len(state),
+		},
+	}
+}
+
+func AdminGetRoomForwardExtremities(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, resErr := roomIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	latestRes, resErr := queryAdminRoom(req.Context(), rsAPI, *roomID, []gomatrixserverlib.StateKeyTuple{
+		{EventType: spec.MRoomCreate, StateKey: ""},
+	})
+	if resErr != nil {
+		return *resErr
+	}
+
+	from := parseUint64OrDefault(req.URL.Query().Get("from"), 0)
+	limit := parseUint64OrDefault(req.URL.Query().Get("limit"), 100)
+
+	extremities := latestRes.LatestEvents
+	sort.Strings(extremities)
+	total := uint64(len(extremities))
+	start := min(from, total)
+	end := start + min(limit, total-start)
+
+	resp := map[string]interface{}{
+		"forward_extremities": extremities[start:end],
+		"total":               total,
+		"depth":               latestRes.Depth,
+	}
+	// Add a next_token if there are still extremities
+	if end < total {
+		resp["next_token"] = end
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: resp,
+	}
+}
+
+func AdminMergeRoomForwardExtremities(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	merged, err := rsAPI.PerformAdminMergeForwardExtremities(req.Context(), roomID.String())
+	if err != nil {
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		}
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]int{
+			"merged": merged,
+		},
+	}
+}
+
+func AdminGetRoomBlock(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	block, err := rsAPI.QueryAdminRoomBlock(req.Context(), roomID.String())
+	if err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to query room block")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: block,
+	}
+}
+
+func AdminSetRoomBlock(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	var request struct {
+		Block *bool `json:"block"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	if request.Block == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Expecting 'block' to be set."),
+		}
+	}
+
+	if err := rsAPI.PerformAdminBlockRoom(req.Context(), roomID.String(), device.UserID, *request.Block); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to block room")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return AdminGetRoomBlock(req, rsAPI)
+}
+
+const (
+	defaultDeletedRoomName    = "Content Violation Notification"
+	defaultDeletedRoomMessage = "Sharing illegal content on this server is not permitted and rooms in violation will be blocked."
+)
+
+func AdminDeleteRoom(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	var request struct {
+		Block         bool    `json:"block"`
+		Purge         *bool   `json:"purge"`
+		NewRoomUserID string  `json:"new_room_user_id"`
+		RoomName      *string `json:"room_name"`
+		Message       *string `json:"message"`
+	}
+	// The body is optional, as by default users are only removed from the
+	// room before it is purged.
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+
+	deleteReq := &roomserverAPI.PerformDeleteRoomRequest{
+		RoomID:        roomID.String(),
+		RequestedBy:   device.UserID,
+		Block:         request.Block,
+		Purge:         request.Purge == nil || *request.Purge,
+		NewRoomUserID: request.NewRoomUserID,
+	}
+	if request.NewRoomUserID != "" {
+		deleteReq.NewRoomName = defaultDeletedRoomName
+		if request.RoomName != nil {
+			deleteReq.NewRoomName = *request.RoomName
+		}
+		deleteReq.Message = defaultDeletedRoomMessage
+		if request.Message != nil {
+			deleteReq.Message = *request.Message
+		}
+	}
+
+	deleteID, err := rsAPI.PerformAdminDeleteRoom(req.Context(), deleteReq)
+	if err != nil {
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound(err.Error()),
+			}
+		}
+		return util.MessageResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]string{
+			"delete_id": deleteID,
+		},
+	}
+}
+
+func AdminDeleteRoomStatus(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	status, err := rsAPI.QueryAdminDeleteRoomStatus(req.Context(), vars["deleteID"])
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if status == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("delete: %s not found", vars["deleteID"])),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: status,
+	}
+}
+
+func AdminGetPublishedRooms(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	rooms, err := rsAPI.QueryAdminPublishedRooms(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query published rooms")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"rooms": rooms,
+		},
+	}
+}
+
+func AdminUnpublishRoom(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	if err := rsAPI.PerformAdminUnpublishRoom(req.Context(), roomID.String(), device.UserID); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to unpublish room")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func AdminGetPublicationRequests(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	requests, err := rsAPI.QueryAdminPublicationRequests(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to query publication requests")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"requests": requests,
+		},
+	}
+}
+
+func AdminReviewPublicationRequest(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI, approve bool) util.JSONResponse {
+	roomID, errRes := roomIDFromRequest(req)
+	if errRes != nil {
+		return *errRes
+	}
+	err := rsAPI.PerformAdminReviewPublication(req.Context(), roomID.String(), device.UserID, approve)
+	switch {
+	case err == nil:
+	case errors.Is(err, roomserverAPI.ErrNoPublicationRequest):
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		logrus.WithError(err).WithField("room_id", roomID.String()).Error("Failed to review publication request")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
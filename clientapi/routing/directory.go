@@ -7,6 +7,7 @@
 package routing
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -427,10 +428,19 @@ func SetVisibility(
 		return *reqErr
 	}
 
-	if err = rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
+	err = rsAPI.PerformPublish(req.Context(), &roomserverAPI.PerformPublishRequest{
 		RoomID:     roomID,
 		Visibility: v.Visibility,
-	}); err != nil {
+		UserID:     dev.UserID,
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, roomserverAPI.ErrPublicationPending), errors.As(err, &roomserverAPI.ErrNotAllowed{}):
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(err.Error()),
+		}
+	default:
 		util.GetLogger(req.Context()).WithError(err).Error("failed to publish room")
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -469,6 +479,7 @@ func SetVisibilityAS(
 		Visibility:   v.Visibility,
 		NetworkID:    networkID,
 		AppserviceID: dev.AppserviceID,
+		UserID:       dev.UserID,
 	}); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("failed to publish room")
 		return util.JSONResponse{
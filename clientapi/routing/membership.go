@@ -16,9 +16,10 @@ import (
 
 	appserviceAPI "github.com/element-hq/dendrite/appservice/api"
 	"github.com/element-hq/dendrite/clientapi/auth/authtypes"
-	"github.com/element-hq/dendrite/clientapi/httputil"
+	clienthttputil "github.com/element-hq/dendrite/clientapi/httputil"
 	"github.com/element-hq/dendrite/clientapi/threepid"
 	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/internal/httputil"
 	"github.com/element-hq/dendrite/roomserver/api"
 	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/roomserver/types"
@@ -49,6 +50,10 @@ func SendBan(
 		}
 	}
 
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
 		return util.JSONResponse{
@@ -154,6 +159,10 @@ func SendKick(
 		}
 	}
 
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
 		return util.JSONResponse{
@@ -237,6 +246,10 @@ func SendUnban(
 		}
 	}
 
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
 		return util.JSONResponse{
@@ -311,6 +324,10 @@ func SendInvite(
 		}
 	}
 
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
 	deviceUserID, err := spec.NewUserID(device.UserID, true)
 	if err != nil {
 		return util.JSONResponse{
@@ -521,12 +538,12 @@ func loadProfile(
 
 func extractRequestData(req *http.Request) (body *threepid.MembershipRequest, evTime time.Time, resErr *util.JSONResponse) {
 
-	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+	if reqErr := clienthttputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		resErr = reqErr
 		return
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := clienthttputil.ParseTSParam(req)
 	if err != nil {
 		resErr = &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/element-hq/dendrite/internal/httputil"
 	"github.com/element-hq/dendrite/roomserver/api"
 	userapi "github.com/element-hq/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib/spec"
@@ -58,6 +59,11 @@ func GetJoinedMembers(
 		}
 	}
 
+	// The list of joined members is incomplete until the room has full state.
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, validRoomID.String()); errRes != nil {
+		return *errRes
+	}
+
 	// Get the current memberships for the requesting user to determine
 	// if they are allowed to query this endpoint.
 	queryReq := api.QueryMembershipForUserRequest{
@@ -0,0 +1,129 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+	userapi "github.com/element-hq/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// QueryRoomSummary returns a summary of a room, as per MSC3266.
+//
+// Implements /_matrix/client/v1/room_summary/{roomIdOrAlias}
+func QueryRoomSummary(
+	req *http.Request,
+	device *userapi.Device,
+	roomIDOrAlias string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	federation fclient.FederationClient,
+) util.JSONResponse {
+	vias := req.URL.Query()["via"]
+
+	roomIDStr := roomIDOrAlias
+	if len(roomIDOrAlias) > 0 && roomIDOrAlias[0] == '#' {
+		var servers []string
+		var resErr *util.JSONResponse
+		roomIDStr, servers, resErr = resolveRoomAliasForSummary(req, roomIDOrAlias, cfg, rsAPI, federation)
+		if resErr != nil {
+			return *resErr
+		}
+		if len(vias) == 0 {
+			vias = servers
+		}
+	}
+
+	roomID, err := spec.NewRoomID(roomIDStr)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("room ID or alias is invalid"),
+		}
+	}
+
+	summary, err := rsAPI.QueryRoomSummary(req.Context(), types.NewDeviceNotServerName(*device), *roomID, vias)
+	if err != nil {
+		var notAllowed roomserverAPI.ErrRoomUnknownOrNotAllowed
+		if errors.As(err, &notAllowed) {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("room is unknown/forbidden"),
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomSummary failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: summary,
+	}
+}
+
+// resolveRoomAliasForSummary resolves a room alias to a room ID, querying the server
+// of the alias over federation if it isn't known locally. Returns the room ID and
+// the servers which can be used to reach the room.
+func resolveRoomAliasForSummary(
+	req *http.Request,
+	roomAlias string,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	federation fclient.FederationClient,
+) (string, []string, *util.JSONResponse) {
+	_, domain, err := gomatrixserverlib.SplitID('#', roomAlias)
+	if err != nil {
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Room alias must be in the form '#localpart:domain'"),
+		}
+	}
+
+	queryRes := &roomserverAPI.GetRoomIDForAliasResponse{}
+	if err = rsAPI.GetRoomIDForAlias(req.Context(), &roomserverAPI.GetRoomIDForAliasRequest{
+		Alias:              roomAlias,
+		IncludeAppservices: true,
+	}, queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+		return "", nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if queryRes.RoomID != "" {
+		return queryRes.RoomID, nil, nil
+	}
+
+	if !cfg.Matrix.IsLocalServerName(domain) {
+		fedRes, fedErr := federation.LookupRoomAlias(req.Context(), cfg.Matrix.ServerName, domain, roomAlias)
+		if fedErr != nil {
+			util.GetLogger(req.Context()).WithError(fedErr).Warn("federation.LookupRoomAlias failed")
+		} else if fedRes.RoomID != "" {
+			servers := make([]string, 0, len(fedRes.Servers))
+			for _, server := range fedRes.Servers {
+				servers = append(servers, string(server))
+			}
+			return fedRes.RoomID, servers, nil
+		}
+	}
+
+	return "", nil, &util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: spec.NotFound(fmt.Sprintf("Room alias %s not found", roomAlias)),
+	}
+}
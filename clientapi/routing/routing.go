@@ -84,9 +84,12 @@ func Setup(
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
 
 	unstableFeatures := map[string]bool{
-		"org.matrix.e2e_cross_signing": true,
-		"org.matrix.msc2285.stable":    true,
-		"org.matrix.msc3916.stable":    true,
+		"org.matrix.e2e_cross_signing":            true,
+		"org.matrix.msc2285.stable":               true,
+		"org.matrix.msc3916.stable":               true,
+		"im.nheko.summary":                        true,
+		"uk.half-shot.msc2666":                    true,
+		"uk.half-shot.msc2666.query_mutual_rooms": true,
 	}
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
@@ -219,6 +222,54 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/purgeHistory/{roomID}",
+		httputil.MakeAdminAPI("admin_purge_history", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeHistory(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeHistoryStatus/{purgeID}",
+		httputil.MakeAdminAPI("admin_purge_history_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeHistoryStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/compressState",
+		httputil.MakeAdminAPI("admin_compress_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCompressState(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/compressStateStatus/{jobID}",
+		httputil.MakeAdminAPI("admin_compress_state_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCompressStateStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/checkIntegrity",
+		httputil.MakeAdminAPI("admin_check_integrity", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCheckIntegrity(req, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/checkIntegrityStatus/{jobID}",
+		httputil.MakeAdminAPI("admin_check_integrity_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCheckIntegrityStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/redactUserEvents/{userID}",
+		httputil.MakeAdminAPI("admin_redact_user_events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRedactUserEvents(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/redactUserEventsStatus/{jobID}",
+		httputil.MakeAdminAPI("admin_redact_user_events_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminRedactUserEventsStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/resetPassword/{userID}",
 		httputil.MakeAdminAPI("admin_reset_password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminResetPassword(req, cfg, device, userAPI)
@@ -243,6 +294,160 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/federation/destinations",
+		httputil.MakeAdminAPI("admin_federation_destinations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListFederationDestinations(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations/{serverName}",
+		httputil.MakeAdminAPI("admin_federation_destination", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetFederationDestination(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations/{serverName}/resetBackoff",
+		httputil.MakeAdminAPI("admin_federation_reset_backoff", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResetFederationBackoff(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations/{serverName}/unblacklist",
+		httputil.MakeAdminAPI("admin_federation_unblacklist", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnblacklistFederationDestination(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/destinations/{serverName}/purgeQueue",
+		httputil.MakeAdminAPI("admin_federation_purge_queue", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeFederationQueue(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/selfcheck",
+		httputil.MakeAdminAPI("admin_federation_selfcheck", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminFederationSelfCheck(req, dendriteCfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/keys",
+		httputil.MakeAdminAPI("admin_federation_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListServerSigningKeys(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/keys/{serverName}",
+		httputil.MakeAdminAPI("admin_federation_server_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if req.Method == http.MethodDelete {
+				return AdminDeleteServerSigningKeys(req, federationSender)
+			}
+			return AdminListServerSigningKeys(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/keys/{serverName}/expire",
+		httputil.MakeAdminAPI("admin_federation_expire_key", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminExpireServerSigningKey(req, federationSender)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/capture",
+		httputil.MakeAdminAPI("admin_federation_capture", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodPut:
+				return AdminSetFederationCaptureServers(req, federationSender)
+			case http.MethodDelete:
+				return AdminClearFederationCapture(req, federationSender)
+			default:
+				return AdminGetFederationCapture(req, federationSender)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/federation/capture/{exchangeID}/export",
+		httputil.MakeAdminAPI("admin_federation_capture_export", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminExportFederationCapture(req, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}",
+		httputil.MakeAdminAPI("admin_room_details", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetRoomDetails(req, cfg, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/members",
+		httputil.MakeAdminAPI("admin_room_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetRoomMembers(req, cfg, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/state",
+		httputil.MakeAdminAPI("admin_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetRoomState(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/forwardExtremities",
+		httputil.MakeAdminAPI("admin_room_forward_extremities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if req.Method == http.MethodDelete {
+				return AdminMergeRoomForwardExtremities(req, rsAPI)
+			}
+			return AdminGetRoomForwardExtremities(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/block",
+		httputil.MakeAdminAPI("admin_room_block", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if req.Method == http.MethodPut {
+				return AdminSetRoomBlock(req, device, rsAPI)
+			}
+			return AdminGetRoomBlock(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/delete",
+		httputil.MakeAdminAPI("admin_delete_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteRoom(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deleteRoomStatus/{deleteID}",
+		httputil.MakeAdminAPI("admin_delete_room_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteRoomStatus(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory",
+		httputil.MakeAdminAPI("admin_room_directory", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetPublishedRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/requests",
+		httputil.MakeAdminAPI("admin_publication_requests", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetPublicationRequests(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/requests/{roomID}/approve",
+		httputil.MakeAdminAPI("admin_approve_publication", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminReviewPublicationRequest(req, device, rsAPI, true)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/requests/{roomID}/reject",
+		httputil.MakeAdminAPI("admin_reject_publication", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminReviewPublicationRequest(req, device, rsAPI, false)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/roomDirectory/{roomID}",
+		httputil.MakeAdminAPI("admin_unpublish_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminUnpublishRoom(req, device, rsAPI)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/emptyRooms",
 		httputil.MakeAdminAPI("admin_empty_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return QueryEmptyRooms(req, rsAPI)
@@ -534,6 +739,16 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	roomSummaryHandler := httputil.MakeAuthAPI("room_summary", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return QueryRoomSummary(req, device, vars["roomIDOrAlias"], cfg, rsAPI, federation)
+	}, httputil.WithAllowGuests())
+	v1mux.Handle("/room_summary/{roomIDOrAlias}", roomSummaryHandler).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/im.nheko.summary/rooms/{roomIDOrAlias}/summary", roomSummaryHandler).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
 		if r := rateLimits.Limit(req, nil); r != nil {
 			return *r
@@ -0,0 +1,78 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/internal/fedcheck"
+	"github.com/element-hq/dendrite/setup"
+)
+
+// This is a utility for checking that other servers can reach this one over
+// federation. It resolves the server names from the config file in the same
+// way that remote servers do, then calls the federation endpoints that they
+// resolve to, and reports each step.
+//
+// Usage: ./check-federation --config dendrite.yaml [--server-name example.com] [--json]
+
+var serverName = flag.String("server-name", "", "only check this server name, which must be one of ours (default: all of them)")
+var jsonOutput = flag.Bool("json", false, "print the reports as JSON")
+
+func main() {
+	cfg := setup.ParseFlags(true)
+
+	serverNames := []spec.ServerName{cfg.Global.ServerName}
+	for _, v := range cfg.Global.VirtualHosts {
+		serverNames = append(serverNames, v.ServerName)
+	}
+	if *serverName != "" {
+		serverNames = []spec.ServerName{spec.ServerName(*serverName)}
+	}
+
+	ok := true
+	reports := make([]*fedcheck.Report, 0, len(serverNames))
+	for _, name := range serverNames {
+		checker, err := fedcheck.NewLocalChecker(cfg, name)
+		if err != nil {
+			logrus.WithError(err).Fatalf("Can't check %q", name)
+		}
+		report := checker.Check(context.Background(), name)
+		ok = ok && report.OK
+		reports = append(reports, report)
+	}
+
+	if *jsonOutput {
+		j, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(j))
+	} else {
+		for _, report := range reports {
+			fmt.Printf("%s:\n", report.ServerName)
+			for _, check := range report.Checks {
+				target := ""
+				if check.Target != "" {
+					target = " (" + check.Target + ")"
+				}
+				fmt.Printf("  [%s] %s%s: %s\n", strings.ToUpper(check.Status), check.Name, target, check.Message)
+			}
+		}
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
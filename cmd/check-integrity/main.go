@@ -0,0 +1,115 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/element-hq/dendrite/internal/caching"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/integrity"
+	"github.com/element-hq/dendrite/roomserver/storage"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// This is a utility for checking that the data stored by the roomserver is
+// consistent: that auth events and state are stored, that the current state of
+// each room matches the state resolved from its forward extremities, and that
+// the membership table agrees with the current state. The report of every room
+// is written to stdout as JSON, and the tool exits with a non-zero status if
+// any problems were found.
+//
+// Dendrite should not be running while this tool is, as new events arriving in
+// a room at the same time can cause problems to be reported which aren't there.
+// To check rooms while Dendrite is running, use the
+// /_dendrite/admin/checkIntegrity endpoint.
+//
+// Usage: ./check-integrity --config=dendrite.yaml [--room=!roomid:server_name]
+
+var room = flag.String("room", "", "the room to check, or all rooms if not given")
+
+// dummyQuerier implements QuerySenderIDAPI. Does **NOT** do any "magic" for pseudoID rooms
+// to avoid having to "start" a full roomserver API.
+type dummyQuerier struct{}
+
+func (d dummyQuerier) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	s := spec.SenderIDFromUserID(userID)
+	return &s, nil
+}
+
+func (d dummyQuerier) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return senderID.ToUserID(), nil
+}
+
+func main() {
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "error",
+	})
+
+	processCtx := process.NewProcessContext()
+	ctx := processCtx.Context()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+
+	dbOpts := cfg.RoomServer.Database
+	if dbOpts.ConnectionString == "" {
+		dbOpts = cfg.Global.DatabaseOptions
+	}
+
+	fmt.Fprintln(os.Stderr, "Opening database")
+	roomserverDB, err := storage.Open(
+		ctx, cm, &dbOpts,
+		caching.NewRistrettoCache(8*1024*1024, time.Minute*5, caching.DisableMetrics),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	roomIDs := []string{*room}
+	if *room == "" {
+		roomIDs, err = roomserverDB.RoomsWithEventType(ctx, spec.MRoomCreate)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	reports := make([]*types.RoomIntegrityReport, 0, len(roomIDs))
+	inconsistent, failed := 0, false
+	for i, roomID := range roomIDs {
+		report, err := integrity.CheckRoom(ctx, roomserverDB, dummyQuerier{}, roomID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s: failed: %s\n", i+1, len(roomIDs), roomID, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s: %d problems\n", i+1, len(roomIDs), roomID, len(report.Problems))
+		if !report.Consistent() {
+			inconsistent++
+		}
+		reports = append(reports, report)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(reports); err != nil {
+		panic(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Found problems in %d of %d rooms\n", inconsistent, len(roomIDs))
+	if failed || inconsistent > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/element-hq/dendrite/internal/caching"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/storage"
+	"github.com/element-hq/dendrite/setup"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// This is a utility for compressing the stored state snapshots of rooms, so
+// that they take up less space in the roomserver database. The resolved state
+// of every snapshot is checked to be the same before and after compressing it.
+//
+// Dendrite MUST NOT be running while this tool is, as new events arriving in a
+// room at the same time could be given the wrong state. To compress state
+// while Dendrite is running, use the /_dendrite/admin/compressState endpoint.
+//
+// Usage: ./compress-state --config=dendrite.yaml [--room=!roomid:server_name]
+
+var room = flag.String("room", "", "the room to compress the state of, or all rooms if not given")
+
+func main() {
+	cfg := setup.ParseFlags(true)
+	cfg.Logging = append(cfg.Logging[:0], config.LogrusHook{
+		Type:  "std",
+		Level: "error",
+	})
+
+	processCtx := process.NewProcessContext()
+	ctx := processCtx.Context()
+	cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+
+	dbOpts := cfg.RoomServer.Database
+	if dbOpts.ConnectionString == "" {
+		dbOpts = cfg.Global.DatabaseOptions
+	}
+
+	fmt.Println("Opening database")
+	roomserverDB, err := storage.Open(
+		ctx, cm, &dbOpts,
+		caching.NewRistrettoCache(8*1024*1024, time.Minute*5, caching.DisableMetrics),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	roomIDs := []string{*room}
+	if *room == "" {
+		roomIDs, err = roomserverDB.RoomsWithEventType(ctx, spec.MRoomCreate)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var snapshots, compressed, removed int
+	failed := false
+	for i, roomID := range roomIDs {
+		roomInfo, err := roomserverDB.RoomInfo(ctx, roomID)
+		if err != nil {
+			panic(err)
+		}
+		if roomInfo == nil || roomInfo.IsStub() {
+			fmt.Printf("[%d/%d] %s: room not found\n", i+1, len(roomIDs), roomID)
+			continue
+		}
+		res, err := roomserverDB.CompressRoomState(ctx, roomInfo.RoomNID)
+		if err != nil {
+			fmt.Printf("[%d/%d] %s: failed: %s\n", i+1, len(roomIDs), roomID, err)
+			failed = true
+		}
+		if res == nil {
+			continue
+		}
+		fmt.Printf(
+			"[%d/%d] %s: compressed %d of %d snapshots, removed %d state blocks\n",
+			i+1, len(roomIDs), roomID, res.CompressedSnapshots, res.Snapshots, res.RemovedBlocks,
+		)
+		snapshots += res.Snapshots
+		compressed += res.CompressedSnapshots
+		removed += res.RemovedBlocks
+	}
+
+	fmt.Printf("Compressed %d of %d snapshots, removed %d state blocks\n", compressed, snapshots, removed)
+	if failed {
+		os.Exit(1)
+	}
+}
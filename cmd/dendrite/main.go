@@ -13,6 +13,7 @@ import (
 	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/caching"
 	"github.com/element-hq/dendrite/internal/httputil"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/setup/jetstream"
 	"github.com/element-hq/dendrite/setup/process"
@@ -135,7 +136,14 @@ func main() {
 		}()
 	}
 
-	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
+	serverPolicy, err := serverpolicy.New(cfg.FederationAPI.AllowedServers, cfg.FederationAPI.DeniedServers)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Invalid federation server policy")
+	}
+	captureRecorder := federationapi.NewCaptureRecorder(&cfg.FederationAPI)
+	federationClient := basepkg.CreateFederationClient(
+		cfg, dnsCache, basepkg.WithServerPolicy(serverPolicy), basepkg.WithCaptureRecorder(captureRecorder),
+	)
 	httpClient := basepkg.CreateClient(cfg, dnsCache)
 
 	// prepare required dependencies
@@ -147,6 +155,7 @@ func main() {
 	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
 	fsAPI := federationapi.NewInternalAPI(
 		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, caches, nil, false,
+		federationapi.WithServerPolicy(serverPolicy), federationapi.WithCaptureRecorder(captureRecorder),
 	)
 
 	keyRing := fsAPI.KeyRing()
@@ -174,6 +183,8 @@ func main() {
 		FederationAPI: fsAPI,
 		RoomserverAPI: rsAPI,
 		UserAPI:       userAPI,
+
+		ServerPolicy: serverPolicy,
 	}
 	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
 
@@ -204,6 +215,11 @@ func main() {
 		}()
 	}
 
+	// Pick up changes to the runtime-reloadable config options on SIGHUP
+	go basepkg.ReloadOnSIGHUP(processCtx, func() error {
+		return setup.ReloadConfig(cfg, serverPolicy)
+	})
+
 	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
 	basepkg.WaitForShutdown(processCtx)
 }
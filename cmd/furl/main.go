@@ -15,17 +15,36 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/internal/fedcapture"
 )
 
 var requestFrom = flag.String("from", "", "the server name that the request should originate from")
 var requestKey = flag.String("key", "matrix_key.pem", "the private key to use when signing the request")
 var requestPost = flag.Bool("post", false, "send a POST request instead of GET (pipe input into stdin or type followed by Ctrl-D)")
+var requestReplay = flag.String("replay", "", "resend a request exported from the federation capture admin endpoint, instead of giving a URL")
 
 func main() {
 	flag.Parse()
 
+	var replay *fedcapture.Replay
+	if *requestReplay != "" {
+		data, err := os.ReadFile(*requestReplay)
+		if err != nil {
+			panic(err)
+		}
+		replay = &fedcapture.Replay{}
+		if err = json.Unmarshal(data, replay); err != nil {
+			panic(err)
+		}
+		if *requestFrom == "" {
+			*requestFrom = string(replay.Origin)
+		}
+	}
+
 	if requestFrom == nil || *requestFrom == "" {
 		fmt.Println("expecting: furl -from origin.com [-key matrix_key.pem] https://path/to/url")
+		fmt.Println("       or: furl [-from origin.com] [-key matrix_key.pem] -replay exported.json")
 		fmt.Println("supported flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -61,15 +80,32 @@ func main() {
 		},
 	)
 
-	u, err := url.Parse(flag.Arg(0))
-	if err != nil {
-		panic(err)
-	}
-
 	var bodyObj interface{}
 	var bodyBytes []byte
+	var destination spec.ServerName
+	var requestURI string
 	method := "GET"
-	if *requestPost {
+	hasBody := *requestPost
+	if replay != nil {
+		method = replay.Method
+		destination = replay.Destination
+		requestURI = replay.RequestURI
+		if replay.Body != "" {
+			hasBody = true
+			if err = json.Unmarshal([]byte(replay.Body), &bodyObj); err != nil {
+				panic(err)
+			}
+		}
+	} else {
+		u, err := url.Parse(flag.Arg(0))
+		if err != nil {
+			panic(err)
+		}
+		destination = spec.ServerName(u.Host)
+		requestURI = u.RequestURI()
+	}
+
+	if replay == nil && *requestPost {
 		method = "POST"
 		fmt.Println("Waiting for JSON input. Press Enter followed by Ctrl-D when done...")
 
@@ -87,11 +123,11 @@ func main() {
 	req := fclient.NewFederationRequest(
 		method,
 		serverName,
-		spec.ServerName(u.Host),
-		u.RequestURI(),
+		destination,
+		requestURI,
 	)
 
-	if *requestPost {
+	if hasBody {
 		if err = req.SetContent(bodyObj); err != nil {
 			panic(err)
 		}
@@ -13,6 +13,7 @@ import (
 	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/caching"
 	"github.com/element-hq/dendrite/internal/httputil"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/setup/jetstream"
 	"github.com/element-hq/dendrite/setup/process"
@@ -106,7 +107,14 @@ func main() {
 		}()
 	}
 
-	federationClient := basepkg.CreateFederationClient(cfg, dnsCache)
+	serverPolicy, err := serverpolicy.New(cfg.FederationAPI.AllowedServers, cfg.FederationAPI.DeniedServers)
+	if err != nil {
+		logrus.WithError(err).Fatalf("Invalid federation server policy")
+	}
+	captureRecorder := federationapi.NewCaptureRecorder(&cfg.FederationAPI)
+	federationClient := basepkg.CreateFederationClient(
+		cfg, dnsCache, basepkg.WithServerPolicy(serverPolicy), basepkg.WithCaptureRecorder(captureRecorder),
+	)
 	httpClient := basepkg.CreateClient(cfg, dnsCache)
 
 	// prepare required dependencies
@@ -118,6 +126,7 @@ func main() {
 	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.EnableMetrics)
 	fsAPI := federationapi.NewInternalAPI(
 		processCtx, cfg, cm, &natsInstance, federationClient, rsAPI, caches, nil, false,
+		federationapi.WithServerPolicy(serverPolicy), federationapi.WithCaptureRecorder(captureRecorder),
 	)
 
 	keyRing := fsAPI.KeyRing()
@@ -145,6 +154,8 @@ func main() {
 		FederationAPI: fsAPI,
 		RoomserverAPI: rsAPI,
 		UserAPI:       userAPI,
+
+		ServerPolicy: serverPolicy,
 	}
 	monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.EnableMetrics)
 
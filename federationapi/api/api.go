@@ -11,6 +11,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/element-hq/dendrite/federationapi/types"
+	"github.com/element-hq/dendrite/internal/fedcapture"
 	rstypes "github.com/element-hq/dendrite/roomserver/types"
 )
 
@@ -42,6 +43,8 @@ type FederationInternalAPI interface {
 }
 
 type ClientFederationAPI interface {
+	FederationAdminAPI
+
 	// Query the server names of the joined hosts in a room.
 	// Unlike QueryJoinedHostsInRoom, this function returns a de-duplicated slice
 	// containing only the server names (without information for membership events).
@@ -49,6 +52,66 @@ type ClientFederationAPI interface {
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
 }
 
+// FederationAdminAPI allows server admins to inspect and manage the
+// destinations that we send federation traffic to.
+type FederationAdminAPI interface {
+	// QueryDestinations returns all destinations that we hold statistics for
+	// or have queued PDUs/EDUs for.
+	QueryDestinations(ctx context.Context) ([]FederationDestination, error)
+	// QueryDestination returns the state of a single destination, or nil if
+	// we hold no statistics or pending events for it.
+	QueryDestination(ctx context.Context, serverName spec.ServerName) (*FederationDestination, error)
+	// PerformResetBackoff ends any backoff for the destination and retries sending to it.
+	PerformResetBackoff(ctx context.Context, serverName spec.ServerName) error
+	// PerformUnblacklist removes the destination from the blacklist and the assumed offline
+	// list, and retries sending to it. Returns whether the destination was blacklisted.
+	PerformUnblacklist(ctx context.Context, serverName spec.ServerName) (bool, error)
+	// PerformPurgeDestinationQueue drops everything queued for the destination. Returns
+	// the number of PDUs and EDUs that were removed.
+	PerformPurgeDestinationQueue(ctx context.Context, serverName spec.ServerName) (pdus, edus int64, err error)
+	// QueryServerSigningKeys returns the signing keys that we hold for the server, or for
+	// all servers if the server name is empty, including any pinned keys.
+	QueryServerSigningKeys(ctx context.Context, serverName spec.ServerName) ([]ServerSigningKey, error)
+	// PerformDeleteServerSigningKeys deletes the given stored key for the server, or all of
+	// its keys if the key ID is empty, so that they are fetched again. Returns the number
+	// of keys that were deleted.
+	PerformDeleteServerSigningKeys(ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID) (int64, error)
+	// PerformExpireServerSigningKey marks the stored key as having expired at the given
+	// time, so that it is only accepted for events sent before then. Returns whether
+	// the key was found.
+	PerformExpireServerSigningKey(ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID, expiredTS spec.Timestamp) (bool, error)
+	// FederationCapture returns the buffer of captured federation traffic, or nil if
+	// capturing isn't enabled.
+	FederationCapture() *fedcapture.Recorder
+}
+
+// FederationDestination is the state of a remote server that we send to.
+// Timestamps are zero when the event hasn't happened since startup.
+type FederationDestination struct {
+	ServerName        spec.ServerName   `json:"destination"`
+	LastSuccessTS     spec.Timestamp    `json:"last_success_ts"`
+	LastFailureTS     spec.Timestamp    `json:"last_failure_ts"`
+	RetryCount        uint32            `json:"retry_count"`
+	BackoffUntilTS    spec.Timestamp    `json:"backoff_until_ts"`
+	Blacklisted       bool              `json:"blacklisted"`
+	AssumedOffline    bool              `json:"assumed_offline"`
+	RelayServers      []spec.ServerName `json:"relay_servers"`
+	PendingPDUs       int64             `json:"pending_pdus"`
+	PendingEDUs       int64             `json:"pending_edus"`
+	LastTransactionMS int64             `json:"last_transaction_duration_ms"`
+	MeanTransactionMS int64             `json:"mean_transaction_duration_ms"`
+}
+
+// ServerSigningKey is a signing key that we hold for a remote server.
+type ServerSigningKey struct {
+	ServerName   spec.ServerName         `json:"server_name"`
+	KeyID        gomatrixserverlib.KeyID `json:"key_id"`
+	Key          spec.Base64Bytes        `json:"key"`
+	ValidUntilTS spec.Timestamp          `json:"valid_until_ts"`
+	ExpiredTS    spec.Timestamp          `json:"expired_ts"`
+	Pinned       bool                    `json:"pinned"`
+}
+
 type RoomserverFederationAPI interface {
 	gomatrixserverlib.BackfillClient
 	gomatrixserverlib.FederatedStateClient
@@ -88,7 +88,7 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 
 	// Only handle events we care about, avoids unneeded unmarshalling
 	switch receivedType {
-	case api.OutputTypeNewRoomEvent, api.OutputTypeNewInboundPeek, api.OutputTypePurgeRoom:
+	case api.OutputTypeNewRoomEvent, api.OutputTypeNewInboundPeek, api.OutputTypePurgeRoom, api.OutputTypeResyncedState:
 	default:
 		return true
 	}
@@ -132,6 +132,15 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 			logrus.WithField("room_id", output.PurgeRoom.RoomID).Warn("Room purged from federation API")
 		}
 
+	case api.OutputTypeResyncedState:
+		if err := s.processResyncedState(*output.ResyncedState); err != nil {
+			log.WithFields(log.Fields{
+				"room_id":    output.ResyncedState.RoomID,
+				log.ErrorKey: err,
+			}).Panicf("roomserver output log: resynced state failure")
+			return false
+		}
+
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -158,6 +167,34 @@ func (s *OutputRoomEventConsumer) processInboundPeek(orp api.OutputNewInboundPee
 	return s.db.AddInboundPeek(s.ctx, orp.ServerName, orp.RoomID, orp.PeekID, orp.RenewalInterval)
 }
 
+// processResyncedState adds the hosts that we learned about when the full
+// state of a partial state room was fetched to the joined hosts of the room,
+// and removes those whose membership events were soft-failed.
+func (s *OutputRoomEventConsumer) processResyncedState(ors api.OutputResyncedState) error {
+	if len(ors.AddsStateEventIDs) == 0 && len(ors.RemovesStateEventIDs) == 0 {
+		return nil
+	}
+	eventsRes := &api.QueryEventsByIDResponse{}
+	if len(ors.AddsStateEventIDs) > 0 {
+		if err := s.rsAPI.QueryEventsByID(s.ctx, &api.QueryEventsByIDRequest{
+			RoomID:   ors.RoomID,
+			EventIDs: ors.AddsStateEventIDs,
+		}, eventsRes); err != nil {
+			return fmt.Errorf("s.rsAPI.QueryEventsByID: %w", err)
+		}
+	}
+	evs := make([]gomatrixserverlib.PDU, len(eventsRes.Events))
+	for i := range evs {
+		evs[i] = eventsRes.Events[i].PDU
+	}
+	addsJoinedHosts, err := JoinedHostsFromEvents(s.ctx, evs, s.rsAPI)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.UpdateRoom(s.ctx, ors.RoomID, addsJoinedHosts, ors.RemovesStateEventIDs, false)
+	return err
+}
+
 // processMessage updates the list of currently joined hosts in the room
 // and then sends the event to the hosts that were joined before the event.
 func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent, rewritesState bool) error {
@@ -367,6 +404,19 @@ func (s *OutputRoomEventConsumer) joinedHostsAtEvent(
 		joined[joinedHost.ServerName] = true
 	}
 
+	// If the room has partial state then we don't know about most of the
+	// members yet, so also send to the servers that the resident server said
+	// were in the room when we joined.
+	partialState, err := s.rsAPI.QueryPartialStateRoom(s.ctx, ore.Event.PDU.RoomID().String())
+	if err != nil {
+		return nil, err
+	}
+	if partialState != nil {
+		for _, serverName := range partialState.ServersInRoom {
+			joined[serverName] = true
+		}
+	}
+
 	// handle peeking hosts
 	inboundPeeks, err := s.db.GetInboundPeeks(s.ctx, ore.Event.PDU.RoomID().String())
 	if err != nil {
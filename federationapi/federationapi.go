@@ -24,6 +24,8 @@ import (
 	"github.com/element-hq/dendrite/federationapi/statistics"
 	"github.com/element-hq/dendrite/federationapi/storage"
 	"github.com/element-hq/dendrite/internal/caching"
+	"github.com/element-hq/dendrite/internal/fedcapture"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/setup/jetstream"
 	userapi "github.com/element-hq/dendrite/userapi/api"
@@ -81,6 +83,42 @@ func AddPublicRoutes(
 	)
 }
 
+// NewCaptureRecorder returns the buffer for federation traffic capture, or nil
+// if capturing isn't enabled. The same recorder should be given to both the
+// federation client and NewInternalAPI, so that both outbound and inbound
+// traffic are captured.
+func NewCaptureRecorder(cfg *config.FederationAPI) *fedcapture.Recorder {
+	if !cfg.Capture.Enabled {
+		return nil
+	}
+	return fedcapture.NewRecorder(cfg.Capture.BufferSize, cfg.Capture.MaxBodyBytes, cfg.Capture.Servers)
+}
+
+// InternalAPIOpts are the optional settings of the federation API.
+type InternalAPIOpts struct {
+	ServerPolicy    *serverpolicy.Policy
+	CaptureRecorder *fedcapture.Recorder
+}
+
+// InternalAPIOption is an option to NewInternalAPI.
+type InternalAPIOption func(opts *InternalAPIOpts)
+
+// WithServerPolicy refuses federation with the servers which the server-wide
+// federation policy doesn't allow. Every server is allowed without it.
+func WithServerPolicy(serverPolicy *serverpolicy.Policy) InternalAPIOption {
+	return func(opts *InternalAPIOpts) {
+		opts.ServerPolicy = serverPolicy
+	}
+}
+
+// WithCaptureRecorder captures inbound federation traffic into the recorder,
+// which should be the one given to the federation client too.
+func WithCaptureRecorder(recorder *fedcapture.Recorder) InternalAPIOption {
+	return func(opts *InternalAPIOpts) {
+		opts.CaptureRecorder = recorder
+	}
+}
+
 // NewInternalAPI returns a concerete implementation of the internal API. Callers
 // can call functions directly on the returned API or via an HTTP interface using AddInternalRoutes.
 func NewInternalAPI(
@@ -93,8 +131,13 @@ func NewInternalAPI(
 	caches *caching.Caches,
 	keyRing *gomatrixserverlib.KeyRing,
 	resetBlacklist bool,
+	options ...InternalAPIOption,
 ) *internal.FederationInternalAPI {
 	cfg := &dendriteCfg.FederationAPI
+	opts := InternalAPIOpts{}
+	for _, option := range options {
+		option(&opts)
+	}
 
 	federationDB, err := storage.NewDatabase(processContext.Context(), cm, &cfg.Database, caches, dendriteCfg.Global.IsLocalServerName)
 	if err != nil {
@@ -106,6 +149,8 @@ func NewInternalAPI(
 	}
 
 	stats := statistics.NewStatistics(federationDB, cfg.FederationMaxRetries+1, cfg.P2PFederationRetriesUntilAssumedOffline+1, cfg.EnableRelays)
+	stats.ServerPolicy = opts.ServerPolicy
+	stats.MaxRetryPeriod = cfg.MaxRetryPeriod
 
 	js, nats := natsInstance.Prepare(processContext, &cfg.Matrix.JetStream)
 
@@ -115,7 +160,7 @@ func NewInternalAPI(
 		federationDB, processContext,
 		cfg.Matrix.DisableFederation,
 		cfg.Matrix.ServerName, federation, &stats,
-		signingInfo,
+		signingInfo, queue.WithMetricsDestinations(cfg.MetricsDestinations),
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -167,5 +212,7 @@ func NewInternalAPI(
 	}
 	time.AfterFunc(time.Minute, cleanExpiredEDUs)
 
-	return internal.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	fedAPI := internal.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	fedAPI.SetFederationCapture(opts.CaptureRecorder)
+	return fedAPI
 }
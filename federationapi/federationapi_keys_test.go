@@ -71,7 +71,7 @@ func TestMain(m *testing.M) {
 			s.cache = caching.NewRistrettoCache(8*1024*1024, time.Hour, false)
 			natsInstance := jetstream.NATSInstance{}
 			// Create a temporary directory for JetStream.
-			d, err := os.MkdirTemp("./", "jetstream*")
+			d, err := os.MkdirTemp("", "jetstream*")
 			if err != nil {
 				panic(err)
 			}
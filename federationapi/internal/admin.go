@@ -0,0 +1,210 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/federationapi/api"
+)
+
+// QueryDestinations implements api.FederationAdminAPI
+func (r *FederationInternalAPI) QueryDestinations(
+	ctx context.Context,
+) ([]api.FederationDestination, error) {
+	serverNames := map[spec.ServerName]struct{}{}
+	for _, serverName := range r.statistics.Servers() {
+		serverNames[serverName] = struct{}{}
+	}
+	pduServers, err := r.db.GetPendingPDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.db.GetPendingPDUServerNames: %w", err)
+	}
+	eduServers, err := r.db.GetPendingEDUServerNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.db.GetPendingEDUServerNames: %w", err)
+	}
+	for _, serverName := range append(pduServers, eduServers...) {
+		serverNames[serverName] = struct{}{}
+	}
+
+	destinations := make([]api.FederationDestination, 0, len(serverNames))
+	for serverName := range serverNames {
+		destination, err := r.QueryDestination(ctx, serverName)
+		if err != nil {
+			return nil, err
+		}
+		if destination == nil {
+			continue
+		}
+		destinations = append(destinations, *destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].ServerName < destinations[j].ServerName
+	})
+	return destinations, nil
+}
+
+// QueryDestination implements api.FederationAdminAPI
+func (r *FederationInternalAPI) QueryDestination(
+	ctx context.Context, serverName spec.ServerName,
+) (*api.FederationDestination, error) {
+	pdus, edus, err := r.queues.PendingCounts(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("r.queues.PendingCounts: %w", err)
+	}
+	// Don't create statistics for destinations we know nothing about, but do
+	// load them for destinations with pending events, as sending will anyway.
+	stats, ok := r.statistics.Lookup(serverName)
+	if !ok {
+		if pdus == 0 && edus == 0 {
+			return nil, nil
+		}
+		stats = r.statistics.ForServer(serverName)
+	}
+	relayServers := stats.KnownRelayServers()
+	if relayServers == nil {
+		relayServers = []spec.ServerName{}
+	}
+	lastTransaction, meanTransaction := r.queues.TransactionDurations(serverName)
+	return &api.FederationDestination{
+		ServerName:        serverName,
+		LastSuccessTS:     timestampOrZero(stats.LastSuccess()),
+		LastFailureTS:     timestampOrZero(stats.LastFailure()),
+		RetryCount:        stats.BackoffCount(),
+		BackoffUntilTS:    timestampOrZero(stats.BackoffInfo()),
+		Blacklisted:       stats.Blacklisted(),
+		AssumedOffline:    stats.AssumedOffline(),
+		RelayServers:      relayServers,
+		PendingPDUs:       pdus,
+		PendingEDUs:       edus,
+		LastTransactionMS: lastTransaction.Milliseconds(),
+		MeanTransactionMS: meanTransaction.Milliseconds(),
+	}, nil
+}
+
+// PerformResetBackoff implements api.FederationAdminAPI
+func (r *FederationInternalAPI) PerformResetBackoff(
+	ctx context.Context, serverName spec.ServerName,
+) error {
+	r.statistics.ForServer(serverName).ResetBackoff()
+	r.queues.RetryServer(serverName, false)
+	return nil
+}
+
+// PerformUnblacklist implements api.FederationAdminAPI
+func (r *FederationInternalAPI) PerformUnblacklist(
+	ctx context.Context, serverName spec.ServerName,
+) (bool, error) {
+	wasBlacklisted := r.statistics.ForServer(serverName).MarkServerAlive()
+	r.queues.RetryServer(serverName, wasBlacklisted)
+	return wasBlacklisted, nil
+}
+
+// PerformPurgeDestinationQueue implements api.FederationAdminAPI
+func (r *FederationInternalAPI) PerformPurgeDestinationQueue(
+	ctx context.Context, serverName spec.ServerName,
+) (pdus, edus int64, err error) {
+	pdus, edus, err = r.queues.PurgeServer(ctx, serverName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("r.queues.PurgeServer: %w", err)
+	}
+	return pdus, edus, nil
+}
+
+// QueryServerSigningKeys implements api.FederationAdminAPI
+func (r *FederationInternalAPI) QueryServerSigningKeys(
+	ctx context.Context, serverName spec.ServerName,
+) ([]api.ServerSigningKey, error) {
+	stored, err := r.db.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("r.db.GetServerKeys: %w", err)
+	}
+	keys := make([]api.ServerSigningKey, 0, len(stored))
+	for req, res := range stored {
+		keys = append(keys, api.ServerSigningKey{
+			ServerName:   req.ServerName,
+			KeyID:        req.KeyID,
+			Key:          res.Key,
+			ValidUntilTS: res.ValidUntilTS,
+			ExpiredTS:    res.ExpiredTS,
+		})
+	}
+	for pinnedServer, pinnedKeys := range r.pinnedKeys {
+		if serverName != "" && pinnedServer != serverName {
+			continue
+		}
+		for keyID, key := range pinnedKeys {
+			res := r.pinnedKeys.result(key)
+			keys = append(keys, api.ServerSigningKey{
+				ServerName:   pinnedServer,
+				KeyID:        keyID,
+				Key:          res.Key,
+				ValidUntilTS: res.ValidUntilTS,
+				Pinned:       true,
+			})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ServerName != keys[j].ServerName {
+			return keys[i].ServerName < keys[j].ServerName
+		}
+		return keys[i].KeyID < keys[j].KeyID
+	})
+	return keys, nil
+}
+
+// PerformDeleteServerSigningKeys implements api.FederationAdminAPI
+func (r *FederationInternalAPI) PerformDeleteServerSigningKeys(
+	ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID,
+) (int64, error) {
+	stored, err := r.db.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return 0, fmt.Errorf("r.db.GetServerKeys: %w", err)
+	}
+	deleted, err := r.db.DeleteServerKeys(ctx, serverName, keyID)
+	if err != nil {
+		return 0, fmt.Errorf("r.db.DeleteServerKeys: %w", err)
+	}
+	for req := range stored {
+		if keyID == "" || req.KeyID == keyID {
+			r.keyCache.InvalidateServerKey(req)
+		}
+	}
+	return deleted, nil
+}
+
+// PerformExpireServerSigningKey implements api.FederationAdminAPI
+func (r *FederationInternalAPI) PerformExpireServerSigningKey(
+	ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID, expiredTS spec.Timestamp,
+) (bool, error) {
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: serverName, KeyID: keyID}
+	stored, err := r.db.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return false, fmt.Errorf("r.db.GetServerKeys: %w", err)
+	}
+	if _, ok := stored[req]; !ok {
+		return false, nil
+	}
+	if err = r.db.ExpireServerKey(ctx, req, expiredTS); err != nil {
+		return false, fmt.Errorf("r.db.ExpireServerKey: %w", err)
+	}
+	r.keyCache.InvalidateServerKey(req)
+	return true, nil
+}
+
+func timestampOrZero(t *time.Time) spec.Timestamp {
+	if t == nil || t.IsZero() {
+		return 0
+	}
+	return spec.AsTimestamp(*t)
+}
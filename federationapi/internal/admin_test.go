@@ -0,0 +1,67 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/element-hq/dendrite/federationapi/queue"
+	"github.com/element-hq/dendrite/federationapi/statistics"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
+	"github.com/element-hq/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryDestination(t *testing.T) {
+	testDB := test.NewInMemoryFederationDatabase()
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	cfg := config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "local",
+				KeyID:      "ed25519:1",
+				PrivateKey: key,
+			},
+		},
+	}
+	fedClient := &testFedClient{}
+	stats := statistics.NewStatistics(testDB, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	queues := queue.NewOutgoingQueues(
+		testDB, process.NewProcessContext(),
+		false,
+		cfg.Matrix.ServerName, fedClient, &stats,
+		nil,
+	)
+	fedAPI := NewFederationInternalAPI(
+		testDB, &cfg, nil, fedClient, &stats, nil, queues, nil,
+	)
+
+	// Querying an unknown destination doesn't start tracking it.
+	unknown := spec.ServerName("unknown")
+	destination, err := fedAPI.QueryDestination(context.Background(), unknown)
+	assert.NoError(t, err)
+	assert.Nil(t, destination)
+	_, found := stats.Lookup(unknown)
+	assert.False(t, found)
+
+	known := spec.ServerName("known")
+	stats.ForServer(known).Failure()
+	destination, err = fedAPI.QueryDestination(context.Background(), known)
+	assert.NoError(t, err)
+	assert.NotNil(t, destination)
+	assert.Equal(t, known, destination.ServerName)
+	assert.Equal(t, uint32(1), destination.RetryCount)
+
+	destinations, err := fedAPI.QueryDestinations(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, destinations, 1)
+}
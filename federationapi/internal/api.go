@@ -13,6 +13,8 @@ import (
 	"github.com/element-hq/dendrite/federationapi/storage"
 	"github.com/element-hq/dendrite/federationapi/storage/cache"
 	"github.com/element-hq/dendrite/internal/caching"
+	"github.com/element-hq/dendrite/internal/fedcapture"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/setup/config"
 	"github.com/matrix-org/gomatrix"
@@ -30,8 +32,11 @@ type FederationInternalAPI struct {
 	rsAPI      roomserverAPI.FederationRoomserverAPI
 	federation fclient.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
+	keyCache   caching.ServerKeyCache
+	pinnedKeys pinnedServerKeys
 	queues     *queue.OutgoingQueues
-	joins      sync.Map // joins currently in progress
+	capture    *fedcapture.Recorder // nil unless federation capture is enabled
+	joins      sync.Map             // joins currently in progress
 }
 
 func NewFederationInternalAPI(
@@ -48,21 +53,23 @@ func NewFederationInternalAPI(
 		logrus.WithError(err).Panicf("failed to set up caching wrapper for server key database")
 	}
 
+	pinnedKeys := newPinnedServerKeys(cfg.PinnedServerKeys)
+
 	if keyRing == nil {
 		keyRing = &gomatrixserverlib.KeyRing{
 			KeyFetchers: []gomatrixserverlib.KeyFetcher{},
-			KeyDatabase: serverKeyDB,
+			KeyDatabase: pinnedKeys.database(serverKeyDB),
 		}
 
 		pubKey := cfg.Matrix.PrivateKey.Public().(ed25519.PublicKey)
 		addDirectFetcher := func() {
 			keyRing.KeyFetchers = append(
 				keyRing.KeyFetchers,
-				&gomatrixserverlib.DirectKeyFetcher{
+				pinnedKeys.fetcher(&gomatrixserverlib.DirectKeyFetcher{
 					Client:            federation,
 					IsLocalServerName: cfg.Matrix.IsLocalServerName,
 					LocalPublicKey:    []byte(pubKey),
-				},
+				}),
 			)
 		}
 
@@ -92,7 +99,7 @@ func NewFederationInternalAPI(
 				perspective.PerspectiveServerKeys[key.KeyID] = rawkey
 			}
 
-			keyRing.KeyFetchers = append(keyRing.KeyFetchers, perspective)
+			keyRing.KeyFetchers = append(keyRing.KeyFetchers, pinnedKeys.fetcher(perspective))
 
 			logrus.WithFields(logrus.Fields{
 				"server_name":     ps.ServerName,
@@ -106,13 +113,41 @@ func NewFederationInternalAPI(
 		cfg:        cfg,
 		rsAPI:      rsAPI,
 		keyRing:    keyRing,
+		keyCache:   caches,
+		pinnedKeys: pinnedKeys,
 		federation: federation,
 		statistics: statistics,
 		queues:     queues,
 	}
 }
 
+// ServerPolicy returns the server-wide federation policy, which is nil if
+// every server is allowed.
+func (a *FederationInternalAPI) ServerPolicy() *serverpolicy.Policy {
+	if a.statistics == nil {
+		return nil
+	}
+	return a.statistics.ServerPolicy
+}
+
+// FederationCapture returns the federation capture buffer, which is nil if
+// capturing isn't enabled.
+func (a *FederationInternalAPI) FederationCapture() *fedcapture.Recorder {
+	return a.capture
+}
+
+// SetFederationCapture sets the buffer which inbound federation traffic is
+// captured into. It must be called before the public routes are set up.
+func (a *FederationInternalAPI) SetFederationCapture(capture *fedcapture.Recorder) {
+	a.capture = capture
+}
+
 func (a *FederationInternalAPI) IsBlacklistedOrBackingOff(s spec.ServerName) (*statistics.ServerStatistics, error) {
+	if !a.statistics.IsAllowed(s) {
+		return nil, &api.FederationClientError{
+			Err: fmt.Sprintf("server %q is not allowed by the federation server policy", s),
+		}
+	}
 	stats := a.statistics.ForServer(s)
 	if stats.Blacklisted() {
 		return stats, &api.FederationClientError{
@@ -176,6 +211,11 @@ func (a *FederationInternalAPI) doRequestIfNotBackingOffOrBlacklisted(
 func (a *FederationInternalAPI) doRequestIfNotBlacklisted(
 	s spec.ServerName, request func() (interface{}, error),
 ) (interface{}, error) {
+	if !a.statistics.IsAllowed(s) {
+		return nil, &api.FederationClientError{
+			Err: fmt.Sprintf("server %q is not allowed by the federation server policy", s),
+		}
+	}
 	stats := a.statistics.ForServer(s)
 	if blacklisted := stats.Blacklisted(); blacklisted {
 		return stats, &api.FederationClientError{
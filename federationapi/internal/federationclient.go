@@ -38,6 +38,16 @@ func (a *FederationInternalAPI) SendJoin(
 	return &ires, nil
 }
 
+// SendJoinPartialState is like SendJoin, but asks the remote server to omit
+// most membership events from the response (MSC3706).
+func (a *FederationInternalAPI) SendJoinPartialState(
+	ctx context.Context, origin, s spec.ServerName, event gomatrixserverlib.PDU,
+) (res fclient.RespSendJoin, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*5)
+	defer cancel()
+	return a.federation.SendJoinPartialState(ctx, origin, s, event)
+}
+
 func (a *FederationInternalAPI) GetEventAuth(
 	ctx context.Context, origin, s spec.ServerName,
 	roomVersion gomatrixserverlib.RoomVersion, roomID, eventID string,
@@ -167,10 +167,13 @@ func (s *FederationInternalAPI) handleDatabaseKeys(
 
 		// If the key is valid right now then we can also remove it
 		// from the request list as we don't need to fetch it again
-		// in that case. If the key isn't valid right now, then by
-		// leaving it in the 'requests' map, we'll try to update the
-		// key using the fetchers in handleFetcherKeys.
-		if res.WasValidAt(now, gomatrixserverlib.StrictValiditySignatureCheck) {
+		// in that case. The same goes for expired keys, which won't
+		// change again, and which are still good enough to verify
+		// events from before they expired. If the key isn't valid
+		// right now, then by leaving it in the 'requests' map, we'll
+		// try to update the key using the fetchers in handleFetcherKeys.
+		if res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired ||
+			res.WasValidAt(now, gomatrixserverlib.StrictValiditySignatureCheck) {
 			delete(requests, req)
 		}
 	}
@@ -208,10 +211,20 @@ func (s *FederationInternalAPI) handleFetcherKeys(
 	// Now let's look at the results that we got from this fetcher.
 	for req, res := range fetcherResults {
 		if prev, ok := results[req]; ok {
+			// If we already know that the key expired, e.g. because
+			// an admin expired it early, then don't let the fetched
+			// result revive it or push its expiry back.
+			if prev.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired &&
+				(res.ExpiredTS == gomatrixserverlib.PublicKeyNotExpired || res.ExpiredTS > prev.ExpiredTS) {
+				delete(requests, req)
+				continue
+			}
+
 			// We've already got a previous entry for this request
 			// so let's see if the newly retrieved one contains a more
-			// up-to-date validity period.
-			if res.ValidUntilTS > prev.ValidUntilTS {
+			// up-to-date validity period, or tells us that the key
+			// has since been moved to old_verify_keys.
+			if res.ValidUntilTS > prev.ValidUntilTS || res.ExpiredTS != prev.ExpiredTS {
 				// This key is newer than the one we had so let's store
 				// it in the database.
 				storeResults[req] = res
@@ -191,7 +191,12 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 			return r.rsAPI.StoreUserRoomPublicKey(ctx, senderID, *storeUserID, roomID)
 		},
 	}
-	response, joinErr := gomatrixserverlib.PerformJoin(ctx, r, joinInput)
+	var joinClient gomatrixserverlib.FederatedJoinClient = r
+	partialJoinClient := &partialStateJoinClient{r, nil}
+	if r.cfg.PartialStateJoins {
+		joinClient = partialJoinClient
+	}
+	response, joinErr := gomatrixserverlib.PerformJoin(ctx, joinClient, joinInput)
 
 	if joinErr != nil {
 		if !joinErr.Reachable {
@@ -236,9 +241,49 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 	); err != nil {
 		return fmt.Errorf("roomserverAPI.SendEventWithState: %w", err)
 	}
+
+	// If the remote server omitted members from the join response then the
+	// room only has partial state, so tell the roomserver, which will fetch
+	// the full state in the background.
+	if resp := partialJoinClient.resp; resp != nil && resp.MembersOmitted {
+		// Put the server that we joined through first, as we know it's up.
+		serversInRoom := []spec.ServerName{serverName}
+		for _, server := range resp.ServersInRoom {
+			if spec.ServerName(server) != serverName {
+				serversInRoom = append(serversInRoom, spec.ServerName(server))
+			}
+		}
+		if err = r.rsAPI.PerformMarkPartialStateRoom(context.Background(), roomserverAPI.PartialStateRoom{
+			RoomID:        roomID,
+			JoinEventID:   response.JoinEvent.EventID(),
+			ServersInRoom: serversInRoom,
+		}); err != nil {
+			return fmt.Errorf("r.rsAPI.PerformMarkPartialStateRoom: %w", err)
+		}
+		logrus.WithField("room", roomID).Infof("Joined federated room with partial state, %d servers in room", len(serversInRoom))
+	}
 	return nil
 }
 
+// partialStateJoinClient makes send_join requests that ask for partial state
+// (MSC3706) and remembers the response, so that we can tell afterwards whether
+// the remote server actually omitted the members.
+type partialStateJoinClient struct {
+	*FederationInternalAPI
+	resp *fclient.RespSendJoin
+}
+
+func (c *partialStateJoinClient) SendJoin(
+	ctx context.Context, origin, s spec.ServerName, event gomatrixserverlib.PDU,
+) (gomatrixserverlib.SendJoinResponse, error) {
+	res, err := c.FederationInternalAPI.SendJoinPartialState(ctx, origin, s, event)
+	if err != nil {
+		return &fclient.RespSendJoin{}, err
+	}
+	c.resp = &res
+	return &res, nil
+}
+
 // PerformOutboundPeekRequest implements api.FederationInternalAPI
 func (r *FederationInternalAPI) PerformOutboundPeek(
 	ctx context.Context,
@@ -0,0 +1,183 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+// pinnedKeyValidity is how far ahead pinned keys are reported to be valid
+// for. They never expire, but callers expect a validity period.
+const pinnedKeyValidity = time.Hour * 24
+
+// pinnedServerKeys are the only keys that we trust for the servers that
+// they are configured for. Keys are never fetched or stored for these
+// servers.
+type pinnedServerKeys map[spec.ServerName]map[gomatrixserverlib.KeyID]ed25519.PublicKey
+
+func newPinnedServerKeys(cfg []config.PinnedServerKeys) pinnedServerKeys {
+	pinned := pinnedServerKeys{}
+	for _, server := range cfg {
+		keys := pinned[server.ServerName]
+		if keys == nil {
+			keys = map[gomatrixserverlib.KeyID]ed25519.PublicKey{}
+			pinned[server.ServerName] = keys
+		}
+		for _, key := range server.Keys {
+			rawKey, err := key.Decode()
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"server_name": server.ServerName,
+					"key_id":      key.KeyID,
+				}).Warn("Couldn't parse pinned server key")
+				continue
+			}
+			keys[key.KeyID] = rawKey
+		}
+		logrus.WithFields(logrus.Fields{
+			"server_name":     server.ServerName,
+			"num_public_keys": len(keys),
+		}).Info("Pinned server keys")
+	}
+	return pinned
+}
+
+func (p pinnedServerKeys) result(key ed25519.PublicKey) gomatrixserverlib.PublicKeyLookupResult {
+	return gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey: gomatrixserverlib.VerifyKey{
+			Key: spec.Base64Bytes(key),
+		},
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: spec.AsTimestamp(time.Now().Add(pinnedKeyValidity)),
+	}
+}
+
+// lookup answers the requests for pinned servers, removing them from the
+// requests. A request for a key ID that isn't pinned gets no result.
+func (p pinnedServerKeys) lookup(
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	for req := range requests {
+		keys, ok := p[req.ServerName]
+		if !ok {
+			continue
+		}
+		delete(requests, req)
+		if key, ok := keys[req.KeyID]; ok {
+			results[req] = p.result(key)
+		}
+	}
+}
+
+// database wraps the key database so that pinned keys are returned from it
+// and keys for pinned servers are never stored in it.
+func (p pinnedServerKeys) database(db gomatrixserverlib.KeyDatabase) gomatrixserverlib.KeyDatabase {
+	if len(p) == 0 {
+		return db
+	}
+	return &pinnedKeyDatabase{inner: db, pinned: p}
+}
+
+// fetcher wraps the key fetcher so that keys are never fetched for pinned
+// servers.
+func (p pinnedServerKeys) fetcher(f gomatrixserverlib.KeyFetcher) gomatrixserverlib.KeyFetcher {
+	if len(p) == 0 {
+		return f
+	}
+	return &pinnedKeyFetcher{inner: f, pinned: p}
+}
+
+type pinnedKeyDatabase struct {
+	inner  gomatrixserverlib.KeyDatabase
+	pinned pinnedServerKeys
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher
+func (d *pinnedKeyDatabase) FetcherName() string {
+	return fmt.Sprintf("PinnedKeys (wrapping %q)", d.inner.FetcherName())
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (d *pinnedKeyDatabase) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	d.pinned.lookup(requests, results)
+	if len(requests) == 0 {
+		return results, nil
+	}
+	fromDB, err := d.inner.FetchKeys(ctx, requests)
+	if err != nil {
+		return results, err
+	}
+	for req, res := range fromDB {
+		results[req] = res
+	}
+	return results, nil
+}
+
+// StoreKeys implements gomatrixserverlib.KeyDatabase
+func (d *pinnedKeyDatabase) StoreKeys(
+	ctx context.Context,
+	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	toStore := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(keyMap))
+	for req, res := range keyMap {
+		if _, ok := d.pinned[req.ServerName]; !ok {
+			toStore[req] = res
+		}
+	}
+	return d.inner.StoreKeys(ctx, toStore)
+}
+
+type pinnedKeyFetcher struct {
+	inner  gomatrixserverlib.KeyFetcher
+	pinned pinnedServerKeys
+}
+
+// FetcherName implements gomatrixserverlib.KeyFetcher
+func (f *pinnedKeyFetcher) FetcherName() string {
+	return f.inner.FetcherName()
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (f *pinnedKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	toFetch := make(map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp, len(requests))
+	for req, ts := range requests {
+		if _, ok := f.pinned[req.ServerName]; !ok {
+			toFetch[req] = ts
+		}
+	}
+	if len(toFetch) == 0 {
+		return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}, nil
+	}
+	results, err := f.inner.FetchKeys(ctx, toFetch)
+	if err != nil {
+		return nil, err
+	}
+	// Fetchers can return more keys than were asked for, e.g. a notary
+	// might return keys for a pinned server. Don't let those through.
+	for req := range results {
+		if _, ok := f.pinned[req.ServerName]; ok {
+			delete(results, req)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+type keyResults = map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+
+// stubKeyStore serves as both the key database and a key fetcher, returning
+// a key for everything that is asked for.
+type stubKeyStore struct {
+	requested []gomatrixserverlib.PublicKeyLookupRequest
+	stored    keyResults
+}
+
+func (s *stubKeyStore) FetcherName() string { return "stub" }
+
+func (s *stubKeyStore) FetchKeys(
+	_ context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp,
+) (keyResults, error) {
+	results := keyResults{}
+	for req := range requests {
+		s.requested = append(s.requested, req)
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{ValidUntilTS: 1}
+	}
+	// Also return a key for a pinned server that wasn't asked for.
+	results[gomatrixserverlib.PublicKeyLookupRequest{ServerName: "pinned.org", KeyID: "ed25519:other"}] = gomatrixserverlib.PublicKeyLookupResult{}
+	return results, nil
+}
+
+func (s *stubKeyStore) StoreKeys(_ context.Context, results keyResults) error {
+	s.stored = results
+	return nil
+}
+
+func TestPinnedServerKeys(t *testing.T) {
+	pubKey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	pinned := newPinnedServerKeys([]config.PinnedServerKeys{{
+		ServerName: "pinned.org",
+		Keys: []config.KeyPerspectiveTrustKey{{
+			KeyID:     "ed25519:pinned",
+			PublicKey: base64.RawStdEncoding.EncodeToString(pubKey),
+		}},
+	}})
+	pinnedKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "pinned.org", KeyID: "ed25519:pinned"}
+	unpinnedKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "pinned.org", KeyID: "ed25519:unpinned"}
+	otherKey := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "other.org", KeyID: "ed25519:auto"}
+	requests := func() map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp {
+		return map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{
+			pinnedKey: 0, unpinnedKey: 0, otherKey: 0,
+		}
+	}
+
+	// The database returns the pinned key, and only goes to the underlying
+	// database for servers that aren't pinned.
+	inner := &stubKeyStore{}
+	db := pinned.database(inner)
+	results, err := db.FetchKeys(context.Background(), requests())
+	assert.NoError(t, err)
+	assert.Equal(t, []gomatrixserverlib.PublicKeyLookupRequest{otherKey}, inner.requested)
+	if assert.Contains(t, results, pinnedKey) {
+		assert.Equal(t, spec.Base64Bytes(pubKey), results[pinnedKey].Key)
+		assert.Equal(t, gomatrixserverlib.PublicKeyNotExpired, results[pinnedKey].ExpiredTS)
+	}
+	assert.NotContains(t, results, unpinnedKey)
+
+	// Keys for pinned servers are never stored.
+	err = db.StoreKeys(context.Background(), keyResults{unpinnedKey: {}, otherKey: {}})
+	assert.NoError(t, err)
+	assert.Equal(t, keyResults{otherKey: {}}, inner.stored)
+
+	// Fetchers are never asked for keys for pinned servers, and anything
+	// they return for pinned servers is dropped.
+	inner = &stubKeyStore{}
+	results, err = pinned.fetcher(inner).FetchKeys(context.Background(), requests())
+	assert.NoError(t, err)
+	assert.Equal(t, []gomatrixserverlib.PublicKeyLookupRequest{otherKey}, inner.requested)
+	assert.Equal(t, keyResults{otherKey: {ValidUntilTS: 1}}, results)
+
+	// Without any pinned keys, nothing is wrapped.
+	assert.Same(t, inner, newPinnedServerKeys(nil).fetcher(inner))
+}
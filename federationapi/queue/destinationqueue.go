@@ -9,6 +9,7 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -23,6 +24,7 @@ import (
 	"github.com/element-hq/dendrite/federationapi/statistics"
 	"github.com/element-hq/dendrite/federationapi/storage"
 	"github.com/element-hq/dendrite/federationapi/storage/shared/receipt"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/roomserver/types"
 	"github.com/element-hq/dendrite/setup/process"
 )
@@ -47,6 +49,7 @@ type destinationQueue struct {
 	client             fclient.FederationClient        // federation client
 	origin             spec.ServerName                 // origin of requests
 	destination        spec.ServerName                 // destination of requests
+	metrics            bool                            // report metrics for this destination on its own
 	running            atomic.Bool                     // is the queue worker running?
 	backingOff         atomic.Bool                     // true if we're backing off
 	overflowed         atomic.Bool                     // the queues exceed maxPDUsInMemory/maxEDUsInMemory, so we should consult the database for more
@@ -56,7 +59,12 @@ type destinationQueue struct {
 	notify             chan struct{}                   // interrupts idle wait pending PDUs/EDUs
 	pendingPDUs        []*queuedPDU                    // PDUs waiting to be sent
 	pendingEDUs        []*queuedEDU                    // EDUs waiting to be sent
-	pendingMutex       sync.RWMutex                    // protects pendingPDUs and pendingEDUs
+	pendingMutex       sync.RWMutex                    // protects pendingPDUs, pendingEDUs and the reported depths
+	reportedPDUs       int                             // pendingPDUs last added to destinationQueueDepth
+	reportedEDUs       int                             // pendingEDUs last added to destinationQueueDepth
+	transactionCount   atomic.Int64                    // transactions attempted since startup
+	transactionTotal   atomic.Int64                    // time taken by all transactions attempted, in nanoseconds
+	transactionLast    atomic.Int64                    // time taken by the last transaction attempted, in nanoseconds
 }
 
 // Send event adds the event to the pending queue for the destination.
@@ -346,9 +354,18 @@ func (oq *destinationQueue) backgroundSend() {
 		}
 
 		// Work out which PDUs/EDUs to include in the next transaction.
-		oq.pendingMutex.RLock()
+		// Drop any EDUs that have been superseded by newer ones and then
+		// order the rest so that more important EDUs go out first. This
+		// only ever reorders or shrinks the pending list, so the first
+		// eduCount entries are still the ones that we sent when it comes
+		// to handling success.
+		oq.pendingMutex.Lock()
+		var superseded []*queuedEDU
+		oq.pendingEDUs, superseded = coalesceEDUs(oq.pendingEDUs)
+		sortEDUsByPriority(oq.pendingEDUs)
 		pduCount := len(oq.pendingPDUs)
 		eduCount := len(oq.pendingEDUs)
+		oq.updateQueueDepth()
 		if pduCount > maxPDUsPerTransaction {
 			pduCount = maxPDUsPerTransaction
 		}
@@ -357,7 +374,11 @@ func (oq *destinationQueue) backgroundSend() {
 		}
 		toSendPDUs := oq.pendingPDUs[:pduCount]
 		toSendEDUs := oq.pendingEDUs[:eduCount]
-		oq.pendingMutex.RUnlock()
+		oq.pendingMutex.Unlock()
+
+		if len(superseded) > 0 {
+			oq.cleanSupersededEDUs(superseded)
+		}
 
 		// If we didn't get anything from the database and there are no
 		// pending EDUs then there's nothing to do - stop here.
@@ -365,9 +386,22 @@ func (oq *destinationQueue) backgroundSend() {
 			continue
 		}
 
+		// The server-wide federation policy may have been reloaded since
+		// the events were queued. If the destination is no longer allowed
+		// then nothing will ever be delivered, so drop the queue instead
+		// of backing off and eventually blacklisting the destination.
+		if !oq.queues.statistics.IsAllowed(oq.destination) {
+			oq.dropDeniedDestination()
+			return
+		}
+
 		// If we have pending PDUs or EDUs then construct a transaction.
 		// Try sending the next transaction and see what happens.
 		terr, sendMethod := oq.nextTransaction(toSendPDUs, toSendEDUs)
+		if errors.Is(terr, serverpolicy.ErrServerNotAllowed) {
+			oq.dropDeniedDestination()
+			return
+		}
 		if terr != nil {
 			// We failed to send the transaction. Mark it as a failure.
 			_, blacklisted := oq.statistics.Failure()
@@ -405,6 +439,22 @@ func (oq *destinationQueue) nextTransaction(
 	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
 	defer cancel()
 
+	start := time.Now()
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		duration := time.Since(start)
+		destinationTransactionDuration.WithLabelValues(result).Observe(duration.Seconds())
+		if oq.metrics {
+			perDestinationTransactionDuration.WithLabelValues(string(oq.destination), result).Observe(duration.Seconds())
+		}
+		oq.transactionLast.Store(int64(duration))
+		oq.transactionTotal.Add(int64(duration))
+		oq.transactionCount.Add(1)
+	}()
+
 	relayServers := oq.statistics.KnownRelayServers()
 	hasRelayServers := len(relayServers) > 0
 	shouldSendToRelays := oq.statistics.AssumedOffline() && hasRelayServers
@@ -545,6 +595,19 @@ func (oq *destinationQueue) createTransaction(
 	return t, pduReceipts, eduReceipts
 }
 
+// cleanSupersededEDUs removes EDUs that will never be sent, because a newer
+// EDU replaces them, from the database.
+func (oq *destinationQueue) cleanSupersededEDUs(edus []*queuedEDU) {
+	receipts := make([]*receipt.Receipt, 0, len(edus))
+	for _, edu := range edus {
+		receipts = append(receipts, edu.dbReceipt)
+	}
+	logrus.WithField("server_name", oq.destination).Debugf("Dropping %d superseded EDUs", len(receipts))
+	if err := oq.db.CleanEDUs(oq.process.Context(), oq.destination, receipts); err != nil {
+		logrus.WithError(err).Errorf("Failed to clean superseded EDUs for server %q", oq.destination)
+	}
+}
+
 // blacklistDestination removes all pending PDUs and EDUs that have been cached
 // and deletes this queue.
 func (oq *destinationQueue) blacklistDestination() {
@@ -562,6 +625,7 @@ func (oq *destinationQueue) blacklistDestination() {
 	}
 	oq.pendingPDUs = nil
 	oq.pendingEDUs = nil
+	oq.updateQueueDepth()
 	oq.pendingMutex.Unlock()
 
 	// Delete this queue as no more messages will be sent to this
@@ -570,6 +634,67 @@ func (oq *destinationQueue) blacklistDestination() {
 	oq.queues.clearQueue(oq)
 }
 
+// dropDeniedDestination removes all pending PDUs and EDUs for a destination
+// which the server-wide federation policy no longer allows, both in memory
+// and in the database, and deletes this queue. Unlike blacklistDestination,
+// this doesn't count as a failure against the destination, so it is not
+// backed off or blacklisted if the policy allows it again later.
+func (oq *destinationQueue) dropDeniedDestination() {
+	logrus.Warnf("Dropping queued events for %q as it is denied by the federation policy", oq.destination)
+
+	oq.purgePending()
+	if _, _, err := oq.db.PurgePendingForServer(oq.process.Context(), oq.destination); err != nil {
+		logrus.WithError(err).Errorf("Failed to remove queued events for %q", oq.destination)
+	}
+
+	oq.statistics.AssignBackoffNotifier(nil)
+	oq.queues.clearQueue(oq)
+}
+
+// purgePending drops all PDUs and EDUs that have been cached for
+// this destination. The caller is responsible for removing them
+// from the database.
+func (oq *destinationQueue) purgePending() {
+	oq.pendingMutex.Lock()
+	defer oq.pendingMutex.Unlock()
+	for i := range oq.pendingPDUs {
+		oq.pendingPDUs[i] = nil
+	}
+	for i := range oq.pendingEDUs {
+		oq.pendingEDUs[i] = nil
+	}
+	oq.pendingPDUs = nil
+	oq.pendingEDUs = nil
+	oq.overflowed.Store(false)
+	oq.updateQueueDepth()
+}
+
+// transactionDurations returns how long the last transaction attempted took,
+// and how long transactions took on average, or zero if none were attempted.
+func (oq *destinationQueue) transactionDurations() (last, mean time.Duration) {
+	count := oq.transactionCount.Load()
+	if count == 0 {
+		return 0, 0
+	}
+	return time.Duration(oq.transactionLast.Load()), time.Duration(oq.transactionTotal.Load() / count)
+}
+
+// updateQueueDepth brings this queue's contribution to the aggregate
+// destinationQueueDepth gauge up to date. The gauge isn't labelled by
+// destination, as that would create a series for every server we have
+// ever talked to, but the admin API reports the queue of each destination
+// and the destinations which metrics were asked for are reported on their
+// own. The caller must hold pendingMutex.
+func (oq *destinationQueue) updateQueueDepth() {
+	destinationQueueDepth.WithLabelValues("pdu").Add(float64(len(oq.pendingPDUs) - oq.reportedPDUs))
+	destinationQueueDepth.WithLabelValues("edu").Add(float64(len(oq.pendingEDUs) - oq.reportedEDUs))
+	oq.reportedPDUs, oq.reportedEDUs = len(oq.pendingPDUs), len(oq.pendingEDUs)
+	if oq.metrics {
+		perDestinationQueueDepth.WithLabelValues(string(oq.destination), "pdu").Set(float64(len(oq.pendingPDUs)))
+		perDestinationQueueDepth.WithLabelValues(string(oq.destination), "edu").Set(float64(len(oq.pendingEDUs)))
+	}
+}
+
 // handleTransactionSuccess updates the cached event queues as well as the success and
 // backoff information for this server.
 func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int, sendMethod statistics.SendMethod) {
@@ -580,6 +705,10 @@ func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int,
 	oq.pendingMutex.Lock()
 	defer oq.pendingMutex.Unlock()
 
+	// The pending queues may have been purged while the transaction
+	// was in flight, so don't assume they are still as long as it was.
+	pduCount = min(pduCount, len(oq.pendingPDUs))
+	eduCount = min(eduCount, len(oq.pendingEDUs))
 	for i := range oq.pendingPDUs[:pduCount] {
 		oq.pendingPDUs[i] = nil
 	}
@@ -588,6 +717,7 @@ func (oq *destinationQueue) handleTransactionSuccess(pduCount int, eduCount int,
 	}
 	oq.pendingPDUs = oq.pendingPDUs[pduCount:]
 	oq.pendingEDUs = oq.pendingEDUs[eduCount:]
+	oq.updateQueueDepth()
 
 	if len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0 {
 		select {
@@ -0,0 +1,119 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package queue
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/federationapi/types"
+)
+
+// eduPriority is the class that an EDU is sent in. EDUs with a lower
+// priority value are packed into transactions before those with a higher
+// one. PDUs are always sent ahead of every EDU class.
+type eduPriority int
+
+const (
+	eduPriorityDevice    eduPriority = iota // to-device messages and device/key updates
+	eduPriorityReceipt                      // read receipts and unrecognised EDUs
+	eduPriorityEphemeral                    // typing notifications and presence
+)
+
+// priorityForEDU returns the priority class for the given EDU type.
+func priorityForEDU(eduType string) eduPriority {
+	switch eduType {
+	case spec.MDirectToDevice, spec.MDeviceListUpdate, types.MSigningKeyUpdate:
+		return eduPriorityDevice
+	case spec.MTyping, spec.MPresence:
+		return eduPriorityEphemeral
+	default:
+		return eduPriorityReceipt
+	}
+}
+
+// supersedeKey returns a key identifying the state that an EDU replaces.
+// When two pending EDUs share a key, only the newest needs to be sent. An
+// empty key means the EDU can't be coalesced with anything else.
+func supersedeKey(edu *gomatrixserverlib.EDU) string {
+	switch edu.Type {
+	case spec.MTyping:
+		var content struct {
+			RoomID string `json:"room_id"`
+			UserID string `json:"user_id"`
+		}
+		if err := json.Unmarshal(edu.Content, &content); err != nil {
+			return ""
+		}
+		if content.RoomID == "" || content.UserID == "" {
+			return ""
+		}
+		return spec.MTyping + "\x00" + content.RoomID + "\x00" + content.UserID
+	case spec.MPresence:
+		var content types.Presence
+		if err := json.Unmarshal(edu.Content, &content); err != nil {
+			return ""
+		}
+		if len(content.Push) != 1 || content.Push[0].UserID == "" {
+			return ""
+		}
+		return spec.MPresence + "\x00" + content.Push[0].UserID
+	default:
+		return ""
+	}
+}
+
+// coalesceEDUs drops EDUs which are superseded by a newer EDU for the same
+// room or user, e.g. an old typing notification. The newest EDU is the one
+// with the highest database NID. The remaining EDUs keep their relative
+// order. The superseded EDUs are returned so that they can be removed from
+// the database.
+func coalesceEDUs(edus []*queuedEDU) (kept, superseded []*queuedEDU) {
+	newest := make(map[string]*queuedEDU, len(edus))
+	keys := make([]string, len(edus))
+	for i, edu := range edus {
+		if edu == nil || edu.edu == nil {
+			continue
+		}
+		key := supersedeKey(edu.edu)
+		if key == "" {
+			continue
+		}
+		keys[i] = key
+		if existing, ok := newest[key]; !ok || existing.dbReceipt.GetNID() < edu.dbReceipt.GetNID() {
+			newest[key] = edu
+		}
+	}
+	kept = edus[:0]
+	for i, edu := range edus {
+		if keys[i] != "" && newest[keys[i]] != edu {
+			superseded = append(superseded, edu)
+			continue
+		}
+		kept = append(kept, edu)
+	}
+	// Clear the tail so the dropped EDUs can be garbage collected.
+	clear(edus[len(kept):])
+	return kept, superseded
+}
+
+// sortEDUsByPriority orders EDUs by their priority class, preserving the
+// existing order of EDUs within the same class.
+func sortEDUsByPriority(edus []*queuedEDU) {
+	slices.SortStableFunc(edus, func(a, b *queuedEDU) int {
+		return int(eduPriorityOf(a)) - int(eduPriorityOf(b))
+	})
+}
+
+func eduPriorityOf(edu *queuedEDU) eduPriority {
+	if edu == nil || edu.edu == nil {
+		return eduPriorityReceipt
+	}
+	return priorityForEDU(edu.edu.Type)
+}
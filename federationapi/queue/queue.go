@@ -7,6 +7,7 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"sync"
@@ -37,14 +38,17 @@ type OutgoingQueues struct {
 	client      fclient.FederationClient
 	statistics  *statistics.Statistics
 	signing     map[spec.ServerName]*fclient.SigningIdentity
-	queuesMutex sync.Mutex // protects the below
+	metrics     map[spec.ServerName]struct{} // destinations with metrics of their own
+	queuesMutex sync.Mutex                   // protects the below
 	queues      map[spec.ServerName]*destinationQueue
 }
 
 func init() {
 	prometheus.MustRegister(
 		destinationQueueTotal, destinationQueueRunning,
-		destinationQueueBackingOff,
+		destinationQueueBackingOff, destinationQueueDepth,
+		destinationTransactionDuration, perDestinationQueueDepth,
+		perDestinationTransactionDuration,
 	)
 }
 
@@ -72,6 +76,64 @@ var destinationQueueBackingOff = prometheus.NewGauge(
 	},
 )
 
+var destinationQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_queue_depth",
+		Help:      "Number of PDUs and EDUs held in memory waiting to be sent, across all destinations",
+	},
+	[]string{"type"},
+)
+
+var destinationTransactionDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "destination_transaction_duration_seconds",
+		Help:      "Time taken to send a transaction, across all destinations",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	},
+	[]string{"result"},
+)
+
+// perDestinationQueueDepth and perDestinationTransactionDuration are only
+// reported for the destinations given to WithMetricsDestinations, so that
+// the number of series stays bounded.
+var perDestinationQueueDepth = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "per_destination_queue_depth",
+		Help:      "Number of PDUs and EDUs held in memory waiting to be sent to a destination",
+	},
+	[]string{"destination", "type"},
+)
+
+var perDestinationTransactionDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "per_destination_transaction_duration_seconds",
+		Help:      "Time taken to send a transaction to a destination",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	},
+	[]string{"destination", "result"},
+)
+
+// OutgoingQueuesOption configures optional behaviour of the OutgoingQueues.
+type OutgoingQueuesOption func(oqs *OutgoingQueues)
+
+// WithMetricsDestinations reports the queue depth and transaction durations
+// of the given destinations as metrics of their own, as well as in aggregate.
+func WithMetricsDestinations(destinations []string) OutgoingQueuesOption {
+	return func(oqs *OutgoingQueues) {
+		for _, destination := range destinations {
+			oqs.metrics[spec.ServerName(destination)] = struct{}{}
+		}
+	}
+}
+
 // NewOutgoingQueues makes a new OutgoingQueues
 func NewOutgoingQueues(
 	db storage.Database,
@@ -81,6 +143,7 @@ func NewOutgoingQueues(
 	client fclient.FederationClient,
 	statistics *statistics.Statistics,
 	signing []*fclient.SigningIdentity,
+	options ...OutgoingQueuesOption,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		disabled:   disabled,
@@ -90,8 +153,12 @@ func NewOutgoingQueues(
 		client:     client,
 		statistics: statistics,
 		signing:    map[spec.ServerName]*fclient.SigningIdentity{},
+		metrics:    map[spec.ServerName]struct{}{},
 		queues:     map[spec.ServerName]*destinationQueue{},
 	}
+	for _, option := range options {
+		option(queues)
+	}
 	for _, identity := range signing {
 		queues.signing[identity.ServerName] = identity
 	}
@@ -117,10 +184,22 @@ func NewOutgoingQueues(
 			step = (time.Second * 120) / time.Duration(max)
 		}
 		for serverName := range serverNames {
-			if queue := queues.getQueue(serverName); queue != nil {
-				time.AfterFunc(offset, queue.wakeQueueIfNeeded)
-				offset += step
+			queue := queues.getQueue(serverName)
+			if queue == nil {
+				continue
+			}
+			// If we were still backing off from this server before the
+			// restart then leave the queue asleep until the backoff ends.
+			if queue.statistics.BackingOff() && queue.backingOff.CompareAndSwap(false, true) {
+				destinationQueueBackingOff.Inc()
+				if queue.statistics.BackingOff() {
+					continue
+				}
+				// The backoff finished before we marked the queue as
+				// backing off, so the notifier didn't wake it.
 			}
+			time.AfterFunc(offset, queue.wakeQueueIfNeeded)
+			offset += step
 		}
 	}
 	return queues
@@ -137,6 +216,9 @@ type queuedEDU struct {
 }
 
 func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQueue {
+	if !oqs.statistics.IsAllowed(destination) {
+		return nil
+	}
 	if oqs.statistics.ForServer(destination).Blacklisted() {
 		return nil
 	}
@@ -145,12 +227,14 @@ func (oqs *OutgoingQueues) getQueue(destination spec.ServerName) *destinationQue
 	oq, ok := oqs.queues[destination]
 	if !ok || oq == nil {
 		destinationQueueTotal.Inc()
+		_, metrics := oqs.metrics[destination]
 		oq = &destinationQueue{
 			queues:      oqs,
 			db:          oqs.db,
 			process:     oqs.process,
 			origin:      oqs.origin,
 			destination: destination,
+			metrics:     metrics,
 			client:      oqs.client,
 			statistics:  oqs.statistics.ForServer(destination),
 			notify:      make(chan struct{}, 1),
@@ -342,3 +426,35 @@ func (oqs *OutgoingQueues) RetryServer(srv spec.ServerName, wasBlacklisted bool)
 		queue.wakeQueueIfEventsPending(wasBlacklisted)
 	}
 }
+
+// PurgeServer drops everything that is queued for the given server, both
+// in memory and in the database. Returns how many PDUs and EDUs were removed
+// from the database.
+func (oqs *OutgoingQueues) PurgeServer(ctx context.Context, srv spec.ServerName) (pdus, edus int64, err error) {
+	oqs.queuesMutex.Lock()
+	oq := oqs.queues[srv]
+	oqs.queuesMutex.Unlock()
+	if oq != nil {
+		oq.purgePending()
+	}
+	return oqs.db.PurgePendingForServer(ctx, srv)
+}
+
+// TransactionDurations returns how long the last transaction to the given
+// server took, and how long transactions to it took on average, or zero if
+// none have been attempted since startup.
+func (oqs *OutgoingQueues) TransactionDurations(srv spec.ServerName) (last, mean time.Duration) {
+	oqs.queuesMutex.Lock()
+	oq := oqs.queues[srv]
+	oqs.queuesMutex.Unlock()
+	if oq == nil {
+		return 0, 0
+	}
+	return oq.transactionDurations()
+}
+
+// PendingCounts returns how many PDUs and EDUs are waiting in the database
+// to be sent to the given server.
+func (oqs *OutgoingQueues) PendingCounts(ctx context.Context, srv spec.ServerName) (pdus, edus int64, err error) {
+	return oqs.db.GetPendingCounts(ctx, srv)
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/element-hq/dendrite/test/testrig"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/prometheus/client_golang/prometheus"
 	"gotest.tools/v3/poll"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -26,6 +27,8 @@ import (
 
 	"github.com/element-hq/dendrite/federationapi/statistics"
 	"github.com/element-hq/dendrite/federationapi/storage"
+	fedtypes "github.com/element-hq/dendrite/federationapi/types"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/roomserver/types"
 	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/setup/process"
@@ -60,8 +63,10 @@ type stubFederationClient struct {
 	fclient.FederationClient
 	shouldTxSucceed      bool
 	shouldTxRelaySucceed bool
+	txErr                error
 	txCount              atomic.Uint32
 	txRelayCount         atomic.Uint32
+	lastTx               atomic.Pointer[gomatrixserverlib.Transaction]
 }
 
 func (f *stubFederationClient) SendTransaction(ctx context.Context, t gomatrixserverlib.Transaction) (res fclient.RespSend, err error) {
@@ -69,8 +74,12 @@ func (f *stubFederationClient) SendTransaction(ctx context.Context, t gomatrixse
 	if !f.shouldTxSucceed {
 		result = fmt.Errorf("transaction failed")
 	}
+	if f.txErr != nil {
+		result = f.txErr
+	}
 
 	f.txCount.Add(1)
+	f.lastTx.Store(&t)
 	return fclient.RespSend{}, result
 }
 
@@ -149,6 +158,120 @@ func TestSendPDUOnSuccessRemovedFromDB(t *testing.T) {
 		return poll.Continue("waiting for more send attempts before checking database. Currently %d", fc.txCount.Load())
 	}
 	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	// The time taken by the transaction is reported for the destination.
+	check = func(log poll.LogT) poll.Result {
+		if last, mean := queues.TransactionDurations(destination); last > 0 && mean == last {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the transaction duration")
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+}
+
+func TestSendPDUPerDestinationMetrics(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("metricshost")
+	_, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, true, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	WithMetricsDestinations([]string{string(destination)})(queues)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(perDestinationTransactionDuration)
+	transactions := func() uint64 {
+		families, err := registry.Gather()
+		assert.NoError(t, err)
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "destination" && label.GetValue() == string(destination) {
+						return metric.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+		}
+		return 0
+	}
+
+	ev := mustCreatePDU(t)
+	err := queues.SendEvent(ev, "localhost", []spec.ServerName{destination})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 && transactions() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the transaction duration")
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+}
+
+func TestSendPDUToDisallowedServerNotQueued(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, true, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+
+	serverPolicy, err := serverpolicy.New(nil, []string{"remote*"})
+	assert.NoError(t, err)
+	queues.statistics.ServerPolicy = serverPolicy
+
+	ev := mustCreatePDU(t)
+	err = queues.SendEvent(ev, "localhost", []spec.ServerName{destination})
+	assert.NoError(t, err)
+
+	pdus, _, err := db.GetPendingCounts(pc.Context(), destination)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), pdus)
+	assert.Equal(t, uint32(0), fc.txCount.Load())
+}
+
+func TestSendPDUToDeniedServerDropped(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, false, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+
+	// The federation transport refuses the request, as it would if the
+	// policy was reloaded to deny the destination after it was queued.
+	fc.txErr = serverpolicy.ErrServerNotAllowed
+
+	ev := mustCreatePDU(t)
+	err := queues.SendEvent(ev, "localhost", []spec.ServerName{destination})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 {
+			data, dbErr := db.GetPendingPDUs(pc.Context(), destination, 100)
+			assert.NoError(t, dbErr)
+			if len(data) == 0 {
+				return poll.Success()
+			}
+			return poll.Continue("waiting for event to be removed from database. Currently present PDU: %d", len(data))
+		}
+		return poll.Continue("waiting for more send attempts before checking database. Currently %d", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	serverStats := queues.statistics.ForServer(destination)
+	assert.Equal(t, uint32(0), serverStats.BackoffCount())
+	assert.False(t, serverStats.Blacklisted())
+	assert.Nil(t, serverStats.LastFailure())
 }
 
 func TestSendEDUOnSuccessRemovedFromDB(t *testing.T) {
@@ -180,6 +303,92 @@ func TestSendEDUOnSuccessRemovedFromDB(t *testing.T) {
 	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
 }
 
+func TestSendEDUsPrioritisedAndCoalesced(t *testing.T) {
+	t.Parallel()
+	failuresUntilBlacklist := uint32(16)
+	destination := spec.ServerName("remotehost")
+	db, fc, queues, pc, close := testSetup(failuresUntilBlacklist, failuresUntilBlacklist+1, true, false, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+
+	// Store two typing notifications for the same user and room, where the
+	// second supersedes the first, followed by a to-device message.
+	destinations := map[spec.ServerName]struct{}{destination: {}}
+	for _, edu := range []*gomatrixserverlib.EDU{
+		{Type: spec.MTyping, Content: []byte(`{"room_id":"!room:localhost","user_id":"@alice:localhost","typing":true}`)},
+		{Type: spec.MTyping, Content: []byte(`{"room_id":"!room:localhost","user_id":"@alice:localhost","typing":false}`)},
+		{Type: spec.MDirectToDevice, Content: []byte(`{}`)},
+	} {
+		eduJSON, _ := json.Marshal(edu)
+		nid, err := db.StoreJSON(pc.Context(), string(eduJSON))
+		assert.NoError(t, err)
+		err = db.AssociateEDUWithDestinations(pc.Context(), destinations, nid, edu.Type, nil)
+		assert.NoError(t, err, "failed to associate EDU with destinations")
+	}
+
+	err := queues.SendEDU(&gomatrixserverlib.EDU{Type: spec.MReceipt, Content: []byte(`{}`)}, "localhost", []spec.ServerName{destination})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		data, dbErr := db.GetPendingEDUs(pc.Context(), destination, 100)
+		assert.NoError(t, dbErr)
+		if len(data) == 0 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for all events to be removed from database. Currently present EDU: %d", len(data))
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	assert.Equal(t, uint32(1), fc.txCount.Load())
+	txn := fc.lastTx.Load()
+	if !assert.NotNil(t, txn) || !assert.Len(t, txn.EDUs, 3) {
+		return
+	}
+	assert.Equal(t, spec.MDirectToDevice, txn.EDUs[0].Type)
+	assert.Equal(t, spec.MReceipt, txn.EDUs[1].Type)
+	assert.Equal(t, spec.MTyping, txn.EDUs[2].Type)
+	assert.JSONEq(t, `{"room_id":"!room:localhost","user_id":"@alice:localhost","typing":false}`, string(txn.EDUs[2].Content))
+}
+
+func TestRehydratedQueueRespectsPersistedBackoff(t *testing.T) {
+	t.Parallel()
+	destination := spec.ServerName("remotehost")
+	db, pc, close := mustCreateFederationDatabase(t, test.DBTypeSQLite, true)
+	defer close()
+
+	// Simulate a PDU and a backoff which were both left over from before
+	// a restart.
+	ev := mustCreatePDU(t)
+	headeredJSON, _ := json.Marshal(ev)
+	nid, _ := db.StoreJSON(pc.Context(), string(headeredJSON))
+	err := db.AssociatePDUWithDestinations(pc.Context(), map[spec.ServerName]struct{}{destination: {}}, nid)
+	assert.NoError(t, err)
+	err = db.SetServerBackoff(pc.Context(), destination, fedtypes.ServerBackoff{
+		FailureCount: 3,
+		BackoffUntil: spec.AsTimestamp(time.Now().Add(time.Minute)),
+		FailingSince: spec.AsTimestamp(time.Now().Add(-time.Minute)),
+	})
+	assert.NoError(t, err)
+
+	fc := &stubFederationClient{shouldTxSucceed: true}
+	stats := statistics.NewStatistics(db, 16, 17, false)
+	queues := NewOutgoingQueues(db, pc, false, "localhost", fc, &stats, nil)
+
+	queues.queuesMutex.Lock()
+	dest := queues.queues[destination]
+	queues.queuesMutex.Unlock()
+	if !assert.NotNil(t, dest) {
+		return
+	}
+	assert.True(t, dest.backingOff.Load())
+	assert.False(t, dest.running.Load())
+	assert.Equal(t, uint32(3), dest.statistics.BackoffCount())
+	assert.Equal(t, uint32(0), fc.txCount.Load())
+}
+
 func TestSendPDUOnFailStoredInDB(t *testing.T) {
 	t.Parallel()
 	failuresUntilBlacklist := uint32(16)
@@ -305,6 +305,22 @@ func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU,
 		}
 	}
 
+	// Don't accept invites to rooms which have been blocked by an admin.
+	blocked, err := rsAPI.QueryRoomBlocked(ctx, inviteEvent.RoomID().String())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomBlocked failed")
+		return nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if blocked {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This room has been blocked on this server"),
+		}
+	}
+
 	headeredInvite := &types.HeaderedEvent{PDU: inviteEvent}
 	if err = rsAPI.HandleInvite(ctx, headeredInvite); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("HandleInvite failed")
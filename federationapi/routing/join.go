@@ -33,6 +33,16 @@ func MakeJoin(
 	roomID spec.RoomID, userID spec.UserID,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	// We can't check whether the user is allowed to join, nor give them
+	// the state of the room, until we have the full state ourselves.
+	if errRes := ErrorIfPartialStateRoom(httpReq.Context(), rsAPI, roomID.String()); errRes != nil {
+		return *errRes
+	}
+
+	if errRes := errorIfRoomBlocked(httpReq.Context(), rsAPI, roomID.String()); errRes != nil {
+		return *errRes
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("failed obtaining room version")
@@ -180,6 +190,30 @@ func MakeJoin(
 	}
 }
 
+// errorIfRoomBlocked returns an error response if an admin has blocked the room,
+// as remote servers can't join blocked rooms through us.
+func errorIfRoomBlocked(
+	ctx context.Context,
+	rsAPI api.FederationRoomserverAPI,
+	roomID string,
+) *util.JSONResponse {
+	blocked, err := rsAPI.QueryRoomBlocked(ctx, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomBlocked failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if blocked {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This room has been blocked on this server"),
+		}
+	}
+	return nil
+}
+
 // SendJoin implements the /send_join API
 func SendJoin(
 	httpReq *http.Request,
@@ -190,6 +224,13 @@ func SendJoin(
 	roomID spec.RoomID,
 	eventID string,
 ) util.JSONResponse {
+	if errRes := ErrorIfPartialStateRoom(httpReq.Context(), rsAPI, roomID.String()); errRes != nil {
+		return *errRes
+	}
+	if errRes := errorIfRoomBlocked(httpReq.Context(), rsAPI, roomID.String()); errRes != nil {
+		return *errRes
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
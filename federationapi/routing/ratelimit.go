@@ -0,0 +1,175 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+// Endpoint classes which share a rate limiting budget.
+const (
+	rateLimitClassSend    = "send"
+	rateLimitClassHistory = "history"
+)
+
+var federationRateLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of inbound federation requests rejected by rate limiting",
+	},
+	[]string{"origin", "class", "reason"},
+)
+
+type fedAPIHandler func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse
+
+// federationRateLimits limits how many requests each remote server can make
+// to an endpoint class within the cooloff period, and how many of those
+// requests can be in flight at once.
+type federationRateLimits struct {
+	enabled bool
+	exempt  map[spec.ServerName]struct{}
+	classes map[string]*originRateLimits
+}
+
+// originRateLimits holds the per-origin state for a single endpoint class.
+type originRateLimits struct {
+	class         string
+	threshold     int64
+	maxConcurrent int64
+	cooloff       time.Duration
+	mutex         sync.Mutex
+	origins       map[spec.ServerName]*originSlots
+}
+
+type originSlots struct {
+	requests   chan struct{} // freed once the cooloff period has passed
+	concurrent chan struct{} // freed once the request has finished
+}
+
+func newFederationRateLimits(cfg *config.FederationRateLimiting) *federationRateLimits {
+	l := &federationRateLimits{
+		enabled: cfg.Enabled,
+		exempt:  map[spec.ServerName]struct{}{},
+		classes: map[string]*originRateLimits{
+			rateLimitClassSend:    newOriginRateLimits(rateLimitClassSend, cfg.Send),
+			rateLimitClassHistory: newOriginRateLimits(rateLimitClassHistory, cfg.History),
+		},
+	}
+	for _, serverName := range cfg.ExemptServers {
+		l.exempt[spec.ServerName(serverName)] = struct{}{}
+	}
+	if l.enabled {
+		go l.clean()
+	}
+	return l
+}
+
+func newOriginRateLimits(class string, cfg config.FederationRateLimit) *originRateLimits {
+	return &originRateLimits{
+		class:         class,
+		threshold:     cfg.Threshold,
+		maxConcurrent: cfg.MaxConcurrent,
+		cooloff:       time.Duration(cfg.CooloffMS) * time.Millisecond,
+		origins:       map[spec.ServerName]*originSlots{},
+	}
+}
+
+func (l *federationRateLimits) clean() {
+	for {
+		// On a 30 second interval, forget about any origins which have
+		// no requests counting against their budgets, freeing up memory.
+		// acquire takes its slots under the same lock, so an origin can't
+		// be forgotten between being looked up and its slots being taken.
+		time.Sleep(time.Second * 30)
+		for _, c := range l.classes {
+			c.mutex.Lock()
+			for origin, slots := range c.origins {
+				if len(slots.requests) == 0 && len(slots.concurrent) == 0 {
+					delete(c.origins, origin)
+				}
+			}
+			c.mutex.Unlock()
+		}
+	}
+}
+
+// wrap applies the budget for the given endpoint class to f. Since it is
+// called with the already-verified federation request, the limits are
+// applied to the authenticated origin rather than the remote address.
+func (l *federationRateLimits) wrap(class string, f fedAPIHandler) fedAPIHandler {
+	if !l.enabled {
+		return f
+	}
+	c := l.classes[class]
+	return func(req *http.Request, fedReq *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+		origin := fedReq.Origin()
+		if _, ok := l.exempt[origin]; ok {
+			return f(req, fedReq, vars)
+		}
+		release, errRes := c.acquire(origin)
+		if errRes != nil {
+			return *errRes
+		}
+		defer release()
+		return f(req, fedReq, vars)
+	}
+}
+
+// acquire takes a request slot and a concurrency slot for the origin. The
+// returned function must be called when the request has finished. The slots
+// are taken under the same lock as the lookup, otherwise clean could forget
+// the origin in between and a later request would get a fresh budget.
+func (c *originRateLimits) acquire(origin spec.ServerName) (func(), *util.JSONResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	slots, ok := c.origins[origin]
+	if !ok {
+		slots = &originSlots{
+			requests:   make(chan struct{}, c.threshold),
+			concurrent: make(chan struct{}, c.maxConcurrent),
+		}
+		c.origins[origin] = slots
+	}
+
+	select {
+	case slots.requests <- struct{}{}:
+	default:
+		federationRateLimitedTotal.WithLabelValues(string(origin), c.class, "rate").Inc()
+		return nil, &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many requests from your server, try again later", c.cooloff.Milliseconds()),
+		}
+	}
+
+	// After the cooloff, free up the request slot again, whether or not
+	// the request was allowed to run.
+	go func() {
+		<-time.After(c.cooloff)
+		<-slots.requests
+	}()
+
+	select {
+	case slots.concurrent <- struct{}{}:
+	default:
+		federationRateLimitedTotal.WithLabelValues(string(origin), c.class, "concurrency").Inc()
+		return nil, &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many concurrent requests from your server, try again later", c.cooloff.Milliseconds()),
+		}
+	}
+	return func() { <-slots.concurrent }, nil
+}
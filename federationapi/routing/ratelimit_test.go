@@ -0,0 +1,70 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+func TestFederationRateLimits(t *testing.T) {
+	limits := newFederationRateLimits(&config.FederationRateLimiting{
+		Enabled:       true,
+		Send:          config.FederationRateLimit{Threshold: 2, CooloffMS: 60000, MaxConcurrent: 1},
+		History:       config.FederationRateLimit{Threshold: 1, CooloffMS: 60000, MaxConcurrent: 1},
+		ExemptServers: []string{"exempt.org"},
+	})
+
+	var inner func() util.JSONResponse
+	handler := limits.wrap(rateLimitClassSend, func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse {
+		return inner()
+	})
+	ok := func() util.JSONResponse { return util.JSONResponse{Code: http.StatusOK} }
+	request := func(origin spec.ServerName) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/federation/v1/send/1", nil)
+		fedReq := fclient.NewFederationRequest(http.MethodPut, origin, "localhost", "/send/1")
+		return handler(req, &fedReq, nil)
+	}
+
+	// A second request from the same origin can't run while the first one
+	// is still in flight.
+	inner = func() util.JSONResponse {
+		res := request("remote.org")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		if assert.IsType(t, spec.LimitExceededError{}, res.JSON) {
+			assert.Equal(t, spec.ErrorLimitExceeded, res.JSON.(spec.LimitExceededError).ErrCode)
+		}
+		return ok()
+	}
+	assert.Equal(t, http.StatusOK, request("remote.org").Code)
+
+	// Both request slots have now been used up within the cooloff period.
+	inner = ok
+	assert.Equal(t, http.StatusTooManyRequests, request("remote.org").Code)
+
+	// Other origins have their own budgets, and exempt servers have none.
+	assert.Equal(t, http.StatusOK, request("other.org").Code)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, request("exempt.org").Code)
+	}
+
+	// Each endpoint class has its own budget.
+	history := limits.wrap(rateLimitClassHistory, func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse {
+		return ok()
+	})
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/backfill/!room:remote.org", nil)
+	fedReq := fclient.NewFederationRequest(http.MethodGet, "remote.org", "localhost", "/backfill/!room:remote.org")
+	assert.Equal(t, http.StatusOK, history(req, &fedReq, nil).Code)
+	assert.Equal(t, http.StatusTooManyRequests, history(req, &fedReq, nil).Code)
+}
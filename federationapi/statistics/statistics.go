@@ -11,6 +11,8 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/element-hq/dendrite/federationapi/storage"
+	"github.com/element-hq/dendrite/federationapi/types"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
@@ -35,6 +37,15 @@ type Statistics struct {
 	// to send messages to the user's async relay servers if we know them.
 	FailuresUntilAssumedOffline uint32
 
+	// How long should we keep retrying a server that has been failing
+	// consistently before we blacklist it, regardless of how many failures
+	// that is. Zero means that only FailuresUntilBlacklist applies.
+	MaxRetryPeriod time.Duration
+
+	// The server-wide federation allow/deny lists. Servers which are not
+	// allowed are never sent to. A nil policy allows every server.
+	ServerPolicy *serverpolicy.Policy
+
 	enableRelays bool
 }
 
@@ -77,6 +88,7 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 		} else {
 			server.blacklisted.Store(blacklisted)
 		}
+		server.restoreBackoff()
 
 		// Don't bother hitting the database 2 additional times
 		// if we don't want to use relays.
@@ -103,6 +115,33 @@ func (s *Statistics) ForServer(serverName spec.ServerName) *ServerStatistics {
 	return server
 }
 
+// Lookup returns the statistics for the given server name if we hold
+// any, without creating them like ForServer does.
+func (s *Statistics) Lookup(serverName spec.ServerName) (*ServerStatistics, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	server, found := s.servers[serverName]
+	return server, found
+}
+
+// IsAllowed returns whether the server-wide federation policy allows us
+// to federate with the given server.
+func (s *Statistics) IsAllowed(serverName spec.ServerName) bool {
+	return s.ServerPolicy.IsAllowed(serverName)
+}
+
+// Servers returns the names of all servers that we currently hold
+// statistics for.
+func (s *Statistics) Servers() []spec.ServerName {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	servers := make([]spec.ServerName, 0, len(s.servers))
+	for serverName := range s.servers {
+		servers = append(servers, serverName)
+	}
+	return servers
+}
+
 type SendMethod uint8
 
 const (
@@ -123,6 +162,9 @@ type ServerStatistics struct {
 	backoffUntil      atomic.Value    // time.Time until this backoff interval ends
 	backoffCount      atomic.Uint32   // number of times BackoffDuration has been called
 	successCounter    atomic.Uint32   // how many times have we succeeded?
+	lastSuccess       atomic.Value    // time.Time of the last successful send
+	lastFailure       atomic.Value    // time.Time of the last failed send
+	failingSince      atomic.Value    // time.Time of the first of the consecutive failures
 	backoffNotifier   func()          // notifies destination queue when backoff completes
 	notifierMutex     sync.Mutex
 	knownRelayServers []spec.ServerName
@@ -164,8 +206,9 @@ func (s *ServerStatistics) AssignBackoffNotifier(notifier func()) {
 // `relay` specifies whether the success was to the actual destination
 // or one of their relay servers.
 func (s *ServerStatistics) Success(method SendMethod) {
+	s.lastSuccess.Store(time.Now())
 	s.cancel()
-	s.backoffCount.Store(0)
+	s.forgetBackoff()
 	// NOTE : Sending to the final destination vs. a relay server has
 	// slightly different semantics.
 	if method == SendDirect {
@@ -185,6 +228,8 @@ func (s *ServerStatistics) Success(method SendMethod) {
 // will result in backoff waiting until, and a bool signalling
 // whether we have blacklisted and therefore to give up.
 func (s *ServerStatistics) Failure() (time.Time, bool) {
+	s.lastFailure.Store(time.Now())
+
 	// Return immediately if we have blacklisted this node.
 	if s.blacklisted.Load() {
 		return time.Time{}, true
@@ -196,6 +241,11 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 	// unset the backoffStarted flag when done.
 	if s.backoffStarted.CompareAndSwap(false, true) {
 		backoffCount := s.backoffCount.Add(1)
+		failingSince, ok := s.failingSince.Load().(time.Time)
+		if !ok || failingSince.IsZero() {
+			failingSince = time.Now()
+			s.failingSince.Store(failingSince)
+		}
 
 		if backoffCount >= s.statistics.FailuresUntilAssumedOffline {
 			s.assumedOffline.CompareAndSwap(false, true)
@@ -206,7 +256,10 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 			}
 		}
 
-		if backoffCount >= s.statistics.FailuresUntilBlacklist {
+		// Park servers that have been failing for too long by blacklisting
+		// them, so that we stop retrying until they contact us again.
+		retryPeriodExceeded := s.statistics.MaxRetryPeriod > 0 && time.Since(failingSince) >= s.statistics.MaxRetryPeriod
+		if backoffCount >= s.statistics.FailuresUntilBlacklist || retryPeriodExceeded {
 			s.blacklisted.Store(true)
 			if s.statistics.DB != nil {
 				if err := s.statistics.DB.AddServerToBlacklist(s.serverName); err != nil {
@@ -226,11 +279,72 @@ func (s *ServerStatistics) Failure() (time.Time, bool) {
 		s.statistics.backoffMutex.Lock()
 		s.statistics.backoffTimers[s.serverName] = time.AfterFunc(time.Until(until), s.backoffFinished)
 		s.statistics.backoffMutex.Unlock()
+
+		s.persistBackoff(count, until, failingSince)
 	}
 
 	return s.backoffUntil.Load().(time.Time), false
 }
 
+// persistBackoff stores the current backoff state in the database, so that
+// it survives a restart.
+func (s *ServerStatistics) persistBackoff(count uint32, until, failingSince time.Time) {
+	if s.statistics.DB == nil {
+		return
+	}
+	if err := s.statistics.DB.SetServerBackoff(context.Background(), s.serverName, types.ServerBackoff{
+		FailureCount: count,
+		BackoffUntil: spec.AsTimestamp(until),
+		FailingSince: spec.AsTimestamp(failingSince),
+	}); err != nil {
+		logrus.WithError(err).Errorf("Failed to store backoff for %q", s.serverName)
+	}
+}
+
+// forgetBackoff resets the failure counter and removes any persisted
+// backoff state for this server.
+func (s *ServerStatistics) forgetBackoff() {
+	s.failingSince.Store(time.Time{})
+	// Only hit the database if there was something to remove, since
+	// this is called after every successful request.
+	if s.backoffCount.Swap(0) == 0 || s.statistics.DB == nil {
+		return
+	}
+	if err := s.statistics.DB.RemoveServerBackoff(context.Background(), s.serverName); err != nil {
+		logrus.WithError(err).Errorf("Failed to remove backoff for %q", s.serverName)
+	}
+}
+
+// restoreBackoff loads any backoff state that was persisted before the last
+// restart, so that we don't immediately retry servers that were failing.
+func (s *ServerStatistics) restoreBackoff() {
+	if s.statistics.DB == nil {
+		return
+	}
+	backoff, err := s.statistics.DB.GetServerBackoff(context.Background(), s.serverName)
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to get backoff for %q", s.serverName)
+		return
+	}
+	if backoff == nil {
+		return
+	}
+	s.backoffCount.Store(backoff.FailureCount)
+	if backoff.FailingSince != 0 {
+		s.failingSince.Store(backoff.FailingSince.Time())
+	}
+	if backoff.FailureCount >= s.statistics.FailuresUntilAssumedOffline {
+		s.assumedOffline.Store(true)
+	}
+	until := backoff.BackoffUntil.Time()
+	s.backoffUntil.Store(until)
+	if time.Now().Before(until) && s.backoffStarted.CompareAndSwap(false, true) {
+		s.statistics.backoffMutex.Lock()
+		s.statistics.backoffTimers[s.serverName] = time.AfterFunc(time.Until(until), s.backoffFinished)
+		s.statistics.backoffMutex.Unlock()
+	}
+}
+
 // MarkServerAlive removes the assumed offline and blacklisted statuses from this server.
 // Returns whether the server was blacklisted before this point.
 func (s *ServerStatistics) MarkServerAlive() bool {
@@ -275,6 +389,44 @@ func (s *ServerStatistics) BackoffInfo() *time.Time {
 	return nil
 }
 
+// ResetBackoff ends the current backoff interval, if any, and resets the
+// failure counter so that the next failure starts with the shortest interval.
+// It does not change whether the server is blacklisted.
+func (s *ServerStatistics) ResetBackoff() {
+	s.backoffUntil.Store(time.Time{})
+	s.forgetBackoff()
+	s.ClearBackoff()
+}
+
+// BackingOff returns true if a backoff interval is currently running.
+func (s *ServerStatistics) BackingOff() bool {
+	return s.backoffStarted.Load()
+}
+
+// BackoffCount returns the number of consecutive failures that have
+// been counted towards the backoff.
+func (s *ServerStatistics) BackoffCount() uint32 {
+	return s.backoffCount.Load()
+}
+
+// LastSuccess returns the time of the last successful send, or nil
+// if there hasn't been one since startup.
+func (s *ServerStatistics) LastSuccess() *time.Time {
+	if t, ok := s.lastSuccess.Load().(time.Time); ok {
+		return &t
+	}
+	return nil
+}
+
+// LastFailure returns the time of the last failed send, or nil
+// if there hasn't been one since startup.
+func (s *ServerStatistics) LastFailure() *time.Time {
+	if t, ok := s.lastFailure.Load().(time.Time); ok {
+		return &t
+	}
+	return nil
+}
+
 // Blacklisted returns true if the server is blacklisted and false
 // otherwise.
 func (s *ServerStatistics) Blacklisted() bool {
@@ -297,7 +449,7 @@ func (s *ServerStatistics) removeBlacklist() bool {
 		_ = s.statistics.DB.RemoveServerFromBlacklist(s.serverName)
 	}
 	s.cancel()
-	s.backoffCount.Store(0)
+	s.forgetBackoff()
 
 	return wasBlacklisted
 }
@@ -1,10 +1,12 @@
 package statistics
 
 import (
+	"context"
 	"math"
 	"testing"
 	"time"
 
+	"github.com/element-hq/dendrite/federationapi/types"
 	"github.com/element-hq/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/stretchr/testify/assert"
@@ -115,3 +117,74 @@ func TestRelayServersListing(t *testing.T) {
 	relayServers = server.KnownRelayServers()
 	assert.Equal(t, []spec.ServerName{"relay1", "relay2"}, relayServers)
 }
+
+func TestResetBackoff(t *testing.T) {
+	stats := NewStatistics(test.NewInMemoryFederationDatabase(), FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server := stats.ForServer("test.com")
+	assert.Nil(t, server.LastFailure())
+	assert.Nil(t, server.LastSuccess())
+
+	until, blacklisted := server.Failure()
+	assert.False(t, blacklisted)
+	assert.True(t, until.After(time.Now()))
+	assert.NotNil(t, server.LastFailure())
+	assert.Equal(t, uint32(1), server.BackoffCount())
+	assert.Equal(t, []spec.ServerName{"test.com"}, stats.Servers())
+
+	server.ResetBackoff()
+	assert.Equal(t, uint32(0), server.BackoffCount())
+	assert.True(t, server.BackoffInfo().IsZero())
+	assert.False(t, server.backoffStarted.Load())
+
+	server.Success(SendDirect)
+	assert.NotNil(t, server.LastSuccess())
+}
+
+func TestBackoffPersistedAcrossRestarts(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server := stats.ForServer("test.com")
+	for i := 0; i < FailuresUntilAssumedOffline; i++ {
+		server.ClearBackoff()
+		server.Failure()
+	}
+	until := server.BackoffInfo()
+	assert.NotNil(t, until)
+
+	// A fresh Statistics with the same database should pick up where
+	// the previous one left off.
+	restarted := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server = restarted.ForServer("test.com")
+	assert.Equal(t, uint32(FailuresUntilAssumedOffline), server.BackoffCount())
+	assert.True(t, server.BackingOff())
+	assert.True(t, server.AssumedOffline())
+	assert.WithinDuration(t, *until, *server.BackoffInfo(), time.Millisecond)
+
+	// Succeeding should clear the persisted state.
+	server.Success(SendDirect)
+	restarted = NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	server = restarted.ForServer("test.com")
+	assert.Equal(t, uint32(0), server.BackoffCount())
+	assert.False(t, server.BackingOff())
+}
+
+func TestMaxRetryPeriod(t *testing.T) {
+	db := test.NewInMemoryFederationDatabase()
+	err := db.SetServerBackoff(context.Background(), "test.com", types.ServerBackoff{
+		FailureCount: 1,
+		BackoffUntil: spec.AsTimestamp(time.Now().Add(-time.Minute)),
+		FailingSince: spec.AsTimestamp(time.Now().Add(-time.Hour * 2)),
+	})
+	assert.NoError(t, err)
+
+	stats := NewStatistics(db, FailuresUntilBlacklist, FailuresUntilAssumedOffline, false)
+	stats.MaxRetryPeriod = time.Hour
+	server := stats.ForServer("test.com")
+	assert.False(t, server.BackingOff())
+
+	// The server has been failing for longer than the retry period, so the
+	// next failure should park it even though there have been few failures.
+	_, blacklisted := server.Failure()
+	assert.True(t, blacklisted)
+	assert.True(t, server.Blacklisted())
+}
@@ -66,8 +66,11 @@ func (d *KeyDatabase) StoreKeys(
 	ctx context.Context,
 	keyMap map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
 ) error {
-	for req, res := range keyMap {
-		d.cache.StoreServerKey(req, res)
+	// The database doesn't always take the new result as-is, e.g. it keeps
+	// the earliest expiry for a key, so drop the cached keys rather than
+	// caching the new results. They will be cached again on the next fetch.
+	for req := range keyMap {
+		d.cache.InvalidateServerKey(req)
 	}
 	return d.inner.StoreKeys(ctx, keyMap)
 }
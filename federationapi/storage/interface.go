@@ -43,6 +43,12 @@ type Database interface {
 	GetPendingPDUServerNames(ctx context.Context) ([]spec.ServerName, error)
 	GetPendingEDUServerNames(ctx context.Context) ([]spec.ServerName, error)
 
+	// GetPendingCounts returns the number of PDUs and EDUs queued for the given destination.
+	GetPendingCounts(ctx context.Context, serverName spec.ServerName) (pdus, edus int64, err error)
+	// PurgePendingForServer drops all queued PDUs and EDUs for the given destination,
+	// returning how many of each were removed.
+	PurgePendingForServer(ctx context.Context, serverName spec.ServerName) (pdus, edus int64, err error)
+
 	// these don't have contexts passed in as we want things to happen regardless of the request context
 	AddServerToBlacklist(serverName spec.ServerName) error
 	RemoveServerFromBlacklist(serverName spec.ServerName) error
@@ -61,6 +67,14 @@ type Database interface {
 	// If it is present, returns true. If not, returns false.
 	IsServerAssumedOffline(ctx context.Context, serverName spec.ServerName) (bool, error)
 
+	// Stores the backoff state for the server, replacing any previous state.
+	SetServerBackoff(ctx context.Context, serverName spec.ServerName, backoff types.ServerBackoff) error
+	// Removes the backoff state for the server.
+	// If the server doesn't exist in the table, nothing happens and returns success.
+	RemoveServerBackoff(ctx context.Context, serverName spec.ServerName) error
+	// Gets the backoff state for the server, or nil if there is none.
+	GetServerBackoff(ctx context.Context, serverName spec.ServerName) (*types.ServerBackoff, error)
+
 	AddOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string, renewalInterval int64) error
 	RenewOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string, renewalInterval int64) error
 	GetOutboundPeek(ctx context.Context, serverName spec.ServerName, roomID, peekID string) (*types.OutboundPeek, error)
@@ -76,6 +90,12 @@ type Database interface {
 	// Query the notary for the server keys for the given server. If `optKeyIDs` is not empty, multiple server keys may be returned (between 1 - len(optKeyIDs))
 	// such that the combination of all server keys will include all the `optKeyIDs`.
 	GetNotaryKeys(ctx context.Context, serverName spec.ServerName, optKeyIDs []gomatrixserverlib.KeyID) ([]gomatrixserverlib.ServerKeys, error)
+	// GetServerKeys returns the server keys that we have stored for the given server, or for all servers if the server name is empty.
+	GetServerKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	// DeleteServerKeys deletes the given stored key for the server, or all of its keys if the key ID is empty.
+	DeleteServerKeys(ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID) (int64, error)
+	// ExpireServerKey marks the stored key as having expired at the given time.
+	ExpireServerKey(ctx context.Context, request gomatrixserverlib.PublicKeyLookupRequest, expiredTS spec.Timestamp) error
 	// DeleteExpiredEDUs cleans up expired EDUs
 	DeleteExpiredEDUs(ctx context.Context) error
 
@@ -52,11 +52,31 @@ const upsertServerSigningKeysSQL = "" +
 	" server_name_and_key_id, valid_until_ts, expired_ts, server_key)" +
 	" VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT ON CONSTRAINT keydb_server_keys_unique" +
-	" DO UPDATE SET valid_until_ts = $4, expired_ts = $5, server_key = $6"
+	" DO UPDATE SET valid_until_ts = $4, server_key = $6," +
+	// Never un-expire a key, and keep the earliest expiry that we know of, so
+	// that a key which was expired early isn't revived by a later fetch.
+	" expired_ts = CASE WHEN keydb_server_keys.expired_ts <> 0 AND ($5 = 0 OR keydb_server_keys.expired_ts < $5)" +
+	" THEN keydb_server_keys.expired_ts ELSE $5 END"
+
+const selectServerSigningKeysSQL = "" +
+	"SELECT server_name, server_key_id, valid_until_ts, expired_ts," +
+	"   server_key FROM keydb_server_keys" +
+	" WHERE $1 = '' OR server_name = $1" +
+	" ORDER BY server_name, server_key_id"
+
+const deleteServerSigningKeysSQL = "" +
+	"DELETE FROM keydb_server_keys WHERE server_name = $1 AND ($2 = '' OR server_key_id = $2)"
+
+const expireServerSigningKeySQL = "" +
+	"UPDATE keydb_server_keys SET valid_until_ts = 0, expired_ts = $3" +
+	" WHERE server_name = $1 AND server_key_id = $2 AND (expired_ts = 0 OR expired_ts > $3)"
 
 type serverSigningKeyStatements struct {
 	bulkSelectServerKeysStmt *sql.Stmt
 	upsertServerKeysStmt     *sql.Stmt
+	selectServerKeysStmt     *sql.Stmt
+	deleteServerKeysStmt     *sql.Stmt
+	expireServerKeyStmt      *sql.Stmt
 }
 
 func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatements, err error) {
@@ -68,6 +88,9 @@ func NewPostgresServerSigningKeysTable(db *sql.DB) (s *serverSigningKeyStatement
 	return s, sqlutil.StatementList{
 		{&s.bulkSelectServerKeysStmt, bulkSelectServerSigningKeysSQL},
 		{&s.upsertServerKeysStmt, upsertServerSigningKeysSQL},
+		{&s.selectServerKeysStmt, selectServerSigningKeysSQL},
+		{&s.deleteServerKeysStmt, deleteServerSigningKeysSQL},
+		{&s.expireServerKeyStmt, expireServerSigningKeySQL},
 	}.Prepare(db)
 }
 
@@ -132,6 +155,53 @@ func (s *serverSigningKeyStatements) UpsertServerKeys(
 	return err
 }
 
+func (s *serverSigningKeyStatements) SelectServerKeys(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectServerKeysStmt).QueryContext(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectServerKeys: rows.close() failed")
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	var r gomatrixserverlib.PublicKeyLookupRequest
+	var key string
+	var validUntilTS, expiredTS int64
+	for rows.Next() {
+		if err = rows.Scan(&r.ServerName, &r.KeyID, &validUntilTS, &expiredTS, &key); err != nil {
+			return nil, err
+		}
+		var vk gomatrixserverlib.VerifyKey
+		if err = vk.Key.Decode(key); err != nil {
+			return nil, err
+		}
+		results[r] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    vk,
+			ValidUntilTS: spec.Timestamp(validUntilTS),
+			ExpiredTS:    spec.Timestamp(expiredTS),
+		}
+	}
+	return results, rows.Err()
+}
+
+func (s *serverSigningKeyStatements) DeleteServerKeys(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName, keyID gomatrixserverlib.KeyID,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteServerKeysStmt).ExecContext(ctx, serverName, keyID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *serverSigningKeyStatements) ExpireServerKey(
+	ctx context.Context, txn *sql.Tx,
+	request gomatrixserverlib.PublicKeyLookupRequest, expiredTS spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.expireServerKeyStmt).ExecContext(ctx, request.ServerName, request.KeyID, expiredTS)
+	return err
+}
+
 func nameAndKeyID(request gomatrixserverlib.PublicKeyLookupRequest) string {
 	return string(request.ServerName) + "\x1F" + string(request.KeyID)
 }
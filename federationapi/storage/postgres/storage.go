@@ -58,6 +58,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	backoff, err := NewPostgresBackoffTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	relayServers, err := NewPostgresRelayServersTable(d.db)
 	if err != nil {
 		return nil, err
@@ -105,6 +109,7 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		FederationQueueJSON:      queueJSON,
 		FederationBlacklist:      blacklist,
 		FederationAssumedOffline: assumedOffline,
+		FederationBackoff:        backoff,
 		FederationRelayServers:   relayServers,
 		FederationInboundPeeks:   inboundPeeks,
 		FederationOutboundPeeks:  outboundPeeks,
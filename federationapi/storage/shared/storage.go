@@ -32,6 +32,7 @@ type Database struct {
 	FederationJoinedHosts    tables.FederationJoinedHosts
 	FederationBlacklist      tables.FederationBlacklist
 	FederationAssumedOffline tables.FederationAssumedOffline
+	FederationBackoff        tables.FederationBackoff
 	FederationRelayServers   tables.FederationRelayServers
 	FederationOutboundPeeks  tables.FederationOutboundPeeks
 	FederationInboundPeeks   tables.FederationInboundPeeks
@@ -201,6 +202,32 @@ func (d *Database) IsServerAssumedOffline(
 	return d.FederationAssumedOffline.SelectAssumedOffline(ctx, nil, serverName)
 }
 
+func (d *Database) SetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+	backoff types.ServerBackoff,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationBackoff.UpsertBackoff(ctx, txn, serverName, backoff)
+	})
+}
+
+func (d *Database) RemoveServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.FederationBackoff.DeleteBackoff(ctx, txn, serverName)
+	})
+}
+
+func (d *Database) GetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	return d.FederationBackoff.SelectBackoff(ctx, nil, serverName)
+}
+
 func (d *Database) P2PAddRelayServersForServer(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -381,3 +408,83 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 		return nil
 	})
 }
+
+// GetPendingCounts returns the number of PDUs and EDUs that are
+// waiting to be sent to the given destination.
+func (d *Database) GetPendingCounts(
+	ctx context.Context, serverName spec.ServerName,
+) (pdus, edus int64, err error) {
+	if pdus, err = d.FederationQueuePDUs.SelectQueuePDUCount(ctx, nil, serverName); err != nil {
+		return 0, 0, fmt.Errorf("SelectQueuePDUCount: %w", err)
+	}
+	if edus, err = d.FederationQueueEDUs.SelectQueueEDUCount(ctx, nil, serverName); err != nil {
+		return 0, 0, fmt.Errorf("SelectQueueEDUCount: %w", err)
+	}
+	return pdus, edus, nil
+}
+
+// PurgePendingForServer removes everything that is queued for the given
+// destination. JSON blobs are only deleted once no other destination
+// references them.
+func (d *Database) PurgePendingForServer(
+	ctx context.Context, serverName spec.ServerName,
+) (pdus, edus int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pdus, err = d.FederationQueuePDUs.SelectQueuePDUCount(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("SelectQueuePDUCount: %w", err)
+		}
+		pduNIDs, err := d.FederationQueuePDUs.SelectQueuePDUs(ctx, txn, serverName, int(pdus))
+		if err != nil {
+			return fmt.Errorf("SelectQueuePDUs: %w", err)
+		}
+		edus, err = d.FederationQueueEDUs.SelectQueueEDUCount(ctx, txn, serverName)
+		if err != nil {
+			return fmt.Errorf("SelectQueueEDUCount: %w", err)
+		}
+		eduNIDs, err := d.FederationQueueEDUs.SelectQueueEDUs(ctx, txn, serverName, int(edus))
+		if err != nil {
+			return fmt.Errorf("SelectQueueEDUs: %w", err)
+		}
+
+		var deleteNIDs []int64
+		if len(pduNIDs) > 0 {
+			if err = d.FederationQueuePDUs.DeleteQueuePDUs(ctx, txn, serverName, pduNIDs); err != nil {
+				return fmt.Errorf("DeleteQueuePDUs: %w", err)
+			}
+			for _, nid := range pduNIDs {
+				count, err := d.FederationQueuePDUs.SelectQueuePDUReferenceJSONCount(ctx, txn, nid)
+				if err != nil {
+					return fmt.Errorf("SelectQueuePDUReferenceJSONCount: %w", err)
+				}
+				if count == 0 {
+					deleteNIDs = append(deleteNIDs, nid)
+					d.Cache.EvictFederationQueuedPDU(nid)
+				}
+			}
+		}
+		if len(eduNIDs) > 0 {
+			if err = d.FederationQueueEDUs.DeleteQueueEDUs(ctx, txn, serverName, eduNIDs); err != nil {
+				return fmt.Errorf("DeleteQueueEDUs: %w", err)
+			}
+			for _, nid := range eduNIDs {
+				count, err := d.FederationQueueEDUs.SelectQueueEDUReferenceJSONCount(ctx, txn, nid)
+				if err != nil {
+					return fmt.Errorf("SelectQueueEDUReferenceJSONCount: %w", err)
+				}
+				if count == 0 {
+					deleteNIDs = append(deleteNIDs, nid)
+					d.Cache.EvictFederationQueuedEDU(nid)
+				}
+			}
+		}
+
+		if len(deleteNIDs) > 0 {
+			if err = d.FederationQueueJSON.DeleteQueueJSON(ctx, txn, deleteNIDs); err != nil {
+				return fmt.Errorf("DeleteQueueJSON: %w", err)
+			}
+		}
+		return nil
+	})
+	return pdus, edus, err
+}
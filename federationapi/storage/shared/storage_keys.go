@@ -50,3 +50,33 @@ func (d *Database) StoreKeys(
 		return lastErr
 	})
 }
+
+// GetServerKeys returns the keys stored for the given server, or for all
+// servers if the server name is empty.
+func (d *Database) GetServerKeys(
+	ctx context.Context, serverName spec.ServerName,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return d.ServerSigningKeys.SelectServerKeys(ctx, nil, serverName)
+}
+
+// DeleteServerKeys deletes the given key for the server, or all of its keys
+// if the key ID is empty. Returns the number of keys that were deleted.
+func (d *Database) DeleteServerKeys(
+	ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID,
+) (deleted int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		deleted, err = d.ServerSigningKeys.DeleteServerKeys(ctx, txn, serverName, keyID)
+		return err
+	})
+	return
+}
+
+// ExpireServerKey marks the key as having expired at the given time, so
+// that it is only accepted for events sent before then.
+func (d *Database) ExpireServerKey(
+	ctx context.Context, request gomatrixserverlib.PublicKeyLookupRequest, expiredTS spec.Timestamp,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ServerSigningKeys.ExpireServerKey(ctx, txn, request, expiredTS)
+	})
+}
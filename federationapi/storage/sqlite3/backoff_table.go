@@ -0,0 +1,93 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/element-hq/dendrite/federationapi/types"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const backoffSchema = `
+CREATE TABLE IF NOT EXISTS federationsender_backoff(
+	-- The name of the remote server
+	server_name TEXT PRIMARY KEY NOT NULL,
+	-- The number of consecutive failures sending to the server
+	failure_count INTEGER NOT NULL,
+	-- When the current backoff interval ends, in milliseconds
+	backoff_until INTEGER NOT NULL,
+	-- When the first of the consecutive failures happened, in milliseconds
+	failing_since INTEGER NOT NULL
+);
+`
+
+const upsertBackoffSQL = "" +
+	"INSERT INTO federationsender_backoff (server_name, failure_count, backoff_until, failing_since)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name) DO UPDATE SET failure_count = $2, backoff_until = $3, failing_since = $4"
+
+const selectBackoffSQL = "" +
+	"SELECT failure_count, backoff_until, failing_since FROM federationsender_backoff WHERE server_name = $1"
+
+const deleteBackoffSQL = "" +
+	"DELETE FROM federationsender_backoff WHERE server_name = $1"
+
+type backoffStatements struct {
+	db                *sql.DB
+	upsertBackoffStmt *sql.Stmt
+	selectBackoffStmt *sql.Stmt
+	deleteBackoffStmt *sql.Stmt
+}
+
+func NewSQLiteBackoffTable(db *sql.DB) (s *backoffStatements, err error) {
+	s = &backoffStatements{
+		db: db,
+	}
+	_, err = db.Exec(backoffSchema)
+	if err != nil {
+		return
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertBackoffStmt, upsertBackoffSQL},
+		{&s.selectBackoffStmt, selectBackoffSQL},
+		{&s.deleteBackoffStmt, deleteBackoffSQL},
+	}.Prepare(db)
+}
+
+func (s *backoffStatements) UpsertBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName, backoff types.ServerBackoff,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertBackoffStmt)
+	_, err := stmt.ExecContext(ctx, serverName, backoff.FailureCount, backoff.BackoffUntil, backoff.FailingSince)
+	return err
+}
+
+func (s *backoffStatements) SelectBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	var backoff types.ServerBackoff
+	stmt := sqlutil.TxStmt(txn, s.selectBackoffStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&backoff.FailureCount, &backoff.BackoffUntil, &backoff.FailingSince)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &backoff, nil
+}
+
+func (s *backoffStatements) DeleteBackoff(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBackoffStmt)
+	_, err := stmt.ExecContext(ctx, serverName)
+	return err
+}
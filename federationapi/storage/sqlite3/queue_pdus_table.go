@@ -62,6 +62,10 @@ const selectQueuePDUsReferenceJSONCountSQL = "" +
 const selectQueuePDUsServerNamesSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_queue_pdus"
 
+const selectQueuePDUCountSQL = "" +
+	"SELECT COUNT(*) FROM federationsender_queue_pdus" +
+	" WHERE server_name = $1"
+
 type queuePDUsStatements struct {
 	db                                *sql.DB
 	insertQueuePDUStmt                *sql.Stmt
@@ -69,6 +73,7 @@ type queuePDUsStatements struct {
 	selectQueuePDUsStmt               *sql.Stmt
 	selectQueueReferenceJSONCountStmt *sql.Stmt
 	selectQueueServerNamesStmt        *sql.Stmt
+	selectQueuePDUCountStmt           *sql.Stmt
 	// deleteQueuePDUsStmt *sql.Stmt - prepared at runtime due to variadic
 }
 
@@ -86,6 +91,7 @@ func NewSQLiteQueuePDUsTable(db *sql.DB) (s *queuePDUsStatements, err error) {
 		{&s.selectQueuePDUsStmt, selectQueuePDUsSQL},
 		{&s.selectQueueReferenceJSONCountStmt, selectQueuePDUsReferenceJSONCountSQL},
 		{&s.selectQueueServerNamesStmt, selectQueuePDUsServerNamesSQL},
+		{&s.selectQueuePDUCountStmt, selectQueuePDUCountSQL},
 	}.Prepare(db)
 }
 
@@ -195,3 +201,12 @@ func (s *queuePDUsStatements) SelectQueuePDUServerNames(
 
 	return result, rows.Err()
 }
+
+func (s *queuePDUsStatements) SelectQueuePDUCount(
+	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
+) (int64, error) {
+	var count int64
+	stmt := sqlutil.TxStmt(txn, s.selectQueuePDUCountStmt)
+	err := stmt.QueryRowContext(ctx, serverName).Scan(&count)
+	return count, err
+}
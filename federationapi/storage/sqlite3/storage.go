@@ -56,6 +56,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, err
 	}
+	backoff, err := NewSQLiteBackoffTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	relayServers, err := NewSQLiteRelayServersTable(d.db)
 	if err != nil {
 		return nil, err
@@ -103,6 +107,7 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		FederationQueueJSON:      queueJSON,
 		FederationBlacklist:      blacklist,
 		FederationAssumedOffline: assumedOffline,
+		FederationBackoff:        backoff,
 		FederationRelayServers:   relayServers,
 		FederationOutboundPeeks:  outboundPeeks,
 		FederationInboundPeeks:   inboundPeeks,
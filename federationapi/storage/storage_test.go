@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/element-hq/dendrite/federationapi/storage"
+	"github.com/element-hq/dendrite/federationapi/types"
 	"github.com/element-hq/dendrite/internal/caching"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/setup/config"
@@ -305,6 +306,105 @@ func TestServersAssumedOffline(t *testing.T) {
 	})
 }
 
+func TestServerBackoff(t *testing.T) {
+	server1 := spec.ServerName("server1")
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateFederationDatabase(t, dbType)
+		defer closeDB()
+
+		// There's nothing stored to begin with.
+		backoff, err := db.GetServerBackoff(context.Background(), server1)
+		assert.Nil(t, err)
+		assert.Nil(t, backoff)
+
+		want := types.ServerBackoff{FailureCount: 3, BackoffUntil: 2000, FailingSince: 1000}
+		err = db.SetServerBackoff(context.Background(), server1, want)
+		assert.Nil(t, err)
+		backoff, err = db.GetServerBackoff(context.Background(), server1)
+		assert.Nil(t, err)
+		assert.Equal(t, &want, backoff)
+
+		// Storing again replaces the previous state.
+		want.FailureCount, want.BackoffUntil = 4, 3000
+		err = db.SetServerBackoff(context.Background(), server1, want)
+		assert.Nil(t, err)
+		backoff, err = db.GetServerBackoff(context.Background(), server1)
+		assert.Nil(t, err)
+		assert.Equal(t, &want, backoff)
+
+		err = db.RemoveServerBackoff(context.Background(), server1)
+		assert.Nil(t, err)
+		backoff, err = db.GetServerBackoff(context.Background(), server1)
+		assert.Nil(t, err)
+		assert.Nil(t, backoff)
+	})
+}
+
+func TestServerSigningKeys(t *testing.T) {
+	key1 := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "server1", KeyID: "ed25519:1"}
+	key2 := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "server1", KeyID: "ed25519:2"}
+	key3 := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "server2", KeyID: "ed25519:1"}
+	valid := func(b byte) gomatrixserverlib.PublicKeyLookupResult {
+		return gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes{b, b, b}},
+			ValidUntilTS: 5000,
+		}
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		ctx := context.Background()
+		db, closeDB := mustCreateFederationDatabase(t, dbType)
+		defer closeDB()
+
+		err := db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			key1: valid(1), key2: valid(2), key3: valid(3),
+		})
+		assert.Nil(t, err)
+
+		keys, err := db.GetServerKeys(ctx, "")
+		assert.Nil(t, err)
+		assert.Len(t, keys, 3)
+		keys, err = db.GetServerKeys(ctx, "server1")
+		assert.Nil(t, err)
+		assert.Equal(t, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			key1: valid(1), key2: valid(2),
+		}, keys)
+
+		// Expiring a key early sticks, even if the key is stored again as
+		// valid or with a later expiry.
+		err = db.ExpireServerKey(ctx, key1, 3000)
+		assert.Nil(t, err)
+		later := valid(1)
+		later.ExpiredTS = 4000
+		for _, res := range []gomatrixserverlib.PublicKeyLookupResult{valid(1), later} {
+			err = db.StoreKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{key1: res})
+			assert.Nil(t, err)
+			keys, err = db.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{key1: 0})
+			assert.Nil(t, err)
+			assert.Equal(t, spec.Timestamp(3000), keys[key1].ExpiredTS)
+		}
+		// An earlier expiry still replaces a later one.
+		err = db.ExpireServerKey(ctx, key1, 2000)
+		assert.Nil(t, err)
+		keys, err = db.FetchKeys(ctx, map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp{key1: 0})
+		assert.Nil(t, err)
+		assert.Equal(t, spec.Timestamp(2000), keys[key1].ExpiredTS)
+
+		deleted, err := db.DeleteServerKeys(ctx, "server1", key2.KeyID)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), deleted)
+		deleted, err = db.DeleteServerKeys(ctx, "server1", "")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), deleted)
+		keys, err = db.GetServerKeys(ctx, "")
+		assert.Nil(t, err)
+		assert.Equal(t, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			key3: valid(3),
+		}, keys)
+	})
+}
+
 func TestRelayServersStored(t *testing.T) {
 	server := spec.ServerName("server")
 	relayServer1 := spec.ServerName("relayserver1")
@@ -344,3 +444,41 @@ func TestRelayServersStored(t *testing.T) {
 		assert.Zero(t, len(relayServers))
 	})
 }
+
+func TestPurgePendingForServer(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateFederationDatabase(t, dbType)
+		defer close()
+
+		both := map[spec.ServerName]struct{}{"remote1": {}, "remote2": {}}
+		for i := 0; i < 3; i++ {
+			receipt, err := db.StoreJSON(ctx, "{}")
+			assert.NoError(t, err)
+			assert.NoError(t, db.AssociateEDUWithDestinations(ctx, both, receipt, spec.MReceipt, nil))
+		}
+		receipt, err := db.StoreJSON(ctx, "{}")
+		assert.NoError(t, err)
+		assert.NoError(t, db.AssociatePDUWithDestinations(ctx, map[spec.ServerName]struct{}{"remote1": {}}, receipt))
+
+		pdus, edus, err := db.GetPendingCounts(ctx, "remote1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), pdus)
+		assert.Equal(t, int64(3), edus)
+
+		pdus, edus, err = db.PurgePendingForServer(ctx, "remote1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), pdus)
+		assert.Equal(t, int64(3), edus)
+
+		pdus, edus, err = db.GetPendingCounts(ctx, "remote1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), pdus)
+		assert.Equal(t, int64(0), edus)
+
+		// EDUs shared with another destination must still be there
+		data, err := db.GetPendingEDUs(ctx, "remote2", 100)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(data))
+	})
+}
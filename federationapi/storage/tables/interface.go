@@ -23,6 +23,7 @@ type FederationQueuePDUs interface {
 	SelectQueuePDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueuePDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueuePDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	SelectQueuePDUCount(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (int64, error)
 }
 
 type FederationQueueEDUs interface {
@@ -31,6 +32,7 @@ type FederationQueueEDUs interface {
 	SelectQueueEDUs(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, limit int) ([]int64, error)
 	SelectQueueEDUReferenceJSONCount(ctx context.Context, txn *sql.Tx, jsonNID int64) (int64, error)
 	SelectQueueEDUServerNames(ctx context.Context, txn *sql.Tx) ([]spec.ServerName, error)
+	SelectQueueEDUCount(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (int64, error)
 	SelectExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) ([]int64, error)
 	DeleteExpiredEDUs(ctx context.Context, txn *sql.Tx, expiredBefore spec.Timestamp) error
 	Prepare() error
@@ -79,6 +81,13 @@ type FederationAssumedOffline interface {
 	DeleteAllAssumedOffline(ctx context.Context, txn *sql.Tx) error
 }
 
+type FederationBackoff interface {
+	UpsertBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, backoff types.ServerBackoff) error
+	// SelectBackoff returns the backoff state for the server, or nil if there is none.
+	SelectBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (*types.ServerBackoff, error)
+	DeleteBackoff(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) error
+}
+
 type FederationRelayServers interface {
 	InsertRelayServers(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, relayServers []spec.ServerName) error
 	SelectRelayServers(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) ([]spec.ServerName, error)
@@ -129,4 +138,10 @@ type FederationNotaryServerKeysMetadata interface {
 type FederationServerSigningKeys interface {
 	BulkSelectServerKeys(ctx context.Context, txn *sql.Tx, requests map[gomatrixserverlib.PublicKeyLookupRequest]spec.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
 	UpsertServerKeys(ctx context.Context, txn *sql.Tx, request gomatrixserverlib.PublicKeyLookupRequest, key gomatrixserverlib.PublicKeyLookupResult) error
+	// SelectServerKeys returns all keys for the given server, or for all servers if the server name is empty.
+	SelectServerKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error)
+	// DeleteServerKeys deletes the given key for the server, or all of its keys if the key ID is empty.
+	DeleteServerKeys(ctx context.Context, txn *sql.Tx, serverName spec.ServerName, keyID gomatrixserverlib.KeyID) (int64, error)
+	// ExpireServerKey marks the key as expired at the given time, unless it had already expired before then.
+	ExpireServerKey(ctx context.Context, txn *sql.Tx, request gomatrixserverlib.PublicKeyLookupRequest, expiredTS spec.Timestamp) error
 }
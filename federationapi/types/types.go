@@ -44,6 +44,16 @@ type InboundPeek struct {
 	RenewalInterval   int64
 }
 
+// ServerBackoff is the persisted backoff state for a remote server.
+type ServerBackoff struct {
+	// The number of consecutive failures.
+	FailureCount uint32
+	// When the current backoff interval ends.
+	BackoffUntil spec.Timestamp
+	// When the first of the consecutive failures happened.
+	FailingSince spec.Timestamp
+}
+
 type FederationReceiptMRead struct {
 	User map[string]FederationReceiptData `json:"m.read"`
 }
@@ -20,6 +20,10 @@ type ServerKeyCache interface {
 	// request -> result is emulating gomatrixserverlib.StoreKeys:
 	// https://github.com/matrix-org/gomatrixserverlib/blob/f69539c86ea55d1e2cc76fd8e944e2d82d30397c/keyring.go#L112
 	StoreServerKey(request gomatrixserverlib.PublicKeyLookupRequest, response gomatrixserverlib.PublicKeyLookupResult)
+
+	// InvalidateServerKey removes the key from the cache, so that the next
+	// lookup goes to the database.
+	InvalidateServerKey(request gomatrixserverlib.PublicKeyLookupRequest)
 }
 
 func (c Caches) GetServerKey(
@@ -44,3 +48,10 @@ func (c Caches) StoreServerKey(
 	key := fmt.Sprintf("%s/%s", request.ServerName, request.KeyID)
 	c.ServerKeys.Set(key, response)
 }
+
+func (c Caches) InvalidateServerKey(
+	request gomatrixserverlib.PublicKeyLookupRequest,
+) {
+	key := fmt.Sprintf("%s/%s", request.ServerName, request.KeyID)
+	c.ServerKeys.Unset(key)
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package caching
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/element-hq/dendrite/syncapi/synctypes"
+)
+
+var syncFilterCacheLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching",
+		Name:      "sync_filter_lookups_total",
+		Help:      "Number of sync filter cache lookups, by whether the filter was cached",
+	},
+	[]string{"result"},
+)
+
+// registerSyncFilterCacheMetrics registers the metrics once, as caches may be
+// created more than once per process.
+var registerSyncFilterCacheMetrics sync.Once
+
+// SyncFilterCache caches stored sync filters, so they don't need to be loaded
+// from the database and parsed on every /sync request.
+type SyncFilterCache interface {
+	GetSyncFilter(localpart, filterID string) (filter synctypes.Filter, ok bool)
+	StoreSyncFilter(localpart, filterID string, filter synctypes.Filter)
+}
+
+// SyncAPICaches contains the caches used by the sync API.
+type SyncAPICaches interface {
+	LazyLoadCache
+	SyncFilterCache
+}
+
+func syncFilterCacheKey(localpart, filterID string) string {
+	return localpart + " " + filterID
+}
+
+// GetSyncFilter returns the cached filter. The filter is shared with other
+// requests, so anything referenced by it must not be modified.
+func (c Caches) GetSyncFilter(localpart, filterID string) (synctypes.Filter, bool) {
+	filter, ok := c.SyncFilters.Get(syncFilterCacheKey(localpart, filterID))
+	if ok {
+		syncFilterCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		syncFilterCacheLookups.WithLabelValues("miss").Inc()
+	}
+	return filter, ok
+}
+
+func (c Caches) StoreSyncFilter(localpart, filterID string, filter synctypes.Filter) {
+	c.SyncFilters.Set(syncFilterCacheKey(localpart, filterID), filter)
+}
@@ -8,6 +8,7 @@ package caching
 
 import (
 	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
 )
@@ -29,6 +30,7 @@ type Caches struct {
 	FederationEDUs          Cache[int64, *gomatrixserverlib.EDU]                   // queue NID -> EDU
 	RoomHierarchies         Cache[string, fclient.RoomHierarchyResponse]           // room ID -> space response
 	LazyLoading             Cache[lazyLoadingCacheKey, string]                     // composite key -> event ID
+	SyncFilters             Cache[string, synctypes.Filter]                        // localpart and filter ID -> filter
 }
 
 // Cache is the interface that an implementation must satisfy.
@@ -21,6 +21,7 @@ import (
 
 	"github.com/element-hq/dendrite/roomserver/types"
 	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/syncapi/synctypes"
 )
 
 const (
@@ -37,6 +38,7 @@ const (
 	eventTypeCache
 	eventTypeNIDCache
 	eventStateKeyNIDCache
+	syncFiltersCache
 )
 
 const (
@@ -72,6 +74,9 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 		}, func() float64 {
 			return float64(cache.Metrics.CostAdded() - cache.Metrics.CostEvicted())
 		})
+		registerSyncFilterCacheMetrics.Do(func() {
+			prometheus.MustRegister(syncFilterCacheLookups)
+		})
 	}
 	return &Caches{
 		RoomVersions: &RistrettoCachePartition[string, gomatrixserverlib.RoomVersion]{ // room ID -> room version
@@ -151,6 +156,12 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 			Mutable: true,
 			MaxAge:  maxAge,
 		},
+		SyncFilters: &RistrettoCachePartition[string, synctypes.Filter]{ // localpart and filter ID -> filter
+			cache:   cache,
+			Prefix:  syncFiltersCache,
+			Mutable: true,
+			MaxAge:  maxAge,
+		},
 	}
 }
 
@@ -0,0 +1,356 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package fedcapture records federation requests and responses to and from
+// selected servers, so that federation problems can be debugged without
+// turning up log levels.
+package fedcapture
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const (
+	Inbound  = "inbound"
+	Outbound = "outbound"
+)
+
+// Exchange is a single captured request and its response.
+type Exchange struct {
+	ID                int64           `json:"id"`
+	Direction         string          `json:"direction"`
+	Timestamp         spec.Timestamp  `json:"ts"`
+	DurationMS        int64           `json:"duration_ms"`
+	Origin            spec.ServerName `json:"origin"`
+	Destination       spec.ServerName `json:"destination"`
+	Method            string          `json:"method"`
+	RequestURI        string          `json:"request_uri"`
+	RequestHeaders    http.Header     `json:"request_headers"`
+	RequestBody       string          `json:"request_body,omitempty"`
+	RequestTruncated  bool            `json:"request_truncated,omitempty"`
+	StatusCode        int             `json:"status_code,omitempty"`
+	ResponseHeaders   http.Header     `json:"response_headers,omitempty"`
+	ResponseBody      string          `json:"response_body,omitempty"`
+	ResponseTruncated bool            `json:"response_truncated,omitempty"`
+	Error             string          `json:"error,omitempty"`
+}
+
+// Replay is the exported form of an exchange, which can be sent again
+// with `furl -replay`.
+type Replay struct {
+	Method      string          `json:"method"`
+	Origin      spec.ServerName `json:"origin"`
+	Destination spec.ServerName `json:"destination"`
+	RequestURI  string          `json:"request_uri"`
+	Body        string          `json:"body,omitempty"`
+}
+
+// Replay returns the exchange in a form that can be resent.
+func (e *Exchange) Replay() Replay {
+	return Replay{
+		Method:      e.Method,
+		Origin:      e.Origin,
+		Destination: e.Destination,
+		RequestURI:  e.RequestURI,
+		Body:        e.RequestBody,
+	}
+}
+
+// Recorder holds the most recently captured exchanges in a ring buffer.
+// Only exchanges with the selected servers are captured. It is safe for
+// concurrent use. A nil Recorder captures nothing.
+type Recorder struct {
+	mutex        sync.RWMutex
+	servers      map[spec.ServerName]struct{}
+	exchanges    []Exchange
+	next         int // index in exchanges to write to next
+	lastID       int64
+	maxBodyBytes int
+}
+
+// NewRecorder creates a recorder which holds up to bufferSize exchanges,
+// capturing at most maxBodyBytes of each request and response body.
+func NewRecorder(bufferSize, maxBodyBytes int, servers []string) *Recorder {
+	r := &Recorder{
+		exchanges:    make([]Exchange, 0, bufferSize),
+		maxBodyBytes: maxBodyBytes,
+	}
+	r.SetServers(servers)
+	return r
+}
+
+// SetServers replaces the list of servers that are captured.
+func (r *Recorder) SetServers(servers []string) {
+	selected := make(map[spec.ServerName]struct{}, len(servers))
+	for _, server := range servers {
+		selected[spec.ServerName(server)] = struct{}{}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.servers = selected
+}
+
+// Servers returns the servers that are captured.
+func (r *Recorder) Servers() []spec.ServerName {
+	if r == nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	servers := make([]spec.ServerName, 0, len(r.servers))
+	for server := range r.servers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// Capturing returns true if exchanges with the given server are captured.
+func (r *Recorder) Capturing(serverName spec.ServerName) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	_, ok := r.servers[serverName]
+	return ok
+}
+
+// Record adds an exchange to the buffer, evicting the oldest one if the
+// buffer is full.
+func (r *Recorder) Record(e Exchange) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if cap(r.exchanges) == 0 {
+		return
+	}
+	r.lastID++
+	e.ID = r.lastID
+	if len(r.exchanges) < cap(r.exchanges) {
+		r.exchanges = append(r.exchanges, e)
+	} else {
+		r.exchanges[r.next] = e
+	}
+	r.next = (r.next + 1) % cap(r.exchanges)
+}
+
+// Exchanges returns the captured exchanges, oldest first.
+func (r *Recorder) Exchanges() []Exchange {
+	if r == nil {
+		return nil
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	exchanges := make([]Exchange, 0, len(r.exchanges))
+	if len(r.exchanges) == cap(r.exchanges) {
+		exchanges = append(exchanges, r.exchanges[r.next:]...)
+		exchanges = append(exchanges, r.exchanges[:r.next]...)
+	} else {
+		exchanges = append(exchanges, r.exchanges...)
+	}
+	return exchanges
+}
+
+// Exchange returns the captured exchange with the given ID, if it is
+// still in the buffer.
+func (r *Recorder) Exchange(id int64) (Exchange, bool) {
+	if r == nil {
+		return Exchange{}, false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, e := range r.exchanges {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// Clear removes all captured exchanges.
+func (r *Recorder) Clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.exchanges = r.exchanges[:0]
+	r.next = 0
+}
+
+// readBody reads up to maxBodyBytes of the body for capturing, returning
+// a replacement body that still yields the whole of the original.
+func (r *Recorder) readBody(body io.ReadCloser) (restored io.ReadCloser, captured string, truncated bool, err error) {
+	if body == nil || body == http.NoBody {
+		return body, "", false, nil
+	}
+	head, err := io.ReadAll(io.LimitReader(body, int64(r.maxBodyBytes)+1))
+	restored = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), body), body}
+	if err != nil {
+		return restored, "", false, err
+	}
+	captured, truncated = r.truncate(head)
+	return restored, captured, truncated, nil
+}
+
+func (r *Recorder) truncate(data []byte) (string, bool) {
+	if len(data) > r.maxBodyBytes {
+		return string(data[:r.maxBodyBytes]), true
+	}
+	return string(data), false
+}
+
+// requestOrigin returns the origin from the X-Matrix Authorization header.
+func requestOrigin(header http.Header) spec.ServerName {
+	for _, value := range header.Values("Authorization") {
+		if scheme, origin, _, _, _ := fclient.ParseAuthorization(value); scheme == "X-Matrix" {
+			return origin
+		}
+	}
+	return ""
+}
+
+// redactedHeaders are replaced in captured requests, so that the signatures
+// in them aren't handed out by the admin API. Replays are signed afresh.
+var redactedHeaders = []string{"Authorization"}
+
+// redactHeaders returns a copy of the headers with credentials redacted.
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		values := redacted.Values(name)
+		for i := range values {
+			values[i] = "<redacted>"
+		}
+	}
+	return redacted
+}
+
+// Transport returns an http.RoundTripper which captures outbound requests
+// to the selected servers before passing them to next.
+func (r *Recorder) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{recorder: r, next: next}
+}
+
+type transport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	destination := spec.ServerName(req.URL.Host)
+	if !t.recorder.Capturing(destination) {
+		return t.next.RoundTrip(req)
+	}
+	e := Exchange{
+		Direction:      Outbound,
+		Timestamp:      spec.AsTimestamp(time.Now()),
+		Origin:         requestOrigin(req.Header),
+		Destination:    destination,
+		Method:         req.Method,
+		RequestURI:     req.URL.RequestURI(),
+		RequestHeaders: redactHeaders(req.Header),
+	}
+	var err error
+	req.Body, e.RequestBody, e.RequestTruncated, err = t.recorder.readBody(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	e.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		e.Error = err.Error()
+		t.recorder.Record(e)
+		return nil, err
+	}
+	e.StatusCode = res.StatusCode
+	e.ResponseHeaders = res.Header.Clone()
+	res.Body, e.ResponseBody, e.ResponseTruncated, err = t.recorder.readBody(res.Body)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.recorder.Record(e)
+	return res, err
+}
+
+// Middleware returns an http.Handler which captures inbound requests from
+// the selected servers before passing them to next. The origin is taken
+// from the X-Matrix Authorization header before it has been verified.
+func (r *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := requestOrigin(req.Header)
+		if origin == "" || !r.Capturing(origin) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		e := Exchange{
+			Direction:      Inbound,
+			Timestamp:      spec.AsTimestamp(time.Now()),
+			Origin:         origin,
+			Destination:    spec.ServerName(req.Host),
+			Method:         req.Method,
+			RequestURI:     req.URL.RequestURI(),
+			RequestHeaders: redactHeaders(req.Header),
+		}
+		var err error
+		req.Body, e.RequestBody, e.RequestTruncated, err = r.readBody(req.Body)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK, maxBodyBytes: r.maxBodyBytes}
+		start := time.Now()
+		next.ServeHTTP(rec, req)
+		e.DurationMS = time.Since(start).Milliseconds()
+		e.StatusCode = rec.statusCode
+		e.ResponseHeaders = w.Header().Clone()
+		e.ResponseBody, e.ResponseTruncated = rec.body.String(), rec.truncated
+		r.Record(e)
+	})
+}
+
+// responseRecorder passes the response through to the client, keeping a
+// copy of the status code and up to maxBodyBytes of the body.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode   int
+	body         bytes.Buffer
+	maxBodyBytes int
+	truncated    bool
+}
+
+func (rw *responseRecorder) WriteHeader(statusCode int) {
+	rw.statusCode = statusCode
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseRecorder) Write(data []byte) (int, error) {
+	if remaining := rw.maxBodyBytes - rw.body.Len(); len(data) > remaining {
+		rw.body.Write(data[:max(remaining, 0)])
+		rw.truncated = true
+	} else {
+		rw.body.Write(data)
+	}
+	return rw.ResponseWriter.Write(data)
+}
+
+// Flush sends any buffered data to the client, if the underlying writer
+// supports it, so that streamed responses still work while capturing.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer, for use by http.ResponseController.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
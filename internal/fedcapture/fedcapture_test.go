@@ -0,0 +1,153 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package fedcapture
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorderRingBuffer(t *testing.T) {
+	r := NewRecorder(3, 16, nil)
+	for i := 0; i < 5; i++ {
+		r.Record(Exchange{Method: http.MethodGet})
+	}
+
+	exchanges := r.Exchanges()
+	if assert.Len(t, exchanges, 3) {
+		// The two oldest exchanges have been evicted.
+		assert.Equal(t, int64(3), exchanges[0].ID)
+		assert.Equal(t, int64(4), exchanges[1].ID)
+		assert.Equal(t, int64(5), exchanges[2].ID)
+	}
+	_, ok := r.Exchange(1)
+	assert.False(t, ok)
+	_, ok = r.Exchange(4)
+	assert.True(t, ok)
+
+	r.Clear()
+	assert.Empty(t, r.Exchanges())
+	r.Record(Exchange{})
+	if exchanges = r.Exchanges(); assert.Len(t, exchanges, 1) {
+		assert.Equal(t, int64(6), exchanges[0].ID, "IDs should not be reused after clearing")
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var r *Recorder
+	assert.False(t, r.Capturing("remote.org"))
+	assert.Nil(t, r.Exchanges())
+	assert.Nil(t, r.Servers())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransport(t *testing.T) {
+	r := NewRecorder(10, 8, []string{"remote.org"})
+	tripper := r.Transport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// The inner transport must still see the whole request body.
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"hello":"world"}`, string(body))
+		assert.Contains(t, req.Header.Get("Authorization"), `sig="sig"`)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{}`)),
+		}, nil
+	}))
+
+	for _, destination := range []string{"remote.org", "other.org"} {
+		req := httptest.NewRequest(http.MethodPut, "matrix://"+destination+"/_matrix/federation/v1/send/1", strings.NewReader(`{"hello":"world"}`))
+		req.Header.Set("Authorization", `X-Matrix origin="local.org",destination="`+destination+`",key="ed25519:1",sig="sig"`)
+		res, err := tripper.RoundTrip(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, `{}`, string(body))
+	}
+
+	// Only the request to the selected destination was captured.
+	exchanges := r.Exchanges()
+	if !assert.Len(t, exchanges, 1) {
+		return
+	}
+	e := exchanges[0]
+	assert.Equal(t, Outbound, e.Direction)
+	assert.Equal(t, "local.org", string(e.Origin))
+	assert.Equal(t, "remote.org", string(e.Destination))
+	assert.Equal(t, "/_matrix/federation/v1/send/1", e.RequestURI)
+	assert.Equal(t, "<redacted>", e.RequestHeaders.Get("Authorization"))
+	assert.Equal(t, `{"hello"`, e.RequestBody)
+	assert.True(t, e.RequestTruncated)
+	assert.Equal(t, http.StatusOK, e.StatusCode)
+	assert.Equal(t, `{}`, e.ResponseBody)
+	assert.False(t, e.ResponseTruncated)
+
+	replay := e.Replay()
+	assert.Equal(t, http.MethodPut, replay.Method)
+	assert.Equal(t, "remote.org", string(replay.Destination))
+}
+
+func TestMiddleware(t *testing.T) {
+	r := NewRecorder(10, 4, []string{"remote.org"})
+	handler := r.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+	}))
+
+	for _, origin := range []string{"remote.org", "other.org", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/state/!room:local.org", nil)
+		if origin != "" {
+			req.Header.Set("Authorization", `X-Matrix origin="`+origin+`",destination="local.org",key="ed25519:1",sig="sig"`)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		// The response is passed through in full, however much is captured.
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Equal(t, `{"errcode":"M_FORBIDDEN"}`, w.Body.String())
+	}
+
+	exchanges := r.Exchanges()
+	if !assert.Len(t, exchanges, 1) {
+		return
+	}
+	e := exchanges[0]
+	assert.Equal(t, Inbound, e.Direction)
+	assert.Equal(t, "remote.org", string(e.Origin))
+	assert.Equal(t, "<redacted>", e.RequestHeaders.Get("Authorization"))
+	assert.Equal(t, http.StatusForbidden, e.StatusCode)
+	assert.Equal(t, `{"er`, e.ResponseBody)
+	assert.True(t, e.ResponseTruncated)
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	r := NewRecorder(10, 1024, []string{"remote.org"})
+	handler := r.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(`{}`))
+		assert.NoError(t, http.NewResponseController(w).Flush())
+		w.(http.Flusher).Flush()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/federation/v1/version", nil)
+	req.Header.Set("Authorization", `X-Matrix origin="remote.org",destination="local.org",key="ed25519:1",sig="sig"`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.True(t, w.Flushed)
+	assert.Equal(t, `{}`, w.Body.String())
+	assert.Len(t, r.Exchanges(), 1)
+}
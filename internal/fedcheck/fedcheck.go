@@ -0,0 +1,360 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package fedcheck checks that a server can be reached over federation, by
+// resolving its server name the same way that a remote server would and
+// then calling its federation endpoints. Each step is reported, so that
+// delegation problems can be pinned down.
+package fedcheck
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+// The outcomes of a check.
+const (
+	StatusOK      = "ok"
+	StatusWarning = "warning"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// certificateExpiryWarning is how long before a certificate expires that a
+// warning is reported.
+const certificateExpiryWarning = time.Hour * 24 * 14
+
+// maxResponseSize limits how much of a response is read.
+const maxResponseSize = 1024 * 1024
+
+// Check is the outcome of a single step.
+type Check struct {
+	Name    string `json:"name"`
+	Target  string `json:"target,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// Report is the outcome of all steps for a server name.
+type Report struct {
+	ServerName spec.ServerName `json:"server_name"`
+	OK         bool            `json:"ok"`
+	Checks     []Check         `json:"checks"`
+}
+
+func (r *Report) add(name, target, status, message string, args ...interface{}) {
+	if status == StatusFailed {
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, Check{
+		Name:    name,
+		Target:  target,
+		Status:  status,
+		Message: fmt.Sprintf(message, args...),
+	})
+}
+
+// Checker runs the checks.
+type Checker struct {
+	// RootCAs are the certificate authorities to trust. The system ones
+	// are used if nil.
+	RootCAs *x509.CertPool
+	// SkipVerify reports certificate problems as warnings rather than as
+	// failures, for when TLS validation is disabled.
+	SkipVerify bool
+	// ExpectedKeys are keys which the key endpoint must publish, e.g. our
+	// own when checking our own server name.
+	ExpectedKeys map[gomatrixserverlib.KeyID]ed25519.PublicKey
+	// Timeout applies to each network request. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// NewLocalChecker returns a checker for one of our own server names, which
+// expects the key endpoint to publish our signing key for that name.
+func NewLocalChecker(cfg *config.Dendrite, serverName spec.ServerName) (*Checker, error) {
+	identity, err := cfg.Global.SigningIdentityFor(serverName)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{
+		SkipVerify: cfg.FederationAPI.DisableTLSValidation,
+		ExpectedKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+			identity.KeyID: identity.PrivateKey.Public().(ed25519.PublicKey),
+		},
+	}, nil
+}
+
+func (c *Checker) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second * 10
+	}
+	return c.Timeout
+}
+
+// Check resolves the server name and calls the version and key endpoints
+// on every address that it resolves to.
+func (c *Checker) Check(ctx context.Context, serverName spec.ServerName) *Report {
+	report := &Report{ServerName: serverName, OK: true}
+
+	host, port, valid := spec.ParseAndValidateServerName(serverName)
+	if !valid {
+		report.add("server_name", "", StatusFailed, "%q is not a valid server name", serverName)
+		return report
+	}
+	report.add("server_name", "", StatusOK, "%q is a valid server name", serverName)
+
+	// Well-known and SRV lookups only happen for hostnames without an
+	// explicit port.
+	isIP := net.ParseIP(strings.Trim(host, "[]")) != nil
+	srvName := serverName
+	switch {
+	case isIP || port != -1:
+		report.add("well_known", "", StatusSkipped, "Not looked up because the server name is an IP address or has an explicit port")
+	default:
+		wkCtx, cancel := context.WithTimeout(ctx, c.timeout())
+		wellKnown, err := fclient.LookupWellKnown(wkCtx, serverName)
+		cancel()
+		if err != nil {
+			report.add("well_known", "https://"+string(serverName)+"/.well-known/matrix/server", StatusWarning,
+				"No usable well-known, so requests will go to the server name itself: %s", err)
+		} else {
+			report.add("well_known", "https://"+string(serverName)+"/.well-known/matrix/server", StatusOK,
+				"Delegated to %q", wellKnown.NewAddress)
+			srvName = wellKnown.NewAddress
+		}
+	}
+
+	// The SRV records are only consulted if the delegated name doesn't
+	// have an explicit port either.
+	if srvHost, srvPort, ok := spec.ParseAndValidateServerName(srvName); ok && srvPort == -1 && net.ParseIP(strings.Trim(srvHost, "[]")) == nil {
+		c.checkSRV(ctx, report, srvName)
+	} else {
+		report.add("srv", "", StatusSkipped, "Not looked up because %q is an IP address or has an explicit port", srvName)
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, c.timeout())
+	results, err := fclient.ResolveServer(resolveCtx, serverName)
+	cancel()
+	if err != nil || len(results) == 0 {
+		report.add("resolve", "", StatusFailed, "Failed to resolve server name: %v", err)
+		return report
+	}
+	destinations := make([]string, 0, len(results))
+	for _, result := range results {
+		destinations = append(destinations, result.Destination)
+	}
+	report.add("resolve", "", StatusOK, "Resolved to %s", strings.Join(destinations, ", "))
+
+	for _, result := range results {
+		c.checkDestination(ctx, report, serverName, result)
+	}
+	return report
+}
+
+func (c *Checker) checkSRV(ctx context.Context, report *Report, serverName spec.ServerName) {
+	srvCtx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	for _, service := range []string{"matrix-fed", "matrix"} {
+		target := fmt.Sprintf("_%s._tcp.%s", service, serverName)
+		_, records, err := net.DefaultResolver.LookupSRV(srvCtx, service, "tcp", string(serverName))
+		var dnsErr *net.DNSError
+		switch {
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			continue
+		case err != nil:
+			report.add("srv", target, StatusWarning, "SRV lookup failed, so requests will go to port 8448: %s", err)
+			return
+		case len(records) > 0:
+			found := make([]string, 0, len(records))
+			for _, record := range records {
+				found = append(found, fmt.Sprintf("%s:%d", strings.TrimSuffix(record.Target, "."), record.Port))
+			}
+			status := StatusOK
+			message := "Found %s"
+			if service == "matrix" {
+				status = StatusWarning
+				message = "Found %s, but the _matrix._tcp SRV record is deprecated in favour of _matrix-fed._tcp"
+			}
+			report.add("srv", target, status, message, strings.Join(found, ", "))
+			return
+		}
+	}
+	report.add("srv", "_matrix-fed._tcp."+string(serverName), StatusOK, "No SRV records, so requests will go to port 8448")
+}
+
+func (c *Checker) checkDestination(ctx context.Context, report *Report, serverName spec.ServerName, result fclient.ResolutionResult) {
+	if !c.checkTLS(ctx, report, result) {
+		return
+	}
+	client := &http.Client{
+		Timeout: c.timeout(),
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         result.TLSServerName,
+				RootCAs:            c.RootCAs,
+				InsecureSkipVerify: c.SkipVerify,
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	var version struct {
+		Server struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"server"`
+	}
+	if body, ok := c.get(ctx, report, client, "version", result, "/_matrix/federation/v1/version"); ok {
+		if err := json.Unmarshal(body, &version); err != nil {
+			report.add("version", result.Destination, StatusFailed, "Response isn't valid JSON: %s", err)
+		} else {
+			report.add("version", result.Destination, StatusOK, "Server is %s %s", version.Server.Name, version.Server.Version)
+		}
+	}
+
+	if body, ok := c.get(ctx, report, client, "key", result, "/_matrix/key/v2/server"); ok {
+		c.checkKeys(report, serverName, result, body)
+	}
+}
+
+// checkTLS connects to the destination and checks its certificate. Returns
+// false if the destination can't be reached.
+func (c *Checker) checkTLS(ctx context.Context, report *Report, result fclient.ResolutionResult) bool {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: c.timeout()},
+		Config: &tls.Config{
+			ServerName:         result.TLSServerName,
+			InsecureSkipVerify: true, // verified below, so that we can report the reason
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", result.Destination)
+	if err != nil {
+		report.add("tls", result.Destination, StatusFailed, "Failed to connect: %s", err)
+		return false
+	}
+	state := conn.(*tls.Conn).ConnectionState()
+	_ = conn.Close()
+	if len(state.PeerCertificates) == 0 {
+		report.add("tls", result.Destination, StatusFailed, "No certificate was presented")
+		return false
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	failed := StatusFailed
+	if c.SkipVerify {
+		failed = StatusWarning
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       result.TLSServerName,
+		Roots:         c.RootCAs,
+		Intermediates: intermediates,
+	})
+	switch {
+	case err != nil:
+		report.add("tls", result.Destination, failed, "Certificate isn't valid for %q: %s", result.TLSServerName, err)
+		return c.SkipVerify
+	case time.Until(leaf.NotAfter) < certificateExpiryWarning:
+		report.add("tls", result.Destination, StatusWarning, "Certificate for %q expires soon, at %s", result.TLSServerName, leaf.NotAfter.Format(time.RFC3339))
+	default:
+		report.add("tls", result.Destination, StatusOK, "Certificate is valid for %q until %s", result.TLSServerName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return true
+}
+
+// get sends a request to the destination in the same way as the federation
+// client does, returning the body if the request succeeded.
+func (c *Checker) get(
+	ctx context.Context, report *Report, client *http.Client,
+	name string, result fclient.ResolutionResult, path string,
+) ([]byte, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+result.Destination+path, nil)
+	if err != nil {
+		report.add(name, result.Destination, StatusFailed, "Failed to create request: %s", err)
+		return nil, false
+	}
+	req.Host = string(result.Host)
+	res, err := client.Do(req)
+	if err != nil {
+		report.add(name, result.Destination, StatusFailed, "Request to %s failed: %s", path, err)
+		return nil, false
+	}
+	defer res.Body.Close() // nolint:errcheck
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		report.add(name, result.Destination, StatusFailed, "Failed to read response from %s: %s", path, err)
+		return nil, false
+	}
+	if res.StatusCode != http.StatusOK {
+		report.add(name, result.Destination, StatusFailed, "Request to %s returned HTTP %d: %s", path, res.StatusCode, bytes.TrimSpace(body))
+		return nil, false
+	}
+	return body, true
+}
+
+func (c *Checker) checkKeys(report *Report, serverName spec.ServerName, result fclient.ResolutionResult, body []byte) {
+	var keys gomatrixserverlib.ServerKeys
+	if err := json.Unmarshal(body, &keys); err != nil {
+		report.add("key", result.Destination, StatusFailed, "Response isn't valid JSON: %s", err)
+		return
+	}
+	if keys.ServerName != serverName {
+		report.add("key", result.Destination, StatusFailed, "Keys are for %q rather than %q, check the server_name in the config", keys.ServerName, serverName)
+		return
+	}
+	if keys.ValidUntilTS.Time().Before(time.Now()) {
+		report.add("key", result.Destination, StatusFailed, "Keys expired at %s", keys.ValidUntilTS.Time().Format(time.RFC3339))
+		return
+	}
+	if len(keys.VerifyKeys) == 0 {
+		report.add("key", result.Destination, StatusFailed, "No verify keys were published")
+		return
+	}
+	for keyID, key := range keys.VerifyKeys {
+		if err := gomatrixserverlib.VerifyJSON(string(serverName), keyID, ed25519.PublicKey(key.Key), keys.Raw); err != nil {
+			report.add("key", result.Destination, StatusFailed, "Keys aren't correctly signed with %q: %s", keyID, err)
+			return
+		}
+	}
+	for keyID, expected := range c.ExpectedKeys {
+		key, ok := keys.VerifyKeys[keyID]
+		if !ok {
+			report.add("key", result.Destination, StatusFailed, "Key %q isn't published, is another server answering for this name?", keyID)
+			return
+		}
+		if !bytes.Equal(key.Key, expected) {
+			report.add("key", result.Destination, StatusFailed, "Key %q doesn't match our key, is another server answering for this name?", keyID)
+			return
+		}
+	}
+	keyIDs := make([]string, 0, len(keys.VerifyKeys))
+	for keyID := range keys.VerifyKeys {
+		keyIDs = append(keyIDs, string(keyID))
+	}
+	report.add("key", result.Destination, StatusOK, "Published %s, valid until %s", strings.Join(keyIDs, ", "), keys.ValidUntilTS.Time().Format(time.RFC3339))
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package fedcheck
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func statuses(report *Report) map[string]string {
+	result := map[string]string{}
+	for _, check := range report.Checks {
+		result[check.Name] = check.Status
+	}
+	return result
+}
+
+func TestCheck(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	var serverName spec.ServerName
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_matrix/federation/v1/version":
+			_, _ = w.Write([]byte(`{"server":{"name":"Dendrite","version":"test"}}`))
+		case "/_matrix/key/v2/server":
+			keys, _ := json.Marshal(gomatrixserverlib.ServerKeyFields{
+				ServerName:   serverName,
+				VerifyKeys:   map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{"ed25519:test": {Key: spec.Base64Bytes(publicKey)}},
+				ValidUntilTS: spec.AsTimestamp(time.Now().Add(time.Hour)),
+			})
+			signed, _ := gomatrixserverlib.SignJSON(string(serverName), "ed25519:test", privateKey, keys)
+			_, _ = w.Write(signed)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	serverName = spec.ServerName(strings.TrimPrefix(srv.URL, "https://"))
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	// Everything passes when the certificate is trusted and our key is
+	// published.
+	checker := &Checker{
+		RootCAs:      roots,
+		ExpectedKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{"ed25519:test": publicKey},
+	}
+	report := checker.Check(context.Background(), serverName)
+	assert.True(t, report.OK, "%+v", report.Checks)
+	assert.Equal(t, map[string]string{
+		"server_name": StatusOK,
+		"well_known":  StatusSkipped,
+		"srv":         StatusSkipped,
+		"resolve":     StatusOK,
+		"tls":         StatusOK,
+		"version":     StatusOK,
+		"key":         StatusOK,
+	}, statuses(report))
+
+	// An untrusted certificate fails the check, unless TLS validation is
+	// disabled.
+	checker.RootCAs = x509.NewCertPool()
+	report = checker.Check(context.Background(), serverName)
+	assert.False(t, report.OK)
+	assert.Equal(t, StatusFailed, statuses(report)["tls"])
+	assert.NotContains(t, statuses(report), "version")
+
+	checker.SkipVerify = true
+	report = checker.Check(context.Background(), serverName)
+	assert.True(t, report.OK, "%+v", report.Checks)
+	assert.Equal(t, StatusWarning, statuses(report)["tls"])
+
+	// A different key being published means that another server is
+	// answering for our name.
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	checker.ExpectedKeys["ed25519:test"] = otherKey
+	report = checker.Check(context.Background(), serverName)
+	assert.False(t, report.OK)
+	assert.Equal(t, StatusFailed, statuses(report)["key"])
+
+	// Invalid server names fail straight away.
+	report = checker.Check(context.Background(), "not a server name")
+	assert.False(t, report.OK)
+	assert.Len(t, report.Checks, 1)
+}
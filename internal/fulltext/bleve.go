@@ -10,12 +10,13 @@
 package fulltext
 
 import (
-	"regexp"
+	"math"
+	"strconv"
 	"strings"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/element-hq/dendrite/setup/process"
-	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
 
 	// side effect imports to allow all possible languages
 	_ "github.com/blevesearch/bleve/v2/analysis/lang/ar"
@@ -40,6 +41,8 @@ import (
 	_ "github.com/blevesearch/bleve/v2/analysis/lang/sv"
 	_ "github.com/blevesearch/bleve/v2/analysis/lang/tr"
 	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/numeric"
+	"github.com/blevesearch/bleve/v2/search"
 
 	"github.com/element-hq/dendrite/setup/config"
 )
@@ -47,41 +50,15 @@ import (
 // Search contains all existing bleve.Index
 type Search struct {
 	FulltextIndex bleve.Index
-}
-
-type Indexer interface {
-	Index(elements ...IndexElement) error
-	Delete(eventID string) error
-	Search(term string, roomIDs, keys []string, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error)
-	GetHighlights(result *bleve.SearchResult) []string
-	Close() error
-}
-
-// IndexElement describes the layout of an element to index
-type IndexElement struct {
-	EventID        string
-	RoomID         string
-	Content        string
-	ContentType    string
-	StreamPosition int64
-}
-
-// SetContentType sets i.ContentType given an identifier
-func (i *IndexElement) SetContentType(v string) {
-	switch v {
-	case "m.room.message":
-		i.ContentType = "content.body"
-	case spec.MRoomName:
-		i.ContentType = "content.name"
-	case spec.MRoomTopic:
-		i.ContentType = "content.topic"
-	}
+	// Whether the index maps senders as keywords, which indexes created
+	// before senders were indexed don't.
+	sendersIndexed bool
 }
 
 // New opens a new/existing fulltext index
 func New(processCtx *process.ProcessContext, cfg config.Fulltext) (fts *Search, err error) {
 	fts = &Search{}
-	fts.FulltextIndex, err = openIndex(cfg)
+	fts.FulltextIndex, fts.sendersIndexed, err = openIndex(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -118,107 +95,157 @@ func (f *Search) Delete(eventID string) error {
 	return f.FulltextIndex.Delete(eventID)
 }
 
-var highlightMatcher = regexp.MustCompile("<mark>(.*?)</mark>")
-
 // GetHighlights extracts the highlights from a SearchResult.
-func (f *Search) GetHighlights(result *bleve.SearchResult) []string {
-	if result == nil {
-		return []string{}
-	}
-
-	seenMatches := make(map[string]struct{})
-
-	for _, hit := range result.Hits {
-		if hit.Fragments == nil {
-			continue
-		}
-		fragments, ok := hit.Fragments["Content"]
-		if !ok {
-			continue
-		}
-		for _, x := range fragments {
-			substringMatches := highlightMatcher.FindAllStringSubmatch(x, -1)
-			for _, matches := range substringMatches {
-				for i := range matches {
-					if i == 0 { // skip first match, this is the complete substring match
-						continue
-					}
-					if _, ok := seenMatches[matches[i]]; ok {
-						continue
-					}
-					seenMatches[matches[i]] = struct{}{}
-				}
-			}
-		}
-	}
+func (f *Search) GetHighlights(result *SearchResult) []string {
+	return highlights(result)
+}
 
-	res := make([]string, 0, len(seenMatches))
-	for m := range seenMatches {
-		res = append(res, m)
+// Search searches the index for events matching the given query.
+func (f *Search) Search(query SearchQuery) (*SearchResult, error) {
+	if !f.sendersIndexed && (len(query.Senders) > 0 || len(query.NotSenders) > 0) {
+		return nil, ErrSenderFilterUnsupported
 	}
-	return res
-}
 
-// Search searches the index given a search term, roomIDs and keys.
-func (f *Search) Search(term string, roomIDs, keys []string, limit, from int, orderByStreamPos bool) (*bleve.SearchResult, error) {
 	qry := bleve.NewConjunctionQuery()
 	termQuery := bleve.NewBooleanQuery()
 
-	terms := strings.Split(term, " ")
+	terms := strings.Split(query.Term, " ")
 	for _, term := range terms {
 		matchQuery := bleve.NewMatchQuery(term)
 		matchQuery.SetField("Content")
 		termQuery.AddMust(matchQuery)
 	}
+	for _, sender := range query.NotSenders {
+		senderSearch := bleve.NewMatchQuery(sender)
+		senderSearch.SetField("Sender")
+		termQuery.AddMustNot(senderSearch)
+	}
 	qry.AddQuery(termQuery)
 
+	// The filters don't score, so that events are ranked the same regardless
+	// of the filters and a page of a group continues where the group ended.
 	roomQuery := bleve.NewBooleanQuery()
-	for _, roomID := range roomIDs {
+	for _, roomID := range query.RoomIDs {
 		roomSearch := bleve.NewMatchQuery(roomID)
 		roomSearch.SetField("RoomID")
+		roomSearch.SetBoost(0)
 		roomQuery.AddShould(roomSearch)
 	}
-	if len(roomIDs) > 0 {
+	if len(query.RoomIDs) > 0 {
 		qry.AddQuery(roomQuery)
 	}
 	keyQuery := bleve.NewBooleanQuery()
-	for _, key := range keys {
+	for _, key := range query.Keys {
 		keySearch := bleve.NewMatchQuery(key)
 		keySearch.SetField("ContentType")
+		keySearch.SetBoost(0)
 		keyQuery.AddShould(keySearch)
 	}
-	if len(keys) > 0 {
+	if len(query.Keys) > 0 {
 		qry.AddQuery(keyQuery)
 	}
+	senderQuery := bleve.NewBooleanQuery()
+	for _, sender := range query.Senders {
+		senderSearch := bleve.NewMatchQuery(sender)
+		senderSearch.SetField("Sender")
+		senderSearch.SetBoost(0)
+		senderQuery.AddShould(senderSearch)
+	}
+	if len(query.Senders) > 0 {
+		qry.AddQuery(senderQuery)
+	}
 
-	s := bleve.NewSearchRequestOptions(qry, limit, from, false)
+	s := bleve.NewSearchRequestOptions(qry, query.Limit, 0, false)
 	s.Fields = []string{"*"}
-	s.SortBy([]string{"_score"})
-	if orderByStreamPos {
+	// Stream positions are unique, so they break ties between equally ranked
+	// events and the next page can continue after the last hit.
+	if query.OrderByStreamPos {
 		s.SortBy([]string{"-StreamPosition"})
+	} else {
+		s.SortBy([]string{"-_score", "-StreamPosition"})
+	}
+	if query.After != nil {
+		streamPosition := string(numeric.MustNewPrefixCodedInt64(numeric.Float64ToInt64(float64(query.After.StreamPosition)), 0))
+		if query.OrderByStreamPos {
+			s.SetSearchAfter([]string{streamPosition})
+		} else {
+			s.SetSearchAfter([]string{strconv.FormatFloat(query.After.Score, 'g', -1, 64), streamPosition})
+		}
+	}
+	// Facets are counted over all matching events, regardless of the page.
+	if query.CountGroups {
+		s.AddFacet("RoomID", bleve.NewFacetRequest("RoomID", math.MaxInt32))
+		if f.sendersIndexed {
+			s.AddFacet("Sender", bleve.NewFacetRequest("Sender", math.MaxInt32))
+		}
 	}
 
 	// Highlight some words
 	s.Highlight = bleve.NewHighlight()
 	s.Highlight.Fields = []string{"Content"}
 
-	return f.FulltextIndex.Search(s)
+	bleveResult, err := f.FulltextIndex.Search(s)
+	if err != nil {
+		return nil, err
+	}
+	result := &SearchResult{
+		Hits:  make([]SearchHit, 0, len(bleveResult.Hits)),
+		Total: bleveResult.Total,
+		Took:  bleveResult.Took,
+	}
+	for _, hit := range bleveResult.Hits {
+		roomID, _ := hit.Fields["RoomID"].(string)
+		sender, _ := hit.Fields["Sender"].(string)
+		streamPosition, _ := hit.Fields["StreamPosition"].(float64)
+		result.Hits = append(result.Hits, SearchHit{
+			ID:             hit.ID,
+			RoomID:         roomID,
+			Sender:         sender,
+			Score:          hit.Score,
+			StreamPosition: int64(streamPosition),
+			Fragments:      hit.Fragments["Content"],
+		})
+	}
+	if facet, ok := bleveResult.Facets["RoomID"]; ok {
+		result.RoomCounts = facetCounts(facet.Terms.Terms())
+	}
+	if facet, ok := bleveResult.Facets["Sender"]; ok {
+		result.SenderCounts = facetCounts(facet.Terms.Terms())
+	}
+	return result, nil
 }
 
-func openIndex(cfg config.Fulltext) (bleve.Index, error) {
+func facetCounts(terms []*search.TermFacet) map[string]uint64 {
+	counts := make(map[string]uint64, len(terms))
+	for _, term := range terms {
+		counts[term.Term] = uint64(term.Count)
+	}
+	return counts
+}
+
+func openIndex(cfg config.Fulltext) (bleve.Index, bool, error) {
 	m := getMapping(cfg)
 	if cfg.InMemory {
-		return bleve.NewMemOnly(m)
+		index, err := bleve.NewMemOnly(m)
+		return index, true, err
 	}
 	if index, err := bleve.Open(string(cfg.IndexPath)); err == nil {
-		return index, nil
+		// Indexes created before senders were indexed don't map the sender as a
+		// keyword, so filtering by sender won't work until the index is rebuilt.
+		if im, ok := index.Mapping().(*mapping.IndexMappingImpl); ok {
+			if dm, ok := im.TypeMapping["Event"]; ok && dm.Properties["Sender"] == nil {
+				logrus.WithField("index_path", cfg.IndexPath).Warn("Fulltext index does not support filtering by sender, which is refused until it is deleted and all events are reindexed")
+				return index, false, nil
+			}
+		}
+		return index, true, nil
 	}
 
 	index, err := bleve.New(string(cfg.IndexPath), m)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return index, nil
+	return index, true, nil
 }
 
 func getMapping(cfg config.Fulltext) *mapping.IndexMappingImpl {
@@ -234,6 +261,7 @@ func getMapping(cfg config.Fulltext) *mapping.IndexMappingImpl {
 	eventMapping.AddFieldMappingsAt("ContentType", idFieldMapping)
 	eventMapping.AddFieldMappingsAt("RoomID", idFieldMapping)
 	eventMapping.AddFieldMappingsAt("EventID", idFieldMapping)
+	eventMapping.AddFieldMappingsAt("Sender", idFieldMapping)
 
 	indexMapping := bleve.NewIndexMapping()
 	indexMapping.AddDocumentMapping("Event", eventMapping)
@@ -52,9 +52,15 @@ func mustAddTestData(t *testing.T, fts *fulltext.Search, firstStreamPos int64) (
 		if i > 15 {
 			wantRoomID = util.RandomString(16)
 		}
+		// Bob sends every third message
+		sender := "@alice:test"
+		if i%3 == 0 {
+			sender = "@bob:test"
+		}
 		e := fulltext.IndexElement{
 			EventID:        eventID,
 			RoomID:         wantRoomID,
+			Sender:         sender,
 			Content:        "lorem ipsum",
 			StreamPosition: streamPos,
 		}
@@ -123,7 +129,7 @@ func TestDelete(t *testing.T) {
 	fts, ctx := mustOpenIndex(t, "")
 	defer ctx.ShutdownDendrite()
 	eventIDs, roomIDs := mustAddTestData(t, fts, 0)
-	res1, err := fts.Search("lorem", roomIDs[:1], nil, 50, 0, false)
+	res1, err := fts.Search(fulltext.SearchQuery{Term: "lorem", RoomIDs: roomIDs[:1], Limit: 50})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,7 +138,7 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res2, err := fts.Search("lorem", roomIDs[:1], nil, 50, 0, false)
+	res2, err := fts.Search(fulltext.SearchQuery{Term: "lorem", RoomIDs: roomIDs[:1], Limit: 50})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,8 +152,10 @@ func TestSearch(t *testing.T) {
 	type args struct {
 		term             string
 		keys             []string
+		senders          []string
+		notSenders       []string
 		limit            int
-		from             int
+		after            *fulltext.SearchCursor
 		orderByStreamPos bool
 		roomIndex        []int
 	}
@@ -155,6 +163,7 @@ func TestSearch(t *testing.T) {
 		name           string
 		args           args
 		wantCount      int
+		wantTotal      uint64
 		wantErr        bool
 		wantHighlights []string
 	}{
@@ -220,6 +229,52 @@ func TestSearch(t *testing.T) {
 				keys:      []string{"content.topic"},
 			},
 		},
+		{
+			name:           "Can search for results from a sender",
+			wantCount:      10,
+			wantTotal:      10,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:    "lorem",
+				limit:   20,
+				senders: []string{"@bob:test"},
+			},
+		},
+		{
+			name:           "Can search for results not from a sender",
+			wantCount:      20,
+			wantTotal:      20,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:       "lorem",
+				limit:      20,
+				notSenders: []string{"@bob:test"},
+			},
+		},
+		{
+			name:           "Can search for results from a sender in one room",
+			wantCount:      6,
+			wantTotal:      6,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:      "lorem",
+				roomIndex: []int{0},
+				limit:     20,
+				senders:   []string{"@bob:test"},
+			},
+		},
+		{
+			name:           "Total ignores limit and after",
+			wantCount:      5,
+			wantTotal:      30,
+			wantHighlights: []string{"lorem"},
+			args: args{
+				term:             "lorem",
+				limit:            5,
+				after:            &fulltext.SearchCursor{StreamPosition: 21},
+				orderByStreamPos: true,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -233,7 +288,16 @@ func TestSearch(t *testing.T) {
 			}
 			t.Logf("searching in rooms: %v - %v\n", searchRooms, tt.args.keys)
 
-			got, err := f.Search(tt.args.term, searchRooms, tt.args.keys, tt.args.limit, tt.args.from, tt.args.orderByStreamPos)
+			got, err := f.Search(fulltext.SearchQuery{
+				Term:             tt.args.term,
+				RoomIDs:          searchRooms,
+				Keys:             tt.args.keys,
+				Senders:          tt.args.senders,
+				NotSenders:       tt.args.notSenders,
+				Limit:            tt.args.limit,
+				After:            tt.args.after,
+				OrderByStreamPos: tt.args.orderByStreamPos,
+			})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Search() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -247,7 +311,17 @@ func TestSearch(t *testing.T) {
 			if !reflect.DeepEqual(len(got.Hits), tt.wantCount) {
 				t.Errorf("Search() got = %v, want %v", len(got.Hits), tt.wantCount)
 			}
-			if tt.args.orderByStreamPos {
+			if tt.wantTotal > 0 && got.Total != tt.wantTotal {
+				t.Errorf("Search() got total = %v, want %v", got.Total, tt.wantTotal)
+			}
+			for _, hit := range got.Hits {
+				for _, sender := range tt.args.notSenders {
+					if hit.Sender == sender {
+						t.Errorf("Search() got result from excluded sender %s", sender)
+					}
+				}
+			}
+			if tt.args.orderByStreamPos && tt.args.after == nil {
 				if got.Hits[0].ID != eventIDs[29] {
 					t.Fatalf("expected ID %s, got %s", eventIDs[29], got.Hits[0].ID)
 				}
@@ -255,3 +329,65 @@ func TestSearch(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchPagination(t *testing.T) {
+	for _, orderByStreamPos := range []bool{false, true} {
+		fts, ctx := mustOpenIndex(t, "")
+		eventIDs, _ := mustAddTestData(t, fts, 0)
+
+		seen := map[string]bool{}
+		var after *fulltext.SearchCursor
+		for {
+			res, err := fts.Search(fulltext.SearchQuery{
+				Term:             "lorem",
+				Limit:            7,
+				After:            after,
+				OrderByStreamPos: orderByStreamPos,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Total != 30 {
+				t.Fatalf("expected a total of 30, got %d", res.Total)
+			}
+			if len(res.Hits) == 0 {
+				break
+			}
+			for _, hit := range res.Hits {
+				if seen[hit.ID] {
+					t.Fatalf("event %s returned on more than one page", hit.ID)
+				}
+				seen[hit.ID] = true
+			}
+			after = res.Hits[len(res.Hits)-1].Cursor()
+		}
+		if len(seen) != len(eventIDs) {
+			t.Fatalf("expected %d events over all pages, got %d", len(eventIDs), len(seen))
+		}
+		ctx.ShutdownDendrite()
+	}
+}
+
+func TestSearchCountGroups(t *testing.T) {
+	fts, ctx := mustOpenIndex(t, "")
+	defer ctx.ShutdownDendrite()
+	_, roomIDs := mustAddTestData(t, fts, 0)
+
+	res, err := fts.Search(fulltext.SearchQuery{
+		Term:        "lorem",
+		Limit:       1,
+		CountGroups: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.RoomCounts[roomIDs[0]]; got != 16 {
+		t.Fatalf("expected 16 results in the first room, got %d", got)
+	}
+	if got := res.SenderCounts["@bob:test"]; got != 10 {
+		t.Fatalf("expected 10 results from @bob:test, got %d", got)
+	}
+	if got := res.SenderCounts["@alice:test"]; got != 20 {
+		t.Fatalf("expected 20 results from @alice:test, got %d", got)
+	}
+}
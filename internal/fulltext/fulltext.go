@@ -0,0 +1,145 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package fulltext
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Indexer is implemented by all fulltext search backends.
+type Indexer interface {
+	Index(elements ...IndexElement) error
+	Delete(eventID string) error
+	Search(query SearchQuery) (*SearchResult, error)
+	GetHighlights(result *SearchResult) []string
+	Close() error
+}
+
+// IndexElement describes the layout of an element to index
+type IndexElement struct {
+	EventID        string
+	RoomID         string
+	Sender         string
+	Content        string
+	ContentType    string
+	StreamPosition int64
+}
+
+// SetContentType sets i.ContentType given an identifier
+func (i *IndexElement) SetContentType(v string) {
+	switch v {
+	case "m.room.message":
+		i.ContentType = "content.body"
+	case spec.MRoomName:
+		i.ContentType = "content.name"
+	case spec.MRoomTopic:
+		i.ContentType = "content.topic"
+	}
+}
+
+// SearchQuery describes which events to search for.
+type SearchQuery struct {
+	// The search term to match against the content of the events.
+	Term string
+	// Only return events in these rooms, or in all rooms if empty.
+	RoomIDs []string
+	// Only return events with these content keys, or all keys if empty.
+	Keys []string
+	// Only return events sent by these senders, or by any sender if empty.
+	Senders []string
+	// Never return events sent by these senders.
+	NotSenders []string
+	// The maximum number of events to return.
+	Limit int
+	// Only return events ordered after this position, to continue from the
+	// last hit of the previous page.
+	After *SearchCursor
+	// Order the events by stream position, newest first, instead of by rank.
+	OrderByStreamPos bool
+	// Count the matching events in each room and of each sender.
+	CountGroups bool
+}
+
+// SearchCursor is the position of a hit in the ordered results.
+type SearchCursor struct {
+	// The rank of the hit, which is only used when ordering by rank.
+	Score float64
+	// The stream position of the hit.
+	StreamPosition int64
+}
+
+// ErrSenderFilterUnsupported is returned when searching by sender in an index
+// which was created before senders were indexed.
+var ErrSenderFilterUnsupported = errors.New("the fulltext index must be rebuilt to filter by sender")
+
+// SearchResult is the result of a search, independent of the backend used.
+type SearchResult struct {
+	// The matching events, ordered as requested.
+	Hits []SearchHit
+	// The total number of matching events, ignoring Limit and After.
+	Total uint64
+	// The number of matching events in each room and of each sender, ignoring
+	// Limit and After. Only set if CountGroups was requested, and may only
+	// contain the rooms and senders of the returned hits.
+	RoomCounts, SenderCounts map[string]uint64
+	// How long the search took.
+	Took time.Duration
+}
+
+// SearchHit is a single event matching a search.
+type SearchHit struct {
+	// The event ID of the matching event.
+	ID string
+	// The room the event was sent in.
+	RoomID string
+	// The sender of the event.
+	Sender string
+	// The rank of the event, higher is better.
+	Score float64
+	// The stream position of the event.
+	StreamPosition int64
+	// Highlighted fragments of the content, with matches wrapped in <mark></mark>.
+	Fragments []string
+}
+
+// Cursor returns the position of the hit, to continue the search after it.
+func (h *SearchHit) Cursor() *SearchCursor {
+	return &SearchCursor{Score: h.Score, StreamPosition: h.StreamPosition}
+}
+
+var highlightMatcher = regexp.MustCompile("<mark>(.*?)</mark>")
+
+// highlights extracts the unique highlighted words from the fragments of all hits.
+func highlights(result *SearchResult) []string {
+	if result == nil {
+		return []string{}
+	}
+
+	seenMatches := make(map[string]struct{})
+	res := []string{}
+	for _, hit := range result.Hits {
+		for _, x := range hit.Fragments {
+			substringMatches := highlightMatcher.FindAllStringSubmatch(x, -1)
+			for _, matches := range substringMatches {
+				for i := range matches {
+					if i == 0 { // skip first match, this is the complete substring match
+						continue
+					}
+					if _, ok := seenMatches[matches[i]]; ok {
+						continue
+					}
+					seenMatches[matches[i]] = struct{}{}
+					res = append(res, matches[i])
+				}
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,322 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+//go:build !wasm
+// +build !wasm
+
+package fulltext
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/element-hq/dendrite/internal"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
+)
+
+// The content to index, depending on the event type. This must match
+// the content extracted by the sync API consumers when indexing events.
+const postgresContentExpr = "" +
+	"CASE type" +
+	" WHEN 'm.room.message' THEN headered_event_json::jsonb->'content'->>'body'" +
+	" WHEN 'm.room.name' THEN headered_event_json::jsonb->'content'->>'name'" +
+	" WHEN 'm.room.topic' THEN headered_event_json::jsonb->'content'->>'topic'" +
+	" END"
+
+// Backfills the search vectors for all existing events.
+const backfillSearchVectorsSQL = "" +
+	"UPDATE syncapi_output_room_events SET search_vector = to_tsvector($1::regconfig, NULLIF(" + postgresContentExpr + ", ''))," +
+	" search_sender = COALESCE(search_sender, sender)" +
+	" WHERE type IN ('m.room.message', 'm.room.name', 'm.room.topic')"
+
+// Backfills the user IDs of the senders of indexed events. The sender ID is the
+// user ID in all room versions without pseudo IDs, and is what the sync API
+// falls back to when indexing an event whose sender's user ID isn't known.
+const backfillSearchSendersSQL = "" +
+	"UPDATE syncapi_output_room_events SET search_sender = sender" +
+	" WHERE search_vector IS NOT NULL AND search_sender IS NULL"
+
+// Removes the original events of edits from the index, as is done when indexing new events.
+const backfillRemoveEditedSQL = "" +
+	"UPDATE syncapi_output_room_events SET search_vector = NULL WHERE event_id IN (" +
+	" SELECT headered_event_json::jsonb->'content'->'m.relates_to'->>'event_id' FROM syncapi_output_room_events" +
+	" WHERE type = 'm.room.message' AND headered_event_json::jsonb->'content'->'m.relates_to'->>'rel_type' = 'm.replace'" +
+	")"
+
+const indexSearchVectorSQL = "" +
+	"UPDATE syncapi_output_room_events SET search_vector = to_tsvector($1::regconfig, $2), search_sender = $3 WHERE event_id = $4"
+
+const deleteSearchVectorSQL = "" +
+	"UPDATE syncapi_output_room_events SET search_vector = NULL, search_sender = NULL WHERE event_id = $1"
+
+// The totals are counted over all matching events, before skipping the events
+// of previous pages. Senders are matched and grouped by their user IDs, as with
+// the bleve backend, rather than by the sender IDs of the events.
+const searchSelectSQL = "" +
+	"WITH matches AS (" +
+	" SELECT id, event_id, room_id, search_sender, type, headered_event_json, query, ts_rank(search_vector, query) AS rank," +
+	" COUNT(*) OVER () AS total," +
+	" COUNT(*) OVER (PARTITION BY room_id) AS room_total," +
+	" COUNT(*) OVER (PARTITION BY search_sender) AS sender_total" +
+	" FROM syncapi_output_room_events, plainto_tsquery($1::regconfig, $2) AS query" +
+	" WHERE search_vector @@ query" +
+	" AND (cardinality($3::TEXT[]) = 0 OR room_id = ANY($3))" +
+	" AND (cardinality($4::TEXT[]) = 0 OR type = ANY($4))" +
+	" AND (cardinality($5::TEXT[]) = 0 OR search_sender = ANY($5))" +
+	" AND NOT (search_sender = ANY($6))" +
+	")" +
+	" SELECT event_id, room_id, search_sender, id, rank, total, room_total, sender_total," +
+	" ts_headline($1::regconfig, COALESCE(" + postgresContentExpr + ", ''), query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=TRUE')" +
+	" FROM matches"
+
+const searchByRankSQL = searchSelectSQL +
+	" WHERE $8::BIGINT IS NULL OR rank < $7::REAL OR (rank = $7::REAL AND id < $8)" +
+	" ORDER BY rank DESC, id DESC LIMIT $9"
+
+const searchByStreamPositionSQL = searchSelectSQL +
+	" WHERE $7::BIGINT IS NULL OR id < $7" +
+	" ORDER BY id DESC LIMIT $8"
+
+const countSearchResultsSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_output_room_events, plainto_tsquery($1::regconfig, $2) AS query" +
+	" WHERE search_vector @@ query" +
+	" AND (cardinality($3::TEXT[]) = 0 OR room_id = ANY($3))" +
+	" AND (cardinality($4::TEXT[]) = 0 OR type = ANY($4))" +
+	" AND (cardinality($5::TEXT[]) = 0 OR search_sender = ANY($5))" +
+	" AND NOT (search_sender = ANY($6))"
+
+// Postgres is a fulltext search backend using PostgreSQL full-text search on the
+// events stored by the sync API. Unlike the bleve backend, the index is part of
+// the sync API database, so it can be shared by multiple sync API processes.
+type Postgres struct {
+	db                         *sql.DB
+	textSearchConfig           string
+	indexSearchVectorStmt      *sql.Stmt
+	deleteSearchVectorStmt     *sql.Stmt
+	searchByRankStmt           *sql.Stmt
+	searchByStreamPositionStmt *sql.Stmt
+	countSearchResultsStmt     *sql.Stmt
+}
+
+// NewPostgres creates a new fulltext search backend using the given sync API database,
+// which must already contain the sync API tables. Existing events are indexed the first
+// time this is called with a given language.
+func NewPostgres(processCtx *process.ProcessContext, cfg config.Fulltext, db *sql.DB) (*Postgres, error) {
+	p := &Postgres{
+		db:               db,
+		textSearchConfig: postgresTextSearchConfig(cfg.Language),
+	}
+
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: fmt.Sprintf("fulltext: backfill search vectors (%s)", p.textSearchConfig),
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			if _, err := txn.ExecContext(ctx, backfillSearchVectorsSQL, p.textSearchConfig); err != nil {
+				return err
+			}
+			_, err := txn.ExecContext(ctx, backfillRemoveEditedSQL)
+			return err
+		},
+	}, sqlutil.Migration{
+		Version: "fulltext: backfill search senders",
+		Up: func(ctx context.Context, txn *sql.Tx) error {
+			_, err := txn.ExecContext(ctx, backfillSearchSendersSQL)
+			return err
+		},
+	})
+	if err := m.Up(processCtx.Context()); err != nil {
+		return nil, fmt.Errorf("failed to backfill search vectors: %w", err)
+	}
+
+	if err := (sqlutil.StatementList{
+		{&p.indexSearchVectorStmt, indexSearchVectorSQL},
+		{&p.deleteSearchVectorStmt, deleteSearchVectorSQL},
+		{&p.searchByRankStmt, searchByRankSQL},
+		{&p.searchByStreamPositionStmt, searchByStreamPositionSQL},
+		{&p.countSearchResultsStmt, countSearchResultsSQL},
+	}.Prepare(db)); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		processCtx.ComponentStarted()
+		// Wait for the processContext to be done, indicating that Dendrite is shutting down.
+		<-processCtx.WaitForShutdown()
+		_ = p.Close()
+		processCtx.ComponentFinished()
+	}()
+	return p, nil
+}
+
+// Close closes the prepared statements. The database connection is owned by the sync API.
+func (p *Postgres) Close() error {
+	for _, stmt := range []*sql.Stmt{
+		p.indexSearchVectorStmt, p.deleteSearchVectorStmt, p.searchByRankStmt,
+		p.searchByStreamPositionStmt, p.countSearchResultsStmt,
+	} {
+		if err := stmt.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index indexes the given elements. The events must already be stored in the sync API database.
+func (p *Postgres) Index(elements ...IndexElement) error {
+	return sqlutil.WithTransaction(p.db, func(txn *sql.Tx) error {
+		stmt := sqlutil.TxStmt(txn, p.indexSearchVectorStmt)
+		for _, element := range elements {
+			if _, err := stmt.ExecContext(context.Background(), p.textSearchConfig, element.Content, element.Sender, element.EventID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete deletes an indexed element by the eventID
+func (p *Postgres) Delete(eventID string) error {
+	_, err := p.deleteSearchVectorStmt.ExecContext(context.Background(), eventID)
+	return err
+}
+
+// GetHighlights extracts the highlights from a SearchResult.
+func (p *Postgres) GetHighlights(result *SearchResult) []string {
+	return highlights(result)
+}
+
+// Search searches the index for events matching the given query.
+func (p *Postgres) Search(query SearchQuery) (*SearchResult, error) {
+	start := time.Now()
+	ctx := context.Background()
+
+	eventTypes := make([]string, 0, len(query.Keys))
+	for _, key := range query.Keys {
+		switch key {
+		case "content.body":
+			eventTypes = append(eventTypes, "m.room.message")
+		case "content.name":
+			eventTypes = append(eventTypes, "m.room.name")
+		case "content.topic":
+			eventTypes = append(eventTypes, "m.room.topic")
+		}
+	}
+	params := []interface{}{
+		p.textSearchConfig, query.Term,
+		pq.StringArray(nonNil(query.RoomIDs)), pq.StringArray(eventTypes),
+		pq.StringArray(nonNil(query.Senders)), pq.StringArray(nonNil(query.NotSenders)),
+	}
+
+	var afterScore, afterStreamPosition interface{}
+	if query.After != nil {
+		afterScore, afterStreamPosition = query.After.Score, query.After.StreamPosition
+	}
+	var rows *sql.Rows
+	var err error
+	if query.OrderByStreamPos {
+		rows, err = p.searchByStreamPositionStmt.QueryContext(ctx, append(params, afterStreamPosition, query.Limit)...)
+	} else {
+		rows, err = p.searchByRankStmt.QueryContext(ctx, append(params, afterScore, afterStreamPosition, query.Limit)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "Postgres.Search: rows.close() failed")
+
+	result := &SearchResult{
+		Hits: []SearchHit{},
+	}
+	if query.CountGroups {
+		result.RoomCounts = map[string]uint64{}
+		result.SenderCounts = map[string]uint64{}
+	}
+	for rows.Next() {
+		var hit SearchHit
+		var roomTotal, senderTotal uint64
+		var fragment string
+		if err = rows.Scan(
+			&hit.ID, &hit.RoomID, &hit.Sender, &hit.StreamPosition, &hit.Score,
+			&result.Total, &roomTotal, &senderTotal, &fragment,
+		); err != nil {
+			return nil, err
+		}
+		hit.Fragments = []string{fragment}
+		result.Hits = append(result.Hits, hit)
+		if query.CountGroups {
+			result.RoomCounts[hit.RoomID] = roomTotal
+			result.SenderCounts[hit.Sender] = senderTotal
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The total is only known if at least one row was returned, so count
+	// separately if we paginated past the end of the results or only asked
+	// for the total.
+	if len(result.Hits) == 0 && (query.After != nil || query.Limit == 0) {
+		if err = p.countSearchResultsStmt.QueryRowContext(ctx, params...).Scan(&result.Total); err != nil {
+			return nil, err
+		}
+	}
+
+	result.Took = time.Since(start)
+	return result, nil
+}
+
+// nonNil returns an empty slice instead of nil, as nil arrays are passed to PostgreSQL as NULL.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// postgresTextSearchConfig maps the configured language, which is a bleve analyzer
+// name, to the matching built-in PostgreSQL text search configuration.
+func postgresTextSearchConfig(language string) string {
+	switch language {
+	case "ar":
+		return "arabic"
+	case "da":
+		return "danish"
+	case "de":
+		return "german"
+	case "en":
+		return "english"
+	case "es":
+		return "spanish"
+	case "fi":
+		return "finnish"
+	case "fr":
+		return "french"
+	case "hu":
+		return "hungarian"
+	case "it":
+		return "italian"
+	case "nl":
+		return "dutch"
+	case "no":
+		return "norwegian"
+	case "pt":
+		return "portuguese"
+	case "ro":
+		return "romanian"
+	case "ru":
+		return "russian"
+	case "sv":
+		return "swedish"
+	case "tr":
+		return "turkish"
+	default:
+		return "simple"
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
+)
+
+// WaitForFullState blocks until the room has full state, if it was joined with
+// partial state (MSC3706), for requests which need the full membership of the
+// room. Returns nil once the room has full state, or the response to send if
+// it doesn't, which asks the client to try again later if it still might.
+func WaitForFullState(ctx context.Context, rsAPI roomserverAPI.PartialStateAPI, roomID string) *util.JSONResponse {
+	waitCtx, cancel := context.WithTimeout(ctx, roomserverAPI.FullStateWaitTimeout)
+	defer cancel()
+	err := rsAPI.WaitForFullState(waitCtx, roomID)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return &util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: spec.Unknown("The room is still being joined, try again later"),
+			Headers: map[string]string{
+				"Retry-After": strconv.Itoa(int(roomserverAPI.FullStateWaitTimeout.Seconds())),
+			},
+		}
+	case errors.Is(err, roomserverAPI.ErrFullStateUnavailable):
+		return &util.JSONResponse{
+			Code: http.StatusServiceUnavailable,
+			JSON: spec.Unknown("The room was only partially joined, and the rest of it could not be fetched"),
+		}
+	default:
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.WaitForFullState failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
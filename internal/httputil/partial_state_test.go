@@ -0,0 +1,53 @@
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
+)
+
+type fakePartialStateAPI struct {
+	roomserverAPI.PartialStateAPI
+	err error
+}
+
+func (f *fakePartialStateAPI) WaitForFullState(ctx context.Context, roomID string) error {
+	return f.err
+}
+
+func TestWaitForFullState(t *testing.T) {
+	testCases := []struct {
+		name       string
+		err        error
+		wantCode   int
+		retryAfter string
+	}{
+		{name: "full state", err: nil},
+		{name: "still joining", err: context.DeadlineExceeded, wantCode: http.StatusServiceUnavailable, retryAfter: "10"},
+		{name: "resync given up", err: roomserverAPI.ErrFullStateUnavailable, wantCode: http.StatusServiceUnavailable},
+		{name: "other error", err: errors.New("oops"), wantCode: http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := WaitForFullState(context.Background(), &fakePartialStateAPI{err: tc.err}, "!room:test")
+			if tc.wantCode == 0 {
+				if res != nil {
+					t.Fatalf("unexpected response: %+v", res)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatalf("expected a response with code %d", tc.wantCode)
+			}
+			if res.Code != tc.wantCode {
+				t.Fatalf("unexpected status code: %d", res.Code)
+			}
+			if got := res.Headers["Retry-After"]; got != tc.retryAfter {
+				t.Fatalf("unexpected Retry-After: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package serverpolicy implements the server-wide lists of server names that
+// we will or won't federate with, independent of room ACLs.
+package serverpolicy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// ErrServerNotAllowed is returned when a request to a remote server is refused
+// because of the federation_api.allowed_servers/denied_servers lists.
+var ErrServerNotAllowed = errors.New("server is not allowed by the federation server policy")
+
+// Policy decides which servers we federate with. It is safe for concurrent
+// use and can be updated at runtime. A nil policy allows everything.
+type Policy struct {
+	mutex   sync.RWMutex
+	allowed []*regexp.Regexp
+	denied  []*regexp.Regexp
+}
+
+// New returns a policy for the federation_api.allowed_servers and
+// federation_api.denied_servers lists.
+func New(allowed, denied []string) (*Policy, error) {
+	p := &Policy{}
+	if err := p.Update(allowed, denied); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Update replaces the allowed and denied patterns. If either list fails to
+// compile then the policy is left unchanged.
+func (p *Policy) Update(allowed, denied []string) error {
+	allowedRegexes, err := compileServerNamePatterns(allowed)
+	if err != nil {
+		return fmt.Errorf("allowed_servers: %w", err)
+	}
+	deniedRegexes, err := compileServerNamePatterns(denied)
+	if err != nil {
+		return fmt.Errorf("denied_servers: %w", err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.allowed, p.denied = allowedRegexes, deniedRegexes
+	return nil
+}
+
+// IsAllowed returns whether we may federate with the given server. Patterns
+// are matched against both the full server name and the host without a port.
+func (p *Policy) IsAllowed(serverName spec.ServerName) bool {
+	if p == nil {
+		return true
+	}
+	names := []string{string(serverName)}
+	if host, _, err := net.SplitHostPort(string(serverName)); err == nil {
+		names = append(names, host)
+	}
+	matches := func(regexes []*regexp.Regexp) bool {
+		for _, re := range regexes {
+			for _, name := range names {
+				if re.MatchString(name) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if matches(p.denied) {
+		return false
+	}
+	return len(p.allowed) == 0 || matches(p.allowed)
+}
+
+// compileServerNamePatterns turns server name globs, which may contain the
+// * and ? wildcards, into anchored case-insensitive regular expressions.
+func compileServerNamePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, errors.New("empty pattern")
+		}
+		escaped := regexp.QuoteMeta(pattern)
+		escaped = strings.ReplaceAll(escaped, "\\?", ".")
+		escaped = strings.ReplaceAll(escaped, "\\*", ".*")
+		re, err := regexp.Compile("(?i)^" + escaped + "$")
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes, nil
+}
+
+// Transport returns an http.RoundTripper which refuses requests to servers
+// which aren't allowed before passing the rest on to next. Federation clients
+// address requests to the destination server name, so this covers every
+// outbound federation request.
+func (p *Policy) Transport(next http.RoundTripper) http.RoundTripper {
+	return transport{policy: p, next: next}
+}
+
+type transport struct {
+	policy *Policy
+	next   http.RoundTripper
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if serverName := spec.ServerName(req.URL.Host); !t.policy.IsAllowed(serverName) {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %s", ErrServerNotAllowed, serverName)
+	}
+	return t.next.RoundTrip(req)
+}
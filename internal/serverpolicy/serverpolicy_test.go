@@ -0,0 +1,142 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package serverpolicy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+func TestPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    []string
+		denied     []string
+		serverName spec.ServerName
+		want       bool
+	}{
+		{
+			name:       "empty policy allows everything",
+			serverName: "example.com",
+			want:       true,
+		},
+		{
+			name:       "denied by exact name",
+			denied:     []string{"evil.com"},
+			serverName: "evil.com",
+			want:       false,
+		},
+		{
+			name:       "denied by wildcard, ignoring port",
+			denied:     []string{"*.evil.com"},
+			serverName: "matrix.evil.com:8448",
+			want:       false,
+		},
+		{
+			name:       "patterns are anchored",
+			denied:     []string{"evil.com"},
+			serverName: "notevil.com",
+			want:       true,
+		},
+		{
+			name:       "not in allow list",
+			allowed:    []string{"*.example.com"},
+			serverName: "example.org",
+			want:       false,
+		},
+		{
+			name:       "in allow list",
+			allowed:    []string{"*.example.com"},
+			serverName: "matrix.example.com",
+			want:       true,
+		},
+		{
+			name:       "deny list wins over allow list",
+			allowed:    []string{"*.example.com"},
+			denied:     []string{"bad?.example.com"},
+			serverName: "bad1.example.com",
+			want:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.allowed, tt.denied)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			if got := p.IsAllowed(tt.serverName); got != tt.want {
+				t.Errorf("IsAllowed(%q) = %v, want %v", tt.serverName, got, tt.want)
+			}
+		})
+	}
+
+	var nilPolicy *Policy
+	if !nilPolicy.IsAllowed("example.com") {
+		t.Errorf("nil policy should allow everything")
+	}
+	if _, err := New([]string{""}, nil); err == nil {
+		t.Errorf("expected an error for an empty pattern")
+	}
+}
+
+func TestUpdateKeepsPolicyOnError(t *testing.T) {
+	p, err := New(nil, []string{"evil.com"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err = p.Update(nil, []string{""}); err == nil {
+		t.Fatalf("expected an error for an empty pattern")
+	}
+	if p.IsAllowed("evil.com") {
+		t.Errorf("policy should be unchanged after a failed update")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransport(t *testing.T) {
+	p, err := New(nil, []string{"evil.com"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	called := false
+	transport := p.Transport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+
+	req, _ := http.NewRequest(http.MethodGet, "matrix-federation://evil.com/_matrix/federation/v1/version", nil)
+	if _, err = transport.RoundTrip(req); !errors.Is(err, ErrServerNotAllowed) {
+		t.Errorf("expected ErrServerNotAllowed, got %v", err)
+	}
+	if called {
+		t.Errorf("request to a denied server was passed on")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "matrix-federation://example.com/_matrix/federation/v1/version", nil)
+	if _, err = transport.RoundTrip(req); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !called {
+		t.Errorf("request to an allowed server was not passed on")
+	}
+
+	// Updating the policy applies to transports already handed out.
+	if err = p.Update(nil, nil); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "matrix-federation://evil.com/_matrix/federation/v1/version", nil)
+	if _, err = transport.RoundTrip(req); err != nil {
+		t.Errorf("unexpected error after update: %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/element-hq/dendrite/federationapi/producers"
 	"github.com/element-hq/dendrite/federationapi/types"
@@ -47,6 +48,16 @@ var (
 	)
 )
 
+const (
+	// The maximum number of rooms in a transaction whose PDUs are processed
+	// at the same time.
+	maxConcurrentRoomsPerTxn = 8
+	// How long to wait for the roomserver to process the PDUs in a transaction
+	// before responding. PDUs that haven't been processed by then are still
+	// processed in the background.
+	txnProcessingTimeout = time.Second * 30
+)
+
 type TxnReq struct {
 	gomatrixserverlib.Transaction
 	rsAPI                  api.FederationRoomserverAPI
@@ -56,6 +67,8 @@ type TxnReq struct {
 	roomsMu                *MutexByRoom
 	producer               *producers.SyncAPIProducer
 	inboundPresenceEnabled bool
+	maxConcurrentRooms     int
+	processingTimeout      time.Duration
 }
 
 func NewTxnReq(
@@ -80,6 +93,8 @@ func NewTxnReq(
 		roomsMu:                roomsMu,
 		producer:               producer,
 		inboundPresenceEnabled: inboundPresenceEnabled,
+		maxConcurrentRooms:     maxConcurrentRoomsPerTxn,
+		processingTimeout:      txnProcessingTimeout,
 	}
 
 	t.PDUs = pdus
@@ -101,21 +116,10 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 		}
 	}()
 
-	results := make(map[string]fclient.PDUResult)
-	roomVersions := make(map[string]gomatrixserverlib.RoomVersion)
-	getRoomVersion := func(roomID string) gomatrixserverlib.RoomVersion {
-		if v, ok := roomVersions[roomID]; ok {
-			return v
-		}
-		roomVersion, err := t.rsAPI.QueryRoomVersionForRoom(ctx, roomID)
-		if err != nil {
-			util.GetLogger(ctx).WithError(err).Debug("Transaction: Failed to query room version for room", roomID)
-			return ""
-		}
-		roomVersions[roomID] = roomVersion
-		return roomVersion
-	}
-
+	// Group the PDUs by room, keeping the order that they were sent in, so
+	// that the rooms can be processed in parallel with each other.
+	var roomIDs []string
+	pdusByRoom := make(map[string][]json.RawMessage)
 	for _, pdu := range t.PDUs {
 		PDUCountTotal.WithLabelValues("total").Inc()
 		var header struct {
@@ -127,11 +131,62 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 			// failure in the PDU results
 			continue
 		}
-		roomVersion := getRoomVersion(header.RoomID)
-		verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
-		if err != nil {
-			continue
+		if _, ok := pdusByRoom[header.RoomID]; !ok {
+			roomIDs = append(roomIDs, header.RoomID)
 		}
+		pdusByRoom[header.RoomID] = append(pdusByRoom[header.RoomID], pdu)
+	}
+
+	// Only wait for the roomserver to process the PDUs until the deadline,
+	// so that a room that is slow to process, e.g. because missing events
+	// need to be fetched, can't hold up the response for the whole transaction.
+	deadline := time.Now().Add(t.processingTimeout)
+
+	var resultsMu sync.Mutex
+	results := make(map[string]fclient.PDUResult)
+	setResult := func(eventID string, result fclient.PDUResult) {
+		resultsMu.Lock()
+		defer resultsMu.Unlock()
+		results[eventID] = result
+	}
+
+	var roomsWG sync.WaitGroup
+	limiter := make(chan struct{}, t.maxConcurrentRooms)
+	for _, roomID := range roomIDs {
+		limiter <- struct{}{}
+		roomsWG.Add(1)
+		go func(roomID string, pdus []json.RawMessage) {
+			defer roomsWG.Done()
+			defer func() { <-limiter }()
+			t.processRoomPDUs(ctx, deadline, roomID, pdus, setResult)
+		}(roomID, pdusByRoom[roomID])
+	}
+	roomsWG.Wait()
+
+	wg.Wait()
+	return &fclient.RespSend{PDUs: results}, nil
+}
+
+// processRoomPDUs checks the PDUs for a single room and passes them to the
+// roomserver in order, reporting the outcome of each one with setResult. Once
+// the deadline has passed, any remaining PDUs are queued for the roomserver
+// without waiting for them to be processed.
+func (t *TxnReq) processRoomPDUs(
+	ctx context.Context, deadline time.Time, roomID string, pdus []json.RawMessage,
+	setResult func(eventID string, result fclient.PDUResult),
+) {
+	roomVersion, err := t.rsAPI.QueryRoomVersionForRoom(ctx, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Debug("Transaction: Failed to query room version for room", roomID)
+		return
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return
+	}
+
+	async := false
+	for _, pdu := range pdus {
 		event, err := verImpl.NewEventFromUntrustedJSON(pdu)
 		if err != nil {
 			/* Do not reject the entire transaction for a single bad PDU, that's dumb.
@@ -156,50 +211,61 @@ func (t *TxnReq) ProcessTransaction(ctx context.Context) (*fclient.RespSend, *ut
 			continue
 		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID().String(), t.Origin) {
-			results[event.EventID()] = fclient.PDUResult{
+			setResult(event.EventID(), fclient.PDUResult{
 				Error: "Forbidden by server ACLs",
-			}
+			})
 			continue
 		}
 		if err = gomatrixserverlib.VerifyEventSignatures(ctx, event, t.keys, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return t.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		}); err != nil {
 			util.GetLogger(ctx).WithError(err).Debugf("Transaction: Couldn't validate signature of event %q", event.EventID())
-			results[event.EventID()] = fclient.PDUResult{
+			setResult(event.EventID(), fclient.PDUResult{
 				Error: err.Error(),
-			}
+			})
 			continue
 		}
 
-		// pass the event to the roomserver which will do auth checks
-		// If the event fail auth checks, gmsl.NotAllowed error will be returned which we be silently
-		// discarded by the caller of this function
-		if err = api.SendEvents(
-			ctx,
-			t.rsAPI,
-			api.KindNew,
-			[]*rstypes.HeaderedEvent{
-				{PDU: event},
-			},
-			t.Destination,
-			t.Origin,
-			api.DoNotSendToOtherServers,
-			nil,
-			true,
-		); err != nil {
+		// pass the event to the roomserver which will do auth checks, waiting
+		// for the outcome unless we've already run out of time
+		async = async || !time.Now().Before(deadline)
+		var res api.InputRoomEventsResponse
+		t.rsAPI.InputRoomEvents(ctx, &api.InputRoomEventsRequest{
+			InputRoomEvents: []api.InputRoomEvent{{
+				Kind:         api.KindNew,
+				Event:        &rstypes.HeaderedEvent{PDU: event},
+				Origin:       t.Origin,
+				SendAsServer: api.DoNotSendToOtherServers,
+			}},
+			Asynchronous: async,
+			VirtualHost:  t.Destination,
+			WaitDeadline: deadline,
+		}, &res)
+		err = res.Err()
+		switch {
+		case err == nil:
+		case err.Error() == api.InputWaitTimedOut:
+			// The event was queued but the roomserver didn't finish processing
+			// it in time. It will still be processed, so don't report an error,
+			// and queue the rest of the PDUs for this room without waiting.
+			util.GetLogger(ctx).Debugf("Transaction: Timed out waiting for event %q to be processed", event.EventID())
+			async = true
+		case err.Error() == api.InputWasRejected:
+			setResult(event.EventID(), fclient.PDUResult{
+				Error: "Event was rejected",
+			})
+			continue
+		default:
 			util.GetLogger(ctx).WithError(err).Errorf("Transaction: Couldn't submit event %q to input queue: %s", event.EventID(), err)
-			results[event.EventID()] = fclient.PDUResult{
+			setResult(event.EventID(), fclient.PDUResult{
 				Error: err.Error(),
-			}
+			})
 			continue
 		}
 
-		results[event.EventID()] = fclient.PDUResult{}
+		setResult(event.EventID(), fclient.PDUResult{})
 		PDUCountTotal.WithLabelValues("success").Inc()
 	}
-
-	wg.Wait()
-	return &fclient.RespSend{PDUs: results}, nil
 }
 
 // nolint:gocyclo
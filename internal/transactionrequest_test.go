@@ -11,6 +11,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -175,6 +177,90 @@ func TestProcessTransactionRequestPDUInvalidSignature(t *testing.T) {
 	}
 }
 
+type slowRoomRsAPI struct {
+	FakeRsAPI
+	slowRoomID string
+	rejectAll  bool
+	mu         sync.Mutex
+	sync       []string // event IDs that were input synchronously
+	async      []string // event IDs that were input asynchronously
+}
+
+func (r *slowRoomRsAPI) InputRoomEvents(
+	ctx context.Context,
+	req *rsAPI.InputRoomEventsRequest,
+	res *rsAPI.InputRoomEventsResponse,
+) {
+	for _, ire := range req.InputRoomEvents {
+		r.mu.Lock()
+		if req.Asynchronous {
+			r.async = append(r.async, ire.Event.EventID())
+		} else {
+			r.sync = append(r.sync, ire.Event.EventID())
+		}
+		r.mu.Unlock()
+		switch {
+		case req.Asynchronous:
+		case r.rejectAll:
+			res.ErrMsg = rsAPI.InputWasRejected
+		case ire.Event.RoomID().String() == r.slowRoomID:
+			// The event is queued with the request context, and only the
+			// wait for it to be processed is bounded by the deadline.
+			select {
+			case <-ctx.Done():
+				res.ErrMsg = ctx.Err().Error()
+			case <-time.After(time.Until(req.WaitDeadline)):
+				res.ErrMsg = rsAPI.InputWaitTimedOut
+			}
+		}
+	}
+}
+
+func TestProcessTransactionRequestPDUSlowRoom(t *testing.T) {
+	keyRing := &test.NopJSONVerifier{}
+	secondSlowRoomEvent := json.RawMessage(strings.Replace(string(testEvent), `"depth":3917`, `"depth":3918`, 1))
+	otherRoomEvent := json.RawMessage(strings.Replace(string(testEvent), "!roomid:localhost", "!other:localhost", 1))
+	eventIDs := make([]string, 0, 3)
+	for _, pdu := range []json.RawMessage{testEvent, secondSlowRoomEvent, otherRoomEvent} {
+		ev, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10).NewEventFromUntrustedJSON(pdu)
+		if err != nil {
+			t.Fatalf("failed to parse event: %v", err)
+		}
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	api := &slowRoomRsAPI{slowRoomID: "!roomid:localhost"}
+	txn := NewTxnReq(api, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{testEvent, secondSlowRoomEvent, otherRoomEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txn.processingTimeout = time.Millisecond * 100
+
+	start := time.Now()
+	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
+	assert.Less(t, time.Since(start), time.Second*5)
+
+	assert.Nil(t, jsonRes)
+	assert.Equal(t, 3, len(txnRes.PDUs))
+	for _, eventID := range eventIDs {
+		if result, ok := txnRes.PDUs[eventID]; assert.True(t, ok, "no result for %s", eventID) {
+			assert.Empty(t, result.Error, eventID)
+		}
+	}
+	// The other room is processed while the slow room is waiting, and the
+	// PDUs after the slow one are queued without waiting once we've timed out.
+	assert.ElementsMatch(t, []string{eventIDs[0], eventIDs[2]}, api.sync)
+	assert.Equal(t, []string{eventIDs[1]}, api.async)
+}
+
+func TestProcessTransactionRequestPDURejected(t *testing.T) {
+	keyRing := &test.NopJSONVerifier{}
+	txn := NewTxnReq(&slowRoomRsAPI{rejectAll: true}, nil, "ourserver", keyRing, nil, nil, false, []json.RawMessage{testEvent}, []gomatrixserverlib.EDU{}, "", "", "")
+	txnRes, jsonRes := txn.ProcessTransaction(context.Background())
+
+	assert.Nil(t, jsonRes)
+	assert.Equal(t, 1, len(txnRes.PDUs))
+	for _, result := range txnRes.PDUs {
+		assert.NotEmpty(t, result.Error)
+	}
+}
+
 func createTransactionWithEDU(ctx *process.ProcessContext, edus []gomatrixserverlib.EDU) (TxnReq, nats.JetStreamContext, *config.Dendrite) {
 	cfg := &config.Dendrite{}
 	cfg.Defaults(config.DefaultOpts{
@@ -25,6 +25,7 @@ import (
 	"sync"
 	"unicode"
 
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/mediaapi/fileutils"
 	"github.com/element-hq/dendrite/mediaapi/storage"
 	"github.com/element-hq/dendrite/mediaapi/thumbnailer"
@@ -821,6 +822,11 @@ func (r *downloadRequest) fetchRemoteFile(
 	// Attempt to download via authenticated media endpoint
 	isAuthed := true
 	resp, err := r.fedClient.DownloadMedia(ctx, r.origin, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
+	if errors.Is(err, serverpolicy.ErrServerNotAllowed) {
+		// Don't fall back to the unauthenticated endpoint for servers we
+		// aren't allowed to federate with.
+		return "", false, fmt.Errorf("file with media ID %q could not be downloaded from %s: %w", r.MediaMetadata.MediaID, r.MediaMetadata.Origin, err)
+	}
 	if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
 		isAuthed = false
 		// try again on the unauthed endpoint
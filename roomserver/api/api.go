@@ -3,6 +3,8 @@ package api
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/fclient"
@@ -45,6 +47,19 @@ func (e ErrRoomUnknownOrNotAllowed) Error() string {
 	return e.Err.Error()
 }
 
+// ErrPublicationPending is returned by PerformPublish when the room has been
+// queued for a server admin to approve, rather than published.
+var ErrPublicationPending = errors.New("publishing this room requires the approval of a server administrator, which has been requested")
+
+// ErrFullStateUnavailable is returned by WaitForFullState when fetching the
+// full state of a room that was joined with partial state has been given up
+// on, so the room is stuck with partial state until Dendrite is restarted.
+var ErrFullStateUnavailable = errors.New("the full state of the room could not be fetched")
+
+// ErrNoPublicationRequest is returned when approving or rejecting the
+// publication of a room which nobody has asked to publish.
+var ErrNoPublicationRequest = errors.New("there is no pending request to publish this room")
+
 type RestrictedJoinAPI interface {
 	CurrentStateEvent(ctx context.Context, roomID spec.RoomID, eventType string, stateKey string) (gomatrixserverlib.PDU, error)
 	InvitePending(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (bool, error)
@@ -55,6 +70,21 @@ type RestrictedJoinAPI interface {
 	LocallyJoinedUsers(ctx context.Context, roomVersion gomatrixserverlib.RoomVersion, roomNID types.RoomNID) ([]gomatrixserverlib.PDU, error)
 }
 
+// FullStateWaitTimeout is how long client requests that need the full state
+// of a room wait for a partial state join to finish before giving up.
+const FullStateWaitTimeout = time.Second * 10
+
+// PartialStateAPI reports on rooms that were joined with partial state (MSC3706).
+type PartialStateAPI interface {
+	// QueryPartialStateRoom returns the partial state information for the room,
+	// or nil if the room has full state.
+	QueryPartialStateRoom(ctx context.Context, roomID string) (*PartialStateRoom, error)
+	// WaitForFullState blocks until the room has full state or the context is
+	// done. It returns immediately if the room already has full state, and
+	// returns ErrFullStateUnavailable if fetching the full state was given up.
+	WaitForFullState(ctx context.Context, roomID string) error
+}
+
 type DefaultRoomVersionAPI interface {
 	// Returns the default room version used.
 	DefaultRoomVersion() gomatrixserverlib.RoomVersion
@@ -149,6 +179,12 @@ type QueryRoomHierarchyAPI interface {
 		hierarchyWalker *RoomHierarchyWalker,
 		err error,
 	)
+
+	// QueryRoomSummary returns a summary of the given room for the caller, as per MSC3266.
+	// Rooms which the local server is not joined to are queried over federation using the
+	// provided vias. Returns ErrRoomUnknownOrNotAllowed if the room is unknown or the caller
+	// is not allowed to preview it.
+	QueryRoomSummary(ctx context.Context, caller types.DeviceOrServerName, roomID spec.RoomID, vias []string) (*RoomSummary, error)
 }
 
 type QueryMembershipAPI interface {
@@ -170,6 +206,7 @@ type QueryMembershipAPI interface {
 // API functions required by the syncapi
 type SyncRoomserverAPI interface {
 	QueryLatestEventsAndStateAPI
+	PartialStateAPI
 	QueryBulkStateContentAPI
 	QuerySenderIDAPI
 	QueryMembershipAPI
@@ -230,6 +267,7 @@ type ClientRoomserverAPI interface {
 	UserRoomPrivateKeyCreator
 	QueryRoomHierarchyAPI
 	DefaultRoomVersionAPI
+	PartialStateAPI
 
 	QueryMembershipForUser(ctx context.Context, req *QueryMembershipForUserRequest, res *QueryMembershipForUserResponse) error
 	QueryMembershipsForRoom(ctx context.Context, req *QueryMembershipsForRoomRequest, res *QueryMembershipsForRoomResponse) error
@@ -249,6 +287,41 @@ type ClientRoomserverAPI interface {
 	PerformAdminEvacuateRoom(ctx context.Context, roomID string) (affected []string, err error)
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
+	// PerformAdminPurgeHistory starts purging old events from a room in the background,
+	// returning an ID that can be passed to QueryAdminPurgeHistoryStatus.
+	PerformAdminPurgeHistory(ctx context.Context, req *PerformPurgeHistoryRequest) (purgeID string, err error)
+	// QueryAdminPurgeHistoryStatus returns the status of a purge, or nil if the purge is unknown.
+	QueryAdminPurgeHistoryStatus(ctx context.Context, purgeID string) (*PurgeHistoryStatus, error)
+	// PerformAdminCompressState starts compressing the stored state of a room, or of
+	// every room if roomID is empty, in the background, returning an ID that can be
+	// passed to QueryAdminCompressStateStatus.
+	PerformAdminCompressState(ctx context.Context, roomID string) (jobID string, err error)
+	// QueryAdminCompressStateStatus returns the progress of a job, or nil if the job is unknown.
+	QueryAdminCompressStateStatus(ctx context.Context, jobID string) (*CompressStateStatus, error)
+	// PerformAdminCheckIntegrity starts checking the stored data of a room, or of every
+	// room if roomID is empty, in the background, returning an ID that can be passed to
+	// QueryAdminCheckIntegrityStatus.
+	PerformAdminCheckIntegrity(ctx context.Context, roomID string) (jobID string, err error)
+	// QueryAdminCheckIntegrityStatus returns the progress of a job, or nil if the job is unknown.
+	QueryAdminCheckIntegrityStatus(ctx context.Context, jobID string) (*CheckIntegrityStatus, error)
+	// PerformAdminRedactUserEvents starts redacting the events sent by a user in the background,
+	// returning an ID that can be passed to QueryAdminRedactUserEventsStatus.
+	PerformAdminRedactUserEvents(ctx context.Context, req *PerformRedactUserEventsRequest) (jobID string, err error)
+	// QueryAdminRedactUserEventsStatus returns the progress of a job, or nil if the job is unknown.
+	QueryAdminRedactUserEventsStatus(ctx context.Context, jobID string) (*RedactUserEventsStatus, error)
+	// PerformAdminBlockRoom blocks or unblocks a room. Local users can't join or be
+	// invited to a blocked room, and remote servers can't join it through this server.
+	PerformAdminBlockRoom(ctx context.Context, roomID, blockedBy string, block bool) error
+	// QueryAdminRoomBlock returns whether the room is blocked.
+	QueryAdminRoomBlock(ctx context.Context, roomID string) (*RoomBlock, error)
+	// PerformAdminDeleteRoom starts removing all local users from a room in the background,
+	// returning an ID that can be passed to QueryAdminDeleteRoomStatus.
+	PerformAdminDeleteRoom(ctx context.Context, req *PerformDeleteRoomRequest) (deleteID string, err error)
+	// QueryAdminDeleteRoomStatus returns the progress of a deletion, or nil if the deletion is unknown.
+	QueryAdminDeleteRoomStatus(ctx context.Context, deleteID string) (*DeleteRoomStatus, error)
+	// PerformAdminMergeForwardExtremities sends dummy events into a room until it has a
+	// single forward extremity, returning how many forward extremities were merged.
+	PerformAdminMergeForwardExtremities(ctx context.Context, roomID string) (merged int, err error)
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
 	AdminQueryEmptyRooms(ctx context.Context) ([]string, error)
 	PerformPeek(ctx context.Context, req *PerformPeekRequest) (roomID string, err error)
@@ -256,7 +329,20 @@ type ClientRoomserverAPI interface {
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
+	// PerformPublish publishes or unpublishes a room from the room directory. Returns
+	// ErrNotAllowed if the publication policy doesn't allow the room to be published, or
+	// ErrPublicationPending if it has to be approved by a server admin first.
 	PerformPublish(ctx context.Context, req *PerformPublishRequest) error
+	// QueryAdminPublishedRooms returns every entry in the room directory, with who published it.
+	QueryAdminPublishedRooms(ctx context.Context) ([]PublishedRoom, error)
+	// QueryAdminPublicationRequests returns the rooms waiting to be approved for the room directory.
+	QueryAdminPublicationRequests(ctx context.Context) ([]PublicationRequest, error)
+	// PerformAdminReviewPublication approves or rejects a pending request to publish a room.
+	// Returns ErrNoPublicationRequest if there is no such request.
+	PerformAdminReviewPublication(ctx context.Context, roomID, reviewedBy string, approve bool) error
+	// PerformAdminUnpublishRoom removes a room from the room directory, including entries
+	// published by application services, and rejects any pending request to publish it.
+	PerformAdminUnpublishRoom(ctx context.Context, roomID, unpublishedBy string) error
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
@@ -292,6 +378,7 @@ type UserRoomserverAPI interface {
 	QueryMembershipsForRoom(ctx context.Context, req *QueryMembershipsForRoomRequest, res *QueryMembershipsForRoomResponse) error
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
+	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
 	JoinedUserCount(ctx context.Context, roomID string) (int, error)
 }
 
@@ -304,6 +391,7 @@ type FederationRoomserverAPI interface {
 	QueryRoomHierarchyAPI
 	QueryMembershipAPI
 	UserRoomPrivateKeyCreator
+	PartialStateAPI
 	AssignRoomNID(ctx context.Context, roomID spec.RoomID, roomVersion gomatrixserverlib.RoomVersion) (roomNID types.RoomNID, err error)
 	SigningIdentityFor(ctx context.Context, roomID spec.RoomID, senderID spec.UserID) (fclient.SigningIdentity, error)
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
@@ -324,6 +412,11 @@ type FederationRoomserverAPI interface {
 	QueryRoomsForUser(ctx context.Context, userID spec.UserID, desiredMembership string) ([]spec.RoomID, error)
 	QueryRestrictedJoinAllowed(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (string, error)
 	PerformInboundPeek(ctx context.Context, req *PerformInboundPeekRequest, res *PerformInboundPeekResponse) error
+	// PerformMarkPartialStateRoom records that the room was joined with partial
+	// state and starts fetching the full state in the background.
+	PerformMarkPartialStateRoom(ctx context.Context, room PartialStateRoom) error
+	// QueryRoomBlocked returns whether an admin has blocked the room.
+	QueryRoomBlocked(ctx context.Context, roomID string) (bool, error)
 	HandleInvite(ctx context.Context, event *types.HeaderedEvent) error
 
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
@@ -9,6 +9,7 @@ package api
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/element-hq/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -18,6 +19,10 @@ import (
 // for detecting rejected events and returning 403 instead of 500ing
 const InputWasRejected = "InputWasRejected"
 
+// for detecting synchronous inputs that were queued, but not processed before
+// the wait deadline of the request
+const InputWaitTimedOut = "InputWaitTimedOut"
+
 type Kind int
 
 const (
@@ -94,6 +99,9 @@ type InputRoomEventsRequest struct {
 	InputRoomEvents []InputRoomEvent `json:"input_room_events"`
 	Asynchronous    bool             `json:"async"`
 	VirtualHost     spec.ServerName  `json:"virtual_host"`
+	// Optional deadline for waiting for synchronous inputs to be processed.
+	// Inputs that aren't processed by then are still processed later.
+	WaitDeadline time.Time `json:"wait_deadline"`
 }
 
 // InputRoomEventsResponse is a response to InputRoomEvents
@@ -51,6 +51,10 @@ const (
 	OutputTypeRetirePeek OutputType = "retire_peek"
 	// OutputTypePurgeRoom indicates the event is an OutputPurgeRoom
 	OutputTypePurgeRoom OutputType = "purge_room"
+	// OutputTypeResyncedState indicates the event is an OutputResyncedState
+	OutputTypeResyncedState OutputType = "resynced_state"
+	// OutputTypePurgeHistory indicates the event is an OutputPurgeHistory
+	OutputTypePurgeHistory OutputType = "purge_history"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -76,6 +80,10 @@ type OutputEvent struct {
 	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
 	// The content of the event with type OutputPurgeRoom
 	PurgeRoom *OutputPurgeRoom `json:"purge_room,omitempty"`
+	// The content of the event with type OutputTypeResyncedState
+	ResyncedState *OutputResyncedState `json:"resynced_state,omitempty"`
+	// The content of the event with type OutputTypePurgeHistory
+	PurgeHistory *OutputPurgeHistory `json:"purge_history,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -261,3 +269,25 @@ type OutputRetirePeek struct {
 type OutputPurgeRoom struct {
 	RoomID string
 }
+
+// An OutputResyncedState is written when the full state of a room that was
+// joined with partial state (MSC3706) has been fetched. The state events are
+// added to the current state of the room, but only where the partial state
+// had nothing for the same type and state key, so no existing current state
+// is replaced.
+type OutputResyncedState struct {
+	RoomID string
+	// The state event IDs that were added to the current state of the room.
+	AddsStateEventIDs []string
+	// The state event IDs that were removed from the current state of the
+	// room, because they were soft-failed once the full state was known.
+	RemovesStateEventIDs []string
+}
+
+// An OutputPurgeHistory is written when old events have been purged from a
+// room. Large purges are split over several of these.
+type OutputPurgeHistory struct {
+	RoomID string
+	// The IDs of the events that were removed from the room.
+	EventIDs []string
+}
@@ -141,6 +141,30 @@ type PerformPublishRequest struct {
 	Visibility   string
 	AppserviceID string
 	NetworkID    string
+	// The user who asked for the room to be published or unpublished. If set,
+	// and the request isn't from an application service, the publication
+	// policy of the server decides whether the room may be published.
+	UserID string
+}
+
+// PublishedRoom is an entry in the room directory, as returned by
+// QueryAdminPublishedRooms.
+type PublishedRoom struct {
+	RoomID       string `json:"room_id"`
+	AppserviceID string `json:"appservice_id,omitempty"`
+	NetworkID    string `json:"network_id,omitempty"`
+	// The user who published the room, which is empty if the room was
+	// published automatically, e.g. when a published room was upgraded.
+	PublishedBy string         `json:"published_by,omitempty"`
+	PublishedTS spec.Timestamp `json:"published_ts,omitempty"`
+}
+
+// PublicationRequest is a room waiting for a server admin to approve its
+// publication in the room directory.
+type PublicationRequest struct {
+	RoomID      string         `json:"room_id"`
+	RequestedBy string         `json:"requested_by"`
+	RequestedTS spec.Timestamp `json:"requested_ts"`
 }
 
 type PerformInboundPeekRequest struct {
@@ -172,3 +196,152 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformPurgeHistoryRequest is a request to PerformAdminPurgeHistory. Exactly
+// one of BeforeEventID and BeforeTS should be set.
+type PerformPurgeHistoryRequest struct {
+	RoomID string `json:"room_id"`
+	// Purge the events that are topologically older than this event.
+	BeforeEventID string `json:"before_event_id,omitempty"`
+	// Purge the events that were sent before this time.
+	BeforeTS spec.Timestamp `json:"before_ts,omitempty"`
+	// Whether to purge events sent by local users too.
+	DeleteLocalEvents bool `json:"delete_local_events"`
+}
+
+const (
+	PurgeHistoryStatusActive   = "active"
+	PurgeHistoryStatusComplete = "complete"
+	PurgeHistoryStatusFailed   = "failed"
+)
+
+// PurgeHistoryStatus is the status of a purge started with PerformAdminPurgeHistory.
+type PurgeHistoryStatus struct {
+	PurgeID      string `json:"purge_id"`
+	RoomID       string `json:"room_id"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+	PurgedEvents int    `json:"purged_events"`
+}
+
+const (
+	CompressStateStatusActive   = "active"
+	CompressStateStatusComplete = "complete"
+	CompressStateStatusFailed   = "failed"
+)
+
+// CompressStateStatus is the progress of a job started with PerformAdminCompressState.
+type CompressStateStatus struct {
+	JobID string `json:"job_id"`
+	// The room being compressed, or empty if every room is.
+	RoomID     string `json:"room_id,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	RoomsTotal int    `json:"rooms_total"`
+	RoomsDone  int    `json:"rooms_done"`
+	types.StateCompressionResult
+}
+
+const (
+	CheckIntegrityStatusActive   = "active"
+	CheckIntegrityStatusComplete = "complete"
+	CheckIntegrityStatusFailed   = "failed"
+)
+
+// CheckIntegrityStatus is the progress of a job started with PerformAdminCheckIntegrity.
+type CheckIntegrityStatus struct {
+	JobID string `json:"job_id"`
+	// The room being checked, or empty if every room is.
+	RoomID     string `json:"room_id,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	RoomsTotal int    `json:"rooms_total"`
+	RoomsDone  int    `json:"rooms_done"`
+	// The reports of the rooms in which problems were found.
+	Reports []types.RoomIntegrityReport `json:"reports"`
+}
+
+// RoomBlock is whether an admin has blocked a room, as returned by QueryAdminRoomBlock.
+type RoomBlock struct {
+	RoomID    string         `json:"room_id"`
+	Blocked   bool           `json:"block"`
+	BlockedBy string         `json:"user_id,omitempty"`
+	BlockedTS spec.Timestamp `json:"blocked_ts,omitempty"`
+}
+
+// PerformDeleteRoomRequest is a request to PerformAdminDeleteRoom.
+type PerformDeleteRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// The admin who asked for the room to be deleted.
+	RequestedBy string `json:"requested_by"`
+	// Whether to block the room, so that local users can't join it again.
+	Block bool `json:"block"`
+	// Whether to purge the room from the database once local users have left.
+	Purge bool `json:"purge"`
+	// If set, local users are moved into a new room created by this local user,
+	// which has the given name and in which the given message is sent.
+	NewRoomUserID string `json:"new_room_user_id,omitempty"`
+	NewRoomName   string `json:"room_name,omitempty"`
+	Message       string `json:"message,omitempty"`
+}
+
+const (
+	DeleteRoomStatusActive   = "active"
+	DeleteRoomStatusComplete = "complete"
+	DeleteRoomStatusFailed   = "failed"
+)
+
+// DeleteRoomStatus is the progress of a deletion started with PerformAdminDeleteRoom.
+type DeleteRoomStatus struct {
+	DeleteID  string `json:"delete_id"`
+	RoomID    string `json:"room_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	NewRoomID string `json:"new_room_id,omitempty"`
+	// The local users that were joined to the room when the deletion started.
+	UsersTotal        int      `json:"users_total"`
+	KickedUsers       []string `json:"kicked_users"`
+	FailedToKickUsers []string `json:"failed_to_kick_users"`
+	Purged            bool     `json:"purged"`
+}
+
+// PerformRedactUserEventsRequest is a request to PerformAdminRedactUserEvents.
+type PerformRedactUserEventsRequest struct {
+	// The user whose events are redacted, who doesn't have to be local.
+	UserID string `json:"user_id"`
+	// The admin who asked for the events to be redacted.
+	RequestedBy string `json:"requested_by"`
+	// The rooms to redact events in, or every room the user is or was
+	// joined to if empty.
+	RoomIDs []string `json:"room_ids,omitempty"`
+	// Only events sent between these times are redacted. Zero means no bound.
+	Since spec.Timestamp `json:"since_ts,omitempty"`
+	Until spec.Timestamp `json:"until_ts,omitempty"`
+	// The reason given in the redactions.
+	Reason string `json:"reason,omitempty"`
+	// How many redactions are sent per second, between 0.01 and 1000, or zero
+	// for the default.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+}
+
+const (
+	RedactUserEventsStatusActive   = "active"
+	RedactUserEventsStatusComplete = "complete"
+	RedactUserEventsStatusFailed   = "failed"
+)
+
+// RedactUserEventsStatus is the progress of a job started with PerformAdminRedactUserEvents.
+type RedactUserEventsStatus struct {
+	JobID      string `json:"job_id"`
+	UserID     string `json:"user_id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	RoomsTotal int    `json:"rooms_total"`
+	RoomsDone  int    `json:"rooms_done"`
+	// How many events were found, redacted, and failed to be redacted so far.
+	EventsFound    int `json:"events_found"`
+	EventsRedacted int `json:"events_redacted"`
+	EventsFailed   int `json:"events_failed"`
+	// The rooms in which no local user is allowed to redact the events.
+	SkippedRooms []string `json:"skipped_rooms"`
+}
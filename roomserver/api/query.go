@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 
@@ -569,3 +570,29 @@ func (s RoomSet) Copy() RoomSet {
 	}
 	return copied
 }
+
+// RoomSummary is the result of a room summary query, as defined by MSC3266.
+//
+// It extends the public room chunk with the information a client needs to
+// preview a room before joining it.
+type RoomSummary struct {
+	fclient.PublicRoom
+	RoomType       string                        `json:"room_type,omitempty"`
+	RoomVersion    gomatrixserverlib.RoomVersion `json:"room_version,omitempty"`
+	Encryption     string                        `json:"encryption,omitempty"`
+	AllowedRoomIDs []string                      `json:"allowed_room_ids,omitempty"`
+	// The membership of the caller in the room, if any.
+	Membership string `json:"membership,omitempty"`
+}
+
+// PartialStateRoom describes a room that was joined with partial state
+// (MSC3706) and for which the full state is still being fetched.
+type PartialStateRoom struct {
+	RoomID string `json:"room_id"`
+	// The ID of the join event that the partial state was received with.
+	JoinEventID string `json:"join_event_id"`
+	// The servers that the resident server said were in the room at the
+	// time of the join, which are used to send events until the full
+	// membership of the room is known.
+	ServersInRoom []spec.ServerName `json:"servers_in_room"`
+}
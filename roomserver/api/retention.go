@@ -0,0 +1,49 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+)
+
+// MRoomRetention is the type of the state event which holds the message
+// retention policy of a room.
+const MRoomRetention = "m.room.retention"
+
+// RetentionMaxLifetime returns how long events are kept in a room with the
+// given m.room.retention event, which is nil if the room doesn't have one.
+// Returns zero if events should be kept forever.
+//
+// Rooms without a max_lifetime of their own use the default policy from the
+// config, and the result is always clamped to the allowed lifetimes.
+func RetentionMaxLifetime(cfg *config.Retention, retentionEvent *types.HeaderedEvent) time.Duration {
+	if cfg == nil || !cfg.Enabled {
+		return 0
+	}
+	lifetime := cfg.DefaultPolicy.MaxLifetime
+	if retentionEvent != nil {
+		var content struct {
+			MaxLifetime *int64 `json:"max_lifetime"`
+		}
+		if err := json.Unmarshal(retentionEvent.Content(), &content); err == nil && content.MaxLifetime != nil && *content.MaxLifetime > 0 {
+			lifetime = time.Duration(*content.MaxLifetime) * time.Millisecond
+		}
+	}
+	if lifetime <= 0 {
+		return 0
+	}
+	if cfg.AllowedLifetimeMin > 0 && lifetime < cfg.AllowedLifetimeMin {
+		lifetime = cfg.AllowedLifetimeMin
+	}
+	if cfg.AllowedLifetimeMax > 0 && lifetime > cfg.AllowedLifetimeMax {
+		lifetime = cfg.AllowedLifetimeMax
+	}
+	return lifetime
+}
@@ -0,0 +1,495 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+// Package integrity checks that the data which the roomserver has stored for
+// a room is consistent.
+package integrity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/state"
+	"github.com/element-hq/dendrite/roomserver/storage"
+	"github.com/element-hq/dendrite/roomserver/types"
+)
+
+// batchSize is how many events or state snapshots are loaded at a time.
+const batchSize = 100
+
+// CheckRoom checks the data stored for a room: that the auth events of every
+// event are stored, that state snapshots only refer to stored state blocks,
+// that the current state matches the state resolved from the forward
+// extremities, and that the membership table agrees with the current state.
+// Problems are listed in the report rather than returned as errors. If the
+// room changes while it is being checked, the report may describe a mix of the
+// room before and after the change.
+func CheckRoom(
+	ctx context.Context,
+	db storage.Database,
+	querier api.QuerySenderIDAPI,
+	roomID string,
+) (*types.RoomIntegrityReport, error) {
+	roomInfo, err := db.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("db.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, eventutil.ErrRoomNoExists{}
+	}
+
+	c := &checker{
+		db:       db,
+		roomInfo: roomInfo,
+		stateRes: state.NewStateResolution(db, roomInfo, querier),
+		report: &types.RoomIntegrityReport{
+			RoomID:   roomID,
+			Problems: []types.IntegrityProblem{},
+		},
+		brokenSnapshots: map[types.StateSnapshotNID]struct{}{},
+	}
+	if err = c.checkAuthEvents(ctx); err != nil {
+		return nil, err
+	}
+	if err = c.checkStateSnapshots(ctx); err != nil {
+		return nil, err
+	}
+	current, err := c.checkCurrentState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		if err = c.checkMemberships(ctx, current); err != nil {
+			return nil, err
+		}
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	db       storage.Database
+	roomInfo *types.RoomInfo
+	stateRes state.StateResolution
+	report   *types.RoomIntegrityReport
+	// The state snapshots which are missing, or refer to missing state blocks.
+	brokenSnapshots map[types.StateSnapshotNID]struct{}
+}
+
+func (c *checker) problem(problem types.IntegrityProblem) {
+	c.report.Problems = append(c.report.Problems, problem)
+}
+
+// checkAuthEvents checks that the auth events of every event in the room are stored.
+func (c *checker) checkAuthEvents(ctx context.Context) error {
+	eventNIDs, err := c.db.RoomEventNIDsBeforeDepth(ctx, c.roomInfo.RoomNID, math.MaxInt64)
+	if err != nil {
+		return fmt.Errorf("c.db.RoomEventNIDsBeforeDepth: %w", err)
+	}
+	c.report.Events = len(eventNIDs)
+
+	for start := 0; start < len(eventNIDs); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		end := min(start+batchSize, len(eventNIDs))
+		events, err := c.loadEvents(ctx, eventNIDs[start:end])
+		if err != nil {
+			return err
+		}
+		authEventIDMap := map[string]struct{}{}
+		for _, event := range events {
+			for _, authEventID := range event.AuthEventIDs() {
+				authEventIDMap[authEventID] = struct{}{}
+			}
+		}
+		if len(authEventIDMap) == 0 {
+			continue
+		}
+		authEventIDs := make([]string, 0, len(authEventIDMap))
+		for authEventID := range authEventIDMap {
+			authEventIDs = append(authEventIDs, authEventID)
+		}
+		stored, err := c.db.EventNIDs(ctx, authEventIDs)
+		if err != nil {
+			return fmt.Errorf("c.db.EventNIDs: %w", err)
+		}
+		for _, event := range events {
+			for _, authEventID := range event.AuthEventIDs() {
+				if _, ok := stored[authEventID]; ok {
+					continue
+				}
+				c.problem(types.IntegrityProblem{
+					Kind:            types.IntegrityMissingAuthEvent,
+					EventID:         event.EventID(),
+					ExpectedEventID: authEventID,
+					Detail:          fmt.Sprintf("auth event %s is not stored", authEventID),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// loadEvents loads the given events. Events which can't be loaded are added
+// to the report and left out, rather than failing the whole batch.
+func (c *checker) loadEvents(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error) {
+	events, err := c.db.Events(ctx, c.roomInfo.RoomVersion, eventNIDs)
+	if err == nil {
+		return events, nil
+	}
+
+	// Work out which of the events can't be loaded.
+	eventIDs, err := c.db.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("c.db.EventIDs: %w", err)
+	}
+	events = make([]types.Event, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		loaded, err := c.db.Events(ctx, c.roomInfo.RoomVersion, []types.EventNID{eventNID})
+		if err != nil {
+			c.problem(types.IntegrityProblem{
+				Kind:    types.IntegrityUnreadableEvent,
+				EventID: eventIDs[eventNID],
+				Detail:  fmt.Sprintf("event %d can't be loaded: %s", eventNID, err),
+			})
+			continue
+		}
+		events = append(events, loaded...)
+	}
+	return events, nil
+}
+
+// checkStateSnapshots checks that the state snapshots referred to by events
+// and by the current state are stored, and that every state snapshot of the
+// room only refers to stored state blocks.
+func (c *checker) checkStateSnapshots(ctx context.Context) error {
+	stateNIDs, err := c.db.RoomStateSnapshotNIDs(ctx, c.roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("c.db.RoomStateSnapshotNIDs: %w", err)
+	}
+	c.report.Snapshots = len(stateNIDs)
+	stored := make(map[types.StateSnapshotNID]struct{}, len(stateNIDs))
+	for _, stateNID := range stateNIDs {
+		stored[stateNID] = struct{}{}
+	}
+
+	eventStateNIDs, err := c.db.RoomEventStateSnapshotNIDs(ctx, c.roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("c.db.RoomEventStateSnapshotNIDs: %w", err)
+	}
+	var missing []types.EventNID
+	for eventNID, stateNID := range eventStateNIDs {
+		if _, ok := stored[stateNID]; !ok {
+			missing = append(missing, eventNID)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+		eventIDs, err := c.db.EventIDs(ctx, missing)
+		if err != nil {
+			return fmt.Errorf("c.db.EventIDs: %w", err)
+		}
+		for _, eventNID := range missing {
+			stateNID := eventStateNIDs[eventNID]
+			c.brokenSnapshots[stateNID] = struct{}{}
+			c.problem(types.IntegrityProblem{
+				Kind:             types.IntegrityMissingStateSnapshot,
+				EventID:          eventIDs[eventNID],
+				StateSnapshotNID: stateNID,
+				Detail:           fmt.Sprintf("the state before the event refers to state snapshot %d, which is not stored", stateNID),
+			})
+		}
+	}
+	_, currentNID, _, err := c.db.LatestEventIDs(ctx, c.roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("c.db.LatestEventIDs: %w", err)
+	}
+	if currentNID != 0 {
+		if _, ok := stored[currentNID]; !ok {
+			c.brokenSnapshots[currentNID] = struct{}{}
+			c.problem(types.IntegrityProblem{
+				Kind:             types.IntegrityMissingStateSnapshot,
+				StateSnapshotNID: currentNID,
+				Detail:           fmt.Sprintf("the current state refers to state snapshot %d, which is not stored", currentNID),
+			})
+		}
+	}
+
+	// Whether each state block which has been looked at is stored.
+	blocks := map[types.StateBlockNID]bool{}
+	for start := 0; start < len(stateNIDs); start += batchSize {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		end := min(start+batchSize, len(stateNIDs))
+		blockLists, err := c.db.StateBlockNIDs(ctx, stateNIDs[start:end])
+		if err != nil {
+			return fmt.Errorf("c.db.StateBlockNIDs: %w", err)
+		}
+		var unchecked []types.StateBlockNID
+		for _, blockList := range blockLists {
+			for _, blockNID := range blockList.StateBlockNIDs {
+				if _, ok := blocks[blockNID]; !ok {
+					blocks[blockNID] = true
+					unchecked = append(unchecked, blockNID)
+				}
+			}
+		}
+		if err = c.findMissingStateBlocks(ctx, unchecked, blocks); err != nil {
+			return err
+		}
+		for _, blockList := range blockLists {
+			for _, blockNID := range blockList.StateBlockNIDs {
+				if blocks[blockNID] {
+					continue
+				}
+				c.brokenSnapshots[blockList.StateSnapshotNID] = struct{}{}
+				c.problem(types.IntegrityProblem{
+					Kind:             types.IntegrityMissingStateBlock,
+					StateSnapshotNID: blockList.StateSnapshotNID,
+					StateBlockNID:    blockNID,
+					Detail:           fmt.Sprintf("state snapshot %d refers to state block %d, which is not stored", blockList.StateSnapshotNID, blockNID),
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// findMissingStateBlocks marks the given state blocks which aren't stored as
+// false in blocks.
+func (c *checker) findMissingStateBlocks(
+	ctx context.Context, blockNIDs []types.StateBlockNID, blocks map[types.StateBlockNID]bool,
+) error {
+	if len(blockNIDs) == 0 {
+		return nil
+	}
+	var missingErr types.MissingStateError
+	_, err := c.db.StateEntries(ctx, blockNIDs)
+	if err == nil {
+		return nil
+	}
+	if !errors.As(err, &missingErr) {
+		return fmt.Errorf("c.db.StateEntries: %w", err)
+	}
+	// Some of the blocks are missing, so work out which ones.
+	for _, blockNID := range blockNIDs {
+		_, err = c.db.StateEntries(ctx, []types.StateBlockNID{blockNID})
+		switch {
+		case err == nil:
+		case errors.As(err, &missingErr):
+			blocks[blockNID] = false
+		default:
+			return fmt.Errorf("c.db.StateEntries: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkCurrentState resolves the state after the forward extremities of the
+// room and compares it with the current state. Returns the current state, or
+// nil if it can't be loaded.
+func (c *checker) checkCurrentState(ctx context.Context) ([]types.StateEntry, error) {
+	latestEventIDs, currentNID, _, err := c.db.LatestEventIDs(ctx, c.roomInfo.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("c.db.LatestEventIDs: %w", err)
+	}
+	if _, ok := c.brokenSnapshots[currentNID]; ok {
+		return nil, nil
+	}
+	var current []types.StateEntry
+	if currentNID != 0 {
+		if current, err = c.stateRes.LoadStateAtSnapshot(ctx, currentNID); err != nil {
+			return nil, fmt.Errorf("c.stateRes.LoadStateAtSnapshot: %w", err)
+		}
+	}
+
+	prevStates, err := c.db.StateAtEventIDs(ctx, latestEventIDs)
+	if err != nil {
+		c.problem(types.IntegrityProblem{
+			Kind:   types.IntegrityUnresolvableState,
+			Detail: fmt.Sprintf("the state at the forward extremities can't be loaded: %s", err),
+		})
+		return current, nil
+	}
+	for _, prevState := range prevStates {
+		// The missing snapshot has been reported already.
+		if _, ok := c.brokenSnapshots[prevState.BeforeStateSnapshotNID]; ok {
+			return current, nil
+		}
+	}
+	resolved, err := c.stateRes.CalculateStateAfterEvents(ctx, prevStates)
+	if err != nil {
+		c.problem(types.IntegrityProblem{
+			Kind:   types.IntegrityUnresolvableState,
+			Detail: fmt.Sprintf("the state at the forward extremities can't be resolved: %s", err),
+		})
+		return current, nil
+	}
+
+	currentEvents := stateEventNIDs(current)
+	resolvedEvents := stateEventNIDs(resolved)
+	var differing []types.StateKeyTuple
+	for tuple, eventNID := range currentEvents {
+		if resolvedEvents[tuple] != eventNID {
+			differing = append(differing, tuple)
+		}
+	}
+	for tuple := range resolvedEvents {
+		if _, ok := currentEvents[tuple]; !ok {
+			differing = append(differing, tuple)
+		}
+	}
+	if len(differing) == 0 {
+		return current, nil
+	}
+	sort.Slice(differing, func(i, j int) bool { return differing[i].LessThan(differing[j]) })
+
+	var eventNIDs []types.EventNID
+	for _, tuple := range differing {
+		for _, eventNID := range []types.EventNID{currentEvents[tuple], resolvedEvents[tuple]} {
+			if eventNID != 0 {
+				eventNIDs = append(eventNIDs, eventNID)
+			}
+		}
+	}
+	eventIDs, events, err := c.describeEvents(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, tuple := range differing {
+		currentNID, resolvedNID := currentEvents[tuple], resolvedEvents[tuple]
+		problem := types.IntegrityProblem{
+			Kind:            types.IntegrityCurrentStateMismatch,
+			EventID:         eventIDs[currentNID],
+			ExpectedEventID: eventIDs[resolvedNID],
+			Detail: fmt.Sprintf(
+				"the current state has %s, but resolving the state at the forward extremities gives %s",
+				describeEventID(eventIDs[currentNID]), describeEventID(eventIDs[resolvedNID]),
+			),
+		}
+		for _, eventNID := range []types.EventNID{currentNID, resolvedNID} {
+			if event, ok := events[eventNID]; ok {
+				problem.EventType = event.Type()
+				problem.StateKey = event.StateKey()
+				break
+			}
+		}
+		c.problem(problem)
+	}
+	return current, nil
+}
+
+// checkMemberships checks that the membership table agrees with the
+// membership events in the current state.
+func (c *checker) checkMemberships(ctx context.Context, current []types.StateEntry) error {
+	rows, err := c.db.RoomMembershipEventNIDs(ctx, c.roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("c.db.RoomMembershipEventNIDs: %w", err)
+	}
+	inState := map[types.EventStateKeyNID]types.EventNID{}
+	for _, entry := range current {
+		if entry.EventTypeNID == types.MRoomMemberNID {
+			inState[entry.EventStateKeyNID] = entry.EventNID
+		}
+	}
+
+	var differing []types.EventStateKeyNID
+	for targetNID, eventNID := range rows {
+		if inState[targetNID] != eventNID {
+			differing = append(differing, targetNID)
+		}
+	}
+	for targetNID := range inState {
+		if _, ok := rows[targetNID]; !ok {
+			differing = append(differing, targetNID)
+		}
+	}
+	if len(differing) == 0 {
+		return nil
+	}
+	sort.Slice(differing, func(i, j int) bool { return differing[i] < differing[j] })
+
+	stateKeys, err := c.db.EventStateKeys(ctx, differing)
+	if err != nil {
+		return fmt.Errorf("c.db.EventStateKeys: %w", err)
+	}
+	var eventNIDs []types.EventNID
+	for _, targetNID := range differing {
+		for _, eventNID := range []types.EventNID{rows[targetNID], inState[targetNID]} {
+			if eventNID != 0 {
+				eventNIDs = append(eventNIDs, eventNID)
+			}
+		}
+	}
+	eventIDs, _, err := c.describeEvents(ctx, eventNIDs)
+	if err != nil {
+		return err
+	}
+	for _, targetNID := range differing {
+		stateKey := stateKeys[targetNID]
+		c.problem(types.IntegrityProblem{
+			Kind:            types.IntegrityMembershipMismatch,
+			EventID:         eventIDs[rows[targetNID]],
+			ExpectedEventID: eventIDs[inState[targetNID]],
+			EventType:       spec.MRoomMember,
+			StateKey:        &stateKey,
+			Detail: fmt.Sprintf(
+				"the membership table has %s, but the current state has %s",
+				describeEventID(eventIDs[rows[targetNID]]), describeEventID(eventIDs[inState[targetNID]]),
+			),
+		})
+	}
+	return nil
+}
+
+// describeEvents returns the IDs of the given events, along with the events
+// themselves where they can be loaded.
+func (c *checker) describeEvents(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (map[types.EventNID]string, map[types.EventNID]gomatrixserverlib.PDU, error) {
+	eventIDs, err := c.db.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("c.db.EventIDs: %w", err)
+	}
+	events := make(map[types.EventNID]gomatrixserverlib.PDU, len(eventNIDs))
+	loaded, err := c.db.Events(ctx, c.roomInfo.RoomVersion, eventNIDs)
+	if err != nil {
+		// Some of the events can't be loaded, so load them one at a time.
+		loaded = loaded[:0]
+		for _, eventNID := range eventNIDs {
+			if event, err := c.db.Events(ctx, c.roomInfo.RoomVersion, []types.EventNID{eventNID}); err == nil {
+				loaded = append(loaded, event...)
+			}
+		}
+	}
+	for _, event := range loaded {
+		events[event.EventNID] = event.PDU
+	}
+	return eventIDs, events, nil
+}
+
+func stateEventNIDs(entries []types.StateEntry) map[types.StateKeyTuple]types.EventNID {
+	result := make(map[types.StateKeyTuple]types.EventNID, len(entries))
+	for _, entry := range entries {
+		result[entry.StateKeyTuple] = entry.EventNID
+	}
+	return result
+}
+
+func describeEventID(eventID string) string {
+	if eventID == "" {
+		return "no event"
+	}
+	return eventID
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"crypto/ed25519"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -45,6 +46,7 @@ type RoomserverInternalAPI struct {
 	*perform.Upgrader
 	*perform.Admin
 	*perform.Creator
+	*perform.PartialStateResyncer
 	ProcessContext         *process.ProcessContext
 	DB                     storage.Database
 	Cfg                    *config.Dendrite
@@ -173,7 +175,9 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		Inputer: r.Inputer,
 	}
 	r.Publisher = &perform.Publisher{
-		DB: r.DB,
+		DB:      r.DB,
+		Cfg:     &r.Cfg.RoomServer,
+		Queryer: r.Queryer,
 	}
 	r.Backfiller = &perform.Backfiller{
 		IsLocalServerName: r.Cfg.Global.IsLocalServerName,
@@ -190,8 +194,9 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		DB: r.DB,
 	}
 	r.Upgrader = &perform.Upgrader{
-		Cfg:    &r.Cfg.RoomServer,
-		URSAPI: r,
+		Cfg:            &r.Cfg.RoomServer,
+		ProcessContext: r.ProcessContext,
+		URSAPI:         r,
 	}
 	r.Admin = &perform.Admin{
 		DB:      r.DB,
@@ -199,16 +204,61 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		Inputer: r.Inputer,
 		Queryer: r.Queryer,
 		Leaver:  r.Leaver,
+		RSAPI:   r,
 	}
 	r.Creator = &perform.Creator{
 		DB:    r.DB,
 		Cfg:   &r.Cfg.RoomServer,
 		RSAPI: r,
 	}
+	r.PartialStateResyncer = &perform.PartialStateResyncer{
+		DB:             r.DB,
+		Cfg:            &r.Cfg.RoomServer,
+		Queryer:        r.Queryer,
+		Inputer:        r.Inputer,
+		ProcessContext: r.ProcessContext,
+	}
 
 	if err := r.Inputer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start roomserver input API")
 	}
+
+	// Carry on fetching the full state for any rooms that were still
+	// waiting for it when we last shut down.
+	if err := r.PartialStateResyncer.ResumeResyncs(r.ProcessContext.Context()); err != nil {
+		logrus.WithError(err).Error("failed to resume partial state room resyncs")
+	}
+
+	// Periodically purge the events which have outlived the retention
+	// policy of their room.
+	if retention := r.Cfg.RoomServer.Retention; retention.Enabled {
+		go r.purgeExpiredEvents(retention.PurgeInterval)
+	}
+}
+
+// purgeExpiredEvents purges the events which have outlived the retention
+// policy of their room shortly after startup, and then every interval, until
+// the process shuts down.
+func (r *RoomserverInternalAPI) purgeExpiredEvents(interval time.Duration) {
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	select {
+	case <-r.ProcessContext.Context().Done():
+		return
+	case <-timer.C:
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Admin.PurgeExpiredEvents(r.ProcessContext.Context()); err != nil {
+			logrus.WithError(err).Error("Failed to purge expired events")
+		}
+		select {
+		case <-r.ProcessContext.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func (r *RoomserverInternalAPI) SetUserAPI(userAPI userapi.RoomserverUserAPI) {
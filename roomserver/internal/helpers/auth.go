@@ -79,6 +79,27 @@ func CheckForSoftFail(
 	return false, nil
 }
 
+// CheckAllowedByState checks whether the event is allowed by the given state,
+// e.g. the state before the event. The rejection error is set if it isn't,
+// and the returned error only if the state couldn't be loaded.
+func CheckAllowedByState(
+	ctx context.Context,
+	db state.StateResolutionStorage,
+	roomVersion gomatrixserverlib.RoomVersion,
+	event gomatrixserverlib.PDU,
+	stateEntries []types.StateEntry,
+	querier api.QuerySenderIDAPI,
+) (rejectionErr error, err error) {
+	stateNeeded := gomatrixserverlib.StateNeededForAuth([]gomatrixserverlib.PDU{event})
+	authEvents, err := loadAuthEvents(ctx, db, roomVersion, stateNeeded, stateEntries)
+	if err != nil {
+		return nil, fmt.Errorf("loadAuthEvents: %w", err)
+	}
+	return gomatrixserverlib.Allowed(event, &authEvents, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return querier.QueryUserIDForSender(ctx, roomID, senderID)
+	}), nil
+}
+
 // GetAuthEvents returns the numeric IDs for the auth events.
 func GetAuthEvents(
 	ctx context.Context,
@@ -13,6 +13,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	userapi "github.com/element-hq/dendrite/userapi/api"
@@ -81,6 +82,7 @@ type Inputer struct {
 	InputRoomEventTopic string
 	OutputProducer      *producers.RoomEventProducer
 	workers             sync.Map // room ID -> *worker
+	merging             sync.Map // room ID -> struct{}, while merging forward extremities
 
 	Queryer       *query.Queryer
 	UserAPI       userapi.RoomserverUserAPI
@@ -104,6 +106,48 @@ type worker struct {
 	ephemeralSeq uint64
 	// last seq we fully processed
 	durableSeq uint64
+	// held while an event is being processed, or while the room is being
+	// changed outside of the input stream, so that the two never interleave
+	processing sync.Mutex
+	// incremented whenever processing is locked or unlocked, so it is odd
+	// while the room is being changed, see RoomChanges
+	changes atomic.Uint64
+}
+
+func (w *worker) lockProcessing() {
+	w.processing.Lock()
+	w.changes.Add(1)
+}
+
+func (w *worker) unlockProcessing() {
+	w.changes.Add(1)
+	w.processing.Unlock()
+}
+
+// LockRoom stops events for the given room from being processed until the
+// returned function is called. It is used by operations which change the room
+// outside of the input stream, so that they don't race with incoming events.
+func (r *Inputer) LockRoom(roomID string) (unlock func()) {
+	v, _ := r.workers.LoadOrStore(roomID, &worker{
+		r:         r,
+		roomID:    roomID,
+		sentryHub: sentry.CurrentHub().Clone(),
+	})
+	w := v.(*worker)
+	w.lockProcessing()
+	return w.unlockProcessing
+}
+
+// RoomChanges returns a counter which changes whenever the given room is
+// locked or unlocked for changes, see LockRoom, and which is odd while the room
+// is locked. Reads of the room that start and end with the same even counter
+// didn't interleave with any changes, so they don't need to hold the lock.
+func (r *Inputer) RoomChanges(roomID string) uint64 {
+	v, ok := r.workers.Load(roomID)
+	if !ok {
+		return 0
+	}
+	return v.(*worker).changes.Load()
 }
 
 func (r *Inputer) startWorkerForRoom(roomID string, seq uint64) {
@@ -365,11 +409,14 @@ func (w *worker) _next() {
 	// it was a synchronous request.
 	var errString string
 	wasRejected := false
-	if err = w.r.processRoomEvent(
+	w.lockProcessing()
+	err = w.r.processRoomEvent(
 		w.r.ProcessContext.Context(),
 		spec.ServerName(msg.Header.Get("virtual_host")),
 		&inputRoomEvent,
-	); err != nil {
+	)
+	w.unlockProcessing()
+	if err != nil {
 		switch err.(type) {
 		case types.RejectedError:
 			// Don't send events that were rejected to Sentry
@@ -503,9 +550,20 @@ func (r *Inputer) InputRoomEvents(
 	// input we submitted. The last error value we receive will
 	// be the one returned as the error string.
 	defer replySub.Drain() // nolint:errcheck
+	waitCtx := ctx
+	if !request.WaitDeadline.IsZero() {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithDeadline(ctx, request.WaitDeadline)
+		defer cancel()
+	}
 	for i := 0; i < len(request.InputRoomEvents); i++ {
-		msg, err := replySub.NextMsgWithContext(ctx)
+		msg, err := replySub.NextMsgWithContext(waitCtx)
 		if err != nil {
+			if ctx.Err() == nil && waitCtx.Err() != nil {
+				// The inputs are queued and will still be processed.
+				response.ErrMsg = api.InputWaitTimedOut
+				return
+			}
 			response.ErrMsg = err.Error()
 			return
 		}
@@ -328,8 +328,23 @@ func (r *Inputer) processRoomEvent(
 		}
 	}
 
+	// If the room was joined with partial state (MSC3706) then we don't know
+	// the full state of the room yet, so the checks against the current state
+	// and the state before the event could wrongly fail, e.g. because the
+	// membership event of the sender was omitted from the join response. We
+	// only auth such events against their auth events. They are checked
+	// again once the full state arrives, see MergeFullState.
+	partialState := false
+	if roomInfo != nil && input.Kind != api.KindOutlier {
+		var joinEventID string
+		if joinEventID, _, err = r.DB.GetRoomPartialState(ctx, roomInfo.RoomNID); err != nil {
+			return fmt.Errorf("r.DB.GetRoomPartialState: %w", err)
+		}
+		partialState = joinEventID != ""
+	}
+
 	var softfail bool
-	if input.Kind == api.KindNew && !isCreateEvent {
+	if input.Kind == api.KindNew && !isCreateEvent && !partialState {
 		// Check that the event passes authentication checks based on the
 		// current room state.
 		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, roomInfo, headered, input.StateEventIDs, r.Queryer)
@@ -344,7 +359,7 @@ func (r *Inputer) processRoomEvent(
 	// burning CPU time.
 	historyVisibility := gomatrixserverlib.HistoryVisibilityShared // Default to shared.
 	if input.Kind != api.KindOutlier && rejectionErr == nil && !isRejected && !isCreateEvent {
-		historyVisibility, rejectionErr, err = r.processStateBefore(ctx, roomInfo, input, missingPrev)
+		historyVisibility, rejectionErr, err = r.processStateBefore(ctx, roomInfo, input, missingPrev, partialState)
 		if err != nil {
 			return fmt.Errorf("r.processStateBefore: %w", err)
 		}
@@ -570,7 +585,7 @@ func (r *Inputer) processStateBefore(
 	ctx context.Context,
 	roomInfo *types.RoomInfo,
 	input *api.InputRoomEvent,
-	missingPrev bool,
+	missingPrev, partialState bool,
 ) (historyVisibility gomatrixserverlib.HistoryVisibility, rejectionErr error, err error) {
 	historyVisibility = gomatrixserverlib.HistoryVisibilityShared // Default to shared.
 	event := input.Event.PDU
@@ -640,20 +655,24 @@ func (r *Inputer) processStateBefore(
 	}
 	// At this point, stateBeforeEvent should be populated either by
 	// the supplied state in the input request, or from the prev events.
-	// Check whether the event is allowed or not.
-	var stateBeforeAuth *gomatrixserverlib.AuthEvents
-	stateBeforeAuth, err = gomatrixserverlib.NewAuthEvents(
-		gomatrixserverlib.ToPDUs(stateBeforeEvent),
-	)
-	if err != nil {
-		rejectionErr = fmt.Errorf("NewAuthEvents failed: %w", err)
-		return
-	}
-	if rejectionErr = gomatrixserverlib.Allowed(event, stateBeforeAuth, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
-		return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
-	}); rejectionErr != nil {
-		rejectionErr = fmt.Errorf("Allowed() failed for stateBeforeEvent: %w", rejectionErr)
-		return
+	// Check whether the event is allowed or not, unless the room has
+	// partial state, in which case the state before the event may be
+	// missing the events needed to auth it.
+	if !partialState {
+		var stateBeforeAuth *gomatrixserverlib.AuthEvents
+		stateBeforeAuth, err = gomatrixserverlib.NewAuthEvents(
+			gomatrixserverlib.ToPDUs(stateBeforeEvent),
+		)
+		if err != nil {
+			rejectionErr = fmt.Errorf("NewAuthEvents failed: %w", err)
+			return
+		}
+		if rejectionErr = gomatrixserverlib.Allowed(event, stateBeforeAuth, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		}); rejectionErr != nil {
+			rejectionErr = fmt.Errorf("Allowed() failed for stateBeforeEvent: %w", rejectionErr)
+			return
+		}
 	}
 	// Work out what the history visibility was at the time of the
 	// event.
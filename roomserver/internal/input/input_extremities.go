@@ -0,0 +1,185 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+)
+
+// dummyEventType is the type of the event which is sent to merge forward
+// extremities. It has no content and no meaning to clients.
+const dummyEventType = "org.matrix.dummy_event"
+
+// maxMergeRounds limits how many dummy events are sent in one go. Each dummy
+// event can only reference a limited number of prev_events, so rooms with lots
+// of forward extremities need more than one.
+const maxMergeRounds = 10
+
+// ErrNoDummyEventSender is returned when there is no local user in the room
+// who is allowed to send the dummy event that merges forward extremities.
+var ErrNoDummyEventSender = errors.New("no local user is allowed to send events into the room")
+
+// maybeMergeForwardExtremities starts merging the forward extremities of the
+// room in the background if there are more of them than configured. Only one
+// merge runs for a room at a time.
+func (r *Inputer) maybeMergeForwardExtremities(roomID spec.RoomID, extremities int) {
+	max := r.Cfg.MaxForwardExtremities
+	if max <= 0 || extremities <= max {
+		return
+	}
+	if _, merging := r.merging.LoadOrStore(roomID.String(), struct{}{}); merging {
+		return
+	}
+	go func() {
+		defer r.merging.Delete(roomID.String())
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":     roomID.String(),
+			"extremities": extremities,
+		})
+		merged, err := r.MergeForwardExtremities(r.ProcessContext.Context(), roomID, max)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to merge forward extremities")
+			return
+		}
+		logger.WithField("merged", merged).Info("Merged forward extremities")
+	}()
+}
+
+// MergeForwardExtremities sends dummy events into the room, as a local user,
+// until the room has no more than max forward extremities. Returns how many
+// forward extremities were merged away.
+func (r *Inputer) MergeForwardExtremities(
+	ctx context.Context,
+	roomID spec.RoomID,
+	max int,
+) (merged int, err error) {
+	if max < 1 {
+		max = 1
+	}
+	for i := 0; i < maxMergeRounds; i++ {
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID.String())
+		if err != nil {
+			return merged, fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		if roomInfo == nil || roomInfo.IsStub() {
+			return merged, eventutil.ErrRoomNoExists{}
+		}
+		// We can't work out who is allowed to send into the room until
+		// we have the full state.
+		joinEventID, _, err := r.DB.GetRoomPartialState(ctx, roomInfo.RoomNID)
+		if err != nil {
+			return merged, fmt.Errorf("r.DB.GetRoomPartialState: %w", err)
+		}
+		if joinEventID != "" {
+			return merged, fmt.Errorf("room %s has partial state", roomID.String())
+		}
+
+		latestEventIDs, _, _, err := r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+		if err != nil {
+			return merged, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+		}
+		if len(latestEventIDs) <= max {
+			return merged, nil
+		}
+
+		event, origin, err := r.buildDummyEvent(ctx, roomInfo, roomID)
+		if err != nil {
+			return merged, err
+		}
+		inputReq := &api.InputRoomEventsRequest{
+			InputRoomEvents: []api.InputRoomEvent{
+				{
+					Kind:         api.KindNew,
+					Event:        event,
+					Origin:       origin,
+					SendAsServer: string(origin),
+				},
+			},
+		}
+		inputRes := &api.InputRoomEventsResponse{}
+		r.InputRoomEvents(ctx, inputReq, inputRes)
+		if err = inputRes.Err(); err != nil {
+			return merged, fmt.Errorf("failed to send dummy event: %w", err)
+		}
+		merged += len(event.PrevEventIDs()) - 1
+	}
+	return merged, nil
+}
+
+// buildDummyEvent builds a dummy event which references the latest events in
+// the room, as the first local user who is allowed to send it.
+func (r *Inputer) buildDummyEvent(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	roomID spec.RoomID,
+) (*types.HeaderedEvent, spec.ServerName, error) {
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, "", fmt.Errorf("r.DB.Events: %w", err)
+	}
+
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		senderID := spec.SenderID(*memberEvent.StateKey())
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		if err != nil || userID == nil {
+			continue
+		}
+		identity, err := r.SigningIdentity(ctx, roomID, *userID)
+		if err != nil {
+			continue
+		}
+
+		proto := &gomatrixserverlib.ProtoEvent{
+			SenderID: string(senderID),
+			RoomID:   roomID.String(),
+			Type:     dummyEventType,
+		}
+		if err = proto.SetContent(map[string]interface{}{}); err != nil {
+			return nil, "", err
+		}
+		queryRes := &api.QueryLatestEventsAndStateResponse{}
+		event, err := eventutil.QueryAndBuildEvent(ctx, proto, &identity, time.Now(), r.Queryer, queryRes)
+		if err != nil {
+			return nil, "", fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+		}
+
+		// Not every local user might be allowed to send events into the
+		// room, so check before using them.
+		stateEvents := make([]gomatrixserverlib.PDU, len(queryRes.StateEvents))
+		for i := range queryRes.StateEvents {
+			stateEvents[i] = queryRes.StateEvents[i].PDU
+		}
+		provider, err := gomatrixserverlib.NewAuthEvents(stateEvents)
+		if err != nil {
+			return nil, "", err
+		}
+		if err = gomatrixserverlib.Allowed(event.PDU, provider, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		}); err != nil {
+			continue
+		}
+		return event, userID.Domain(), nil
+	}
+	return nil, "", ErrNoDummyEventSender
+}
@@ -60,8 +60,6 @@ func (r *Inputer) updateLatestEvents(
 		return fmt.Errorf("r.DB.GetRoomUpdater: %w", err)
 	}
 
-	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
-
 	u := latestEventsUpdater{
 		ctx:               ctx,
 		api:               r,
@@ -75,6 +73,15 @@ func (r *Inputer) updateLatestEvents(
 		historyVisibility: historyVisibility,
 	}
 
+	// This is deferred before the transaction is ended, so that it runs
+	// once the new latest events have been committed.
+	defer func() {
+		if succeeded && err == nil {
+			r.maybeMergeForwardExtremities(event.RoomID(), len(u.latest))
+		}
+	}()
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+
 	if err = u.doUpdateLatestEvents(); err != nil {
 		return fmt.Errorf("u.doUpdateLatestEvents: %w", err)
 	}
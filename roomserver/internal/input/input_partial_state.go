@@ -0,0 +1,271 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package input
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/internal/helpers"
+	"github.com/element-hq/dendrite/roomserver/state"
+	"github.com/element-hq/dendrite/roomserver/storage/shared"
+	"github.com/element-hq/dendrite/roomserver/types"
+)
+
+// MergeFullState merges the full state of a room that was joined with partial
+// state (MSC3706) into the current state of the room and into the state before
+// each of its forward extremities. The full state is only used to fill in
+// state tuples that are missing, so that any state that has changed since the
+// join is never replaced.
+//
+// Events that arrived while the room had partial state were only checked
+// against their auth events, so they are checked again against the full state
+// before them. Those that fail are soft-failed: they stay in the room DAG, but
+// are removed from the current state and the forward extremities.
+//
+// The merge holds the room lock (see LockRoom) so that it cannot interleave
+// with incoming events for the same room.
+func (r *Inputer) MergeFullState(
+	ctx context.Context, roomID string, roomInfo *types.RoomInfo, fullState []types.StateEntry,
+) error {
+	defer r.LockRoom(roomID)()
+	return r.mergeFullState(ctx, roomID, roomInfo, fullState)
+}
+
+func (r *Inputer) mergeFullState(
+	ctx context.Context, roomID string, roomInfo *types.RoomInfo, fullState []types.StateEntry,
+) (err error) {
+	joinEventID, _, err := r.DB.GetRoomPartialState(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomPartialState: %w", err)
+	}
+
+	var succeeded bool
+	updater, err := r.DB.GetRoomUpdater(ctx, roomInfo)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomUpdater: %w", err)
+	}
+	defer sqlutil.EndTransactionWithCheck(updater, &succeeded, &err)
+	roomState := state.NewStateResolution(updater, roomInfo, r.Queryer)
+
+	softFailed, err := r.reauthPartialStateEvents(ctx, updater, &roomState, roomInfo, joinEventID, fullState)
+	if err != nil {
+		return fmt.Errorf("r.reauthPartialStateEvents: %w", err)
+	}
+
+	// Soft-failed events can't be forward extremities, unless that would
+	// leave the room without any to build new events on.
+	latest := make([]types.StateAtEventAndReference, 0, len(updater.LatestEvents()))
+	for _, extremity := range updater.LatestEvents() {
+		if _, ok := softFailed[extremity.EventNID]; !ok {
+			latest = append(latest, extremity)
+		}
+	}
+	if len(latest) == 0 {
+		latest = append(latest, updater.LatestEvents()...)
+	}
+	for i := range latest {
+		stateNID, _, _, mergeErr := mergeStateSnapshot(ctx, updater, &roomState, roomInfo.RoomNID, latest[i].BeforeStateSnapshotNID, fullState, softFailed)
+		if mergeErr != nil {
+			return fmt.Errorf("mergeStateSnapshot: %w", mergeErr)
+		}
+		if stateNID == latest[i].BeforeStateSnapshotNID {
+			continue
+		}
+		if err = updater.SetState(ctx, latest[i].EventNID, stateNID); err != nil {
+			return fmt.Errorf("updater.SetState: %w", err)
+		}
+		latest[i].BeforeStateSnapshotNID = stateNID
+	}
+
+	currentStateNID, added, removed, err := mergeStateSnapshot(ctx, updater, &roomState, roomInfo.RoomNID, updater.CurrentStateSnapshotNID(), fullState, softFailed)
+	if err != nil {
+		return fmt.Errorf("mergeStateSnapshot: %w", err)
+	}
+
+	lastSent, err := updater.StateAtEventIDs(ctx, []string{updater.LastEventIDSent()})
+	if err != nil {
+		return fmt.Errorf("updater.StateAtEventIDs: %w", err)
+	}
+	if len(lastSent) != 1 {
+		return fmt.Errorf("last sent event %q not found", updater.LastEventIDSent())
+	}
+	if err = updater.SetLatestEvents(roomInfo.RoomNID, latest, lastSent[0].EventNID, currentStateNID); err != nil {
+		return fmt.Errorf("updater.SetLatestEvents: %w", err)
+	}
+
+	updates, err := r.updateMemberships(ctx, updater, removed, added)
+	if err != nil {
+		return fmt.Errorf("r.updateMemberships: %w", err)
+	}
+
+	resynced := &api.OutputResyncedState{
+		RoomID: roomID,
+	}
+	if resynced.AddsStateEventIDs, err = stateEntryEventIDs(ctx, updater, added); err != nil {
+		return err
+	}
+	if resynced.RemovesStateEventIDs, err = stateEntryEventIDs(ctx, updater, removed); err != nil {
+		return err
+	}
+	updates = append(updates, api.OutputEvent{
+		Type:          api.OutputTypeResyncedState,
+		ResyncedState: resynced,
+	})
+
+	// As with updateLatestEvents, the output events are sent inside the
+	// transaction so that we only commit the merge if they were sent.
+	if err = r.OutputProducer.ProduceRoomEvents(roomID, updates); err != nil {
+		return fmt.Errorf("r.OutputProducer.ProduceRoomEvents: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// reauthPartialStateEvents checks the events that were added to the room after
+// the partial state join against the state before them, filled in from the
+// full state. Returns the events that aren't allowed. Events are checked in
+// the order that they arrived, so that the state before an event never
+// includes an event that was soft-failed.
+func (r *Inputer) reauthPartialStateEvents(
+	ctx context.Context, updater *shared.RoomUpdater, roomState *state.StateResolution,
+	roomInfo *types.RoomInfo, joinEventID string, fullState []types.StateEntry,
+) (map[types.EventNID]struct{}, error) {
+	softFailed := map[types.EventNID]struct{}{}
+	if joinEventID == "" {
+		return softFailed, nil
+	}
+	joinEvent, err := updater.StateAtEventIDs(ctx, []string{joinEventID})
+	if err != nil {
+		return nil, fmt.Errorf("updater.StateAtEventIDs: %w", err)
+	}
+	if len(joinEvent) != 1 {
+		return nil, fmt.Errorf("join event %q not found", joinEventID)
+	}
+
+	snapshotNIDs, err := updater.RoomEventStateSnapshotNIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("updater.RoomEventStateSnapshotNIDs: %w", err)
+	}
+	var eventNIDs []types.EventNID
+	for eventNID := range snapshotNIDs {
+		if eventNID > joinEvent[0].EventNID {
+			eventNIDs = append(eventNIDs, eventNID)
+		}
+	}
+	if len(eventNIDs) == 0 {
+		return softFailed, nil
+	}
+	events, err := updater.Events(ctx, roomInfo.RoomVersion, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("updater.Events: %w", err)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].EventNID < events[j].EventNID
+	})
+
+	for _, event := range events {
+		rejected, err := updater.IsEventRejected(ctx, roomInfo.RoomNID, event.EventID())
+		if err != nil {
+			return nil, fmt.Errorf("updater.IsEventRejected: %w", err)
+		}
+		if rejected {
+			continue
+		}
+		entries, err := roomState.LoadStateAtSnapshot(ctx, snapshotNIDs[event.EventNID])
+		if err != nil {
+			return nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+		}
+		stateBefore, _, _ := mergeStateEntries(entries, fullState, softFailed)
+		rejectionErr, err := helpers.CheckAllowedByState(ctx, updater, roomInfo.RoomVersion, event.PDU, stateBefore, r.Queryer)
+		if err != nil {
+			return nil, fmt.Errorf("helpers.CheckAllowedByState: %w", err)
+		}
+		if rejectionErr != nil {
+			logrus.WithError(rejectionErr).WithFields(logrus.Fields{
+				"event_id": event.EventID(),
+				"room_id":  event.RoomID().String(),
+			}).Warn("Soft-failing event which was accepted while the room had partial state")
+			softFailed[event.EventNID] = struct{}{}
+		}
+	}
+	return softFailed, nil
+}
+
+// mergeStateEntries returns the given state plus the entries from fullState
+// for tuples that the state doesn't have, sorted. Entries for soft-failed
+// events are removed first, so their tuples are filled in from fullState too.
+func mergeStateEntries(
+	entries, fullState []types.StateEntry, softFailed map[types.EventNID]struct{},
+) (merged, added, removed []types.StateEntry) {
+	have := make(map[types.StateKeyTuple]struct{}, len(entries))
+	merged = make([]types.StateEntry, 0, len(entries))
+	for _, entry := range entries {
+		if _, ok := softFailed[entry.EventNID]; ok {
+			removed = append(removed, entry)
+			continue
+		}
+		have[entry.StateKeyTuple] = struct{}{}
+		merged = append(merged, entry)
+	}
+	for _, entry := range fullState {
+		if _, ok := have[entry.StateKeyTuple]; ok {
+			continue
+		}
+		if _, ok := softFailed[entry.EventNID]; ok {
+			continue
+		}
+		have[entry.StateKeyTuple] = struct{}{}
+		added = append(added, entry)
+	}
+	return types.DeduplicateStateEntries(append(merged, added...)), added, removed
+}
+
+// mergeStateSnapshot stores a new state snapshot made up of the given snapshot,
+// without any soft-failed events, plus the entries from fullState for tuples
+// that it doesn't have. Returns the original snapshot NID if nothing changed.
+func mergeStateSnapshot(
+	ctx context.Context, updater *shared.RoomUpdater, roomState *state.StateResolution,
+	roomNID types.RoomNID, stateNID types.StateSnapshotNID, fullState []types.StateEntry,
+	softFailed map[types.EventNID]struct{},
+) (types.StateSnapshotNID, []types.StateEntry, []types.StateEntry, error) {
+	entries, err := roomState.LoadStateAtSnapshot(ctx, stateNID)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("roomState.LoadStateAtSnapshot: %w", err)
+	}
+	merged, added, removed := mergeStateEntries(entries, fullState, softFailed)
+	if len(added) == 0 && len(removed) == 0 {
+		return stateNID, nil, nil, nil
+	}
+	newStateNID, err := updater.AddState(ctx, roomNID, nil, merged)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("updater.AddState: %w", err)
+	}
+	return newStateNID, added, removed, nil
+}
+
+// stateEntryEventIDs returns the event IDs of the state entries.
+func stateEntryEventIDs(ctx context.Context, updater *shared.RoomUpdater, entries []types.StateEntry) ([]string, error) {
+	eventNIDs := make([]types.EventNID, len(entries))
+	for i := range entries {
+		eventNIDs[i] = entries[i].EventNID
+	}
+	eventIDs, err := updater.EventIDs(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("updater.EventIDs: %w", err)
+	}
+	result := make([]string, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		result = append(result, eventID)
+	}
+	return result, nil
+}
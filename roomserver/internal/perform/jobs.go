@@ -0,0 +1,93 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// completedJobTTL is how long the status of a finished admin job can still be
+// queried for before it is forgotten.
+const completedJobTTL = time.Hour * 24
+
+// newJobID returns a new random ID for an admin job.
+func newJobID() string {
+	return util.RandomString(16)
+}
+
+// jobRegistry holds the statuses of the background admin jobs of one kind, so
+// that their progress can be queried. Statuses must only be changed with
+// update or finish, which hold the lock of the registry. The zero value is
+// ready to use.
+type jobRegistry[T any] struct {
+	mutex sync.Mutex
+	jobs  map[string]*registeredJob[T] // job ID -> job
+	ttl   time.Duration                // completedJobTTL if zero
+}
+
+type registeredJob[T any] struct {
+	status   *T
+	finished time.Time // zero while the job is running
+}
+
+// add registers the status of a new job.
+func (j *jobRegistry[T]) add(jobID string, status *T) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.evict()
+	if j.jobs == nil {
+		j.jobs = map[string]*registeredJob[T]{}
+	}
+	j.jobs[jobID] = &registeredJob[T]{status: status}
+}
+
+// update calls fn, which may change the statuses of the jobs.
+func (j *jobRegistry[T]) update(fn func()) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	fn()
+}
+
+// finish calls fn, which sets the final status of the job, and then marks the
+// job as finished so that it is forgotten once the TTL has passed.
+func (j *jobRegistry[T]) finish(jobID string, fn func()) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	fn()
+	if job, ok := j.jobs[jobID]; ok {
+		job.finished = time.Now()
+	}
+}
+
+// get returns a copy of the status of the job, made by clone, or nil if there
+// is no such job.
+func (j *jobRegistry[T]) get(jobID string, clone func(status *T) *T) *T {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.evict()
+	job, ok := j.jobs[jobID]
+	if !ok {
+		return nil
+	}
+	return clone(job.status)
+}
+
+// evict forgets the jobs which finished longer than the TTL ago. The caller
+// must hold the lock.
+func (j *jobRegistry[T]) evict() {
+	ttl := j.ttl
+	if ttl == 0 {
+		ttl = completedJobTTL
+	}
+	for jobID, job := range j.jobs {
+		if !job.finished.IsZero() && time.Since(job.finished) > ttl {
+			delete(j.jobs, jobID)
+		}
+	}
+}
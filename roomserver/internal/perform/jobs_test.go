@@ -0,0 +1,58 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testJobStatus struct {
+	JobID string
+	Done  int
+}
+
+func cloneTestJobStatus(status *testJobStatus) *testJobStatus {
+	res := *status
+	return &res
+}
+
+func TestJobRegistry(t *testing.T) {
+	jobs := jobRegistry[testJobStatus]{ttl: time.Millisecond * 50}
+	assert.Nil(t, jobs.get("unknown", cloneTestJobStatus))
+
+	running := &testJobStatus{JobID: newJobID()}
+	finished := &testJobStatus{JobID: newJobID()}
+	assert.NotEqual(t, running.JobID, finished.JobID)
+	jobs.add(running.JobID, running)
+	jobs.add(finished.JobID, finished)
+
+	// The status that is returned is a copy.
+	jobs.update(func() {
+		running.Done++
+	})
+	status := jobs.get(running.JobID, cloneTestJobStatus)
+	if assert.NotNil(t, status) {
+		assert.Equal(t, 1, status.Done)
+		status.Done++
+		assert.Equal(t, 1, running.Done)
+	}
+
+	jobs.finish(finished.JobID, func() {
+		finished.Done = 10
+	})
+	status = jobs.get(finished.JobID, cloneTestJobStatus)
+	if assert.NotNil(t, status) {
+		assert.Equal(t, 10, status.Done)
+	}
+
+	// Only jobs that have finished are forgotten once the TTL has passed.
+	time.Sleep(time.Millisecond * 100)
+	assert.Nil(t, jobs.get(finished.JobID, cloneTestJobStatus))
+	assert.NotNil(t, jobs.get(running.JobID, cloneTestJobStatus))
+}
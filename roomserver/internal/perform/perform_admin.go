@@ -32,6 +32,13 @@ type Admin struct {
 	Queryer *query.Queryer
 	Inputer *input.Inputer
 	Leaver  *Leaver
+	RSAPI   api.RoomserverInternalAPI
+
+	purges          jobRegistry[api.PurgeHistoryStatus]
+	compressions    jobRegistry[api.CompressStateStatus]
+	integrityChecks jobRegistry[api.CheckIntegrityStatus]
+	deletes         jobRegistry[api.DeleteRoomStatus]
+	redactions      jobRegistry[api.RedactUserEventsStatus]
 }
 
 // PerformAdminEvacuateRoom will remove all local users from the given room.
@@ -214,6 +221,19 @@ func (r *Admin) PerformAdminPurgeRoom(
 	})
 }
 
+// PerformAdminMergeForwardExtremities merges the forward extremities of the
+// given room, regardless of the configured maximum.
+func (r *Admin) PerformAdminMergeForwardExtremities(
+	ctx context.Context,
+	roomID string,
+) (int, error) {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return 0, err
+	}
+	return r.Inputer.MergeForwardExtremities(ctx, *validRoomID, 1)
+}
+
 func (r *Admin) PerformAdminDownloadState(
 	ctx context.Context,
 	roomID, userID string, serverName spec.ServerName,
@@ -10,6 +10,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -526,10 +527,18 @@ func (c *Creator) PerformCreateRoom(ctx context.Context, userID spec.UserID, roo
 
 	if createRequest.Visibility == spec.Public {
 		// expose this room in the published room list
-		if err = c.RSAPI.PerformPublish(ctx, &api.PerformPublishRequest{
+		err = c.RSAPI.PerformPublish(ctx, &api.PerformPublishRequest{
 			RoomID:     roomID.String(),
 			Visibility: spec.Public,
-		}); err != nil {
+			UserID:     userID.String(),
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, api.ErrPublicationPending), errors.As(err, &api.ErrNotAllowed{}):
+			// The room has been created by now, so it just isn't published
+			// until a server admin approves it, if at all.
+			util.GetLogger(ctx).WithError(err).Info("room not published")
+		default:
 			util.GetLogger(ctx).WithError(err).Error("failed to publish room")
 			return "", &util.JSONResponse{
 				Code: http.StatusInternalServerError,
@@ -0,0 +1,372 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// PerformAdminBlockRoom blocks or unblocks the given room. Local users can't
+// join or be invited to a blocked room, and remote servers can't join it
+// through us.
+func (r *Admin) PerformAdminBlockRoom(
+	ctx context.Context,
+	roomID, blockedBy string,
+	block bool,
+) error {
+	// Validate we actually got a room ID and nothing else
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return err
+	}
+	if !block {
+		return r.DB.UnblockRoom(ctx, roomID)
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":    roomID,
+		"blocked_by": blockedBy,
+	}).Warn("Blocking room")
+	return r.DB.BlockRoom(ctx, roomID, blockedBy)
+}
+
+// QueryAdminRoomBlock returns whether the given room is blocked, and if so
+// by whom. The room doesn't need to be known to the server.
+func (r *Admin) QueryAdminRoomBlock(
+	ctx context.Context,
+	roomID string,
+) (*api.RoomBlock, error) {
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return nil, err
+	}
+	blockedBy, blockedTS, err := r.DB.GetRoomBlock(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	return &api.RoomBlock{
+		RoomID:    roomID,
+		Blocked:   blockedBy != "",
+		BlockedBy: blockedBy,
+		BlockedTS: blockedTS,
+	}, nil
+}
+
+// PerformAdminDeleteRoom starts a background job which removes all local
+// users from the given room, optionally moving them into a newly created
+// room with a notice explaining why, and optionally blocking and purging
+// the room afterwards. The progress of the job can be followed with
+// QueryAdminDeleteRoomStatus.
+func (r *Admin) PerformAdminDeleteRoom(
+	ctx context.Context,
+	req *api.PerformDeleteRoomRequest,
+) (string, error) {
+	// Validate we actually got a room ID and nothing else
+	if _, err := spec.NewRoomID(req.RoomID); err != nil {
+		return "", err
+	}
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return "", err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return "", eventutil.ErrRoomNoExists{}
+	}
+	if req.NewRoomUserID != "" {
+		userID, err := spec.NewUserID(req.NewRoomUserID, true)
+		if err != nil {
+			return "", err
+		}
+		if !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+			return "", fmt.Errorf("new room user %s is not local to this server", req.NewRoomUserID)
+		}
+	}
+
+	// Block the room before anyone is removed from it, so that they can't
+	// rejoin while the deletion is still in progress.
+	if req.Block {
+		if err = r.PerformAdminBlockRoom(ctx, req.RoomID, req.RequestedBy, true); err != nil {
+			return "", fmt.Errorf("r.PerformAdminBlockRoom: %w", err)
+		}
+	}
+
+	status := &api.DeleteRoomStatus{
+		DeleteID:          newJobID(),
+		RoomID:            req.RoomID,
+		Status:            api.DeleteRoomStatusActive,
+		KickedUsers:       []string{},
+		FailedToKickUsers: []string{},
+	}
+	r.deletes.add(status.DeleteID, status)
+
+	reqCopy := *req
+	go func() {
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":   req.RoomID,
+			"delete_id": status.DeleteID,
+		})
+		logger.Warn("Deleting room")
+		err := r.deleteRoom(r.Inputer.ProcessContext.Context(), roomInfo, &reqCopy, status)
+
+		r.deletes.finish(status.DeleteID, func() {
+			if err != nil {
+				logger.WithError(err).Error("Failed to delete room")
+				status.Status = api.DeleteRoomStatusFailed
+				status.Error = err.Error()
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"kicked_users":         len(status.KickedUsers),
+				"failed_to_kick_users": len(status.FailedToKickUsers),
+				"new_room_id":          status.NewRoomID,
+			}).Warn("Room deleted")
+			status.Status = api.DeleteRoomStatusComplete
+		})
+	}()
+
+	return status.DeleteID, nil
+}
+
+// QueryAdminDeleteRoomStatus returns the progress of a deletion started with
+// PerformAdminDeleteRoom, or nil if there is no deletion with the given ID.
+func (r *Admin) QueryAdminDeleteRoomStatus(
+	ctx context.Context,
+	deleteID string,
+) (*api.DeleteRoomStatus, error) {
+	return r.deletes.get(deleteID, func(status *api.DeleteRoomStatus) *api.DeleteRoomStatus {
+		res := *status
+		res.KickedUsers = append([]string{}, status.KickedUsers...)
+		res.FailedToKickUsers = append([]string{}, status.FailedToKickUsers...)
+		return &res
+	}), nil
+}
+
+func (r *Admin) deleteRoom(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	req *api.PerformDeleteRoomRequest,
+	status *api.DeleteRoomStatus,
+) error {
+	userIDs, err := r.localJoinedUsers(ctx, roomInfo, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.localJoinedUsers: %w", err)
+	}
+	r.deletes.update(func() {
+		status.UsersTotal = len(userIDs)
+	})
+
+	var newRoomID string
+	if req.NewRoomUserID != "" {
+		newRoomID, err = r.createNoticeRoom(ctx, req)
+		if err != nil {
+			return fmt.Errorf("r.createNoticeRoom: %w", err)
+		}
+		r.deletes.update(func() {
+			status.NewRoomID = newRoomID
+		})
+	}
+
+	for _, userID := range userIDs {
+		kicked := r.moveUser(ctx, userID, req.RoomID, newRoomID)
+		r.deletes.update(func() {
+			if kicked {
+				status.KickedUsers = append(status.KickedUsers, userID.String())
+			} else {
+				status.FailedToKickUsers = append(status.FailedToKickUsers, userID.String())
+			}
+		})
+	}
+
+	if req.Purge {
+		if err = r.PerformAdminPurgeRoom(ctx, req.RoomID); err != nil {
+			return fmt.Errorf("r.PerformAdminPurgeRoom: %w", err)
+		}
+		r.deletes.update(func() {
+			status.Purged = true
+		})
+	}
+	return nil
+}
+
+// localJoinedUsers returns the local users who are currently joined to the room.
+func (r *Admin) localJoinedUsers(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	roomID string,
+) ([]spec.UserID, error) {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]spec.UserID, 0, len(memberEvents))
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, *validRoomID, spec.SenderID(*memberEvent.StateKey()))
+		if err != nil || userID == nil {
+			continue
+		}
+		userIDs = append(userIDs, *userID)
+	}
+	return userIDs, nil
+}
+
+// moveUser makes the user leave the old room and, if one was created, join
+// the new room. It returns whether the user left the old room.
+func (r *Admin) moveUser(
+	ctx context.Context,
+	userID spec.UserID,
+	roomID, newRoomID string,
+) bool {
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id": roomID,
+		"user_id": userID.String(),
+	})
+	leaveReq := &api.PerformLeaveRequest{
+		RoomID: roomID,
+		Leaver: userID,
+	}
+	leaveRes := &api.PerformLeaveResponse{}
+	if err := r.RSAPI.PerformLeave(ctx, leaveReq, leaveRes); err != nil {
+		logger.WithError(err).Error("Failed to remove user from deleted room")
+		return false
+	}
+	if newRoomID == "" {
+		return true
+	}
+	joinReq := &api.PerformJoinRequest{
+		RoomIDOrAlias: newRoomID,
+		UserID:        userID.String(),
+	}
+	if _, _, err := r.RSAPI.PerformJoin(ctx, joinReq); err != nil {
+		logger.WithError(err).WithField("new_room_id", newRoomID).Error("Failed to join user to new room")
+	}
+	return true
+}
+
+// createNoticeRoom creates the room that local users are moved into, and
+// sends the notice message into it. Users who join the room aren't allowed
+// to send anything into it themselves.
+func (r *Admin) createNoticeRoom(
+	ctx context.Context,
+	req *api.PerformDeleteRoomRequest,
+) (string, error) {
+	userID, err := spec.NewUserID(req.NewRoomUserID, true)
+	if err != nil {
+		return "", err
+	}
+	evTime := time.Now()
+	roomVersion := r.RSAPI.DefaultRoomVersion()
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVersion)
+	if err != nil {
+		return "", err
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		return "", fmt.Errorf("failed to get signing identity for %q: %w", userID.Domain(), err)
+	}
+
+	roomID, err := spec.NewRoomID(fmt.Sprintf("!%s:%s", util.RandomString(16), userID.Domain()))
+	if err != nil {
+		return "", err
+	}
+	var createEventJSON json.RawMessage
+	if verImpl.DomainlessRoomIDs() {
+		// make the create event up-front so the roomserver can calculate the room NID to store.
+		createContent, err := api.GenerateCreateContent(ctx, roomVersion, userID.String(), nil, nil)
+		if err != nil {
+			return "", fmt.Errorf("api.GenerateCreateContent: %w", err)
+		}
+		authEvents, _ := gomatrixserverlib.NewAuthEvents(nil)
+		createEvent, jsonErr := api.GeneratePDU(
+			ctx, verImpl,
+			gomatrixserverlib.FledglingEvent{
+				Type:    spec.MRoomCreate,
+				Content: createContent,
+			},
+			authEvents, 1, "", identity, evTime, userID.String(), "", r.RSAPI,
+		)
+		if jsonErr != nil {
+			return "", fmt.Errorf("failed to make the create event: %v", jsonErr.JSON)
+		}
+		createEventJSON = createEvent.JSON()
+		newRoomID := createEvent.RoomID()
+		roomID = &newRoomID
+	}
+
+	createReq := &api.PerformCreateRoomRequest{
+		RoomName:                  req.NewRoomName,
+		StatePreset:               spec.PresetPublicChat,
+		CreateEvent:               createEventJSON,
+		RoomVersion:               roomVersion,
+		PowerLevelContentOverride: json.RawMessage(`{"users_default":-10}`),
+		KeyID:                     identity.KeyID,
+		PrivateKey:                identity.PrivateKey,
+		EventTime:                 evTime,
+	}
+	if _, jsonErr := r.RSAPI.PerformCreateRoom(ctx, *userID, *roomID, createReq); jsonErr != nil {
+		return "", fmt.Errorf("failed to create new room: %v", jsonErr.JSON)
+	}
+
+	if req.Message == "" {
+		return roomID.String(), nil
+	}
+	senderID, err := r.RSAPI.QuerySenderIDForUser(ctx, *roomID, *userID)
+	if err != nil {
+		return "", err
+	} else if senderID == nil {
+		return "", fmt.Errorf("sender ID not found for %s in %s", userID.String(), roomID.String())
+	}
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID: string(*senderID),
+		RoomID:   roomID.String(),
+		Type:     "m.room.message",
+	}
+	if err = proto.SetContent(map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    req.Message,
+	}); err != nil {
+		return "", err
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &proto, identity, evTime, r.RSAPI, &queryRes)
+	if err != nil {
+		return "", fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	inputReq := &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       userID.Domain(),
+				SendAsServer: string(userID.Domain()),
+			},
+		},
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, inputReq, inputRes)
+	if err = inputRes.Err(); err != nil {
+		return "", fmt.Errorf("failed to send notice message: %w", err)
+	}
+	return roomID.String(), nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/integrity"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// integrityCheckAttempts is how many times a room is checked without holding
+// the room lock, before it is checked while holding it.
+const integrityCheckAttempts = 3
+
+// PerformAdminCheckIntegrity starts a background job which checks that the
+// stored data of the given room, or of every room if roomID is empty, is
+// consistent. Rooms are only locked if they keep changing while being checked.
+func (r *Admin) PerformAdminCheckIntegrity(
+	ctx context.Context,
+	roomID string,
+) (string, error) {
+	var roomIDs []string
+	if roomID != "" {
+		// Validate we actually got a room ID and nothing else
+		if _, err := spec.NewRoomID(roomID); err != nil {
+			return "", err
+		}
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return "", err
+		}
+		if roomInfo == nil || roomInfo.IsStub() {
+			return "", eventutil.ErrRoomNoExists{}
+		}
+		roomIDs = []string{roomID}
+	} else {
+		var err error
+		roomIDs, err = r.DB.RoomsWithEventType(ctx, spec.MRoomCreate)
+		if err != nil {
+			return "", fmt.Errorf("r.DB.RoomsWithEventType: %w", err)
+		}
+	}
+
+	status := &api.CheckIntegrityStatus{
+		JobID:      newJobID(),
+		RoomID:     roomID,
+		Status:     api.CheckIntegrityStatusActive,
+		RoomsTotal: len(roomIDs),
+		Reports:    []types.RoomIntegrityReport{},
+	}
+	r.integrityChecks.add(status.JobID, status)
+
+	go func() {
+		logger := logrus.WithField("job_id", status.JobID)
+		logger.WithField("rooms", len(roomIDs)).Info("Checking room integrity")
+		err := r.checkIntegrity(r.Inputer.ProcessContext.Context(), roomIDs, status)
+
+		r.integrityChecks.finish(status.JobID, func() {
+			if err != nil {
+				logger.WithError(err).Error("Failed to check room integrity")
+				status.Status = api.CheckIntegrityStatusFailed
+				status.Error = err.Error()
+				return
+			}
+			logger.WithField("inconsistent_rooms", len(status.Reports)).Info("Room integrity checked")
+			status.Status = api.CheckIntegrityStatusComplete
+		})
+	}()
+
+	return status.JobID, nil
+}
+
+// QueryAdminCheckIntegrityStatus returns the progress of a job started by
+// PerformAdminCheckIntegrity, or nil if there is no such job.
+func (r *Admin) QueryAdminCheckIntegrityStatus(
+	ctx context.Context,
+	jobID string,
+) (*api.CheckIntegrityStatus, error) {
+	return r.integrityChecks.get(jobID, func(status *api.CheckIntegrityStatus) *api.CheckIntegrityStatus {
+		res := *status
+		res.Reports = append(res.Reports[:0:0], status.Reports...)
+		return &res
+	}), nil
+}
+
+// checkIntegrity checks each of the given rooms in turn, updating the status
+// as it goes. A room which can't be checked doesn't stop the others from being
+// checked, but does fail the job as a whole.
+func (r *Admin) checkIntegrity(
+	ctx context.Context,
+	roomIDs []string,
+	status *api.CheckIntegrityStatus,
+) error {
+	var lastErr error
+	for _, roomID := range roomIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.checkRoomIntegrity(ctx, roomID, status); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to check room integrity")
+			lastErr = fmt.Errorf("room %s: %w", roomID, err)
+		}
+		r.integrityChecks.update(func() {
+			status.RoomsDone++
+		})
+	}
+	return lastErr
+}
+
+func (r *Admin) checkRoomIntegrity(
+	ctx context.Context,
+	roomID string,
+	status *api.CheckIntegrityStatus,
+) error {
+	report, err := r.consistentIntegrityReport(ctx, roomID)
+	if err != nil {
+		// The room might have been purged since the job started.
+		if errors.Is(err, eventutil.ErrRoomNoExists{}) {
+			return nil
+		}
+		return err
+	}
+	if !report.Consistent() {
+		logrus.WithFields(logrus.Fields{
+			"room_id":  roomID,
+			"problems": len(report.Problems),
+		}).Warn("Room is inconsistent")
+		r.integrityChecks.update(func() {
+			status.Reports = append(status.Reports, *report)
+		})
+	}
+	return nil
+}
+
+// consistentIntegrityReport checks the room without stopping events from being
+// processed for it. If the room changed during the check, the report could mix
+// the room before and after the change, so the check is repeated. If the room
+// keeps changing, it is checked while holding the room lock instead.
+func (r *Admin) consistentIntegrityReport(
+	ctx context.Context,
+	roomID string,
+) (*types.RoomIntegrityReport, error) {
+	for attempt := 0; attempt < integrityCheckAttempts; attempt++ {
+		before := r.Inputer.RoomChanges(roomID)
+		report, err := integrity.CheckRoom(ctx, r.DB, r.Queryer, roomID)
+		if before%2 == 0 && r.Inputer.RoomChanges(roomID) == before {
+			return report, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	defer r.Inputer.LockRoom(roomID)()
+	return integrity.CheckRoom(ctx, r.DB, r.Queryer, roomID)
+}
@@ -122,6 +122,13 @@ func (r *Inviter) PerformInvite(
 	ctx context.Context,
 	req *api.PerformInviteRequest,
 ) error {
+	blocked, err := r.RSAPI.QueryRoomBlocked(ctx, req.InviteInput.RoomID.String())
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return api.ErrNotAllowed{Err: fmt.Errorf("room %s has been blocked on this server", req.InviteInput.RoomID.String())}
+	}
 	senderID, err := r.RSAPI.QuerySenderIDForUser(ctx, req.InviteInput.RoomID, req.InviteInput.Inviter)
 	if err != nil {
 		return err
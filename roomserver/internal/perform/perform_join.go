@@ -161,6 +161,15 @@ func (r *Joiner) performJoinRoomByID(
 		return "", "", rsAPI.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomIDOrAlias, err)}
 	}
 
+	// Admins can block rooms so that local users can't join them.
+	blocked, err := r.Queryer.QueryRoomBlocked(ctx, roomID.String())
+	if err != nil {
+		return "", "", fmt.Errorf("r.Queryer.QueryRoomBlocked: %w", err)
+	}
+	if blocked {
+		return "", "", rsAPI.ErrNotAllowed{Err: fmt.Errorf("room %s has been blocked on this server", roomID.String())}
+	}
+
 	// Force a federated join if we aren't in the room and we've been
 	// given some server names to try joining by.
 	inRoomReq := &rsAPI.QueryServerJoinedToRoomRequest{
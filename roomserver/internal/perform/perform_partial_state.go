@@ -0,0 +1,304 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/internal/input"
+	"github.com/element-hq/dendrite/roomserver/internal/query"
+	"github.com/element-hq/dendrite/roomserver/storage"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
+)
+
+const (
+	// The initial and maximum time to wait between attempts to fetch the
+	// full state of a partial state room.
+	partialStateResyncInitialBackoff = time.Second * 10
+	partialStateResyncMaxBackoff     = time.Hour
+	// How many times fetching the full state of a partial state room is
+	// attempted before giving up, which is around three hours with the
+	// backoff above. The resync is attempted again after a restart.
+	partialStateResyncMaxAttempts = 12
+)
+
+// PartialStateResyncer fetches the full state of rooms that were joined with
+// partial state (MSC3706) in the background, and lets callers wait for a room
+// to have full state.
+type PartialStateResyncer struct {
+	DB             storage.Database
+	Cfg            *config.RoomServer
+	Queryer        *query.Queryer
+	Inputer        *input.Inputer
+	ProcessContext *process.ProcessContext
+
+	mutex     sync.Mutex
+	resyncing map[string]struct{}      // room ID -> resync in progress
+	failed    map[string]struct{}      // room ID -> resync given up
+	waiters   map[string]chan struct{} // room ID -> closed when the resync finishes
+}
+
+// QueryPartialStateRoom implements api.PartialStateAPI.
+func (r *PartialStateResyncer) QueryPartialStateRoom(
+	ctx context.Context, roomID string,
+) (*api.PartialStateRoom, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil || roomInfo == nil {
+		return nil, err
+	}
+	joinEventID, serversInRoom, err := r.DB.GetRoomPartialState(ctx, roomInfo.RoomNID)
+	if err != nil || joinEventID == "" {
+		return nil, err
+	}
+	return &api.PartialStateRoom{
+		RoomID:        roomID,
+		JoinEventID:   joinEventID,
+		ServersInRoom: serversInRoom,
+	}, nil
+}
+
+// WaitForFullState implements api.PartialStateAPI.
+func (r *PartialStateResyncer) WaitForFullState(ctx context.Context, roomID string) error {
+	room, err := r.QueryPartialStateRoom(ctx, roomID)
+	if err != nil || room == nil {
+		return err
+	}
+	waiter := r.waiter(roomID)
+	// Check again now that we hold a waiter, in case the resync finished
+	// between the first check and the waiter being created.
+	if room, err = r.QueryPartialStateRoom(ctx, roomID); err != nil || room == nil {
+		return err
+	}
+	select {
+	case <-waiter:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.failed[roomID]; ok {
+		return api.ErrFullStateUnavailable
+	}
+	return nil
+}
+
+// PerformMarkPartialStateRoom implements api.FederationRoomserverAPI.
+func (r *PartialStateResyncer) PerformMarkPartialStateRoom(
+	ctx context.Context, room api.PartialStateRoom,
+) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, room.RoomID)
+	if err != nil {
+		return err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return eventutil.ErrRoomNoExists{}
+	}
+	if err = r.DB.SetRoomPartialState(ctx, roomInfo.RoomNID, room.JoinEventID, room.ServersInRoom); err != nil {
+		return fmt.Errorf("r.DB.SetRoomPartialState: %w", err)
+	}
+	r.StartResync(room.RoomID)
+	return nil
+}
+
+// ResumeResyncs starts fetching the full state for all rooms that still
+// have partial state, e.g. because we were restarted during a resync.
+func (r *PartialStateResyncer) ResumeResyncs(ctx context.Context) error {
+	roomIDs, err := r.DB.GetPartialStateRooms(ctx)
+	if err != nil {
+		return err
+	}
+	for _, roomID := range roomIDs {
+		r.StartResync(roomID)
+	}
+	return nil
+}
+
+// StartResync starts fetching the full state for the room in the background,
+// unless that is already happening.
+func (r *PartialStateResyncer) StartResync(roomID string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.resyncing == nil {
+		r.resyncing = make(map[string]struct{})
+	}
+	if _, ok := r.resyncing[roomID]; ok {
+		return
+	}
+	r.resyncing[roomID] = struct{}{}
+	delete(r.failed, roomID)
+	go r.resync(roomID)
+}
+
+func (r *PartialStateResyncer) waiter(roomID string) chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.waiters == nil {
+		r.waiters = make(map[string]chan struct{})
+	}
+	waiter, ok := r.waiters[roomID]
+	if _, failed := r.failed[roomID]; failed && !ok {
+		// The resync has already been given up on, so don't wait for it.
+		waiter = make(chan struct{})
+		close(waiter)
+		return waiter
+	}
+	if !ok {
+		waiter = make(chan struct{})
+		r.waiters[roomID] = waiter
+	}
+	return waiter
+}
+
+// resync keeps trying to fetch the full state for the room, backing off
+// between attempts, until it succeeds, it has been tried too many times or
+// we shut down. Anyone waiting for the room to have full state is woken up
+// either way, unless we are shutting down.
+func (r *PartialStateResyncer) resync(roomID string) {
+	defer func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.resyncing, roomID)
+	}()
+
+	ctx := r.ProcessContext.Context()
+	logger := logrus.WithField("room_id", roomID)
+	backoff := partialStateResyncInitialBackoff
+	failed := false
+	for attempt := 1; ; attempt++ {
+		err := r.resyncOnce(ctx, roomID)
+		if err == nil {
+			break
+		}
+		if attempt == partialStateResyncMaxAttempts {
+			logger.WithError(err).Errorf("Failed to fetch full state for partial state room after %d attempts, giving up until restarted", attempt)
+			failed = true
+			break
+		}
+		logger.WithError(err).Warnf("Failed to fetch full state for partial state room, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > partialStateResyncMaxBackoff {
+			backoff = partialStateResyncMaxBackoff
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if failed {
+		if r.failed == nil {
+			r.failed = make(map[string]struct{})
+		}
+		r.failed[roomID] = struct{}{}
+	}
+	if waiter, ok := r.waiters[roomID]; ok {
+		close(waiter)
+		delete(r.waiters, roomID)
+	}
+}
+
+// resyncOnce asks each of the servers that were in the room when we joined
+// for the state at the join event, until one of them answers, and merges it
+// into the room.
+func (r *PartialStateResyncer) resyncOnce(ctx context.Context, roomID string) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		// The room has been purged in the meantime.
+		return nil
+	}
+	joinEventID, serversInRoom, err := r.DB.GetRoomPartialState(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetRoomPartialState: %w", err)
+	}
+	if joinEventID == "" {
+		return nil
+	}
+
+	lastErr := fmt.Errorf("no servers to fetch the state from")
+	for _, serverName := range serversInRoom {
+		if r.Cfg.Matrix.IsLocalServerName(serverName) {
+			continue
+		}
+		var stateRes gomatrixserverlib.StateResponse
+		stateRes, err = r.Inputer.FSAPI.LookupState(ctx, r.Inputer.ServerName, serverName, roomID, joinEventID, roomInfo.RoomVersion)
+		if err != nil {
+			lastErr = fmt.Errorf("r.Inputer.FSAPI.LookupState (%s): %w", serverName, err)
+			continue
+		}
+		if err = r.storeFullState(ctx, roomID, roomInfo, serverName, stateRes); err != nil {
+			lastErr = fmt.Errorf("r.storeFullState (%s): %w", serverName, err)
+			continue
+		}
+		if err = r.DB.ClearRoomPartialState(ctx, roomInfo.RoomNID); err != nil {
+			return fmt.Errorf("r.DB.ClearRoomPartialState: %w", err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"room_id":     roomID,
+			"server_name": serverName,
+		}).Info("Fetched full state for partial state room")
+		return nil
+	}
+	return lastErr
+}
+
+func (r *PartialStateResyncer) storeFullState(
+	ctx context.Context, roomID string, roomInfo *types.RoomInfo,
+	serverName spec.ServerName, stateRes gomatrixserverlib.StateResponse,
+) error {
+	authEvents, stateEvents, err := gomatrixserverlib.CheckStateResponse(
+		ctx, stateRes, roomInfo.RoomVersion, r.Inputer.KeyRing, nil,
+		func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.CheckStateResponse: %w", err)
+	}
+
+	checked := &fclient.RespState{
+		AuthEvents:  gomatrixserverlib.NewEventJSONsFromEvents(authEvents),
+		StateEvents: gomatrixserverlib.NewEventJSONsFromEvents(stateEvents),
+	}
+	outliers := gomatrixserverlib.LineariseStateResponse(roomInfo.RoomVersion, checked)
+	ires := make([]api.InputRoomEvent, 0, len(outliers))
+	for _, outlier := range outliers {
+		ires = append(ires, api.InputRoomEvent{
+			Kind:   api.KindOutlier,
+			Event:  &types.HeaderedEvent{PDU: outlier},
+			Origin: serverName,
+		})
+	}
+	if err = api.SendInputRoomEvents(ctx, r.Inputer, r.Inputer.ServerName, ires, false); err != nil {
+		return fmt.Errorf("api.SendInputRoomEvents: %w", err)
+	}
+
+	stateEventIDs := make([]string, len(stateEvents))
+	for i := range stateEvents {
+		stateEventIDs[i] = stateEvents[i].EventID()
+	}
+	fullState, err := r.DB.StateEntriesForEventIDs(ctx, stateEventIDs, true)
+	if err != nil {
+		return fmt.Errorf("r.DB.StateEntriesForEventIDs: %w", err)
+	}
+	return r.Inputer.MergeFullState(ctx, roomID, roomInfo, types.DeduplicateStateEntries(fullState))
+}
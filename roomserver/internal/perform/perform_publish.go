@@ -8,13 +8,22 @@ package perform
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
 	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/internal/query"
 	"github.com/element-hq/dendrite/roomserver/storage"
+	"github.com/element-hq/dendrite/setup/config"
 )
 
 type Publisher struct {
-	DB storage.Database
+	DB      storage.Database
+	Cfg     *config.RoomServer
+	Queryer *query.Queryer
 }
 
 // PerformPublish publishes or unpublishes a room from the room directory. Returns a database error, if any.
@@ -22,5 +31,134 @@ func (r *Publisher) PerformPublish(
 	ctx context.Context,
 	req *api.PerformPublishRequest,
 ) error {
-	return r.DB.PublishRoom(ctx, req.RoomID, req.AppserviceID, req.NetworkID, req.Visibility == "public")
+	publish := req.Visibility == spec.Public
+	if publish && req.UserID != "" && req.AppserviceID == "" {
+		switch r.Cfg.RoomDirectory.PublicationPolicy {
+		case config.PublicationPolicyApproval:
+			if err := r.DB.RequestRoomPublication(ctx, req.RoomID, req.UserID); err != nil {
+				return fmt.Errorf("r.DB.RequestRoomPublication: %w", err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"room_id": req.RoomID,
+				"user_id": req.UserID,
+			}).Info("Room is waiting for approval to be published")
+			return api.ErrPublicationPending
+		case config.PublicationPolicyRules:
+			allowed, err := r.publicationAllowed(ctx, req.RoomID)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return api.ErrNotAllowed{Err: fmt.Errorf("this server doesn't allow room %s to be published", req.RoomID)}
+			}
+		}
+	}
+	return r.DB.PublishRoom(ctx, req.RoomID, req.AppserviceID, req.NetworkID, req.UserID, publish)
+}
+
+// publicationAllowed returns whether the publication rules allow the room to
+// be published, based on its creator and its aliases. Only the aliases in our
+// own alias table are considered, since anyone able to send state could put
+// any alias into the room's canonical alias event.
+func (r *Publisher) publicationAllowed(ctx context.Context, roomID string) (bool, error) {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return false, err
+	}
+	createEvent, err := r.DB.GetStateEvent(ctx, roomID, spec.MRoomCreate, "")
+	if err != nil {
+		return false, fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if createEvent == nil {
+		return false, eventutil.ErrRoomNoExists{}
+	}
+	var creator string
+	creatorID, err := r.Queryer.QueryUserIDForSender(ctx, *validRoomID, createEvent.SenderID())
+	if err == nil && creatorID != nil {
+		creator = creatorID.String()
+	}
+
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, roomID)
+	if err != nil {
+		return false, fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+
+	return r.Cfg.RoomDirectory.Allowed(creator, aliases), nil
+}
+
+// QueryAdminPublishedRooms returns every entry in the room directory, with
+// who published it and when.
+func (r *Publisher) QueryAdminPublishedRooms(ctx context.Context) ([]api.PublishedRoom, error) {
+	rooms, err := r.DB.GetPublishedRoomEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetPublishedRoomEntries: %w", err)
+	}
+	if rooms == nil {
+		rooms = []api.PublishedRoom{}
+	}
+	return rooms, nil
+}
+
+// QueryAdminPublicationRequests returns the rooms waiting for a server admin
+// to approve their publication, oldest first.
+func (r *Publisher) QueryAdminPublicationRequests(ctx context.Context) ([]api.PublicationRequest, error) {
+	requests, err := r.DB.GetPublicationRequests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetPublicationRequests: %w", err)
+	}
+	if requests == nil {
+		requests = []api.PublicationRequest{}
+	}
+	return requests, nil
+}
+
+// PerformAdminReviewPublication approves or rejects a pending request to
+// publish a room. An approved room is published as the user who asked for it.
+func (r *Publisher) PerformAdminReviewPublication(
+	ctx context.Context,
+	roomID, reviewedBy string,
+	approve bool,
+) error {
+	requestedBy, _, err := r.DB.GetPublicationRequest(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetPublicationRequest: %w", err)
+	}
+	if requestedBy == "" {
+		return api.ErrNoPublicationRequest
+	}
+
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":      roomID,
+		"requested_by": requestedBy,
+		"reviewed_by":  reviewedBy,
+	})
+	if !approve {
+		if err = r.DB.RemovePublicationRequest(ctx, roomID); err != nil {
+			return fmt.Errorf("r.DB.RemovePublicationRequest: %w", err)
+		}
+		logger.Info("Rejected publication of room")
+		return nil
+	}
+	if err = r.DB.PublishRoom(ctx, roomID, "", "", requestedBy, true); err != nil {
+		return fmt.Errorf("r.DB.PublishRoom: %w", err)
+	}
+	logger.Info("Approved publication of room")
+	return nil
+}
+
+// PerformAdminUnpublishRoom removes a room from the room directory, including
+// entries published by application services, and rejects any pending request
+// to publish it.
+func (r *Publisher) PerformAdminUnpublishRoom(
+	ctx context.Context,
+	roomID, unpublishedBy string,
+) error {
+	if err := r.DB.UnpublishRoom(ctx, roomID, unpublishedBy); err != nil {
+		return fmt.Errorf("r.DB.UnpublishRoom: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":        roomID,
+		"unpublished_by": unpublishedBy,
+	}).Info("Unpublished room")
+	return nil
 }
@@ -0,0 +1,388 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// purgeHistoryBatchSize is how many events are loaded from the database, or
+// listed in a single output event, at a time.
+const purgeHistoryBatchSize = 500
+
+// PerformAdminPurgeHistory starts a background job which removes events older
+// than the given event or timestamp from a room. Events that are part of the
+// current state of the room, or that are needed to authorise the events that
+// are kept, are never removed.
+func (r *Admin) PerformAdminPurgeHistory(
+	ctx context.Context,
+	req *api.PerformPurgeHistoryRequest,
+) (string, error) {
+	// Validate we actually got a room ID and nothing else
+	roomID, err := spec.NewRoomID(req.RoomID)
+	if err != nil {
+		return "", err
+	}
+	if req.BeforeEventID == "" && req.BeforeTS == 0 {
+		return "", fmt.Errorf("one of before_event_id or before_ts must be given")
+	}
+	if req.BeforeEventID != "" && req.BeforeTS != 0 {
+		return "", fmt.Errorf("only one of before_event_id or before_ts may be given")
+	}
+
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return "", err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return "", eventutil.ErrRoomNoExists{}
+	}
+
+	if req.BeforeEventID != "" {
+		nids, err := r.DB.EventNIDs(ctx, []string{req.BeforeEventID})
+		if err != nil {
+			return "", err
+		}
+		if meta, ok := nids[req.BeforeEventID]; !ok || meta.RoomNID != roomInfo.RoomNID {
+			return "", fmt.Errorf("event %s is not in room %s", req.BeforeEventID, req.RoomID)
+		}
+	}
+
+	status := &api.PurgeHistoryStatus{
+		PurgeID: newJobID(),
+		RoomID:  req.RoomID,
+		Status:  api.PurgeHistoryStatusActive,
+	}
+	r.purges.add(status.PurgeID, status)
+
+	reqCopy := *req
+	go func() {
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id":  req.RoomID,
+			"purge_id": status.PurgeID,
+		})
+		logger.Warn("Purging room history")
+		purged, err := r.purgeHistory(r.Inputer.ProcessContext.Context(), *roomID, &reqCopy)
+
+		r.purges.finish(status.PurgeID, func() {
+			status.PurgedEvents = purged
+			if err != nil {
+				logger.WithError(err).Error("Failed to purge room history")
+				status.Status = api.PurgeHistoryStatusFailed
+				status.Error = err.Error()
+				return
+			}
+			logger.WithField("purged_events", purged).Warn("Room history purged")
+			status.Status = api.PurgeHistoryStatusComplete
+		})
+	}()
+
+	return status.PurgeID, nil
+}
+
+// QueryAdminPurgeHistoryStatus returns the status of a purge started by
+// PerformAdminPurgeHistory, or nil if there is no such purge.
+func (r *Admin) QueryAdminPurgeHistoryStatus(
+	ctx context.Context,
+	purgeID string,
+) (*api.PurgeHistoryStatus, error) {
+	return r.purges.get(purgeID, func(status *api.PurgeHistoryStatus) *api.PurgeHistoryStatus {
+		res := *status
+		return &res
+	}), nil
+}
+
+func (r *Admin) purgeHistory(
+	ctx context.Context,
+	roomID spec.RoomID,
+	req *api.PerformPurgeHistoryRequest,
+) (int, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return 0, eventutil.ErrRoomNoExists{}
+	}
+
+	// Working out what can be removed takes a while in big rooms, so do it
+	// without stopping new events from arriving in the room.
+	plan, err := r.planPurgeHistory(ctx, roomID, roomInfo, req)
+	if err != nil {
+		return 0, err
+	}
+	if len(plan.purgeNIDs) == 0 {
+		return 0, nil
+	}
+
+	unlock := r.Inputer.LockRoom(req.RoomID)
+	// If events arrived in the meantime they might rely on events that we
+	// planned to remove, so work it out again while holding the lock.
+	latestIDs, currentStateNID, _, err := r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		unlock()
+		return 0, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+	if currentStateNID != plan.currentStateNID || !slices.Equal(latestIDs, plan.latestEventIDs) {
+		if plan, err = r.planPurgeHistory(ctx, roomID, roomInfo, req); err != nil {
+			unlock()
+			return 0, err
+		}
+	}
+	if len(plan.purgeNIDs) == 0 {
+		unlock()
+		return 0, nil
+	}
+	eventIDs, err := r.DB.EventIDs(ctx, plan.purgeNIDs)
+	if err != nil {
+		unlock()
+		return 0, fmt.Errorf("r.DB.EventIDs: %w", err)
+	}
+	err = r.DB.PurgeHistory(ctx, roomInfo.RoomNID, plan.purgeNIDs, plan.clearStateNIDs)
+	unlock()
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.PurgeHistory: %w", err)
+	}
+
+	purgedIDs := make([]string, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		purgedIDs = append(purgedIDs, eventID)
+	}
+	for start := 0; start < len(purgedIDs); start += purgeHistoryBatchSize {
+		end := min(start+purgeHistoryBatchSize, len(purgedIDs))
+		if err = r.Inputer.OutputProducer.ProduceRoomEvents(req.RoomID, []api.OutputEvent{
+			{
+				Type: api.OutputTypePurgeHistory,
+				PurgeHistory: &api.OutputPurgeHistory{
+					RoomID:   req.RoomID,
+					EventIDs: purgedIDs[start:end],
+				},
+			},
+		}); err != nil {
+			return len(plan.purgeNIDs), fmt.Errorf("r.Inputer.OutputProducer.ProduceRoomEvents: %w", err)
+		}
+	}
+	return len(plan.purgeNIDs), nil
+}
+
+// purgeHistoryPlan is what a purge removes, along with the forward extremities
+// and current state of the room that it was worked out from.
+type purgeHistoryPlan struct {
+	latestEventIDs  []string
+	currentStateNID types.StateSnapshotNID
+	purgeNIDs       []types.EventNID
+	clearStateNIDs  []types.EventNID
+}
+
+// planPurgeHistory works out which events the purge removes, and which of the
+// events that are kept no longer need the state before them.
+func (r *Admin) planPurgeHistory(
+	ctx context.Context,
+	roomID spec.RoomID,
+	roomInfo *types.RoomInfo,
+	req *api.PerformPurgeHistoryRequest,
+) (*purgeHistoryPlan, error) {
+	plan := &purgeHistoryPlan{}
+	var err error
+	plan.latestEventIDs, plan.currentStateNID, _, err = r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.LatestEventIDs: %w", err)
+	}
+
+	depth := int64(math.MaxInt64)
+	if req.BeforeEventID != "" {
+		events, err := r.DB.EventsFromIDs(ctx, roomInfo, []string{req.BeforeEventID})
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		if len(events) != 1 {
+			return nil, fmt.Errorf("event %s not found", req.BeforeEventID)
+		}
+		depth = events[0].Depth()
+	}
+
+	// Narrow the candidates down by timestamp and sender. The events are
+	// looked at in depth order, so when purging by timestamp we can stop at
+	// the first batch of events which are all too new to be purged, rather
+	// than loading every event in the room. Events sent with timestamps out
+	// of order with the events around them might be kept because of that.
+	candidates := map[types.EventNID]struct{}{}
+	afterDepth, afterNID := int64(math.MinInt64), types.EventNID(0)
+	for {
+		candidateNIDs, lastDepth, err := r.DB.RoomEventNIDsBeforeDepthAfter(ctx, roomInfo.RoomNID, depth, afterDepth, afterNID, purgeHistoryBatchSize)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.RoomEventNIDsBeforeDepthAfter: %w", err)
+		}
+		if len(candidateNIDs) == 0 {
+			break
+		}
+		afterDepth, afterNID = lastDepth, candidateNIDs[len(candidateNIDs)-1]
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, candidateNIDs)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		expired := false
+		for _, event := range events {
+			if req.BeforeTS != 0 && event.OriginServerTS() >= req.BeforeTS {
+				continue
+			}
+			expired = true
+			if !req.DeleteLocalEvents {
+				userID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, event.SenderID())
+				if err == nil && userID != nil && r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+					continue
+				}
+			}
+			candidates[event.EventNID] = struct{}{}
+		}
+		if len(candidateNIDs) < purgeHistoryBatchSize || (req.BeforeTS != 0 && !expired) {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return plan, nil
+	}
+
+	protected, latestNIDs, err := r.protectedEventNIDs(ctx, roomInfo, candidates, plan.latestEventIDs, plan.currentStateNID)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotNIDs, err := r.DB.RoomEventStateSnapshotNIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomEventStateSnapshotNIDs: %w", err)
+	}
+	for nid := range candidates {
+		if _, ok := protected[nid]; !ok {
+			plan.purgeNIDs = append(plan.purgeNIDs, nid)
+			continue
+		}
+		// The event is being kept, but nothing needs to know the state
+		// before it anymore, so forget it to let the state be cleaned up.
+		if _, ok := latestNIDs[nid]; ok {
+			continue
+		}
+		if snapshotNIDs[nid] != 0 {
+			plan.clearStateNIDs = append(plan.clearStateNIDs, nid)
+		}
+	}
+	return plan, nil
+}
+
+// protectedEventNIDs returns the events in the room that must not be purged:
+// the forward extremities, every event in the state of the room before the
+// events that are being kept, and the auth chains of all of those events.
+func (r *Admin) protectedEventNIDs(
+	ctx context.Context, roomInfo *types.RoomInfo, candidates map[types.EventNID]struct{},
+	latestIDs []string, currentStateNID types.StateSnapshotNID,
+) (protected, latest map[types.EventNID]struct{}, err error) {
+	protected = map[types.EventNID]struct{}{}
+	latest = map[types.EventNID]struct{}{}
+
+	latestMeta, err := r.DB.EventNIDs(ctx, latestIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("r.DB.EventNIDs: %w", err)
+	}
+	for _, meta := range latestMeta {
+		latest[meta.EventNID] = struct{}{}
+		protected[meta.EventNID] = struct{}{}
+	}
+
+	snapshotNIDs, err := r.DB.RoomEventStateSnapshotNIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("r.DB.RoomEventStateSnapshotNIDs: %w", err)
+	}
+	keptSnapshots := map[types.StateSnapshotNID]struct{}{
+		currentStateNID: {},
+	}
+	for eventNID, stateNID := range snapshotNIDs {
+		if _, ok := candidates[eventNID]; !ok {
+			keptSnapshots[stateNID] = struct{}{}
+		}
+	}
+	snapshots := make([]types.StateSnapshotNID, 0, len(keptSnapshots))
+	for stateNID := range keptSnapshots {
+		if stateNID != 0 {
+			snapshots = append(snapshots, stateNID)
+		}
+	}
+
+	// Work out which state blocks the kept snapshots use, and from that
+	// which events are in them.
+	blocks := map[types.StateBlockNID]struct{}{}
+	for start := 0; start < len(snapshots); start += purgeHistoryBatchSize {
+		end := min(start+purgeHistoryBatchSize, len(snapshots))
+		blockLists, err := r.DB.StateBlockNIDs(ctx, snapshots[start:end])
+		if err != nil {
+			return nil, nil, fmt.Errorf("r.DB.StateBlockNIDs: %w", err)
+		}
+		for _, list := range blockLists {
+			for _, blockNID := range list.StateBlockNIDs {
+				blocks[blockNID] = struct{}{}
+			}
+		}
+	}
+	blockNIDs := make([]types.StateBlockNID, 0, len(blocks))
+	for blockNID := range blocks {
+		blockNIDs = append(blockNIDs, blockNID)
+	}
+	for start := 0; start < len(blockNIDs); start += purgeHistoryBatchSize {
+		end := min(start+purgeHistoryBatchSize, len(blockNIDs))
+		entryLists, err := r.DB.StateEntries(ctx, blockNIDs[start:end])
+		if err != nil {
+			return nil, nil, fmt.Errorf("r.DB.StateEntries: %w", err)
+		}
+		for _, list := range entryLists {
+			for _, entry := range list.StateEntries {
+				protected[entry.EventNID] = struct{}{}
+			}
+		}
+	}
+
+	// Walk the auth chains of everything protected so far.
+	queue := make([]types.EventNID, 0, len(protected))
+	for eventNID := range protected {
+		queue = append(queue, eventNID)
+	}
+	for len(queue) > 0 {
+		end := min(purgeHistoryBatchSize, len(queue))
+		batch := queue[:end]
+		queue = queue[end:]
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, batch)
+		if err != nil {
+			return nil, nil, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		var authIDs []string
+		for _, event := range events {
+			authIDs = append(authIDs, event.AuthEventIDs()...)
+		}
+		if len(authIDs) == 0 {
+			continue
+		}
+		authMeta, err := r.DB.EventNIDs(ctx, authIDs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("r.DB.EventNIDs: %w", err)
+		}
+		for _, meta := range authMeta {
+			if _, ok := protected[meta.EventNID]; ok {
+				continue
+			}
+			protected[meta.EventNID] = struct{}{}
+			queue = append(queue, meta.EventNID)
+		}
+	}
+
+	return protected, latest, nil
+}
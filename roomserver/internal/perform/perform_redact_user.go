@@ -0,0 +1,399 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+)
+
+// defaultRedactionsPerSecond is how many redactions are sent per second if the
+// request doesn't say. Every redaction is sent to every server in the room, so
+// this stops a large clean-up from flooding federation.
+const defaultRedactionsPerSecond = 5
+
+// The range of rates which a request may ask for. Outside of it the interval
+// between redactions is either too long to be of use or too short to represent.
+const (
+	minRedactionsPerSecond = 0.01
+	maxRedactionsPerSecond = 1000
+)
+
+// redactionScanBatchSize is how many of the events sent by the user in a room
+// are loaded at a time while checking which of them to redact.
+const redactionScanBatchSize = 100
+
+// PerformAdminRedactUserEvents starts a background job which redacts the
+// events sent by the given user, in the given rooms or in every room they are
+// or were joined to. State events, such as their membership, are left alone.
+// In each room the redactions are sent by the server notices user if it may
+// redact events there, or else by the local member with the highest power
+// level who may.
+func (r *Admin) PerformAdminRedactUserEvents(
+	ctx context.Context,
+	req *api.PerformRedactUserEventsRequest,
+) (string, error) {
+	userID, err := spec.NewUserID(req.UserID, true)
+	if err != nil {
+		return "", err
+	}
+	if req.RateLimit != 0 && (req.RateLimit < minRedactionsPerSecond || req.RateLimit > maxRedactionsPerSecond) {
+		return "", fmt.Errorf("rate limit must be between %v and %v redactions per second", minRedactionsPerSecond, maxRedactionsPerSecond)
+	}
+	if req.Until != 0 && req.Until < req.Since {
+		return "", fmt.Errorf("until_ts must not be before since_ts")
+	}
+
+	roomIDs := req.RoomIDs
+	if len(roomIDs) == 0 {
+		roomIDs, err = r.roomsWithMember(ctx, *userID)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		for _, roomID := range roomIDs {
+			// Validate we actually got room IDs and nothing else
+			if _, err = spec.NewRoomID(roomID); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	status := &api.RedactUserEventsStatus{
+		JobID:        newJobID(),
+		UserID:       userID.String(),
+		Status:       api.RedactUserEventsStatusActive,
+		RoomsTotal:   len(roomIDs),
+		SkippedRooms: []string{},
+	}
+	r.redactions.add(status.JobID, status)
+
+	reqCopy := *req
+	reqCopy.RoomIDs = append([]string{}, roomIDs...)
+	go func() {
+		logger := logrus.WithFields(logrus.Fields{
+			"job_id":       status.JobID,
+			"user_id":      userID.String(),
+			"requested_by": req.RequestedBy,
+		})
+		logger.WithField("rooms", len(roomIDs)).Info("Redacting events sent by user")
+		err := r.redactUserEvents(r.Inputer.ProcessContext.Context(), *userID, &reqCopy, status)
+
+		r.redactions.finish(status.JobID, func() {
+			if err != nil {
+				logger.WithError(err).Error("Failed to redact events sent by user")
+				status.Status = api.RedactUserEventsStatusFailed
+				status.Error = err.Error()
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"redacted": status.EventsRedacted,
+				"failed":   status.EventsFailed,
+				"skipped":  len(status.SkippedRooms),
+			}).Info("Redacted events sent by user")
+			status.Status = api.RedactUserEventsStatusComplete
+		})
+	}()
+
+	return status.JobID, nil
+}
+
+// QueryAdminRedactUserEventsStatus returns the progress of a job started by
+// PerformAdminRedactUserEvents, or nil if there is no such job.
+func (r *Admin) QueryAdminRedactUserEventsStatus(
+	ctx context.Context,
+	jobID string,
+) (*api.RedactUserEventsStatus, error) {
+	return r.redactions.get(jobID, func(status *api.RedactUserEventsStatus) *api.RedactUserEventsStatus {
+		res := *status
+		res.SkippedRooms = append([]string{}, status.SkippedRooms...)
+		return &res
+	}), nil
+}
+
+// roomsWithMember returns the rooms that the user is joined to or has left
+// or been banned from.
+func (r *Admin) roomsWithMember(ctx context.Context, userID spec.UserID) ([]string, error) {
+	joined, err := r.DB.GetRoomsByMembership(ctx, userID, spec.Join)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetRoomsByMembership: %w", err)
+	}
+	left, err := r.DB.GetRoomsByMembership(ctx, userID, spec.Leave)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetRoomsByMembership: %w", err)
+	}
+	roomIDs := append(joined, left...)
+	sort.Strings(roomIDs)
+	return util.UniqueStrings(roomIDs), nil
+}
+
+// redactUserEvents redacts the events sent by the user in each room in turn,
+// sending no more than the requested number of redactions per second overall.
+func (r *Admin) redactUserEvents(
+	ctx context.Context,
+	userID spec.UserID,
+	req *api.PerformRedactUserEventsRequest,
+	status *api.RedactUserEventsStatus,
+) error {
+	perSecond := req.RateLimit
+	if perSecond == 0 {
+		perSecond = defaultRedactionsPerSecond
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / perSecond))
+	defer ticker.Stop()
+
+	for _, roomID := range req.RoomIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.redactUserEventsInRoom(ctx, userID, roomID, req, status, ticker.C); err != nil {
+			return fmt.Errorf("room %s: %w", roomID, err)
+		}
+		r.redactions.update(func() {
+			status.RoomsDone++
+		})
+	}
+	return nil
+}
+
+func (r *Admin) redactUserEventsInRoom(
+	ctx context.Context,
+	userID spec.UserID,
+	roomID string,
+	req *api.PerformRedactUserEventsRequest,
+	status *api.RedactUserEventsStatus,
+	tick <-chan time.Time,
+) error {
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return err
+	}
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		// Nothing was ever sent in the room as far as we know.
+		return nil
+	}
+	senderID, err := r.Queryer.QuerySenderIDForUser(ctx, *validRoomID, userID)
+	if err != nil {
+		return fmt.Errorf("r.Queryer.QuerySenderIDForUser: %w", err)
+	}
+	if senderID == nil {
+		return nil
+	}
+
+	eventIDs, err := r.userEventIDs(ctx, roomInfo, *senderID, req.Since, req.Until)
+	if err != nil {
+		return err
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	r.redactions.update(func() {
+		status.EventsFound += len(eventIDs)
+	})
+
+	logger := logrus.WithFields(logrus.Fields{
+		"job_id":  status.JobID,
+		"room_id": roomID,
+		"user_id": userID.String(),
+	})
+	redactor, err := r.redactor(ctx, roomInfo, *validRoomID)
+	if err != nil {
+		return err
+	}
+	if redactor == nil {
+		logger.Warn("No local user may redact events in the room, skipping it")
+		r.redactions.update(func() {
+			status.SkippedRooms = append(status.SkippedRooms, roomID)
+		})
+		return nil
+	}
+
+	for _, eventID := range eventIDs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+		}
+		err = r.sendRedaction(ctx, *validRoomID, *redactor, eventID, req.Reason)
+		r.redactions.update(func() {
+			if err != nil {
+				logger.WithError(err).WithField("event_id", eventID).Error("Failed to redact event")
+				status.EventsFailed++
+			} else {
+				status.EventsRedacted++
+			}
+		})
+	}
+	return nil
+}
+
+// userEventIDs returns the IDs of the events that the sender sent in the room
+// between since and until, oldest first, which aren't state events and haven't
+// been redacted already.
+func (r *Admin) userEventIDs(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	senderID spec.SenderID,
+	since, until spec.Timestamp,
+) ([]string, error) {
+	eventNIDs, err := r.DB.RoomEventNIDsBySender(ctx, roomInfo.RoomNID, senderID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomEventNIDsBySender: %w", err)
+	}
+
+	var eventIDs []string
+	for start := 0; start < len(eventNIDs); start += redactionScanBatchSize {
+		end := start + redactionScanBatchSize
+		if end > len(eventNIDs) {
+			end = len(eventNIDs)
+		}
+		events, err := r.DB.Events(ctx, roomInfo.RoomVersion, eventNIDs[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.Events: %w", err)
+		}
+		for _, event := range events {
+			switch {
+			case event.StateKey() != nil:
+			case event.Type() == spec.MRoomRedaction:
+			case since != 0 && event.OriginServerTS() < since:
+			case until != 0 && event.OriginServerTS() > until:
+			case gjson.GetBytes(event.Unsigned(), "redacted_because").Exists():
+			default:
+				eventIDs = append(eventIDs, event.EventID())
+			}
+		}
+	}
+	return eventIDs, nil
+}
+
+// redactor returns the local user who sends the redactions into the room: the
+// server notices user if it is joined and may redact events, or else the local
+// member with the highest power level who may. Returns nil if there is nobody.
+func (r *Admin) redactor(
+	ctx context.Context,
+	roomInfo *types.RoomInfo,
+	roomID spec.RoomID,
+) (*spec.UserID, error) {
+	powerLevelsEvent, err := r.DB.GetStateEvent(ctx, roomID.String(), spec.MRoomPowerLevels, "")
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if powerLevelsEvent == nil {
+		return nil, nil
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(powerLevelsEvent.PDU)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromEvent: %w", err)
+	}
+
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+
+	var noticesUserID string
+	if notices := r.Cfg.Matrix.ServerNotices; notices.Enabled {
+		noticesUserID = fmt.Sprintf("@%s:%s", notices.LocalPart, r.Cfg.Matrix.ServerName)
+	}
+	var best *spec.UserID
+	bestLevel := powerLevels.Redact - 1
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		senderID := spec.SenderID(*memberEvent.StateKey())
+		level := powerLevels.UserLevel(senderID)
+		if level < powerLevels.Redact {
+			continue
+		}
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, roomID, senderID)
+		if err != nil || userID == nil {
+			continue
+		}
+		if userID.String() == noticesUserID {
+			return userID, nil
+		}
+		if level > bestLevel {
+			best, bestLevel = userID, level
+		}
+	}
+	return best, nil
+}
+
+// sendRedaction redacts the event as the given local user.
+func (r *Admin) sendRedaction(
+	ctx context.Context,
+	roomID spec.RoomID,
+	redactor spec.UserID,
+	eventID, reason string,
+) error {
+	senderID, err := r.RSAPI.QuerySenderIDForUser(ctx, roomID, redactor)
+	if err != nil {
+		return err
+	} else if senderID == nil {
+		return fmt.Errorf("sender ID not found for %s in %s", redactor.String(), roomID.String())
+	}
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, roomID, redactor)
+	if err != nil {
+		return err
+	}
+
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID: string(*senderID),
+		RoomID:   roomID.String(),
+		Type:     spec.MRoomRedaction,
+		Redacts:  eventID,
+	}
+	// Room version 11 expects the "redacts" field on the
+	// content field, so add it here as well
+	content := map[string]interface{}{
+		"redacts": eventID,
+	}
+	if reason != "" {
+		content["reason"] = reason
+	}
+	if err = proto.SetContent(content); err != nil {
+		return err
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &proto, &identity, time.Now(), r.RSAPI, &queryRes)
+	if err != nil {
+		return fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	inputReq := &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        event,
+				Origin:       redactor.Domain(),
+				SendAsServer: string(redactor.Domain()),
+			},
+		},
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, inputReq, inputRes)
+	return inputRes.Err()
+}
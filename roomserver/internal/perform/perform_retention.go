@@ -0,0 +1,67 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// PurgeExpiredEvents purges the events which have outlived the retention
+// policy of their room from every room that has one.
+func (r *Admin) PurgeExpiredEvents(ctx context.Context) error {
+	// If there is a default policy then every room is affected, otherwise
+	// only the rooms which have set a policy of their own.
+	eventType := api.MRoomRetention
+	if r.Cfg.Retention.DefaultPolicy.MaxLifetime > 0 {
+		eventType = spec.MRoomCreate
+	}
+	roomIDs, err := r.DB.RoomsWithEventType(ctx, eventType)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomsWithEventType: %w", err)
+	}
+
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger := logrus.WithField("room_id", roomID)
+		retentionEvent, err := r.DB.GetStateEvent(ctx, roomID, api.MRoomRetention, "")
+		if err != nil {
+			logger.WithError(err).Error("Failed to get room retention policy")
+			continue
+		}
+		lifetime := api.RetentionMaxLifetime(&r.Cfg.Retention, retentionEvent)
+		if lifetime == 0 {
+			continue
+		}
+		validRoomID, err := spec.NewRoomID(roomID)
+		if err != nil {
+			continue
+		}
+		purged, err := r.purgeHistory(ctx, *validRoomID, &api.PerformPurgeHistoryRequest{
+			RoomID:            roomID,
+			BeforeTS:          spec.AsTimestamp(now.Add(-lifetime)),
+			DeleteLocalEvents: true,
+		})
+		switch {
+		case errors.Is(err, eventutil.ErrRoomNoExists{}):
+		case err != nil:
+			logger.WithError(err).Error("Failed to purge expired events")
+		case purged > 0:
+			logger.WithField("purged_events", purged).Info("Purged expired events")
+		}
+	}
+	return nil
+}
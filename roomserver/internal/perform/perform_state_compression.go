@@ -0,0 +1,138 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/element-hq/dendrite/internal/eventutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+)
+
+// PerformAdminCompressState starts a background job which compresses the
+// stored state snapshots of the given room, or of every room if roomID is
+// empty. Each room is locked while it is being compressed, so no new events
+// are processed for it in the meantime.
+func (r *Admin) PerformAdminCompressState(
+	ctx context.Context,
+	roomID string,
+) (string, error) {
+	var roomIDs []string
+	if roomID != "" {
+		// Validate we actually got a room ID and nothing else
+		if _, err := spec.NewRoomID(roomID); err != nil {
+			return "", err
+		}
+		roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+		if err != nil {
+			return "", err
+		}
+		if roomInfo == nil || roomInfo.IsStub() {
+			return "", eventutil.ErrRoomNoExists{}
+		}
+		roomIDs = []string{roomID}
+	} else {
+		var err error
+		roomIDs, err = r.DB.RoomsWithEventType(ctx, spec.MRoomCreate)
+		if err != nil {
+			return "", fmt.Errorf("r.DB.RoomsWithEventType: %w", err)
+		}
+	}
+
+	status := &api.CompressStateStatus{
+		JobID:      newJobID(),
+		RoomID:     roomID,
+		Status:     api.CompressStateStatusActive,
+		RoomsTotal: len(roomIDs),
+	}
+	r.compressions.add(status.JobID, status)
+
+	go func() {
+		logger := logrus.WithField("job_id", status.JobID)
+		logger.WithField("rooms", len(roomIDs)).Info("Compressing room state")
+		err := r.compressState(r.Inputer.ProcessContext.Context(), roomIDs, status)
+
+		r.compressions.finish(status.JobID, func() {
+			if err != nil {
+				logger.WithError(err).Error("Failed to compress room state")
+				status.Status = api.CompressStateStatusFailed
+				status.Error = err.Error()
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"compressed_snapshots": status.CompressedSnapshots,
+				"removed_blocks":       status.RemovedBlocks,
+			}).Info("Room state compressed")
+			status.Status = api.CompressStateStatusComplete
+		})
+	}()
+
+	return status.JobID, nil
+}
+
+// QueryAdminCompressStateStatus returns the progress of a job started by
+// PerformAdminCompressState, or nil if there is no such job.
+func (r *Admin) QueryAdminCompressStateStatus(
+	ctx context.Context,
+	jobID string,
+) (*api.CompressStateStatus, error) {
+	return r.compressions.get(jobID, func(status *api.CompressStateStatus) *api.CompressStateStatus {
+		res := *status
+		return &res
+	}), nil
+}
+
+// compressState compresses the state of each of the given rooms in turn,
+// updating the status as it goes. A room which fails to compress doesn't stop
+// the others from being compressed, but does fail the job as a whole.
+func (r *Admin) compressState(
+	ctx context.Context,
+	roomIDs []string,
+	status *api.CompressStateStatus,
+) error {
+	var lastErr error
+	for _, roomID := range roomIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.compressRoomState(ctx, roomID, status); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to compress room state")
+			lastErr = fmt.Errorf("room %s: %w", roomID, err)
+		}
+		r.compressions.update(func() {
+			status.RoomsDone++
+		})
+	}
+	return lastErr
+}
+
+func (r *Admin) compressRoomState(
+	ctx context.Context,
+	roomID string,
+	status *api.CompressStateStatus,
+) error {
+	defer r.Inputer.LockRoom(roomID)()
+
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil
+	}
+	res, err := r.DB.CompressRoomState(ctx, roomInfo.RoomNID)
+	if res != nil {
+		r.compressions.update(func() {
+			status.Snapshots += res.Snapshots
+			status.CompressedSnapshots += res.CompressedSnapshots
+			status.RemovedBlocks += res.RemovedBlocks
+		})
+	}
+	return err
+}
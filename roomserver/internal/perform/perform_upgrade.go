@@ -17,15 +17,18 @@ import (
 	"github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/roomserver/types"
 	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/setup/process"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 type Upgrader struct {
-	Cfg    *config.RoomServer
-	URSAPI api.RoomserverInternalAPI
+	Cfg            *config.RoomServer
+	ProcessContext *process.ProcessContext
+	URSAPI         api.RoomserverInternalAPI
 }
 
 // PerformRoomUpgrade upgrades a room from one version to another
@@ -172,6 +175,12 @@ func (r *Upgrader) performRoomUpgrade(
 		return "", fmt.Errorf("sendInitialEvents: %s", pErr)
 	}
 
+	// Start inviting the members of the old room before they learn about the
+	// new room from the tombstone, so that they are able to join it.
+	if r.Cfg.RoomUpgrades.InviteMembers {
+		r.inviteOldRoomMembers(ctx, evTime, userID, *senderID, oldRoomRes, newRoomID)
+	}
+
 	// 5. Send the tombstone event to the old room
 	if pErr = r.sendHeaderedEvent(ctx, userID.Domain(), tombstoneEvent, string(userID.Domain())); pErr != nil {
 		return "", pErr
@@ -197,9 +206,117 @@ func (r *Upgrader) performRoomUpgrade(
 		return "", pErr
 	}
 
+	// Point the spaces which contained the old room at the new room too
+	if r.Cfg.RoomUpgrades.UpdateParentSpaces {
+		r.updateParentSpaces(ctx, evTime, userID, roomID, newRoomID)
+	}
+
 	return newRoomID, nil
 }
 
+// inviteOldRoomMembers invites everyone who is joined to the old room to the
+// new room. Inviting a large room can take a while, especially over federation,
+// so the invites are sent in the background rather than holding up the upgrade
+// request. Failing to invite someone doesn't fail the upgrade.
+func (r *Upgrader) inviteOldRoomMembers(
+	ctx context.Context, evTime time.Time, userID spec.UserID, senderID spec.SenderID,
+	oldRoom *api.QueryLatestEventsAndStateResponse, newRoomID string,
+) {
+	validNewRoomID, err := spec.NewRoomID(newRoomID)
+	if err != nil {
+		return
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(userID.Domain())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("UpgradeRoom: Failed to get signing identity")
+		return
+	}
+	var invitees []spec.UserID
+	for _, event := range oldRoom.StateEvents {
+		if event.Type() != spec.MRoomMember || event.StateKey() == nil || event.StateKeyEquals(string(senderID)) {
+			continue
+		}
+		if membership, err := event.Membership(); err != nil || membership != spec.Join {
+			continue
+		}
+		invitee, err := r.URSAPI.QueryUserIDForSender(ctx, event.RoomID(), spec.SenderID(*event.StateKey()))
+		if err != nil || invitee == nil {
+			continue
+		}
+		invitees = append(invitees, *invitee)
+	}
+	if len(invitees) == 0 {
+		return
+	}
+
+	go func() {
+		logger := logrus.WithField("room_id", newRoomID)
+		for _, invitee := range invitees {
+			err := r.URSAPI.PerformInvite(r.ProcessContext.Context(), &api.PerformInviteRequest{
+				InviteInput: api.InviteInput{
+					RoomID:     *validNewRoomID,
+					Inviter:    userID,
+					Invitee:    invitee,
+					KeyID:      identity.KeyID,
+					PrivateKey: identity.PrivateKey,
+					EventTime:  evTime,
+				},
+				SendAsServer: string(userID.Domain()),
+			})
+			if err != nil {
+				logger.WithError(err).WithField("invitee", invitee.String()).Warn("UpgradeRoom: Failed to invite member of old room")
+			}
+		}
+	}()
+}
+
+// updateParentSpaces adds the new room to every space, which the upgrading
+// user is joined to and allowed to edit, that contains the old room.
+func (r *Upgrader) updateParentSpaces(ctx context.Context, evTime time.Time, userID spec.UserID, roomID, newRoomID string) {
+	joinedRooms, err := r.URSAPI.QueryRoomsForUser(ctx, userID, spec.Join)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("UpgradeRoom: Failed to get rooms for user")
+		return
+	}
+	for _, spaceID := range joinedRooms {
+		if spaceID.String() == roomID || spaceID.String() == newRoomID {
+			continue
+		}
+		childEvent := api.GetStateEvent(ctx, r.URSAPI, spaceID.String(), gomatrixserverlib.StateKeyTuple{
+			EventType: spec.MSpaceChild,
+			StateKey:  roomID,
+		})
+		// A space child event with no "via" doesn't link to the room.
+		if childEvent == nil || !gjson.GetBytes(childEvent.Content(), "via").IsArray() {
+			continue
+		}
+		var content map[string]interface{}
+		if err = json.Unmarshal(childEvent.Content(), &content); err != nil {
+			continue
+		}
+		senderID, err := r.URSAPI.QuerySenderIDForUser(ctx, spaceID, userID)
+		if err != nil || senderID == nil {
+			continue
+		}
+		newChildEvent, err := r.makeHeaderedEvent(ctx, evTime, *senderID, userID.Domain(), spaceID.String(), gomatrixserverlib.FledglingEvent{
+			Type:     spec.MSpaceChild,
+			StateKey: newRoomID,
+			Content:  content,
+		})
+		switch err.(type) {
+		case nil:
+		case api.ErrNotAllowed:
+			continue
+		default:
+			util.GetLogger(ctx).WithError(err).WithField("space_id", spaceID.String()).Warn("UpgradeRoom: Failed to make space child event")
+			continue
+		}
+		if err = r.sendHeaderedEvent(ctx, userID.Domain(), newChildEvent, string(userID.Domain())); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("space_id", spaceID.String()).Warn("UpgradeRoom: Failed to add new room to space")
+		}
+	}
+}
+
 func (r *Upgrader) getRoomPowerLevels(ctx context.Context, roomID string) (*gomatrixserverlib.PowerLevelContent, error) {
 	oldPowerLevelsEvent := api.GetStateEvent(ctx, r.URSAPI, roomID, gomatrixserverlib.StateKeyTuple{
 		EventType: spec.MRoomPowerLevels,
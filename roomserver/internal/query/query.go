@@ -950,6 +950,12 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	return nil
 }
 
+// QueryRoomBlocked returns whether an admin has blocked the room.
+func (r *Queryer) QueryRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	blockedBy, _, err := r.DB.GetRoomBlock(ctx, roomID)
+	return blockedBy != "", err
+}
+
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, nil, req.EventIDs)
 	if err != nil {
@@ -0,0 +1,172 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	roomserver "github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+)
+
+// QueryRoomSummary returns a summary of the given room for the caller, as per MSC3266.
+//
+// If the local server is participating in the room, the summary is built from the
+// current room state. Otherwise, for client callers, the room hierarchy of the room is
+// fetched over federation using the provided vias.
+func (querier *Queryer) QueryRoomSummary(ctx context.Context, caller types.DeviceOrServerName, roomID spec.RoomID, vias []string) (*roomserver.RoomSummary, error) {
+	var summary *roomserver.RoomSummary
+	if roomExists(ctx, querier, roomID) {
+		summary = querier.localRoomSummary(ctx, roomID)
+	} else {
+		summary = querier.federatedRoomSummary(ctx, caller, roomID, vias)
+	}
+	if summary == nil {
+		return nil, roomserver.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("room is unknown/forbidden")}
+	}
+
+	// Include the membership of the caller, if we know it. This also covers
+	// rooms the user has been invited to over federation.
+	if device := caller.Device(); device != nil {
+		summary.Membership = querier.summaryMembership(ctx, roomID, device.UserID)
+	}
+
+	if !summaryAuthorised(ctx, querier, caller, summary) {
+		return nil, roomserver.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("room is unknown/forbidden")}
+	}
+	return summary, nil
+}
+
+// localRoomSummary builds a room summary from the current state of a room we are joined to.
+func (querier *Queryer) localRoomSummary(ctx context.Context, roomID spec.RoomID) *roomserver.RoomSummary {
+	pubRoom := publicRoomsChunk(ctx, querier, roomID)
+	if pubRoom == nil {
+		return nil
+	}
+	summary := &roomserver.RoomSummary{
+		PublicRoom: *pubRoom,
+	}
+
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCreate, StateKey: ""}
+	encryptionTuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomEncryption, StateKey: ""}
+	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomJoinRules, StateKey: ""}
+	var queryRes roomserver.QueryCurrentStateResponse
+	if err := querier.QueryCurrentState(ctx, &roomserver.QueryCurrentStateRequest{
+		RoomID:      roomID.String(),
+		StateTuples: []gomatrixserverlib.StateKeyTuple{createTuple, encryptionTuple, joinRuleTuple},
+	}, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to QueryCurrentState")
+		return nil
+	}
+
+	if create := queryRes.StateEvents[createTuple]; create != nil {
+		var createContent gomatrixserverlib.CreateContent
+		if err := json.Unmarshal(create.Content(), &createContent); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("create_content", create.Content()).Warn("failed to unmarshal m.room.create event")
+		}
+		summary.RoomType = createContent.RoomType
+		summary.RoomVersion = create.Version()
+	}
+	if encryption := queryRes.StateEvents[encryptionTuple]; encryption != nil {
+		var encryptionContent struct {
+			Algorithm string `json:"algorithm"`
+		}
+		if err := json.Unmarshal(encryption.Content(), &encryptionContent); err == nil {
+			summary.Encryption = encryptionContent.Algorithm
+		}
+	}
+	if joinRuleEv := queryRes.StateEvents[joinRuleTuple]; joinRuleEv != nil {
+		for _, allowed := range restrictedJoinRuleAllowedRooms(ctx, joinRuleEv) {
+			summary.AllowedRoomIDs = append(summary.AllowedRoomIDs, allowed.String())
+		}
+	}
+	return summary
+}
+
+// federatedRoomSummary builds a room summary from the room hierarchy of a remote room.
+func (querier *Queryer) federatedRoomSummary(ctx context.Context, caller types.DeviceOrServerName, roomID spec.RoomID, vias []string) *roomserver.RoomSummary {
+	if len(vias) == 0 && roomID.Domain() != "" {
+		vias = []string{string(roomID.Domain())}
+	}
+	fedRes := federatedRoomInfo(ctx, querier, caller, false, roomID, vias)
+	if fedRes == nil {
+		return nil
+	}
+	return &roomserver.RoomSummary{
+		PublicRoom:     fedRes.Room.PublicRoom,
+		RoomType:       fedRes.Room.RoomType,
+		AllowedRoomIDs: fedRes.Room.AllowedRoomIDs,
+	}
+}
+
+// summaryMembership returns the membership of the given user in the room, or an
+// empty string if the user has no membership.
+func (querier *Queryer) summaryMembership(ctx context.Context, roomID spec.RoomID, userID string) string {
+	var res roomserver.QueryMembershipForUserResponse
+	parsedUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return ""
+	}
+	if err = querier.QueryMembershipForUser(ctx, &roomserver.QueryMembershipForUserRequest{
+		RoomID: roomID.String(),
+		UserID: *parsedUserID,
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Debug("failed to QueryMembershipForUser")
+		return ""
+	}
+	if !res.RoomExists {
+		return ""
+	}
+	return res.Membership
+}
+
+// summaryAuthorised returns true if the caller is allowed to see the summary of the room.
+//
+// As per MSC3266, this is the case if the caller is joined or invited, or the room is
+// world readable, or the join rule allows the caller to join or knock. For restricted
+// rooms, the caller must be joined to one of the allowed rooms.
+func summaryAuthorised(ctx context.Context, querier *Queryer, caller types.DeviceOrServerName, summary *roomserver.RoomSummary) bool {
+	if summary.Membership == spec.Join || summary.Membership == spec.Invite || summary.Membership == spec.Knock {
+		return true
+	}
+	if summary.WorldReadable {
+		return true
+	}
+	switch summary.JoinRule {
+	case spec.Public, spec.Knock, spec.KnockRestricted:
+		return true
+	case spec.Restricted:
+	default:
+		return false
+	}
+
+	device := caller.Device()
+	if device == nil {
+		// Servers are only able to see restricted rooms if they are joined to one
+		// of the allowed rooms, which is checked by QueryNextRoomHierarchyPage.
+		roomID, err := spec.NewRoomID(summary.RoomID)
+		if err != nil {
+			return false
+		}
+		authed, _, _ := authorised(ctx, querier, caller, *roomID, nil)
+		return authed
+	}
+	for _, allowed := range summary.AllowedRoomIDs {
+		allowedRoomID, err := spec.NewRoomID(allowed)
+		if err != nil {
+			continue
+		}
+		if querier.summaryMembership(ctx, *allowedRoomID, device.UserID) == spec.Join {
+			return true
+		}
+	}
+	return false
+}
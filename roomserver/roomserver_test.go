@@ -3,7 +3,9 @@ package roomserver_test
 import (
 	"context"
 	"crypto/ed25519"
+	"fmt"
 	"reflect"
+	"regexp"
 	"testing"
 	"time"
 
@@ -12,6 +14,8 @@ import (
 	"github.com/element-hq/dendrite/internal/eventutil"
 	"github.com/element-hq/dendrite/internal/httputil"
 	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/integrity"
+	"github.com/element-hq/dendrite/roomserver/internal"
 	"github.com/element-hq/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/nats-io/nats.go"
@@ -28,6 +32,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/element-hq/dendrite/federationapi"
+	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/setup/jetstream"
 	"github.com/element-hq/dendrite/syncapi"
 
@@ -767,6 +772,108 @@ func TestQueryRestrictedJoinAllowed(t *testing.T) {
 	})
 }
 
+func TestQueryRoomSummary(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	publicRoom := test.NewRoom(t, alice)
+	publicRoom.CreateAndInsert(t, alice, spec.MRoomName, map[string]interface{}{
+		"name": "Public room",
+	}, test.WithStateKey(""))
+	publicRoom.CreateAndInsert(t, alice, spec.MRoomEncryption, map[string]interface{}{
+		"algorithm": "m.megolm.v1.aes-sha2",
+	}, test.WithStateKey(""))
+
+	privateRoom := test.NewRoom(t, alice, test.RoomPreset(test.PresetPrivateChat))
+
+	invitedRoom := test.NewRoom(t, alice, test.RoomPreset(test.PresetPrivateChat))
+	invitedRoom.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Invite,
+	}, test.WithStateKey(bob.ID))
+
+	restrictedRoom := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV10))
+	restrictedRoom.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Restricted,
+		"allow": []map[string]interface{}{
+			{
+				"room_id": publicRoom.ID,
+				"type":    spec.MRoomMembership,
+			},
+		},
+	}, test.WithStateKey(""))
+
+	testCases := []struct {
+		name           string
+		room           *test.Room
+		joinPublicRoom bool
+		wantErr        bool
+		wantMembership string
+	}{
+		{name: "public room", room: publicRoom},
+		{name: "private room", room: privateRoom, wantErr: true},
+		{name: "invited to private room", room: invitedRoom, wantMembership: spec.Invite},
+		{name: "restricted room, not joined to allowed room", room: restrictedRoom, wantErr: true},
+		{name: "restricted room, joined to allowed room", room: restrictedRoom, joinPublicRoom: true},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, room := range []*test.Room{publicRoom, privateRoom, invitedRoom, restrictedRoom} {
+			if err := api.SendEvents(processCtx.Context(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		bobDevice := types.NewDeviceNotServerName(userAPI.Device{UserID: bob.ID})
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if tc.joinPublicRoom {
+					ev := publicRoom.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+						"membership": spec.Join,
+					}, test.WithStateKey(bob.ID))
+					if err := api.SendEvents(processCtx.Context(), rsAPI, api.KindNew, []*types.HeaderedEvent{ev}, "test", "test", "test", nil, false); err != nil {
+						t.Fatalf("failed to send events: %v", err)
+					}
+				}
+
+				roomID, _ := spec.NewRoomID(tc.room.ID)
+				summary, err := rsAPI.QueryRoomSummary(processCtx.Context(), bobDevice, *roomID, nil)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatalf("expected error, got summary %+v", summary)
+					}
+					if _, ok := err.(api.ErrRoomUnknownOrNotAllowed); !ok {
+						t.Fatalf("expected ErrRoomUnknownOrNotAllowed, got %T", err)
+					}
+					return
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, tc.room.ID, summary.RoomID)
+				assert.Equal(t, tc.room.Version, summary.RoomVersion)
+				assert.Equal(t, tc.wantMembership, summary.Membership)
+				if tc.room == publicRoom {
+					assert.Equal(t, "Public room", summary.Name)
+					assert.Equal(t, "m.megolm.v1.aes-sha2", summary.Encryption)
+					assert.Equal(t, spec.Public, summary.JoinRule)
+					assert.Equal(t, 1, summary.JoinedMembersCount)
+				}
+				if tc.room == restrictedRoom {
+					assert.Equal(t, []string{publicRoom.ID}, summary.AllowedRoomIDs)
+				}
+			})
+		}
+	})
+}
+
 func TestUpgrade(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
@@ -1094,6 +1201,86 @@ func TestUpgrade(t *testing.T) {
 	})
 }
 
+func TestUpgradeMigratesMembersAndSpaces(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		natsInstance := jetstream.NATSInstance{}
+		defer close()
+		cfg.RoomServer.RoomUpgrades.InviteMembers = true
+		cfg.RoomServer.RoomUpgrades.UpdateParentSpaces = true
+		cfg.UserAPI.AutoJoinUpgradedRooms = true
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+
+		// The room is invite only, so Bob can only join the new room if he
+		// is invited to it.
+		room := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV6), test.RoomPreset(test.PresetPrivateChat))
+		room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Invite}, test.WithStateKey(bob.ID))
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		space := test.NewRoom(t, alice)
+		space.CreateAndInsert(t, alice, spec.MSpaceChild, map[string]interface{}{
+			"via": []string{string(cfg.Global.ServerName)},
+		}, test.WithStateKey(room.ID))
+		for _, r := range []*test.Room{room, space} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, r.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		aliceID, err := spec.NewUserID(alice.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newRoomID, err := rsAPI.PerformRoomUpgrade(processCtx.Context(), room.ID, *aliceID, rsAPI.DefaultRoomVersion(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The space should now contain the new room as well
+		childEvent := api.GetStateEvent(ctx, rsAPI, space.ID, gomatrixserverlib.StateKeyTuple{
+			EventType: spec.MSpaceChild,
+			StateKey:  newRoomID,
+		})
+		if childEvent == nil {
+			t.Fatalf("expected the space to contain the new room")
+		}
+		if via := gjson.GetBytes(childEvent.Content(), "via").Array(); len(via) != 1 || via[0].Str != string(cfg.Global.ServerName) {
+			t.Fatalf("unexpected via in space child event: %s", childEvent.Content())
+		}
+
+		// Bob should have been invited to the new room, and then joined it
+		// automatically once the old room was tombstoned.
+		bobID, err := spec.NewUserID(bob.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var membership string
+		for i := 0; i < 50; i++ {
+			res := &api.QueryMembershipForUserResponse{}
+			if err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{RoomID: newRoomID, UserID: *bobID}, res); err != nil {
+				t.Fatal(err)
+			}
+			if membership = res.Membership; membership == spec.Join {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if membership != spec.Join {
+			t.Fatalf("expected bob to be joined to the new room, got membership %q", membership)
+		}
+	})
+}
+
 func TestStateReset(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
@@ -1351,3 +1538,861 @@ func TestEmptyRooms(t *testing.T) {
 		assert.Equal(t, []string{r2.ID}, emptyRooms)
 	})
 }
+
+func TestPartialStateRoom(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	initialEvents := room.Events()
+	// Alice bans Bob, but the ban isn't added to the test room so that Bob
+	// can still join and send events.
+	bobBanEv := room.CreateEvent(t, alice, spec.MRoomMember, map[string]interface{}{"membership": spec.Ban}, test.WithStateKey(bob.ID))
+	bobJoinEv := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	charlieJoinEv := room.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+
+	bobMembership := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomMember, StateKey: bob.ID}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, initialEvents, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// Bob's join and ban are known, but aren't part of the partial state
+		// that Charlie's join arrives with.
+		if err := api.SendEvents(ctx, rsAPI, api.KindOutlier, []*types.HeaderedEvent{bobJoinEv, bobBanEv}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send outlier: %v", err)
+		}
+		partialStateIDs := make([]string, len(initialEvents))
+		for i := range initialEvents {
+			partialStateIDs[i] = initialEvents[i].EventID()
+		}
+		if err := api.SendInputRoomEvents(ctx, rsAPI, "test", []api.InputRoomEvent{{
+			Kind:          api.KindNew,
+			Event:         charlieJoinEv,
+			Origin:        "test",
+			HasState:      true,
+			StateEventIDs: partialStateIDs,
+		}}, false); err != nil {
+			t.Fatalf("failed to send join: %v", err)
+		}
+
+		// Only our own server is in the room, so the background resync has
+		// nobody to ask and the room stays partial.
+		err := rsAPI.PerformMarkPartialStateRoom(ctx, api.PartialStateRoom{
+			RoomID:        room.ID,
+			JoinEventID:   charlieJoinEv.EventID(),
+			ServersInRoom: []spec.ServerName{cfg.Global.ServerName},
+		})
+		assert.NoError(t, err)
+
+		partialRoom, err := rsAPI.QueryPartialStateRoom(ctx, room.ID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, partialRoom) {
+			assert.Equal(t, charlieJoinEv.EventID(), partialRoom.JoinEventID)
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		assert.ErrorIs(t, rsAPI.WaitForFullState(waitCtx, room.ID), context.DeadlineExceeded)
+		cancel()
+		assert.Nil(t, api.GetStateEvent(ctx, rsAPI, room.ID, bobMembership))
+
+		// Bob isn't joined according to the partial state, but events from him
+		// must not be rejected while the room is partial.
+		bobMsgEv := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		bobRenameEv := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join, "displayname": "Bob"}, test.WithStateKey(bob.ID))
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{bobMsgEv, bobRenameEv}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		roomInfo, err := internalAPI.DB.RoomInfo(ctx, room.ID)
+		assert.NoError(t, err)
+		latest, _, _, err := internalAPI.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{bobRenameEv.EventID()}, latest)
+		bobMembershipEv := api.GetStateEvent(ctx, rsAPI, room.ID, bobMembership)
+		if assert.NotNil(t, bobMembershipEv) {
+			assert.Equal(t, bobRenameEv.EventID(), bobMembershipEv.EventID())
+		}
+
+		// According to the full state Bob is banned, so his events are
+		// soft-failed and his membership is filled in with the ban.
+		fullStateIDs := append(partialStateIDs, bobBanEv.EventID(), charlieJoinEv.EventID())
+		fullState, err := internalAPI.DB.StateEntriesForEventIDs(ctx, fullStateIDs, true)
+		assert.NoError(t, err)
+		assert.NoError(t, internalAPI.Inputer.MergeFullState(ctx, room.ID, roomInfo, fullState))
+		assert.NoError(t, internalAPI.DB.ClearRoomPartialState(ctx, roomInfo.RoomNID))
+
+		bobMembershipEv = api.GetStateEvent(ctx, rsAPI, room.ID, bobMembership)
+		if assert.NotNil(t, bobMembershipEv) {
+			assert.Equal(t, bobBanEv.EventID(), bobMembershipEv.EventID())
+		}
+		partialRoom, err = rsAPI.QueryPartialStateRoom(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, partialRoom)
+		assert.NoError(t, rsAPI.WaitForFullState(ctx, room.ID))
+	})
+}
+
+func TestPurgeHistory(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	var messages []*types.HeaderedEvent
+	for i := 0; i < 5; i++ {
+		messages = append(messages, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": fmt.Sprintf("message %d", i)}))
+	}
+	stateEvents := room.Events()[:len(room.Events())-len(messages)]
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// Both parameters, or neither, is an error.
+		_, err := rsAPI.PerformAdminPurgeHistory(ctx, &api.PerformPurgeHistoryRequest{RoomID: room.ID})
+		assert.Error(t, err)
+		_, err = rsAPI.PerformAdminPurgeHistory(ctx, &api.PerformPurgeHistoryRequest{RoomID: "!unknown:test", BeforeTS: 1})
+		assert.ErrorIs(t, err, eventutil.ErrRoomNoExists{})
+
+		// Local events are kept unless asked otherwise.
+		purgeID, err := rsAPI.PerformAdminPurgeHistory(ctx, &api.PerformPurgeHistoryRequest{
+			RoomID:        room.ID,
+			BeforeEventID: messages[3].EventID(),
+		})
+		assert.NoError(t, err)
+		status := waitForPurge(t, rsAPI, purgeID)
+		assert.Equal(t, api.PurgeHistoryStatusComplete, status.Status)
+		assert.Equal(t, 0, status.PurgedEvents)
+
+		purgeID, err = rsAPI.PerformAdminPurgeHistory(ctx, &api.PerformPurgeHistoryRequest{
+			RoomID:            room.ID,
+			BeforeEventID:     messages[3].EventID(),
+			DeleteLocalEvents: true,
+		})
+		assert.NoError(t, err)
+		status = waitForPurge(t, rsAPI, purgeID)
+		assert.Equal(t, api.PurgeHistoryStatusComplete, status.Status, status.Error)
+		assert.Equal(t, 3, status.PurgedEvents)
+
+		for i, ev := range messages {
+			nids, err := internalAPI.DB.EventNIDs(ctx, []string{ev.EventID()})
+			assert.NoError(t, err)
+			_, found := nids[ev.EventID()]
+			assert.Equal(t, i >= 3, found, "message %d", i)
+		}
+		for _, ev := range stateEvents {
+			if ev.StateKey() == nil {
+				continue
+			}
+			stateEv := api.GetStateEvent(ctx, rsAPI, room.ID, gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()})
+			if assert.NotNil(t, stateEv) {
+				assert.Equal(t, ev.EventID(), stateEv.EventID())
+			}
+		}
+
+		// The room must still accept new events.
+		newMsg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "after the purge"})
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{newMsg}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+		roomInfo, err := internalAPI.DB.RoomInfo(ctx, room.ID)
+		assert.NoError(t, err)
+		events, err := internalAPI.DB.EventsFromIDs(ctx, roomInfo, []string{newMsg.EventID()})
+		assert.NoError(t, err)
+		if assert.Len(t, events, 1) {
+			assert.False(t, events[0].Rejected)
+		}
+
+		status, err = rsAPI.QueryAdminPurgeHistoryStatus(ctx, "unknown")
+		assert.NoError(t, err)
+		assert.Nil(t, status)
+	})
+}
+
+func waitForPurge(t *testing.T, rsAPI api.RoomserverInternalAPI, purgeID string) *api.PurgeHistoryStatus {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		status, err := rsAPI.QueryAdminPurgeHistoryStatus(context.Background(), purgeID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status == nil {
+			t.Fatalf("purge %s not found", purgeID)
+		}
+		if status.Status != api.PurgeHistoryStatusActive {
+			return status
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatalf("purge %s did not finish", purgeID)
+	return nil
+}
+
+func TestRetentionPurge(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+	now := time.Now()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, alice, api.MRoomRetention, map[string]interface{}{
+		"max_lifetime": (time.Hour * 24).Milliseconds(),
+	}, test.WithStateKey(""))
+	oldMsg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "old"}, test.WithTimestamp(now.Add(-time.Hour*48)))
+	newMsg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "new"}, test.WithTimestamp(now))
+
+	// A room without a policy of its own is unaffected, as there is no default.
+	otherRoom := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	otherOldMsg := otherRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "old"}, test.WithTimestamp(now.Add(-time.Hour*48)))
+	otherRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "new"}, test.WithTimestamp(now))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+		cfg.RoomServer.Retention.Enabled = true
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+
+		for _, r := range []*test.Room{room, otherRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, r.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		if err := internalAPI.Admin.PurgeExpiredEvents(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		for eventID, wantFound := range map[string]bool{
+			oldMsg.EventID():      false,
+			newMsg.EventID():      true,
+			otherOldMsg.EventID(): true,
+		} {
+			nids, err := internalAPI.DB.EventNIDs(ctx, []string{eventID})
+			assert.NoError(t, err)
+			_, found := nids[eventID]
+			assert.Equal(t, wantFound, found, eventID)
+		}
+	})
+}
+
+func TestCompressState(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	// Every state event adds another state block to the snapshots after it.
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	for i := 0; i < 200; i++ {
+		room.CreateAndInsert(t, alice, "com.example.state", map[string]interface{}{"i": i}, test.WithStateKey(fmt.Sprintf("key%d", i)))
+	}
+	// Overwrite some of the earlier state, so that not every block is still needed.
+	for i := 0; i < 200; i += 10 {
+		room.CreateAndInsert(t, alice, "com.example.state", map[string]interface{}{"i": -i}, test.WithStateKey(fmt.Sprintf("key%d", i)))
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		roomInfo, err := internalAPI.DB.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		stateAtEvents := func() map[string][]types.StateEntry {
+			stateRes := state.NewStateResolution(internalAPI.DB, roomInfo, rsAPI)
+			res := map[string][]types.StateEntry{}
+			for _, ev := range room.Events() {
+				entries, err := stateRes.LoadStateAtEvent(ctx, ev.EventID())
+				if err != nil {
+					t.Fatalf("failed to load state at %s: %v", ev.EventID(), err)
+				}
+				res[ev.EventID()] = entries
+			}
+			return res
+		}
+		before := stateAtEvents()
+
+		_, err = rsAPI.PerformAdminCompressState(ctx, "!unknown:test")
+		assert.ErrorIs(t, err, eventutil.ErrRoomNoExists{})
+
+		jobID, err := rsAPI.PerformAdminCompressState(ctx, room.ID)
+		assert.NoError(t, err)
+		var status *api.CompressStateStatus
+		for i := 0; i < 100; i++ {
+			if status, err = rsAPI.QueryAdminCompressStateStatus(ctx, jobID); err != nil || status == nil {
+				t.Fatalf("failed to get job status: %v", err)
+			}
+			if status.Status != api.CompressStateStatusActive {
+				break
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		assert.Equal(t, api.CompressStateStatusComplete, status.Status, status.Error)
+		assert.Equal(t, 1, status.RoomsDone)
+		assert.Greater(t, status.CompressedSnapshots, 0)
+		assert.Greater(t, status.RemovedBlocks, 0)
+
+		assert.Equal(t, before, stateAtEvents())
+
+		// Compressing again shouldn't find anything else to do.
+		res, err := internalAPI.DB.CompressRoomState(ctx, roomInfo.RoomNID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, res.CompressedSnapshots)
+
+		// The room must still accept new events.
+		ev := room.CreateAndInsert(t, alice, "com.example.state", map[string]interface{}{"i": 1000}, test.WithStateKey("key0"))
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, []*types.HeaderedEvent{ev}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send event after compressing: %v", err)
+		}
+		stateEv := api.GetStateEvent(ctx, rsAPI, room.ID, gomatrixserverlib.StateKeyTuple{EventType: "com.example.state", StateKey: "key0"})
+		if assert.NotNil(t, stateEv) {
+			assert.Equal(t, ev.EventID(), stateEv.EventID())
+		}
+	})
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	bobJoin := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	nameEvent := room.CreateAndInsert(t, alice, spec.MRoomName, map[string]interface{}{"name": "integrity"}, test.WithStateKey(""))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		db := rsAPI.(*internal.RoomserverInternalAPI).DB
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		checkIntegrity := func(roomID string) *api.CheckIntegrityStatus {
+			jobID, err := rsAPI.PerformAdminCheckIntegrity(ctx, roomID)
+			assert.NoError(t, err)
+			var status *api.CheckIntegrityStatus
+			for i := 0; i < 100; i++ {
+				if status, err = rsAPI.QueryAdminCheckIntegrityStatus(ctx, jobID); err != nil || status == nil {
+					t.Fatalf("failed to get job status: %v", err)
+				}
+				if status.Status != api.CheckIntegrityStatusActive {
+					break
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			assert.Equal(t, api.CheckIntegrityStatusComplete, status.Status, status.Error)
+			return status
+		}
+
+		_, err := rsAPI.PerformAdminCheckIntegrity(ctx, "!unknown:test")
+		assert.ErrorIs(t, err, eventutil.ErrRoomNoExists{})
+
+		// A room which was built normally is consistent.
+		status := checkIntegrity(room.ID)
+		assert.Equal(t, 1, status.RoomsDone)
+		assert.Empty(t, status.Reports)
+		report, err := integrity.CheckRoom(ctx, db, rsAPI, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, len(room.Events()), report.Events)
+		assert.Empty(t, report.Problems)
+
+		// Reset the current state to before Bob joined, so that it matches
+		// neither the forward extremities nor the membership table.
+		roomInfo, err := db.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		stateNID, err := db.SnapshotNIDFromEventID(ctx, bobJoin.EventID())
+		assert.NoError(t, err)
+		updater, err := db.GetRoomUpdater(ctx, roomInfo)
+		assert.NoError(t, err)
+		lastSent, err := db.EventNIDs(ctx, []string{updater.LastEventIDSent()})
+		assert.NoError(t, err)
+		assert.NoError(t, updater.SetLatestEvents(roomInfo.RoomNID, updater.LatestEvents(), lastSent[updater.LastEventIDSent()].EventNID, stateNID))
+		assert.NoError(t, updater.Commit())
+
+		// Make Bob's join refer to a state snapshot which doesn't exist.
+		bobJoinNIDs, err := db.EventNIDs(ctx, []string{bobJoin.EventID()})
+		assert.NoError(t, err)
+		assert.NoError(t, db.SetState(ctx, bobJoinNIDs[bobJoin.EventID()].EventNID, 999999))
+
+		report, err = integrity.CheckRoom(ctx, db, rsAPI, room.ID)
+		assert.NoError(t, err)
+		assert.False(t, report.Consistent())
+		problems := map[string][]types.IntegrityProblem{}
+		for _, problem := range report.Problems {
+			problems[problem.Kind] = append(problems[problem.Kind], problem)
+		}
+		if assert.Len(t, problems[types.IntegrityMissingStateSnapshot], 1) {
+			assert.Equal(t, bobJoin.EventID(), problems[types.IntegrityMissingStateSnapshot][0].EventID)
+		}
+		if assert.Len(t, problems[types.IntegrityCurrentStateMismatch], 2) {
+			expected := map[string]string{}
+			for _, problem := range problems[types.IntegrityCurrentStateMismatch] {
+				assert.Empty(t, problem.EventID)
+				expected[problem.EventType] = problem.ExpectedEventID
+			}
+			assert.Equal(t, map[string]string{
+				spec.MRoomMember: bobJoin.EventID(),
+				spec.MRoomName:   nameEvent.EventID(),
+			}, expected)
+		}
+		if assert.Len(t, problems[types.IntegrityMembershipMismatch], 1) {
+			problem := problems[types.IntegrityMembershipMismatch][0]
+			assert.Equal(t, bobJoin.EventID(), problem.EventID)
+			assert.Empty(t, problem.ExpectedEventID)
+			if assert.NotNil(t, problem.StateKey) {
+				assert.Equal(t, bob.ID, *problem.StateKey)
+			}
+		}
+
+		status = checkIntegrity("")
+		if assert.Len(t, status.Reports, 1) {
+			assert.Equal(t, room.ID, status.Reports[0].RoomID)
+			assert.Equal(t, len(report.Problems), len(status.Reports[0].Problems))
+		}
+	})
+}
+
+func TestDeleteRoom(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, natsInstance, rsAPI, nil, caching.DisableMetrics, testIsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		_, err := rsAPI.PerformAdminDeleteRoom(ctx, &api.PerformDeleteRoomRequest{RoomID: "!unknown:test"})
+		assert.ErrorIs(t, err, eventutil.ErrRoomNoExists{})
+
+		deleteID, err := rsAPI.PerformAdminDeleteRoom(ctx, &api.PerformDeleteRoomRequest{
+			RoomID:        room.ID,
+			RequestedBy:   alice.ID,
+			Block:         true,
+			NewRoomUserID: alice.ID,
+			NewRoomName:   "Room deleted",
+			Message:       "This room has been deleted",
+		})
+		assert.NoError(t, err)
+		var status *api.DeleteRoomStatus
+		for i := 0; i < 100; i++ {
+			if status, err = rsAPI.QueryAdminDeleteRoomStatus(ctx, deleteID); err != nil || status == nil {
+				t.Fatalf("failed to get delete status: %v", err)
+			}
+			if status.Status != api.DeleteRoomStatusActive {
+				break
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		assert.Equal(t, api.DeleteRoomStatusComplete, status.Status, status.Error)
+		assert.Equal(t, 2, status.UsersTotal)
+		assert.ElementsMatch(t, []string{alice.ID, bob.ID}, status.KickedUsers)
+		assert.Empty(t, status.FailedToKickUsers)
+		assert.False(t, status.Purged)
+		assert.NotEmpty(t, status.NewRoomID)
+
+		// Everyone has left the old room, and bob is in the new one.
+		for _, user := range []*test.User{alice, bob} {
+			userID, err := spec.NewUserID(user.ID, true)
+			assert.NoError(t, err)
+			res := &api.QueryMembershipForUserResponse{}
+			err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{RoomID: room.ID, UserID: *userID}, res)
+			assert.NoError(t, err)
+			assert.Equal(t, spec.Leave, res.Membership)
+			res = &api.QueryMembershipForUserResponse{}
+			err = rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{RoomID: status.NewRoomID, UserID: *userID}, res)
+			assert.NoError(t, err)
+			assert.Equal(t, spec.Join, res.Membership)
+		}
+
+		// The new room contains the notice.
+		res := &api.QueryLatestEventsAndStateResponse{}
+		err = rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{RoomID: status.NewRoomID}, res)
+		assert.NoError(t, err)
+		for _, ev := range res.StateEvents {
+			if ev.Type() == spec.MRoomName {
+				assert.Equal(t, "Room deleted", gjson.GetBytes(ev.Content(), "name").Str)
+			}
+		}
+
+		// The old room is blocked, so nobody can join it or be invited to it.
+		block, err := rsAPI.QueryAdminRoomBlock(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.True(t, block.Blocked)
+		assert.Equal(t, alice.ID, block.BlockedBy)
+
+		_, _, err = rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{RoomIDOrAlias: room.ID, UserID: bob.ID})
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		validRoomID, _ := spec.NewRoomID(room.ID)
+		inviter, _ := spec.NewUserID(alice.ID, true)
+		invitee, _ := spec.NewUserID(charlie.ID, true)
+		err = rsAPI.PerformInvite(ctx, &api.PerformInviteRequest{
+			InviteInput: api.InviteInput{
+				RoomID:  *validRoomID,
+				Inviter: *inviter,
+				Invitee: *invitee,
+			},
+		})
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		// Once unblocked, users can join again.
+		assert.NoError(t, rsAPI.PerformAdminBlockRoom(ctx, room.ID, alice.ID, false))
+		block, err = rsAPI.QueryAdminRoomBlock(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.False(t, block.Blocked)
+		_, _, err = rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{RoomIDOrAlias: room.ID, UserID: bob.ID})
+		assert.NoError(t, err)
+	})
+}
+
+func TestMergeForwardExtremities(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	// Events which all reference the same prev event, as if they were sent
+	// on different sides of a netsplit.
+	forkedEvents := func(count int) []*types.HeaderedEvent {
+		events := make([]*types.HeaderedEvent, count)
+		for i := range events {
+			events[i] = room.CreateEvent(t, alice, "m.room.message", map[string]interface{}{"body": fmt.Sprintf("fork %d", i)})
+		}
+		return events
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+		cfg.RoomServer.MaxForwardExtremities = 0
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+		internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		roomInfo, err := internalAPI.DB.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		latestEvents := func() []string {
+			latest, _, _, err := internalAPI.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+			if err != nil {
+				t.Fatalf("failed to get latest events: %v", err)
+			}
+			return latest
+		}
+
+		// Merging is disabled, so the forward extremities are left alone
+		// until an admin asks for them to be merged.
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, forkedEvents(25), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		assert.Len(t, latestEvents(), 25)
+
+		_, err = rsAPI.PerformAdminMergeForwardExtremities(ctx, "!unknown:test")
+		assert.ErrorIs(t, err, eventutil.ErrRoomNoExists{})
+
+		merged, err := rsAPI.PerformAdminMergeForwardExtremities(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 24, merged)
+		latest := latestEvents()
+		if assert.Len(t, latest, 1) {
+			ev, err := internalAPI.DB.EventsFromIDs(ctx, roomInfo, latest)
+			assert.NoError(t, err)
+			if assert.Len(t, ev, 1) {
+				assert.Equal(t, "org.matrix.dummy_event", ev[0].Type())
+				assert.Equal(t, alice.ID, string(ev[0].SenderID()))
+			}
+		}
+
+		// Once there are too many forward extremities, they are merged
+		// automatically.
+		cfg.RoomServer.MaxForwardExtremities = 5
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, forkedEvents(10), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		for i := 0; i < 100 && len(latestEvents()) > 5; i++ {
+			time.Sleep(time.Millisecond * 50)
+		}
+		assert.LessOrEqual(t, len(latestEvents()), 5)
+	})
+}
+
+func TestPublicationPolicy(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	aliceRoom := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	bobRoom := test.NewRoom(t, bob, test.RoomPreset(test.PresetPublicChat))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, room := range []*test.Room{aliceRoom, bobRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		publishedRooms := func() []string {
+			res := api.QueryPublishedRoomsResponse{}
+			err := rsAPI.QueryPublishedRooms(ctx, &api.QueryPublishedRoomsRequest{IncludeAllNetworks: true}, &res)
+			assert.NoError(t, err)
+			return res.RoomIDs
+		}
+
+		// With the approval policy, rooms are queued until an admin approves them
+		cfg.RoomServer.RoomDirectory.PublicationPolicy = config.PublicationPolicyApproval
+		err := rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: aliceRoom.ID, Visibility: spec.Public, UserID: alice.ID})
+		assert.ErrorIs(t, err, api.ErrPublicationPending)
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: bobRoom.ID, Visibility: spec.Public, UserID: bob.ID})
+		assert.ErrorIs(t, err, api.ErrPublicationPending)
+		assert.Empty(t, publishedRooms())
+
+		requests, err := rsAPI.QueryAdminPublicationRequests(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, requests, 2)
+		for _, request := range requests {
+			switch request.RoomID {
+			case aliceRoom.ID:
+				assert.Equal(t, alice.ID, request.RequestedBy)
+			case bobRoom.ID:
+				assert.Equal(t, bob.ID, request.RequestedBy)
+			default:
+				t.Errorf("unexpected publication request for %s", request.RoomID)
+			}
+		}
+
+		err = rsAPI.PerformAdminReviewPublication(ctx, "!unknown:test", "@admin:test", true)
+		assert.ErrorIs(t, err, api.ErrNoPublicationRequest)
+		assert.NoError(t, rsAPI.PerformAdminReviewPublication(ctx, aliceRoom.ID, "@admin:test", true))
+		assert.NoError(t, rsAPI.PerformAdminReviewPublication(ctx, bobRoom.ID, "@admin:test", false))
+		assert.Equal(t, []string{aliceRoom.ID}, publishedRooms())
+
+		requests, err = rsAPI.QueryAdminPublicationRequests(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, requests)
+
+		entries, err := rsAPI.QueryAdminPublishedRooms(ctx)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, aliceRoom.ID, entries[0].RoomID)
+			assert.Equal(t, alice.ID, entries[0].PublishedBy)
+		}
+
+		// Application services aren't subject to the policy, but the admin
+		// can still remove their entries
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{
+			RoomID: aliceRoom.ID, Visibility: spec.Public, UserID: "@irc:test", AppserviceID: "irc", NetworkID: "irc",
+		})
+		assert.NoError(t, err)
+		entries, err = rsAPI.QueryAdminPublishedRooms(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.NoError(t, rsAPI.PerformAdminUnpublishRoom(ctx, aliceRoom.ID, "@admin:test"))
+		entries, err = rsAPI.QueryAdminPublishedRooms(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+
+		// With the rules policy, only rooms matching the rules are published
+		cfg.RoomServer.RoomDirectory.PublicationPolicy = config.PublicationPolicyRules
+		cfg.RoomServer.RoomDirectory.PublicationRules = []config.PublicationRule{
+			{Action: "deny", Alias: "#secret.*:test"},
+			{Action: "allow", Creator: regexp.QuoteMeta(alice.ID)},
+		}
+		configErrs := &config.ConfigErrors{}
+		cfg.RoomServer.RoomDirectory.Verify(configErrs)
+		assert.Empty(t, *configErrs)
+
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: bobRoom.ID, Visibility: spec.Public, UserID: bob.ID})
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: aliceRoom.ID, Visibility: spec.Public, UserID: alice.ID})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{aliceRoom.ID}, publishedRooms())
+
+		// Rooms with a denied alias can't be published, even by alice
+		validRoomID, _ := spec.NewRoomID(aliceRoom.ID)
+		_, err = rsAPI.SetRoomAlias(ctx, spec.SenderID(alice.ID), *validRoomID, "#secret-plans:test")
+		assert.NoError(t, err)
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: aliceRoom.ID, Visibility: spec.Public, UserID: alice.ID})
+		assert.ErrorAs(t, err, &api.ErrNotAllowed{})
+
+		// Unpublishing is always allowed
+		err = rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: aliceRoom.ID, Visibility: "private", UserID: alice.ID})
+		assert.NoError(t, err)
+		assert.Empty(t, publishedRooms())
+	})
+}
+
+func TestRedactUserEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	bobJoin := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+	spam := []*types.HeaderedEvent{
+		room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "spam"}),
+		room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "more spam"}),
+	}
+	hello := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		natsInstance := &jetstream.NATSInstance{}
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		redactUserEvents := func(req *api.PerformRedactUserEventsRequest) *api.RedactUserEventsStatus {
+			jobID, err := rsAPI.PerformAdminRedactUserEvents(ctx, req)
+			assert.NoError(t, err)
+			var status *api.RedactUserEventsStatus
+			for i := 0; i < 100; i++ {
+				if status, err = rsAPI.QueryAdminRedactUserEventsStatus(ctx, jobID); err != nil || status == nil {
+					t.Fatalf("failed to get job status: %v", err)
+				}
+				if status.Status != api.RedactUserEventsStatusActive {
+					break
+				}
+				time.Sleep(time.Millisecond * 50)
+			}
+			assert.Equal(t, api.RedactUserEventsStatusComplete, status.Status, status.Error)
+			return status
+		}
+
+		_, err := rsAPI.PerformAdminRedactUserEvents(ctx, &api.PerformRedactUserEventsRequest{UserID: "bob"})
+		assert.Error(t, err)
+		_, err = rsAPI.PerformAdminRedactUserEvents(ctx, &api.PerformRedactUserEventsRequest{UserID: bob.ID, RoomIDs: []string{"#alias:test"}})
+		assert.Error(t, err)
+		_, err = rsAPI.PerformAdminRedactUserEvents(ctx, &api.PerformRedactUserEventsRequest{UserID: bob.ID, Since: 2, Until: 1})
+		assert.Error(t, err)
+
+		// Nothing was sent by Bob in the time window, so nothing is redacted.
+		status := redactUserEvents(&api.PerformRedactUserEventsRequest{
+			UserID:      bob.ID,
+			RequestedBy: alice.ID,
+			Since:       spec.AsTimestamp(time.Now().Add(time.Hour)),
+		})
+		assert.Equal(t, 1, status.RoomsTotal)
+		assert.Equal(t, 0, status.EventsFound)
+
+		// Bob's messages are redacted by Alice, the only local user with
+		// enough power, but his membership and Alice's message are not.
+		status = redactUserEvents(&api.PerformRedactUserEventsRequest{
+			UserID:      bob.ID,
+			RequestedBy: alice.ID,
+			Reason:      "spam",
+			RateLimit:   100,
+		})
+		assert.Equal(t, 1, status.RoomsDone)
+		assert.Equal(t, len(spam), status.EventsFound)
+		assert.Equal(t, len(spam), status.EventsRedacted)
+		assert.Equal(t, 0, status.EventsFailed)
+		assert.Empty(t, status.SkippedRooms)
+
+		redacted := map[string]bool{}
+		for _, event := range spam {
+			redacted[event.EventID()] = true
+		}
+		res := &api.QueryEventsByIDResponse{}
+		err = rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+			RoomID:   room.ID,
+			EventIDs: []string{spam[0].EventID(), spam[1].EventID(), bobJoin.EventID(), hello.EventID()},
+		}, res)
+		assert.NoError(t, err)
+		assert.Len(t, res.Events, 4)
+		for _, event := range res.Events {
+			redactedBecause := gjson.GetBytes(event.Unsigned(), "redacted_because")
+			assert.Equal(t, redacted[event.EventID()], redactedBecause.Exists(), event.EventID())
+		}
+
+		// Running again doesn't redact the same events twice.
+		status = redactUserEvents(&api.PerformRedactUserEventsRequest{UserID: bob.ID, RoomIDs: []string{room.ID}})
+		assert.Equal(t, 0, status.EventsFound)
+	})
+}
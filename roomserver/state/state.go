@@ -783,6 +783,27 @@ func (v *StateResolution) CalculateAndStoreStateAfterEvents(
 	return stateNID, nil
 }
 
+// CalculateStateAfterEvents works out the room state after the given events,
+// in the same way as CalculateAndStoreStateAfterEvents, but doesn't store it.
+// Returns the state entries sorted by state key tuple.
+func (v *StateResolution) CalculateStateAfterEvents(
+	ctx context.Context,
+	prevStates []types.StateAtEvent,
+) ([]types.StateEntry, error) {
+	trace, ctx := internal.StartRegion(ctx, "StateResolution.CalculateStateAfterEvents")
+	defer trace.EndRegion()
+
+	if len(prevStates) == 0 {
+		return nil, nil
+	}
+	state, _, _, err := v.calculateStateAfterManyEvents(ctx, v.roomInfo.RoomVersion, prevStates)
+	if err != nil {
+		return nil, fmt.Errorf("v.calculateStateAfterManyEvents: %w", err)
+	}
+	sort.Sort(stateEntrySorter(state))
+	return state, nil
+}
+
 // maxStateBlockNIDs is the maximum number of state data blocks to use to encode a snapshot of room state.
 // Increasing this number means that we can encode more of the state changes as simple deltas which means that
 // we need fewer entries in the state data table. However making this number bigger will increase the size of
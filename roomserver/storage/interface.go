@@ -137,7 +137,11 @@ type Database interface {
 	// Returns an error if the retrieval went wrong.
 	EventsFromIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]types.Event, error)
 	// PerformPublish publishes or unpublishes a room from the room directory. Returns a database error, if any.
-	PublishRoom(ctx context.Context, roomID, appserviceID, networkID string, publish bool) error
+	PublishRoom(ctx context.Context, roomID, appserviceID, networkID, publishedBy string, publish bool) error
+	// UnpublishRoom removes every entry of the room from the room directory, and any request to publish it.
+	UnpublishRoom(ctx context.Context, roomID, unpublishedBy string) error
+	// GetPublishedRoomEntries returns every entry in the room directory, with who published it and when.
+	GetPublishedRoomEntries(ctx context.Context) ([]api.PublishedRoom, error)
 	// Returns a list of room IDs for rooms which are published.
 	GetPublishedRooms(ctx context.Context, networkID string, includeAllNetworks bool) ([]string, error)
 	// Returns whether a given room is published or not.
@@ -169,6 +173,52 @@ type Database interface {
 	GetHistoryVisibilityState(ctx context.Context, roomInfo *types.RoomInfo, eventID string, domain string) ([]gomatrixserverlib.PDU, error)
 	GetLeftUsers(ctx context.Context, userIDs []string) ([]string, error)
 	PurgeRoom(ctx context.Context, roomID string) error
+	// RoomEventNIDsBeforeDepth returns the NIDs of the events in the room with a depth lower than the given depth.
+	RoomEventNIDsBeforeDepth(ctx context.Context, roomNID types.RoomNID, depth int64) ([]types.EventNID, error)
+	// RoomEventNIDsBeforeDepthAfter returns up to limit NIDs of the events in the room with a depth lower than the
+	// given depth, which come after the given depth and event NID in depth order, and the depth of the last of them.
+	RoomEventNIDsBeforeDepthAfter(ctx context.Context, roomNID types.RoomNID, depth, afterDepth int64, afterNID types.EventNID, limit int) ([]types.EventNID, int64, error)
+	// RoomEventStateSnapshotNIDs returns the state snapshot NID of every event in the room that has one.
+	RoomEventStateSnapshotNIDs(ctx context.Context, roomNID types.RoomNID) (map[types.EventNID]types.StateSnapshotNID, error)
+	// RoomEventNIDsBySender returns the NIDs of the events in the room, which aren't outliers, sent by the sender.
+	RoomEventNIDsBySender(ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID) ([]types.EventNID, error)
+	// RoomStateSnapshotNIDs returns the NIDs of all state snapshots in the room.
+	RoomStateSnapshotNIDs(ctx context.Context, roomNID types.RoomNID) ([]types.StateSnapshotNID, error)
+	// RoomMembershipEventNIDs returns the membership event NID of every user in the membership table for the room.
+	RoomMembershipEventNIDs(ctx context.Context, roomNID types.RoomNID) (map[types.EventStateKeyNID]types.EventNID, error)
+	// PurgeHistory removes the given events from the room, and forgets the state before the events in
+	// clearStateNIDs, along with any state that is no longer referenced afterwards.
+	PurgeHistory(ctx context.Context, roomNID types.RoomNID, purgeNIDs, clearStateNIDs []types.EventNID) error
+	// CompressRoomState rewrites the state snapshots of the room to use fewer, shared state blocks,
+	// and removes the state blocks which are no longer used. Events must not be added to the room
+	// while this is running.
+	CompressRoomState(ctx context.Context, roomNID types.RoomNID) (*types.StateCompressionResult, error)
+	// SetRoomPartialState marks the room as having partial state (MSC3706).
+	SetRoomPartialState(ctx context.Context, roomNID types.RoomNID, joinEventID string, serversInRoom []spec.ServerName) error
+	// GetRoomPartialState returns the join event ID and the servers in the room for a room
+	// with partial state. The join event ID is empty if the room has full state.
+	GetRoomPartialState(ctx context.Context, roomNID types.RoomNID) (joinEventID string, serversInRoom []spec.ServerName, err error)
+	// GetPartialStateRooms returns the room IDs of all rooms with partial state.
+	GetPartialStateRooms(ctx context.Context) ([]string, error)
+	// ClearRoomPartialState marks the room as having full state.
+	ClearRoomPartialState(ctx context.Context, roomNID types.RoomNID) error
+	// BlockRoom blocks the room, so that local users can't join or be invited to it.
+	BlockRoom(ctx context.Context, roomID, blockedBy string) error
+	// UnblockRoom removes the room from the block list.
+	UnblockRoom(ctx context.Context, roomID string) error
+	// GetRoomBlock returns who blocked the room and when. The user ID is empty if
+	// the room isn't blocked.
+	GetRoomBlock(ctx context.Context, roomID string) (blockedBy string, blockedTS spec.Timestamp, err error)
+	// RequestRoomPublication records that the user asked for the room to be published,
+	// so that a server admin can approve it.
+	RequestRoomPublication(ctx context.Context, roomID, requestedBy string) error
+	// RemovePublicationRequest forgets the request to publish the room.
+	RemovePublicationRequest(ctx context.Context, roomID string) error
+	// GetPublicationRequest returns who asked for the room to be published and when.
+	// The user ID is empty if nobody has.
+	GetPublicationRequest(ctx context.Context, roomID string) (requestedBy string, requestedTS spec.Timestamp, err error)
+	// GetPublicationRequests returns the rooms waiting to be approved for the room directory.
+	GetPublicationRequests(ctx context.Context) ([]api.PublicationRequest, error)
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
 
 	// GetMembershipForHistoryVisibility queries the membership events for the given eventIDs.
@@ -187,6 +237,8 @@ type Database interface {
 
 	// RoomsWithACLs returns all room IDs for rooms with ACLs
 	RoomsWithACLs(ctx context.Context) ([]string, error)
+	// RoomsWithEventType returns all room IDs for rooms with at least one event of the given type
+	RoomsWithEventType(ctx context.Context, eventType string) ([]string, error)
 
 	// EmptyRooms returns all rooms that the local server has left.
 	EmptyRooms(ctx context.Context) ([]string, error)
@@ -237,6 +289,7 @@ type RoomDatabase interface {
 	GetOrCreateEventTypeNID(ctx context.Context, eventType string) (eventTypeNID types.EventTypeNID, err error)
 	GetOrCreateEventStateKeyNID(ctx context.Context, eventStateKey *string) (types.EventStateKeyNID, error)
 	GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*types.HeaderedEvent, error)
+	GetRoomPartialState(ctx context.Context, roomNID types.RoomNID) (joinEventID string, serversInRoom []spec.ServerName, err error)
 }
 
 type EventDatabase interface {
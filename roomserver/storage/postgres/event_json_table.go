@@ -32,6 +32,9 @@ CREATE TABLE IF NOT EXISTS roomserver_event_json (
     -- TODO: Should we be compressing the events with Snappy or DEFLATE?
     event_json TEXT NOT NULL
 );
+
+-- Used to find the events sent by a user, e.g. to redact them.
+CREATE INDEX IF NOT EXISTS roomserver_event_json_sender_idx ON roomserver_event_json ((event_json::json->>'sender'));
 `
 
 const insertEventJSONSQL = "" +
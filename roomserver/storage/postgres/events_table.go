@@ -145,6 +145,23 @@ const selectEventRejectedSQL = "" +
 
 const selectRoomsWithEventTypeNIDSQL = `SELECT DISTINCT room_nid FROM roomserver_events WHERE event_type_nid = $1`
 
+const selectRoomEventNIDsBeforeDepthSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1 AND depth < $2 ORDER BY depth ASC, event_nid ASC"
+
+const selectRoomEventNIDsBeforeDepthAfterSQL = "" +
+	"SELECT event_nid, depth FROM roomserver_events WHERE room_nid = $1 AND depth < $2" +
+	" AND (depth > $3 OR (depth = $3 AND event_nid > $4))" +
+	" ORDER BY depth ASC, event_nid ASC LIMIT $5"
+
+const selectRoomEventStateSnapshotNIDsSQL = "" +
+	"SELECT event_nid, state_snapshot_nid FROM roomserver_events WHERE room_nid = $1 AND state_snapshot_nid != 0"
+
+const selectRoomEventNIDsBySenderSQL = "" +
+	"SELECT e.event_nid FROM roomserver_events AS e" +
+	" JOIN roomserver_event_json AS j ON j.event_nid = e.event_nid" +
+	" WHERE e.room_nid = $1 AND e.state_snapshot_nid != 0 AND (j.event_json::json->>'sender') = $2" +
+	" ORDER BY e.event_nid ASC"
+
 type eventStatements struct {
 	insertEventStmt                               *sql.Stmt
 	selectEventStmt                               *sql.Stmt
@@ -165,6 +182,10 @@ type eventStatements struct {
 	selectRoomNIDsForEventNIDsStmt                *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
 	selectRoomsWithEventTypeNIDStmt               *sql.Stmt
+	selectRoomEventNIDsBeforeDepthStmt            *sql.Stmt
+	selectRoomEventNIDsBeforeDepthAfterStmt       *sql.Stmt
+	selectRoomEventStateSnapshotNIDsStmt          *sql.Stmt
+	selectRoomEventNIDsBySenderStmt               *sql.Stmt
 }
 
 func CreateEventsTable(db *sql.DB) error {
@@ -206,6 +227,10 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
 		{&s.selectRoomsWithEventTypeNIDStmt, selectRoomsWithEventTypeNIDSQL},
+		{&s.selectRoomEventNIDsBeforeDepthStmt, selectRoomEventNIDsBeforeDepthSQL},
+		{&s.selectRoomEventNIDsBeforeDepthAfterStmt, selectRoomEventNIDsBeforeDepthAfterSQL},
+		{&s.selectRoomEventStateSnapshotNIDsStmt, selectRoomEventStateSnapshotNIDsSQL},
+		{&s.selectRoomEventNIDsBySenderStmt, selectRoomEventNIDsBySenderSQL},
 	}.Prepare(db)
 }
 
@@ -604,3 +629,87 @@ func (s *eventStatements) SelectRoomsWithEventTypeNID(
 
 	return roomNIDs, rows.Err()
 }
+
+func (s *eventStatements) SelectRoomEventNIDsBeforeDepth(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, depth int64,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventNIDsBeforeDepthStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, depth)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventNIDsBeforeDepth: rows.close() failed")
+
+	var eventNIDs []types.EventNID
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomEventNIDsBeforeDepthAfter(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, depth, afterDepth int64, afterNID types.EventNID, limit int,
+) (eventNIDs []types.EventNID, lastDepth int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventNIDsBeforeDepthAfterStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, depth, afterDepth, afterNID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventNIDsBeforeDepthAfter: rows.close() failed")
+
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID, &lastDepth); err != nil {
+			return nil, 0, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, lastDepth, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomEventStateSnapshotNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (map[types.EventNID]types.StateSnapshotNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventStateSnapshotNIDsStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventStateSnapshotNIDs: rows.close() failed")
+
+	result := make(map[types.EventNID]types.StateSnapshotNID)
+	var eventNID types.EventNID
+	var stateNID types.StateSnapshotNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID, &stateNID); err != nil {
+			return nil, err
+		}
+		result[eventNID] = stateNID
+	}
+	return result, rows.Err()
+}
+
+func (s *eventStatements) SelectRoomEventNIDsBySender(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID string,
+) ([]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRoomEventNIDsBySenderStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomEventNIDsBySender: rows.close() failed")
+
+	var eventNIDs []types.EventNID
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	return eventNIDs, rows.Err()
+}
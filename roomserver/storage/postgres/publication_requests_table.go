@@ -0,0 +1,110 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/element-hq/dendrite/internal"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const publicationRequestsSchema = `
+-- Stores the rooms that local users have asked to publish in the room
+-- directory, which are waiting for a server admin to approve them.
+CREATE TABLE IF NOT EXISTS roomserver_publication_requests (
+    -- The room ID of the room to publish.
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The user ID of the user who asked for the room to be published.
+    requested_by TEXT NOT NULL,
+    -- When the room was asked to be published.
+    requested_ts BIGINT NOT NULL
+);
+`
+
+const insertPublicationRequestSQL = "" +
+	"INSERT INTO roomserver_publication_requests (room_id, requested_by, requested_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id) DO NOTHING"
+
+const selectPublicationRequestSQL = "" +
+	"SELECT requested_by, requested_ts FROM roomserver_publication_requests WHERE room_id = $1"
+
+const selectPublicationRequestsSQL = "" +
+	"SELECT room_id, requested_by, requested_ts FROM roomserver_publication_requests ORDER BY requested_ts ASC, room_id ASC"
+
+const deletePublicationRequestSQL = "" +
+	"DELETE FROM roomserver_publication_requests WHERE room_id = $1"
+
+type publicationRequestsStatements struct {
+	insertPublicationRequestStmt  *sql.Stmt
+	selectPublicationRequestStmt  *sql.Stmt
+	selectPublicationRequestsStmt *sql.Stmt
+	deletePublicationRequestStmt  *sql.Stmt
+}
+
+func CreatePublicationRequestsTable(db *sql.DB) error {
+	_, err := db.Exec(publicationRequestsSchema)
+	return err
+}
+
+func PreparePublicationRequestsTable(db *sql.DB) (tables.PublicationRequests, error) {
+	s := &publicationRequestsStatements{}
+	return s, sqlutil.StatementList{
+		{&s.insertPublicationRequestStmt, insertPublicationRequestSQL},
+		{&s.selectPublicationRequestStmt, selectPublicationRequestSQL},
+		{&s.selectPublicationRequestsStmt, selectPublicationRequestsSQL},
+		{&s.deletePublicationRequestStmt, deletePublicationRequestSQL},
+	}.Prepare(db)
+}
+
+func (s *publicationRequestsStatements) InsertPublicationRequest(
+	ctx context.Context, txn *sql.Tx, roomID, requestedBy string, requestedTS spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertPublicationRequestStmt)
+	_, err := stmt.ExecContext(ctx, roomID, requestedBy, requestedTS)
+	return err
+}
+
+func (s *publicationRequestsStatements) SelectPublicationRequest(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (requestedBy string, requestedTS spec.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPublicationRequestStmt)
+	err = stmt.QueryRowContext(ctx, roomID).Scan(&requestedBy, &requestedTS)
+	return
+}
+
+func (s *publicationRequestsStatements) SelectPublicationRequests(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.PublicationRequest, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPublicationRequestsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPublicationRequestsStmt: rows.close() failed")
+
+	var requests []api.PublicationRequest
+	for rows.Next() {
+		var request api.PublicationRequest
+		if err = rows.Scan(&request.RoomID, &request.RequestedBy, &request.RequestedTS); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func (s *publicationRequestsStatements) DeletePublicationRequest(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePublicationRequestStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
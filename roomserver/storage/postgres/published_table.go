@@ -12,8 +12,10 @@ import (
 
 	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/roomserver/storage/postgres/deltas"
 	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const publishedSchema = `
@@ -27,13 +29,17 @@ CREATE TABLE IF NOT EXISTS roomserver_published (
     network_id TEXT NOT NULL,
     -- Whether it is published or not
     published BOOLEAN NOT NULL DEFAULT false,
+    -- The user who last published or unpublished the room, if any
+    published_by TEXT NOT NULL DEFAULT '',
+    -- When the room was last published or unpublished
+    published_ts BIGINT NOT NULL DEFAULT 0,
     PRIMARY KEY (room_id, appservice_id, network_id)
 );
 `
 
 const upsertPublishedSQL = "" +
-	"INSERT INTO roomserver_published (room_id, appservice_id, network_id, published) VALUES ($1, $2, $3, $4) " +
-	"ON CONFLICT (room_id, appservice_id, network_id) DO UPDATE SET published=$4"
+	"INSERT INTO roomserver_published (room_id, appservice_id, network_id, published, published_by, published_ts) VALUES ($1, $2, $3, $4, $5, $6) " +
+	"ON CONFLICT (room_id, appservice_id, network_id) DO UPDATE SET published=$4, published_by=$5, published_ts=$6"
 
 const selectAllPublishedSQL = "" +
 	"SELECT room_id FROM roomserver_published WHERE published = $1 AND CASE WHEN $2 THEN 1=1 ELSE network_id = '' END ORDER BY room_id ASC"
@@ -44,11 +50,21 @@ const selectNetworkPublishedSQL = "" +
 const selectPublishedSQL = "" +
 	"SELECT published FROM roomserver_published WHERE room_id = $1"
 
+const selectPublishedEntriesSQL = "" +
+	"SELECT room_id, appservice_id, network_id, published_by, published_ts FROM roomserver_published " +
+	"WHERE published = true ORDER BY room_id ASC, appservice_id ASC, network_id ASC"
+
+const unpublishRoomSQL = "" +
+	"UPDATE roomserver_published SET published = false, published_by = $1, published_ts = $2 " +
+	"WHERE room_id = $3 AND published = true"
+
 type publishedStatements struct {
 	upsertPublishedStmt        *sql.Stmt
 	selectAllPublishedStmt     *sql.Stmt
 	selectPublishedStmt        *sql.Stmt
 	selectNetworkPublishedStmt *sql.Stmt
+	selectPublishedEntriesStmt *sql.Stmt
+	unpublishRoomStmt          *sql.Stmt
 }
 
 func CreatePublishedTable(db *sql.DB) error {
@@ -66,6 +82,10 @@ func CreatePublishedTable(db *sql.DB) error {
 			Version: "roomserver: published appservice pkey",
 			Up:      deltas.UpPulishedAppservicePrimaryKey,
 		},
+		{
+			Version: "roomserver: published by",
+			Up:      deltas.UpPublishedBy,
+		},
 	}...)
 	return m.Up(context.Background())
 }
@@ -78,17 +98,49 @@ func PreparePublishedTable(db *sql.DB) (tables.Published, error) {
 		{&s.selectAllPublishedStmt, selectAllPublishedSQL},
 		{&s.selectPublishedStmt, selectPublishedSQL},
 		{&s.selectNetworkPublishedStmt, selectNetworkPublishedSQL},
+		{&s.selectPublishedEntriesStmt, selectPublishedEntriesSQL},
+		{&s.unpublishRoomStmt, unpublishRoomSQL},
 	}.Prepare(db)
 }
 
 func (s *publishedStatements) UpsertRoomPublished(
 	ctx context.Context, txn *sql.Tx, roomID, appserviceID, networkID string, published bool,
+	publishedBy string, publishedTS spec.Timestamp,
 ) (err error) {
 	stmt := sqlutil.TxStmt(txn, s.upsertPublishedStmt)
-	_, err = stmt.ExecContext(ctx, roomID, appserviceID, networkID, published)
+	_, err = stmt.ExecContext(ctx, roomID, appserviceID, networkID, published, publishedBy, publishedTS)
 	return
 }
 
+func (s *publishedStatements) UnpublishRoom(
+	ctx context.Context, txn *sql.Tx, roomID, unpublishedBy string, unpublishedTS spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.unpublishRoomStmt)
+	_, err := stmt.ExecContext(ctx, unpublishedBy, unpublishedTS, roomID)
+	return err
+}
+
+func (s *publishedStatements) SelectPublishedEntries(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.PublishedRoom, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPublishedEntriesStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPublishedEntriesStmt: rows.close() failed")
+
+	var entries []api.PublishedRoom
+	for rows.Next() {
+		var entry api.PublishedRoom
+		if err = rows.Scan(&entry.RoomID, &entry.AppserviceID, &entry.NetworkID, &entry.PublishedBy, &entry.PublishedTS); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
 func (s *publishedStatements) SelectPublishedFromRoomID(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (published bool, err error) {
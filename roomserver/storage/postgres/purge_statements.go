@@ -10,6 +10,9 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
+
+	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/roomserver/types"
 )
@@ -49,6 +52,9 @@ const purgeRedactionsSQL = "" +
 const purgeRoomAliasesSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
 
+const purgePartialStateRoomSQL = "" +
+	"DELETE FROM roomserver_partial_state_rooms WHERE room_nid = $1"
+
 const purgeRoomSQL = "" +
 	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
 
@@ -60,11 +66,49 @@ const purgeStateBlockEntriesSQL = "" +
 const purgeStateSnapshotEntriesSQL = "" +
 	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
 
+// Removes the rows recording that the given events are referenced as prev
+// events, which must happen before the events themselves are removed.
+const purgeHistoryPreviousEventsSQL = "" +
+	"DELETE FROM roomserver_previous_events WHERE previous_event_id IN(" +
+	"	SELECT event_id FROM roomserver_events WHERE event_nid = ANY($1)" +
+	")"
+
+const purgeHistoryRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redaction_event_id IN(" +
+	"	SELECT event_id FROM roomserver_events WHERE event_nid = ANY($1)" +
+	")"
+
+const purgeHistoryEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1)"
+
+const purgeHistoryEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE event_nid = ANY($1)"
+
+// Selects the state snapshots of the room that are neither the state before
+// any event, nor the current state of the room.
+const selectUnreferencedStateSnapshotsSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots s WHERE room_nid = $1" +
+	" AND NOT EXISTS(SELECT 1 FROM roomserver_events e WHERE e.room_nid = s.room_nid AND e.state_snapshot_nid = s.state_snapshot_nid)" +
+	" AND NOT EXISTS(SELECT 1 FROM roomserver_rooms r WHERE r.room_nid = s.room_nid AND r.state_snapshot_nid = s.state_snapshot_nid)"
+
+// Removes the state blocks of the given state snapshots that aren't also used
+// by any other state snapshot of the room.
+const purgeHistoryStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid IN(" +
+	"	SELECT DISTINCT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE state_snapshot_nid = ANY($1)" +
+	") AND state_block_nid NOT IN(" +
+	"	SELECT DISTINCT UNNEST(state_block_nids) FROM roomserver_state_snapshots WHERE room_nid = $2 AND state_snapshot_nid != ALL($1)" +
+	")"
+
+const purgeHistoryStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid = ANY($1)"
+
 type purgeStatements struct {
 	purgeEventJSONStmt            *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
 	purgeInvitesStmt              *sql.Stmt
 	purgeMembershipsStmt          *sql.Stmt
+	purgePartialStateRoomStmt     *sql.Stmt
 	purgePreviousEventsStmt       *sql.Stmt
 	purgePreviousEvents2Stmt      *sql.Stmt
 	purgePublishedStmt            *sql.Stmt
@@ -73,6 +117,14 @@ type purgeStatements struct {
 	purgeRoomStmt                 *sql.Stmt
 	purgeStateBlockEntriesStmt    *sql.Stmt
 	purgeStateSnapshotEntriesStmt *sql.Stmt
+
+	purgeHistoryPreviousEventsStmt       *sql.Stmt
+	purgeHistoryRedactionsStmt           *sql.Stmt
+	purgeHistoryEventJSONStmt            *sql.Stmt
+	purgeHistoryEventsStmt               *sql.Stmt
+	selectUnreferencedStateSnapshotsStmt *sql.Stmt
+	purgeHistoryStateBlocksStmt          *sql.Stmt
+	purgeHistoryStateSnapshotsStmt       *sql.Stmt
 }
 
 func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
@@ -83,6 +135,7 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.purgeInvitesStmt, purgeInvitesSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgePartialStateRoomStmt, purgePartialStateRoomSQL},
 		{&s.purgePublishedStmt, purgePublishedSQL},
 		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
 		{&s.purgePreviousEvents2Stmt, purgePreviousEvents2SQL},
@@ -91,6 +144,13 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgeRoomStmt, purgeRoomSQL},
 		{&s.purgeStateBlockEntriesStmt, purgeStateBlockEntriesSQL},
 		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
+		{&s.purgeHistoryPreviousEventsStmt, purgeHistoryPreviousEventsSQL},
+		{&s.purgeHistoryRedactionsStmt, purgeHistoryRedactionsSQL},
+		{&s.purgeHistoryEventJSONStmt, purgeHistoryEventJSONSQL},
+		{&s.purgeHistoryEventsStmt, purgeHistoryEventsSQL},
+		{&s.selectUnreferencedStateSnapshotsStmt, selectUnreferencedStateSnapshotsSQL},
+		{&s.purgeHistoryStateBlocksStmt, purgeHistoryStateBlocksSQL},
+		{&s.purgeHistoryStateSnapshotsStmt, purgeHistoryStateSnapshotsSQL},
 	}.Prepare(db)
 }
 
@@ -116,6 +176,7 @@ func (s *purgeStatements) PurgeRoom(
 		s.purgeStateSnapshotEntriesStmt,
 		s.purgeInvitesStmt,
 		s.purgeMembershipsStmt,
+		s.purgePartialStateRoomStmt,
 		s.purgePreviousEvents2Stmt, // Fast purge the majority of events
 		s.purgePreviousEventsStmt,  // Slow purge the remaining events
 		s.purgeEventJSONStmt,
@@ -131,3 +192,53 @@ func (s *purgeStatements) PurgeRoom(
 	}
 	return nil
 }
+
+func (s *purgeStatements) PurgeHistory(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID,
+) error {
+	for _, stmt := range []*sql.Stmt{
+		s.purgeHistoryPreviousEventsStmt,
+		s.purgeHistoryRedactionsStmt,
+		s.purgeHistoryEventJSONStmt,
+		s.purgeHistoryEventsStmt,
+	} {
+		if _, err := sqlutil.TxStmt(txn, stmt).ExecContext(ctx, eventNIDsAsArray(eventNIDs)); err != nil {
+			return err
+		}
+	}
+
+	stateNIDs, err := s.selectUnreferencedStateSnapshots(ctx, txn, roomNID)
+	if err != nil {
+		return err
+	}
+	if len(stateNIDs) == 0 {
+		return nil
+	}
+
+	if _, err = sqlutil.TxStmt(txn, s.purgeHistoryStateBlocksStmt).ExecContext(ctx, stateNIDs, roomNID); err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.purgeHistoryStateSnapshotsStmt).ExecContext(ctx, stateNIDs)
+	return err
+}
+
+// selectUnreferencedStateSnapshots returns the state snapshots of the room that
+// are no longer used.
+func (s *purgeStatements) selectUnreferencedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (pq.Int64Array, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectUnreferencedStateSnapshotsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUnreferencedStateSnapshots: rows.close() failed")
+	var stateNIDs pq.Int64Array
+	var stateNID int64
+	for rows.Next() {
+		if err = rows.Scan(&stateNID); err != nil {
+			return nil, err
+		}
+		stateNIDs = append(stateNIDs, stateNID)
+	}
+	return stateNIDs, rows.Err()
+}
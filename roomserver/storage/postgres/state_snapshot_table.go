@@ -16,6 +16,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 
+	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/roomserver/types"
 )
@@ -65,6 +66,17 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
 	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
 
+const selectStateSnapshotNIDsForRoomSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots WHERE room_nid = $1 ORDER BY state_snapshot_nid ASC"
+
+// Replace the state blocks of a snapshot along with its hash, unless another
+// snapshot already has the same hash.
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $2, state_block_nids = $3" +
+	" WHERE state_snapshot_nid = $1 AND NOT EXISTS (" +
+	"  SELECT 1 FROM roomserver_state_snapshots WHERE state_snapshot_hash = $2 AND state_snapshot_nid <> $1" +
+	" )"
+
 // Looks up both the history visibility event and relevant membership events from
 // a given domain name from a given state snapshot. This is used to optimise the
 // helpers.CheckServerAllowedToSeeEvent function.
@@ -111,6 +123,8 @@ type stateSnapshotStatements struct {
 	bulkSelectStateBlockNIDsStmt                  *sql.Stmt
 	bulkSelectStateForHistoryVisibilityStmt       *sql.Stmt
 	bulktSelectMembershipForHistoryVisibilityStmt *sql.Stmt
+	selectStateSnapshotNIDsForRoomStmt            *sql.Stmt
+	updateStateBlockNIDsStmt                      *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -126,6 +140,8 @@ func PrepareStateSnapshotTable(db *sql.DB) (*stateSnapshotStatements, error) {
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
 		{&s.bulkSelectStateForHistoryVisibilityStmt, bulkSelectStateForHistoryVisibilitySQL},
 		{&s.bulktSelectMembershipForHistoryVisibilityStmt, bulkSelectMembershipForHistoryVisibilitySQL},
+		{&s.selectStateSnapshotNIDsForRoomStmt, selectStateSnapshotNIDsForRoomSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
 	}.Prepare(db)
 }
 
@@ -175,6 +191,38 @@ func (s *stateSnapshotStatements) BulkSelectStateBlockNIDs(
 	return results, nil
 }
 
+func (s *stateSnapshotStatements) SelectStateSnapshotNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateSnapshotNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStateSnapshotNIDsForRoomStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectStateSnapshotNIDsForRoom: rows.close() failed")
+
+	var stateNIDs []types.StateSnapshotNID
+	var stateNID types.StateSnapshotNID
+	for rows.Next() {
+		if err = rows.Scan(&stateNID); err != nil {
+			return nil, err
+		}
+		stateNIDs = append(stateNIDs, stateNID)
+	}
+	return stateNIDs, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, nids types.StateBlockNIDs,
+) (bool, error) {
+	nids = nids[:util.SortAndUnique(nids)]
+	res, err := sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(ctx, stateNID, nids.Hash(), stateBlockNIDsAsArray(nids))
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
 func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
 	ctx context.Context, txn *sql.Tx, stateSnapshotNID types.StateSnapshotNID, domain string,
 ) ([]types.EventNID, error) {
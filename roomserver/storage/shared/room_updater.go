@@ -186,6 +186,12 @@ func (u *RoomUpdater) StateAtEventIDs(
 	return u.d.EventsTable.BulkSelectStateAtEventByID(ctx, u.txn, eventIDs)
 }
 
+// RoomEventStateSnapshotNIDs returns the state snapshot NID of every event in
+// the room that has one, i.e. every event that isn't an outlier.
+func (u *RoomUpdater) RoomEventStateSnapshotNIDs(ctx context.Context) (map[types.EventNID]types.StateSnapshotNID, error) {
+	return u.d.EventsTable.SelectRoomEventStateSnapshotNIDs(ctx, u.txn, u.roomInfo.RoomNID)
+}
+
 func (u *RoomUpdater) EventsFromIDs(ctx context.Context, roomInfo *types.RoomInfo, eventIDs []string) ([]types.Event, error) {
 	return u.d.eventsFromIDs(ctx, u.txn, u.roomInfo, eventIDs, NoFilter)
 }
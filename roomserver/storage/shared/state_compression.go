@@ -0,0 +1,244 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/matrix-org/util"
+
+	"github.com/element-hq/dendrite/roomserver/types"
+)
+
+// stateCompressionChunkSize is the average number of state entries in each of
+// the state blocks that a compressed snapshot is made up of.
+const stateCompressionChunkSize = 64
+
+// stateCompressionBatchSize is how many snapshots are loaded at a time.
+const stateCompressionBatchSize = 100
+
+// errStateSnapshotExists is returned from the transaction which compresses a
+// snapshot if another snapshot is already made up of the compressed blocks.
+var errStateSnapshotExists = errors.New("a state snapshot with the same state blocks already exists")
+
+// CompressRoomState rewrites the state snapshots of a room so that, rather
+// than being a long list of deltas, each one is made up of a small number of
+// state blocks which are shared with the other snapshots in the room. The
+// state blocks which are no longer used by any snapshot are then removed.
+//
+// The resolved state of every snapshot is compared before and after it is
+// rewritten, and the snapshot is left alone if they differ. The caller must
+// make sure that no events are being added to the room at the same time.
+func (d *Database) CompressRoomState(
+	ctx context.Context, roomNID types.RoomNID,
+) (*types.StateCompressionResult, error) {
+	stateNIDs, err := d.StateSnapshotTable.SelectStateSnapshotNIDsForRoom(ctx, nil, roomNID)
+	if err != nil {
+		return nil, fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotNIDsForRoom: %w", err)
+	}
+	result := &types.StateCompressionResult{
+		Snapshots: len(stateNIDs),
+	}
+
+	// The state blocks which were replaced, and which might not be needed anymore.
+	replaced := map[types.StateBlockNID]struct{}{}
+	for start := 0; start < len(stateNIDs); start += stateCompressionBatchSize {
+		if err = ctx.Err(); err != nil {
+			return result, err
+		}
+		end := min(start+stateCompressionBatchSize, len(stateNIDs))
+		blockLists, err := d.StateSnapshotTable.BulkSelectStateBlockNIDs(ctx, nil, stateNIDs[start:end])
+		if err != nil {
+			return result, fmt.Errorf("d.StateSnapshotTable.BulkSelectStateBlockNIDs: %w", err)
+		}
+		for _, blockList := range blockLists {
+			compressed, err := d.compressStateSnapshot(ctx, blockList, replaced)
+			if err != nil {
+				return result, fmt.Errorf("failed to compress state snapshot %d: %w", blockList.StateSnapshotNID, err)
+			}
+			if compressed {
+				result.CompressedSnapshots++
+			}
+		}
+	}
+	if len(replaced) == 0 {
+		return result, nil
+	}
+
+	// Keep any replaced block that is still used by a snapshot. The snapshots
+	// are looked up again in the same transaction as the blocks are deleted,
+	// so that a block can't be removed from under a snapshot made meanwhile.
+	var unused types.StateBlockNIDs
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		stateNIDs, err := d.StateSnapshotTable.SelectStateSnapshotNIDsForRoom(ctx, txn, roomNID)
+		if err != nil {
+			return fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotNIDsForRoom: %w", err)
+		}
+		for start := 0; start < len(stateNIDs); start += stateCompressionBatchSize {
+			end := min(start+stateCompressionBatchSize, len(stateNIDs))
+			blockLists, err := d.StateSnapshotTable.BulkSelectStateBlockNIDs(ctx, txn, stateNIDs[start:end])
+			if err != nil {
+				return fmt.Errorf("d.StateSnapshotTable.BulkSelectStateBlockNIDs: %w", err)
+			}
+			for _, blockList := range blockLists {
+				for _, blockNID := range blockList.StateBlockNIDs {
+					delete(replaced, blockNID)
+				}
+			}
+		}
+		unused = make(types.StateBlockNIDs, 0, len(replaced))
+		for blockNID := range replaced {
+			unused = append(unused, blockNID)
+		}
+		if err = d.StateBlockTable.BulkDeleteStateBlocks(ctx, txn, unused); err != nil {
+			return fmt.Errorf("d.StateBlockTable.BulkDeleteStateBlocks: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	result.RemovedBlocks = len(unused)
+	return result, nil
+}
+
+// compressStateSnapshot rewrites a single snapshot, if doing so reduces the
+// number of state blocks that it is made up of. The blocks that are no longer
+// used by the snapshot are added to replaced.
+func (d *Database) compressStateSnapshot(
+	ctx context.Context, blockList types.StateBlockNIDList, replaced map[types.StateBlockNID]struct{},
+) (bool, error) {
+	oldBlockNIDs := blockList.StateBlockNIDs
+	oldEntryLists, err := d.stateEntries(ctx, nil, oldBlockNIDs)
+	if err != nil {
+		return false, err
+	}
+	state, err := resolveStateBlocks(oldBlockNIDs, oldEntryLists)
+	if err != nil {
+		return false, err
+	}
+	chunks := chunkStateEntries(state)
+	if len(state) == 0 || len(chunks) >= len(oldBlockNIDs) {
+		return false, nil
+	}
+
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		newBlockNIDs := make(types.StateBlockNIDs, 0, len(chunks))
+		for _, chunk := range chunks {
+			// BulkInsertStateData sorts the entries, so give it a copy.
+			blockNID, err := d.StateBlockTable.BulkInsertStateData(ctx, txn, append(types.StateEntries{}, chunk...))
+			if err != nil {
+				return fmt.Errorf("d.StateBlockTable.BulkInsertStateData: %w", err)
+			}
+			newBlockNIDs = append(newBlockNIDs, blockNID)
+		}
+		newBlockNIDs = newBlockNIDs[:util.SortAndUnique(newBlockNIDs)]
+
+		// Make sure that the new blocks really do resolve to the same state.
+		newEntryLists, err := d.stateEntries(ctx, txn, newBlockNIDs)
+		if err != nil {
+			return err
+		}
+		newState, err := resolveStateBlocks(newBlockNIDs, newEntryLists)
+		if err != nil {
+			return err
+		}
+		if len(newState) != len(state) {
+			return fmt.Errorf("compressed state has %d entries, expected %d", len(newState), len(state))
+		}
+		for i := range state {
+			if newState[i] != state[i] {
+				return fmt.Errorf("compressed state differs at %v", state[i].StateKeyTuple)
+			}
+		}
+
+		updated, err := d.StateSnapshotTable.UpdateStateBlockNIDs(ctx, txn, blockList.StateSnapshotNID, newBlockNIDs)
+		if err != nil {
+			return fmt.Errorf("d.StateSnapshotTable.UpdateStateBlockNIDs: %w", err)
+		}
+		if !updated {
+			// Another snapshot is already made up of these blocks, and the
+			// hashes have to stay unique, so roll back the new blocks.
+			return errStateSnapshotExists
+		}
+
+		kept := make(map[types.StateBlockNID]struct{}, len(newBlockNIDs))
+		for _, blockNID := range newBlockNIDs {
+			kept[blockNID] = struct{}{}
+		}
+		for _, entryList := range oldEntryLists {
+			// Blocks without entries aren't specific to a room, so they might
+			// be used by snapshots elsewhere.
+			if _, ok := kept[entryList.StateBlockNID]; !ok && len(entryList.StateEntries) > 0 {
+				replaced[entryList.StateBlockNID] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errStateSnapshotExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// resolveStateBlocks combines the entries of the given state blocks in the
+// same way as loading the state of a snapshot does: if a state key tuple
+// appears more than once then the entry in the later block wins. The result
+// is sorted by state key tuple.
+func resolveStateBlocks(
+	blockNIDs []types.StateBlockNID, entryLists []types.StateEntryList,
+) ([]types.StateEntry, error) {
+	entriesByBlock := make(map[types.StateBlockNID][]types.StateEntry, len(entryLists))
+	for _, entryList := range entryLists {
+		entriesByBlock[entryList.StateBlockNID] = entryList.StateEntries
+	}
+	var all []types.StateEntry
+	for _, blockNID := range blockNIDs {
+		entries, ok := entriesByBlock[blockNID]
+		if !ok {
+			return nil, types.MissingStateError(fmt.Sprintf("storage: state block %d missing from the database", blockNID))
+		}
+		all = append(all, entries...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].StateKeyTuple.LessThan(all[j].StateKeyTuple)
+	})
+	state := make([]types.StateEntry, 0, len(all))
+	for i := range all {
+		if i+1 < len(all) && all[i+1].StateKeyTuple == all[i].StateKeyTuple {
+			continue
+		}
+		state = append(state, all[i])
+	}
+	return state, nil
+}
+
+// chunkStateEntries splits resolved state, sorted by state key tuple, into
+// chunks. Where a chunk ends depends only on the state key tuples, not on the
+// position in the state, so snapshots with similar state end up with mostly
+// identical chunks, which are then stored as the same state blocks.
+func chunkStateEntries(state []types.StateEntry) [][]types.StateEntry {
+	var chunks [][]types.StateEntry
+	start := 0
+	var buf [16]byte
+	for i := range state {
+		binary.BigEndian.PutUint64(buf[:8], uint64(state[i].EventTypeNID))
+		binary.BigEndian.PutUint64(buf[8:], uint64(state[i].EventStateKeyNID))
+		h := fnv.New32a()
+		_, _ = h.Write(buf[:])
+		if i == len(state)-1 || h.Sum32()%stateCompressionChunkSize == 0 {
+			chunks = append(chunks, state[start:i+1])
+			start = i + 1
+		}
+	}
+	return chunks
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/element-hq/dendrite/internal/eventutil"
 	"github.com/element-hq/dendrite/roomserver/api"
@@ -36,18 +37,21 @@ const redactionsArePermanent = true
 type Database struct {
 	DB *sql.DB
 	EventDatabase
-	Cache              caching.RoomServerCaches
-	Writer             sqlutil.Writer
-	RoomsTable         tables.Rooms
-	StateSnapshotTable tables.StateSnapshot
-	StateBlockTable    tables.StateBlock
-	RoomAliasesTable   tables.RoomAliases
-	InvitesTable       tables.Invites
-	MembershipTable    tables.Membership
-	PublishedTable     tables.Published
-	Purge              tables.Purge
-	UserRoomKeyTable   tables.UserRoomKeys
-	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
+	Cache                    caching.RoomServerCaches
+	Writer                   sqlutil.Writer
+	RoomsTable               tables.Rooms
+	StateSnapshotTable       tables.StateSnapshot
+	StateBlockTable          tables.StateBlock
+	RoomAliasesTable         tables.RoomAliases
+	InvitesTable             tables.Invites
+	MembershipTable          tables.Membership
+	PublishedTable           tables.Published
+	Purge                    tables.Purge
+	UserRoomKeyTable         tables.UserRoomKeys
+	PartialStateRoomsTable   tables.PartialStateRooms
+	BlockedRoomsTable        tables.BlockedRooms
+	PublicationRequestsTable tables.PublicationRequests
+	GetRoomUpdaterFn         func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
 // EventDatabase contains all tables needed to work with events
@@ -844,12 +848,36 @@ func (d *EventDatabase) StoreEvent(
 	}, err
 }
 
-func (d *Database) PublishRoom(ctx context.Context, roomID, appserviceID, networkID string, publish bool) error {
+func (d *Database) PublishRoom(ctx context.Context, roomID, appserviceID, networkID, publishedBy string, publish bool) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.PublishedTable.UpsertRoomPublished(ctx, txn, roomID, appserviceID, networkID, publish)
+		if err := d.PublishedTable.UpsertRoomPublished(ctx, txn, roomID, appserviceID, networkID, publish, publishedBy, spec.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		// Publishing or unpublishing the room settles any request to publish it.
+		if appserviceID == "" && networkID == "" {
+			return d.PublicationRequestsTable.DeletePublicationRequest(ctx, txn, roomID)
+		}
+		return nil
+	})
+}
+
+// UnpublishRoom removes every entry of the room from the room directory,
+// including those of application services, and any request to publish it.
+func (d *Database) UnpublishRoom(ctx context.Context, roomID, unpublishedBy string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.PublishedTable.UnpublishRoom(ctx, txn, roomID, unpublishedBy, spec.AsTimestamp(time.Now())); err != nil {
+			return err
+		}
+		return d.PublicationRequestsTable.DeletePublicationRequest(ctx, txn, roomID)
 	})
 }
 
+// GetPublishedRoomEntries returns every entry in the room directory, with who
+// published it and when.
+func (d *Database) GetPublishedRoomEntries(ctx context.Context) ([]api.PublishedRoom, error) {
+	return d.PublishedTable.SelectPublishedEntries(ctx, nil)
+}
+
 func (d *Database) GetPublishedRoom(ctx context.Context, roomID string) (bool, error) {
 	return d.PublishedTable.SelectPublishedFromRoomID(ctx, nil, roomID)
 }
@@ -1707,6 +1735,20 @@ func (d *Database) RoomsWithACLs(ctx context.Context) ([]string, error) {
 	return roomIDs, nil
 }
 
+func (d *Database) RoomsWithEventType(ctx context.Context, eventType string) ([]string, error) {
+	eventTypeNID, err := d.GetOrCreateEventTypeNID(ctx, eventType)
+	if err != nil {
+		return nil, err
+	}
+
+	roomNIDs, err := d.EventsTable.SelectRoomsWithEventTypeNID(ctx, nil, eventTypeNID)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.RoomsTable.BulkSelectRoomIDs(ctx, nil, roomNIDs)
+}
+
 // EmptyRooms returns all rooms that the local server has left.
 func (d *Database) EmptyRooms(ctx context.Context) ([]string, error) {
 	eventTypeNID := types.EventTypeNID(5)
@@ -1767,6 +1809,105 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+func (d *Database) RoomEventNIDsBeforeDepth(
+	ctx context.Context, roomNID types.RoomNID, depth int64,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDsBeforeDepth(ctx, nil, roomNID, depth)
+}
+
+func (d *Database) RoomEventNIDsBeforeDepthAfter(
+	ctx context.Context, roomNID types.RoomNID, depth, afterDepth int64, afterNID types.EventNID, limit int,
+) ([]types.EventNID, int64, error) {
+	return d.EventsTable.SelectRoomEventNIDsBeforeDepthAfter(ctx, nil, roomNID, depth, afterDepth, afterNID, limit)
+}
+
+func (d *Database) RoomEventStateSnapshotNIDs(
+	ctx context.Context, roomNID types.RoomNID,
+) (map[types.EventNID]types.StateSnapshotNID, error) {
+	return d.EventsTable.SelectRoomEventStateSnapshotNIDs(ctx, nil, roomNID)
+}
+
+func (d *Database) RoomEventNIDsBySender(
+	ctx context.Context, roomNID types.RoomNID, senderID spec.SenderID,
+) ([]types.EventNID, error) {
+	return d.EventsTable.SelectRoomEventNIDsBySender(ctx, nil, roomNID, string(senderID))
+}
+
+func (d *Database) RoomStateSnapshotNIDs(
+	ctx context.Context, roomNID types.RoomNID,
+) ([]types.StateSnapshotNID, error) {
+	return d.StateSnapshotTable.SelectStateSnapshotNIDsForRoom(ctx, nil, roomNID)
+}
+
+func (d *Database) RoomMembershipEventNIDs(
+	ctx context.Context, roomNID types.RoomNID,
+) (map[types.EventStateKeyNID]types.EventNID, error) {
+	return d.MembershipTable.SelectMembershipEventNIDsForRoom(ctx, nil, roomNID)
+}
+
+// PurgeHistory removes the given events from the room. The state before the
+// events in clearStateNIDs is forgotten, as for outliers, so that the state
+// snapshots and blocks that are no longer referenced by any event can be
+// removed too.
+func (d *Database) PurgeHistory(
+	ctx context.Context, roomNID types.RoomNID, purgeNIDs, clearStateNIDs []types.EventNID,
+) error {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, eventNID := range clearStateNIDs {
+			if err := d.EventsTable.UpdateEventState(ctx, txn, eventNID, 0); err != nil {
+				return fmt.Errorf("d.EventsTable.UpdateEventState: %w", err)
+			}
+		}
+		return d.Purge.PurgeHistory(ctx, txn, roomNID, purgeNIDs)
+	})
+	if err != nil {
+		return err
+	}
+	for _, eventNID := range purgeNIDs {
+		d.Cache.InvalidateRoomServerEvent(eventNID)
+	}
+	return nil
+}
+
+// SetRoomPartialState marks the room as having partial state (MSC3706), along
+// with the join event that the partial state was received with and the servers
+// that were in the room at the time.
+func (d *Database) SetRoomPartialState(
+	ctx context.Context, roomNID types.RoomNID, joinEventID string, serversInRoom []spec.ServerName,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PartialStateRoomsTable.UpsertPartialStateRoom(ctx, txn, roomNID, joinEventID, serversInRoom)
+	})
+}
+
+// GetRoomPartialState returns the join event ID and the servers in the room for
+// a room with partial state. The join event ID is empty if the room has full state.
+func (d *Database) GetRoomPartialState(
+	ctx context.Context, roomNID types.RoomNID,
+) (string, []spec.ServerName, error) {
+	joinEventID, serversInRoom, err := d.PartialStateRoomsTable.SelectPartialStateRoom(ctx, nil, roomNID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil
+	}
+	return joinEventID, serversInRoom, err
+}
+
+// GetPartialStateRooms returns the room IDs of all rooms with partial state.
+func (d *Database) GetPartialStateRooms(ctx context.Context) ([]string, error) {
+	roomNIDs, err := d.PartialStateRoomsTable.SelectPartialStateRoomNIDs(ctx, nil)
+	if err != nil || len(roomNIDs) == 0 {
+		return nil, err
+	}
+	return d.RoomsTable.BulkSelectRoomIDs(ctx, nil, roomNIDs)
+}
+
+// ClearRoomPartialState marks the room as having full state.
+func (d *Database) ClearRoomPartialState(ctx context.Context, roomNID types.RoomNID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PartialStateRoomsTable.DeletePartialStateRoom(ctx, txn, roomNID)
+	})
+}
+
 func (d *Database) UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error {
 
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -1776,11 +1917,12 @@ func (d *Database) UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventS
 		}
 		if published {
 			// un-publish old room
-			if err = d.PublishedTable.UpsertRoomPublished(ctx, txn, oldRoomID, "", "", false); err != nil {
+			now := spec.AsTimestamp(time.Now())
+			if err = d.PublishedTable.UpsertRoomPublished(ctx, txn, oldRoomID, "", "", false, "", now); err != nil {
 				return fmt.Errorf("failed to unpublish room: %w", err)
 			}
 			// publish new room
-			if err = d.PublishedTable.UpsertRoomPublished(ctx, txn, newRoomID, "", "", true); err != nil {
+			if err = d.PublishedTable.UpsertRoomPublished(ctx, txn, newRoomID, "", "", true, "", now); err != nil {
 				return fmt.Errorf("failed to publish room: %w", err)
 			}
 		}
@@ -2277,3 +2419,60 @@ func (s stateEntryByStateKeySorter) Less(i, j int) bool {
 	return s[i].StateKeyTuple.LessThan(s[j].StateKeyTuple)
 }
 func (s stateEntryByStateKeySorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// BlockRoom blocks the room, so that local users can't join or be invited to
+// it. Blocking a room that is already blocked does nothing.
+func (d *Database) BlockRoom(ctx context.Context, roomID, blockedBy string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedRoomsTable.InsertBlockedRoom(ctx, txn, roomID, blockedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// UnblockRoom removes the room from the block list.
+func (d *Database) UnblockRoom(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedRoomsTable.DeleteBlockedRoom(ctx, txn, roomID)
+	})
+}
+
+// GetRoomBlock returns who blocked the room and when. The user ID is empty if
+// the room isn't blocked.
+func (d *Database) GetRoomBlock(ctx context.Context, roomID string) (string, spec.Timestamp, error) {
+	blockedBy, blockedTS, err := d.BlockedRoomsTable.SelectBlockedRoom(ctx, nil, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, nil
+	}
+	return blockedBy, blockedTS, err
+}
+
+// RequestRoomPublication records that the user asked for the room to be
+// published, so that a server admin can approve it. Asking again while the
+// room is still waiting does nothing.
+func (d *Database) RequestRoomPublication(ctx context.Context, roomID, requestedBy string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PublicationRequestsTable.InsertPublicationRequest(ctx, txn, roomID, requestedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// RemovePublicationRequest forgets the request to publish the room.
+func (d *Database) RemovePublicationRequest(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PublicationRequestsTable.DeletePublicationRequest(ctx, txn, roomID)
+	})
+}
+
+// GetPublicationRequest returns who asked for the room to be published and
+// when. The user ID is empty if nobody has.
+func (d *Database) GetPublicationRequest(ctx context.Context, roomID string) (string, spec.Timestamp, error) {
+	requestedBy, requestedTS, err := d.PublicationRequestsTable.SelectPublicationRequest(ctx, nil, roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, nil
+	}
+	return requestedBy, requestedTS, err
+}
+
+// GetPublicationRequests returns the rooms waiting to be approved for the
+// room directory, oldest first.
+func (d *Database) GetPublicationRequests(ctx context.Context) ([]api.PublicationRequest, error) {
+	return d.PublicationRequestsTable.SelectPublicationRequests(ctx, nil)
+}
@@ -23,6 +23,8 @@ const eventJSONSchema = `
     event_nid INTEGER NOT NULL PRIMARY KEY,
     event_json TEXT NOT NULL
   );
+
+  CREATE INDEX IF NOT EXISTS roomserver_event_json_sender_idx ON roomserver_event_json (json_extract(CAST(event_json AS TEXT), '$.sender'));
 `
 
 const insertEventJSONSQL = `
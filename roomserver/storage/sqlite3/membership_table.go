@@ -74,6 +74,10 @@ const selectMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND event_nid != 0 and forgotten = false"
 
+const selectMembershipEventNIDsForRoomSQL = "" +
+	"SELECT target_nid, event_nid FROM roomserver_membership" +
+	" WHERE room_nid = $1 AND event_nid != 0"
+
 const selectLocalMembershipsFromRoomSQL = "" +
 	"SELECT event_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND event_nid != 0" +
@@ -139,6 +143,7 @@ type membershipStatements struct {
 	selectMembershipsFromRoomAndMembershipStmt      *sql.Stmt
 	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt                   *sql.Stmt
+	selectMembershipEventNIDsForRoomStmt            *sql.Stmt
 	selectLocalMembershipsFromRoomStmt              *sql.Stmt
 	selectRoomsWithMembershipStmt                   *sql.Stmt
 	updateMembershipStmt                            *sql.Stmt
@@ -175,6 +180,7 @@ func PrepareMembershipTable(db *sql.DB) (tables.Membership, error) {
 		{&s.selectMembershipsFromRoomAndMembershipStmt, selectMembershipsFromRoomAndMembershipSQL},
 		{&s.selectLocalMembershipsFromRoomAndMembershipStmt, selectLocalMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
+		{&s.selectMembershipEventNIDsForRoomStmt, selectMembershipEventNIDsForRoomSQL},
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
@@ -246,6 +252,28 @@ func (s *membershipStatements) SelectMembershipsFromRoom(
 	return
 }
 
+func (s *membershipStatements) SelectMembershipEventNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (map[types.EventStateKeyNID]types.EventNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectMembershipEventNIDsForRoomStmt)
+	rows, err := stmt.QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMembershipEventNIDsForRoom: rows.close() failed")
+
+	result := make(map[types.EventStateKeyNID]types.EventNID)
+	var targetNID types.EventStateKeyNID
+	var eventNID types.EventNID
+	for rows.Next() {
+		if err = rows.Scan(&targetNID, &eventNID); err != nil {
+			return nil, err
+		}
+		result[targetNID] = eventNID
+	}
+	return result, rows.Err()
+}
+
 func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, membership tables.MembershipState, localOnly bool,
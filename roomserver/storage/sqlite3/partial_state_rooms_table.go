@@ -0,0 +1,121 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/element-hq/dendrite/internal"
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+const partialStateRoomsSchema = `
+-- Stores the rooms that we joined with partial state (MSC3706) and haven't
+-- yet fetched the full state for.
+CREATE TABLE IF NOT EXISTS roomserver_partial_state_rooms (
+    -- The room NID of the room.
+    room_nid INTEGER NOT NULL PRIMARY KEY,
+    -- The event ID of the join event that the partial state was received with.
+    join_event_id TEXT NOT NULL,
+    -- The servers that were in the room when we joined, as a JSON array.
+    servers_in_room TEXT NOT NULL
+);
+`
+
+const upsertPartialStateRoomSQL = "" +
+	"INSERT INTO roomserver_partial_state_rooms (room_nid, join_event_id, servers_in_room) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_nid) DO UPDATE SET join_event_id = $2, servers_in_room = $3"
+
+const selectPartialStateRoomSQL = "" +
+	"SELECT join_event_id, servers_in_room FROM roomserver_partial_state_rooms WHERE room_nid = $1"
+
+const selectPartialStateRoomNIDsSQL = "" +
+	"SELECT room_nid FROM roomserver_partial_state_rooms"
+
+const deletePartialStateRoomSQL = "" +
+	"DELETE FROM roomserver_partial_state_rooms WHERE room_nid = $1"
+
+type partialStateRoomsStatements struct {
+	upsertPartialStateRoomStmt     *sql.Stmt
+	selectPartialStateRoomStmt     *sql.Stmt
+	selectPartialStateRoomNIDsStmt *sql.Stmt
+	deletePartialStateRoomStmt     *sql.Stmt
+}
+
+func CreatePartialStateRoomsTable(db *sql.DB) error {
+	_, err := db.Exec(partialStateRoomsSchema)
+	return err
+}
+
+func PreparePartialStateRoomsTable(db *sql.DB) (tables.PartialStateRooms, error) {
+	s := &partialStateRoomsStatements{}
+	return s, sqlutil.StatementList{
+		{&s.upsertPartialStateRoomStmt, upsertPartialStateRoomSQL},
+		{&s.selectPartialStateRoomStmt, selectPartialStateRoomSQL},
+		{&s.selectPartialStateRoomNIDsStmt, selectPartialStateRoomNIDsSQL},
+		{&s.deletePartialStateRoomStmt, deletePartialStateRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *partialStateRoomsStatements) UpsertPartialStateRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, joinEventID string, serversInRoom []spec.ServerName,
+) error {
+	servers, err := json.Marshal(serversInRoom)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertPartialStateRoomStmt)
+	_, err = stmt.ExecContext(ctx, roomNID, joinEventID, string(servers))
+	return err
+}
+
+func (s *partialStateRoomsStatements) SelectPartialStateRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (string, []spec.ServerName, error) {
+	var joinEventID, servers string
+	stmt := sqlutil.TxStmt(txn, s.selectPartialStateRoomStmt)
+	if err := stmt.QueryRowContext(ctx, roomNID).Scan(&joinEventID, &servers); err != nil {
+		return "", nil, err
+	}
+	var serversInRoom []spec.ServerName
+	if err := json.Unmarshal([]byte(servers), &serversInRoom); err != nil {
+		return "", nil, err
+	}
+	return joinEventID, serversInRoom, nil
+}
+
+func (s *partialStateRoomsStatements) SelectPartialStateRoomNIDs(
+	ctx context.Context, txn *sql.Tx,
+) ([]types.RoomNID, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectPartialStateRoomNIDsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPartialStateRoomNIDs: rows.close() failed")
+	var roomNIDs []types.RoomNID
+	for rows.Next() {
+		var roomNID types.RoomNID
+		if err = rows.Scan(&roomNID); err != nil {
+			return nil, err
+		}
+		roomNIDs = append(roomNIDs, roomNID)
+	}
+	return roomNIDs, rows.Err()
+}
+
+func (s *partialStateRoomsStatements) DeletePartialStateRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deletePartialStateRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomNID)
+	return err
+}
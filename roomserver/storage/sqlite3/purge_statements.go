@@ -9,7 +9,9 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
+	"github.com/element-hq/dendrite/internal"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/roomserver/types"
 )
@@ -49,17 +51,28 @@ const purgeRedactionsSQL = "" +
 const purgeRoomAliasesSQL = "" +
 	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
 
+const purgePartialStateRoomSQL = "" +
+	"DELETE FROM roomserver_partial_state_rooms WHERE room_nid = $1"
+
 const purgeRoomSQL = "" +
 	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
 
 const purgeStateSnapshotEntriesSQL = "" +
 	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
 
+// Selects the state snapshots of the room that are neither the state before
+// any event, nor the current state of the room.
+const selectUnreferencedStateSnapshotsSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots AS s WHERE room_nid = $1" +
+	" AND NOT EXISTS(SELECT 1 FROM roomserver_events AS e WHERE e.room_nid = s.room_nid AND e.state_snapshot_nid = s.state_snapshot_nid)" +
+	" AND NOT EXISTS(SELECT 1 FROM roomserver_rooms AS r WHERE r.room_nid = s.room_nid AND r.state_snapshot_nid = s.state_snapshot_nid)"
+
 type purgeStatements struct {
 	purgeEventJSONStmt            *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
 	purgeInvitesStmt              *sql.Stmt
 	purgeMembershipsStmt          *sql.Stmt
+	purgePartialStateRoomStmt     *sql.Stmt
 	purgePreviousEventsStmt       *sql.Stmt
 	purgePreviousEvents2Stmt      *sql.Stmt
 	purgePublishedStmt            *sql.Stmt
@@ -68,6 +81,8 @@ type purgeStatements struct {
 	purgeRoomStmt                 *sql.Stmt
 	purgeStateSnapshotEntriesStmt *sql.Stmt
 	stateSnapshot                 *stateSnapshotStatements
+
+	selectUnreferencedStateSnapshotsStmt *sql.Stmt
 }
 
 func PreparePurgeStatements(db *sql.DB, stateSnapshot *stateSnapshotStatements) (*purgeStatements, error) {
@@ -77,6 +92,7 @@ func PreparePurgeStatements(db *sql.DB, stateSnapshot *stateSnapshotStatements)
 		{&s.purgeEventsStmt, purgeEventsSQL},
 		{&s.purgeInvitesStmt, purgeInvitesSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgePartialStateRoomStmt, purgePartialStateRoomSQL},
 		{&s.purgePublishedStmt, purgePublishedSQL},
 		{&s.purgePreviousEventsStmt, purgePreviousEventsSQL},
 		{&s.purgePreviousEvents2Stmt, purgePreviousEvents2SQL},
@@ -85,6 +101,7 @@ func PreparePurgeStatements(db *sql.DB, stateSnapshot *stateSnapshotStatements)
 		{&s.purgeRoomStmt, purgeRoomSQL},
 		//{&s.purgeStateBlockEntriesStmt, purgeStateBlockEntriesSQL},
 		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
+		{&s.selectUnreferencedStateSnapshotsStmt, selectUnreferencedStateSnapshotsSQL},
 	}.Prepare(db)
 }
 
@@ -113,6 +130,7 @@ func (s *purgeStatements) PurgeRoom(
 		s.purgeStateSnapshotEntriesStmt,
 		s.purgeInvitesStmt,
 		s.purgeMembershipsStmt,
+		s.purgePartialStateRoomStmt,
 		s.purgePreviousEvents2Stmt, // Fast purge the majority of events
 		s.purgePreviousEventsStmt,  // Slow purge the remaining events
 		s.purgeEventJSONStmt,
@@ -151,3 +169,84 @@ func (s *purgeStatements) purgeStateBlocks(
 	query := "DELETE FROM roomserver_state_block WHERE state_block_nid IN($1)"
 	return sqlutil.RunLimitedVariablesExec(ctx, query, txn, params, sqlutil.SQLite3MaxVariables)
 }
+
+func (s *purgeStatements) PurgeHistory(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID,
+) error {
+	params := make([]interface{}, len(eventNIDs))
+	for i := range eventNIDs {
+		params[i] = eventNIDs[i]
+	}
+	for _, query := range []string{
+		// The previous events and redactions are keyed by event ID, so these
+		// must be removed before the events are.
+		"DELETE FROM roomserver_previous_events WHERE previous_event_id IN(SELECT event_id FROM roomserver_events WHERE event_nid IN($1))",
+		"DELETE FROM roomserver_redactions WHERE redaction_event_id IN(SELECT event_id FROM roomserver_events WHERE event_nid IN($1))",
+		"DELETE FROM roomserver_event_json WHERE event_nid IN($1)",
+		"DELETE FROM roomserver_events WHERE event_nid IN($1)",
+	} {
+		if err := sqlutil.RunLimitedVariablesExec(ctx, query, txn, params, sqlutil.SQLite3MaxVariables); err != nil {
+			return err
+		}
+	}
+
+	stateNIDs, stateBlockNIDs, err := s.selectUnreferencedStateSnapshots(ctx, txn, roomNID)
+	if err != nil {
+		return err
+	}
+	if len(stateNIDs) == 0 {
+		return nil
+	}
+
+	query := "DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid IN($1)"
+	if err = sqlutil.RunLimitedVariablesExec(ctx, query, txn, stateNIDs, sqlutil.SQLite3MaxVariables); err != nil {
+		return err
+	}
+
+	// Only remove the state blocks that aren't used by the remaining state
+	// snapshots of the room.
+	remaining, err := s.stateSnapshot.selectStateBlockNIDsForRoomNID(ctx, txn, roomNID)
+	if err != nil {
+		return err
+	}
+	inUse := make(map[types.StateBlockNID]struct{}, len(remaining))
+	for _, blockNID := range remaining {
+		inUse[blockNID] = struct{}{}
+	}
+	unused := make([]interface{}, 0, len(stateBlockNIDs))
+	for _, blockNID := range stateBlockNIDs {
+		if _, ok := inUse[blockNID]; ok {
+			continue
+		}
+		inUse[blockNID] = struct{}{} // dedupe NIDs
+		unused = append(unused, blockNID)
+	}
+	query = "DELETE FROM roomserver_state_block WHERE state_block_nid IN($1)"
+	return sqlutil.RunLimitedVariablesExec(ctx, query, txn, unused, sqlutil.SQLite3MaxVariables)
+}
+
+// selectUnreferencedStateSnapshots returns the state snapshots of the room that
+// are no longer used, and the state blocks that they refer to.
+func (s *purgeStatements) selectUnreferencedStateSnapshots(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (stateNIDs []interface{}, stateBlockNIDs []types.StateBlockNID, err error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectUnreferencedStateSnapshotsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectUnreferencedStateSnapshots: rows.close() failed")
+	var stateNID types.StateSnapshotNID
+	var stateBlockNIDsJSON string
+	for rows.Next() {
+		if err = rows.Scan(&stateNID, &stateBlockNIDsJSON); err != nil {
+			return nil, nil, err
+		}
+		var blockNIDs []types.StateBlockNID
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &blockNIDs); err != nil {
+			return nil, nil, err
+		}
+		stateNIDs = append(stateNIDs, stateNID)
+		stateBlockNIDs = append(stateBlockNIDs, blockNIDs...)
+	}
+	return stateNIDs, stateBlockNIDs, rows.Err()
+}
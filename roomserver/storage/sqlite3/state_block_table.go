@@ -128,7 +128,18 @@ func (s *stateBlockStatements) BulkSelectStateBlockEntries(
 		return nil, err
 	}
 	if i != len(stateBlockNIDs) {
-		return nil, fmt.Errorf("storage: state data NIDs missing from the database (%d != %d)", len(results), len(stateBlockNIDs))
+		return nil, types.MissingStateError(fmt.Sprintf("storage: state data NIDs missing from the database (%d != %d)", i, len(stateBlockNIDs)))
 	}
 	return results, err
 }
+
+func (s *stateBlockStatements) BulkDeleteStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs,
+) error {
+	params := make([]interface{}, len(stateBlockNIDs))
+	for i := range stateBlockNIDs {
+		params[i] = int64(stateBlockNIDs[i])
+	}
+	query := "DELETE FROM roomserver_state_block WHERE state_block_nid IN ($1)"
+	return sqlutil.RunLimitedVariablesExec(ctx, query, txn, params, sqlutil.SQLite3MaxVariables)
+}
@@ -57,11 +57,24 @@ const bulkSelectStateBlockNIDsSQL = "" +
 const selectStateBlockNIDsForRoomNID = "" +
 	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
 
+const selectStateSnapshotNIDsForRoomSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots WHERE room_nid = $1 ORDER BY state_snapshot_nid ASC"
+
+// Replace the state blocks of a snapshot along with its hash, unless another
+// snapshot already has the same hash.
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $1, state_block_nids = $2" +
+	" WHERE state_snapshot_nid = $3 AND NOT EXISTS (" +
+	"  SELECT 1 FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1 AND state_snapshot_nid != $3" +
+	" )"
+
 type stateSnapshotStatements struct {
 	db                           *sql.DB
 	insertStateStmt              *sql.Stmt
 	bulkSelectStateBlockNIDsStmt *sql.Stmt
 	selectStateBlockNIDsStmt     *sql.Stmt
+	selectStateSnapshotNIDsStmt  *sql.Stmt
+	updateStateBlockNIDsStmt     *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -78,6 +91,8 @@ func PrepareStateSnapshotTable(db *sql.DB) (*stateSnapshotStatements, error) {
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
 		{&s.selectStateBlockNIDsStmt, selectStateBlockNIDsForRoomNID},
+		{&s.selectStateSnapshotNIDsStmt, selectStateSnapshotNIDsForRoomSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
 	}.Prepare(db)
 }
 
@@ -141,6 +156,42 @@ func (s *stateSnapshotStatements) BulkSelectStateBlockNIDs(
 	return results, nil
 }
 
+func (s *stateSnapshotStatements) SelectStateSnapshotNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.StateSnapshotNID, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStateSnapshotNIDsStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectStateSnapshotNIDsForRoom: rows.close() failed")
+
+	var stateNIDs []types.StateSnapshotNID
+	var stateNID types.StateSnapshotNID
+	for rows.Next() {
+		if err = rows.Scan(&stateNID); err != nil {
+			return nil, err
+		}
+		stateNIDs = append(stateNIDs, stateNID)
+	}
+	return stateNIDs, rows.Err()
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs types.StateBlockNIDs,
+) (bool, error) {
+	stateBlockNIDs = stateBlockNIDs[:util.SortAndUnique(stateBlockNIDs)]
+	stateBlockNIDsJSON, err := json.Marshal(stateBlockNIDs)
+	if err != nil {
+		return false, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(ctx, stateBlockNIDs.Hash(), string(stateBlockNIDsJSON), stateNID)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
 func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
 	ctx context.Context, txn *sql.Tx, stateSnapshotNID types.StateSnapshotNID, domain string,
 ) ([]types.EventNID, error) {
@@ -136,6 +136,15 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateReportedEventsTable(db); err != nil {
 		return err
 	}
+	if err := CreatePartialStateRoomsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBlockedRoomsTable(db); err != nil {
+		return err
+	}
+	if err := CreatePublicationRequestsTable(db); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -204,6 +213,18 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	partialStateRooms, err := PreparePartialStateRoomsTable(db)
+	if err != nil {
+		return err
+	}
+	blockedRooms, err := PrepareBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
+	publicationRequests, err := PreparePublicationRequestsTable(db)
+	if err != nil {
+		return err
+	}
 
 	d.Database = shared.Database{
 		DB: db,
@@ -219,18 +240,21 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 			RedactionsTable:     redactions,
 			ReportedEventsTable: reportedEvents,
 		},
-		Cache:              cache,
-		Writer:             writer,
-		RoomsTable:         rooms,
-		StateBlockTable:    stateBlock,
-		StateSnapshotTable: stateSnapshot,
-		RoomAliasesTable:   roomAliases,
-		InvitesTable:       invites,
-		MembershipTable:    membership,
-		PublishedTable:     published,
-		GetRoomUpdaterFn:   d.GetRoomUpdater,
-		Purge:              purge,
-		UserRoomKeyTable:   userRoomKeys,
+		Cache:                    cache,
+		Writer:                   writer,
+		RoomsTable:               rooms,
+		StateBlockTable:          stateBlock,
+		StateSnapshotTable:       stateSnapshot,
+		RoomAliasesTable:         roomAliases,
+		InvitesTable:             invites,
+		MembershipTable:          membership,
+		PublishedTable:           published,
+		GetRoomUpdaterFn:         d.GetRoomUpdater,
+		Purge:                    purge,
+		UserRoomKeyTable:         userRoomKeys,
+		PartialStateRoomsTable:   partialStateRooms,
+		BlockedRoomsTable:        blockedRooms,
+		PublicationRequestsTable: publicationRequests,
 	}
 	return nil
 }
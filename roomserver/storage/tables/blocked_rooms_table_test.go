@@ -0,0 +1,67 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/storage/postgres"
+	"github.com/element-hq/dendrite/roomserver/storage/sqlite3"
+	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreateBlockedRoomsTable(t *testing.T, dbType test.DBType) (tab tables.BlockedRooms, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateBlockedRoomsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareBlockedRoomsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreateBlockedRoomsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PrepareBlockedRoomsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestBlockedRoomsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateBlockedRoomsTable(t, dbType)
+		defer close()
+
+		// A room without a row isn't blocked
+		_, _, err := tab.SelectBlockedRoom(ctx, nil, "!a:test")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		assert.NoError(t, tab.InsertBlockedRoom(ctx, nil, "!a:test", "@admin:test", 1000))
+		// Blocking again keeps the original block
+		assert.NoError(t, tab.InsertBlockedRoom(ctx, nil, "!a:test", "@other:test", 2000))
+
+		blockedBy, blockedTS, err := tab.SelectBlockedRoom(ctx, nil, "!a:test")
+		assert.NoError(t, err)
+		assert.Equal(t, "@admin:test", blockedBy)
+		assert.Equal(t, spec.Timestamp(1000), blockedTS)
+
+		_, _, err = tab.SelectBlockedRoom(ctx, nil, "!b:test")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		assert.NoError(t, tab.DeleteBlockedRoom(ctx, nil, "!a:test"))
+		_, _, err = tab.SelectBlockedRoom(ctx, nil, "!a:test")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
@@ -47,7 +47,7 @@ func Test_EventJSONTable(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			err := tab.InsertEventJSON(
 				context.Background(), nil, types.EventNID(i),
-				[]byte(fmt.Sprintf(`{"value":%d"}`, i)),
+				[]byte(fmt.Sprintf(`{"value":%d}`, i)),
 			)
 			assert.NoError(t, err)
 		}
@@ -87,7 +87,7 @@ func Test_EventJSONTable(t *testing.T) {
 				assert.Equal(t, tc.wantCount, len(values))
 				for i, v := range values {
 					assert.Equal(t, v.EventNID, types.EventNID(i+1))
-					assert.Equal(t, []byte(fmt.Sprintf(`{"value":%d"}`, i+1)), v.EventJSON)
+					assert.Equal(t, []byte(fmt.Sprintf(`{"value":%d}`, i+1)), v.EventJSON)
 				}
 			})
 		}
@@ -25,10 +25,14 @@ func mustCreateEventsTable(t *testing.T, dbType test.DBType) (tables.Events, fun
 	var tab tables.Events
 	switch dbType {
 	case test.DBTypePostgres:
+		err = postgres.CreateEventJSONTable(db)
+		assert.NoError(t, err)
 		err = postgres.CreateEventsTable(db)
 		assert.NoError(t, err)
 		tab, err = postgres.PrepareEventsTable(db)
 	case test.DBTypeSQLite:
+		err = sqlite3.CreateEventJSONTable(db)
+		assert.NoError(t, err)
 		err = sqlite3.CreateEventsTable(db)
 		assert.NoError(t, err)
 		tab, err = sqlite3.PrepareEventsTable(db)
@@ -146,6 +150,23 @@ func Test_EventsTable(t *testing.T) {
 		maxDepth, err := tab.SelectMaxEventDepth(ctx, nil, nids)
 		assert.NoError(t, err)
 		assert.Equal(t, int64(len(room.Events())+1), maxDepth)
+
+		// paging through the events in depth order returns all of them once
+		allNIDs, err := tab.SelectRoomEventNIDsBeforeDepth(ctx, nil, 1, maxDepth+1)
+		assert.NoError(t, err)
+		var pagedNIDs []types.EventNID
+		afterDepth, afterNID := int64(0), types.EventNID(0)
+		for {
+			page, lastDepth, err := tab.SelectRoomEventNIDsBeforeDepthAfter(ctx, nil, 1, maxDepth+1, afterDepth, afterNID, 2)
+			assert.NoError(t, err)
+			if len(page) == 0 {
+				break
+			}
+			assert.LessOrEqual(t, len(page), 2)
+			pagedNIDs = append(pagedNIDs, page...)
+			afterDepth, afterNID = lastDepth, page[len(page)-1]
+		}
+		assert.Equal(t, allNIDs, pagedNIDs)
 	})
 }
 
@@ -72,6 +72,17 @@ type Events interface {
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
 
 	SelectRoomsWithEventTypeNID(ctx context.Context, txn *sql.Tx, eventTypeNID types.EventTypeNID) ([]types.RoomNID, error)
+	// SelectRoomEventNIDsBeforeDepth returns the NIDs of the events in the room with a depth lower than the given depth,
+	// in depth order.
+	SelectRoomEventNIDsBeforeDepth(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, depth int64) ([]types.EventNID, error)
+	// SelectRoomEventNIDsBeforeDepthAfter returns up to limit NIDs of the events in the room with a depth lower than the
+	// given depth, which come after the given depth and event NID in depth order, and the depth of the last of them.
+	SelectRoomEventNIDsBeforeDepthAfter(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, depth, afterDepth int64, afterNID types.EventNID, limit int) ([]types.EventNID, int64, error)
+	// SelectRoomEventStateSnapshotNIDs returns the state snapshot NID of every event in the room that has one.
+	SelectRoomEventStateSnapshotNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (map[types.EventNID]types.StateSnapshotNID, error)
+	// SelectRoomEventNIDsBySender returns the NIDs of the events in the room, which aren't outliers, sent by
+	// the sender, in NID order.
+	SelectRoomEventNIDsBySender(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, senderID string) ([]types.EventNID, error)
 }
 
 type Rooms interface {
@@ -90,6 +101,12 @@ type Rooms interface {
 type StateSnapshot interface {
 	InsertState(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, stateBlockNIDs types.StateBlockNIDs) (stateNID types.StateSnapshotNID, err error)
 	BulkSelectStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNIDs []types.StateSnapshotNID) ([]types.StateBlockNIDList, error)
+	// SelectStateSnapshotNIDsForRoom returns the NIDs of all state snapshots in the room.
+	SelectStateSnapshotNIDsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.StateSnapshotNID, error)
+	// UpdateStateBlockNIDs replaces the state blocks of a snapshot and updates its hash to match.
+	// The new blocks must resolve to exactly the same state as the old ones. Returns false, and
+	// leaves the snapshot alone, if another snapshot is already made up of the same blocks.
+	UpdateStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs types.StateBlockNIDs) (bool, error)
 	// BulkSelectStateForHistoryVisibility is a PostgreSQL-only optimisation for finding
 	// which users are in a room faster than having to load the entire room state. In the
 	// case of SQLite, this will return tables.OptimisationNotSupportedError.
@@ -103,6 +120,8 @@ type StateSnapshot interface {
 type StateBlock interface {
 	BulkInsertStateData(ctx context.Context, txn *sql.Tx, entries types.StateEntries) (types.StateBlockNID, error)
 	BulkSelectStateBlockEntries(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) ([][]types.EventNID, error)
+	// BulkDeleteStateBlocks deletes the given state blocks, which must no longer be used by any snapshot.
+	BulkDeleteStateBlocks(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) error
 	//BulkSelectFilteredStateBlockEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) ([]types.StateEntryList, error)
 }
 
@@ -155,6 +174,36 @@ type ReportedEvents interface {
 	DeleteReportedEvent(ctx context.Context, txn *sql.Tx, reportID uint64) error
 }
 
+// PartialStateRooms tracks rooms that were joined with partial state (MSC3706).
+type PartialStateRooms interface {
+	UpsertPartialStateRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, joinEventID string, serversInRoom []spec.ServerName) error
+	// SelectPartialStateRoom returns the join event ID and the servers in the room
+	// for a partial state room, or sql.ErrNoRows if the room has full state.
+	SelectPartialStateRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (joinEventID string, serversInRoom []spec.ServerName, err error)
+	SelectPartialStateRoomNIDs(ctx context.Context, txn *sql.Tx) ([]types.RoomNID, error)
+	DeletePartialStateRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) error
+}
+
+// BlockedRooms tracks the rooms that an admin has blocked.
+type BlockedRooms interface {
+	InsertBlockedRoom(ctx context.Context, txn *sql.Tx, roomID, blockedBy string, blockedTS spec.Timestamp) error
+	// SelectBlockedRoom returns who blocked the room and when, or sql.ErrNoRows
+	// if the room isn't blocked.
+	SelectBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) (blockedBy string, blockedTS spec.Timestamp, err error)
+	DeleteBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+// PublicationRequests tracks the rooms waiting for a server admin to approve
+// their publication in the room directory.
+type PublicationRequests interface {
+	InsertPublicationRequest(ctx context.Context, txn *sql.Tx, roomID, requestedBy string, requestedTS spec.Timestamp) error
+	// SelectPublicationRequest returns who asked for the room to be published
+	// and when, or sql.ErrNoRows if nobody has.
+	SelectPublicationRequest(ctx context.Context, txn *sql.Tx, roomID string) (requestedBy string, requestedTS spec.Timestamp, err error)
+	SelectPublicationRequests(ctx context.Context, txn *sql.Tx) ([]api.PublicationRequest, error)
+	DeletePublicationRequest(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
 type MembershipState int64
 
 const (
@@ -169,6 +218,8 @@ type Membership interface {
 	SelectMembershipForUpdate(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (MembershipState, error)
 	SelectMembershipFromRoomAndTarget(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID) (types.EventNID, MembershipState, bool, error)
 	SelectMembershipsFromRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, localOnly bool) (eventNIDs []types.EventNID, err error)
+	// SelectMembershipEventNIDsForRoom returns the membership event of every user with a membership in the room, including forgotten ones.
+	SelectMembershipEventNIDsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) (map[types.EventStateKeyNID]types.EventNID, error)
 	SelectMembershipsFromRoomAndMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, membership MembershipState, localOnly bool) (eventNIDs []types.EventNID, err error)
 	UpdateMembership(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership MembershipState, eventNID types.EventNID, forgotten bool) (bool, error)
 	SelectRoomsWithMembership(ctx context.Context, txn *sql.Tx, userID types.EventStateKeyNID, membershipState MembershipState) ([]types.RoomNID, error)
@@ -183,7 +234,12 @@ type Membership interface {
 }
 
 type Published interface {
-	UpsertRoomPublished(ctx context.Context, txn *sql.Tx, roomID, appserviceID, networkID string, published bool) (err error)
+	UpsertRoomPublished(ctx context.Context, txn *sql.Tx, roomID, appserviceID, networkID string, published bool, publishedBy string, publishedTS spec.Timestamp) (err error)
+	// UnpublishRoom unpublishes every directory entry of the room, including
+	// those of application services.
+	UnpublishRoom(ctx context.Context, txn *sql.Tx, roomID, unpublishedBy string, unpublishedTS spec.Timestamp) error
+	// SelectPublishedEntries returns every published directory entry.
+	SelectPublishedEntries(ctx context.Context, txn *sql.Tx) ([]api.PublishedRoom, error)
 	SelectPublishedFromRoomID(ctx context.Context, txn *sql.Tx, roomID string) (published bool, err error)
 	SelectAllPublishedRooms(ctx context.Context, txn *sql.Tx, networkdID string, published, includeAllNetworks bool) ([]string, error)
 }
@@ -212,6 +268,12 @@ type Purge interface {
 	PurgeRoom(
 		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
 	) error
+	// PurgeHistory removes the given events from the room, including their
+	// prev event references and redactions, along with any state snapshots and
+	// state blocks of the room that are no longer referenced afterwards.
+	PurgeHistory(
+		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID,
+	) error
 }
 
 type UserRoomKeys interface {
@@ -0,0 +1,80 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/storage/postgres"
+	"github.com/element-hq/dendrite/roomserver/storage/sqlite3"
+	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreatePartialStateRoomsTable(t *testing.T, dbType test.DBType) (tab tables.PartialStateRooms, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreatePartialStateRoomsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PreparePartialStateRoomsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreatePartialStateRoomsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PreparePartialStateRoomsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestPartialStateRoomsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreatePartialStateRoomsTable(t, dbType)
+		defer close()
+
+		// A room without a row has full state
+		_, _, err := tab.SelectPartialStateRoom(ctx, nil, 1)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		servers := []spec.ServerName{"a.test", "b.test"}
+		assert.NoError(t, tab.UpsertPartialStateRoom(ctx, nil, 1, "$join1", servers))
+		assert.NoError(t, tab.UpsertPartialStateRoom(ctx, nil, 2, "$join2", nil))
+
+		joinEventID, serversInRoom, err := tab.SelectPartialStateRoom(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "$join1", joinEventID)
+		assert.Equal(t, servers, serversInRoom)
+
+		// Upserting again replaces the existing row
+		assert.NoError(t, tab.UpsertPartialStateRoom(ctx, nil, 1, "$join3", servers[:1]))
+		joinEventID, serversInRoom, err = tab.SelectPartialStateRoom(ctx, nil, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "$join3", joinEventID)
+		assert.Equal(t, servers[:1], serversInRoom)
+
+		roomNIDs, err := tab.SelectPartialStateRoomNIDs(ctx, nil)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []types.RoomNID{1, 2}, roomNIDs)
+
+		assert.NoError(t, tab.DeletePartialStateRoom(ctx, nil, 1))
+		_, _, err = tab.SelectPartialStateRoom(ctx, nil, 1)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+
+		roomNIDs, err = tab.SelectPartialStateRoomNIDs(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.RoomNID{2}, roomNIDs)
+	})
+}
@@ -0,0 +1,74 @@
+package tables_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/storage/postgres"
+	"github.com/element-hq/dendrite/roomserver/storage/sqlite3"
+	"github.com/element-hq/dendrite/roomserver/storage/tables"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCreatePublicationRequestsTable(t *testing.T, dbType test.DBType) (tab tables.PublicationRequests, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreatePublicationRequestsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PreparePublicationRequestsTable(db)
+	case test.DBTypeSQLite:
+		err = sqlite3.CreatePublicationRequestsTable(db)
+		assert.NoError(t, err)
+		tab, err = sqlite3.PreparePublicationRequestsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestPublicationRequestsTable(t *testing.T) {
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreatePublicationRequestsTable(t, dbType)
+		defer close()
+
+		requests, err := tab.SelectPublicationRequests(ctx, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, requests)
+
+		assert.NoError(t, tab.InsertPublicationRequest(ctx, nil, "!b:test", "@bob:test", 2000))
+		assert.NoError(t, tab.InsertPublicationRequest(ctx, nil, "!a:test", "@alice:test", 1000))
+		// Asking again keeps the original request
+		assert.NoError(t, tab.InsertPublicationRequest(ctx, nil, "!a:test", "@charlie:test", 3000))
+
+		requestedBy, requestedTS, err := tab.SelectPublicationRequest(ctx, nil, "!a:test")
+		assert.NoError(t, err)
+		assert.Equal(t, "@alice:test", requestedBy)
+		assert.Equal(t, spec.Timestamp(1000), requestedTS)
+
+		// Requests are returned oldest first
+		requests, err = tab.SelectPublicationRequests(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []api.PublicationRequest{
+			{RoomID: "!a:test", RequestedBy: "@alice:test", RequestedTS: 1000},
+			{RoomID: "!b:test", RequestedBy: "@bob:test", RequestedTS: 2000},
+		}, requests)
+
+		assert.NoError(t, tab.DeletePublicationRequest(ctx, nil, "!a:test"))
+		_, _, err = tab.SelectPublicationRequest(ctx, nil, "!a:test")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/roomserver/storage/postgres"
 	"github.com/element-hq/dendrite/roomserver/storage/sqlite3"
 	"github.com/element-hq/dendrite/roomserver/storage/tables"
@@ -53,7 +54,7 @@ func TestPublishedTable(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			room := test.NewRoom(t, alice)
 			published := i%2 == 0
-			err := tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, published)
+			err := tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, published, "", 0)
 			assert.NoError(t, err)
 			if published {
 				publishedRooms = append(publishedRooms, room.ID)
@@ -71,9 +72,9 @@ func TestPublishedTable(t *testing.T) {
 
 		// test an actual upsert
 		room := test.NewRoom(t, alice)
-		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, true)
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, true, "", 0)
 		assert.NoError(t, err)
-		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, false)
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, false, "", 0)
 		assert.NoError(t, err)
 		// should now be false, due to the upsert
 		publishedRes, err := tab.SelectPublishedFromRoomID(ctx, nil, room.ID)
@@ -83,7 +84,7 @@ func TestPublishedTable(t *testing.T) {
 		// network specific test
 		nwID = "irc"
 		room = test.NewRoom(t, alice)
-		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, true)
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, asID, nwID, true, "", 0)
 		assert.NoError(t, err)
 		publishedRooms = append(publishedRooms, room.ID)
 		sort.Strings(publishedRooms)
@@ -96,5 +97,34 @@ func TestPublishedTable(t *testing.T) {
 		roomIDs, err = tab.SelectAllPublishedRooms(ctx, nil, "", true, true)
 		assert.NoError(t, err)
 		assert.Equal(t, publishedRooms, roomIDs)
+
+		// check that the publisher of each entry is returned
+		room = test.NewRoom(t, alice)
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, "", "", true, alice.ID, 1000)
+		assert.NoError(t, err)
+		err = tab.UpsertRoomPublished(ctx, nil, room.ID, "irc", "irc", true, "@irc:test", 2000)
+		assert.NoError(t, err)
+		entries, err := tab.SelectPublishedEntries(ctx, nil)
+		assert.NoError(t, err)
+		var roomEntries []api.PublishedRoom
+		for _, entry := range entries {
+			if entry.RoomID == room.ID {
+				roomEntries = append(roomEntries, entry)
+			}
+		}
+		assert.Equal(t, []api.PublishedRoom{
+			{RoomID: room.ID, PublishedBy: alice.ID, PublishedTS: 1000},
+			{RoomID: room.ID, AppserviceID: "irc", NetworkID: "irc", PublishedBy: "@irc:test", PublishedTS: 2000},
+		}, roomEntries)
+
+		// unpublishing the room removes all of its entries
+		err = tab.UnpublishRoom(ctx, nil, room.ID, "@admin:test", 3000)
+		assert.NoError(t, err)
+		entries, err = tab.SelectPublishedEntries(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, len(publishedRooms), len(entries))
+		for _, entry := range entries {
+			assert.NotEqual(t, room.ID, entry.RoomID)
+		}
 	})
 }
@@ -95,3 +95,36 @@ func TestStateSnapshotTable(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestStateSnapshotTableUpdateStateBlockNIDs(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateStateSnapshotTable(t, dbType)
+		defer close()
+
+		stateNID1, err := tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{1, 2, 3})
+		assert.NoError(t, err)
+		stateNID2, err := tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{4, 5, 6})
+		assert.NoError(t, err)
+
+		updated, err := tab.UpdateStateBlockNIDs(ctx, nil, stateNID1, types.StateBlockNIDs{8, 7})
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		// The hash must have been updated too, so inserting the same blocks
+		// again returns the updated snapshot.
+		stateNID, err := tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{7, 8})
+		assert.NoError(t, err)
+		assert.Equal(t, stateNID1, stateNID)
+
+		// Another snapshot can't be given the same blocks.
+		updated, err = tab.UpdateStateBlockNIDs(ctx, nil, stateNID2, types.StateBlockNIDs{7, 8})
+		assert.NoError(t, err)
+		assert.False(t, updated)
+
+		nidLists, err := tab.BulkSelectStateBlockNIDs(ctx, nil, []types.StateSnapshotNID{stateNID1, stateNID2})
+		assert.NoError(t, err)
+		assert.Equal(t, []types.StateBlockNID{7, 8}, nidLists[0].StateBlockNIDs)
+		assert.Equal(t, []types.StateBlockNID{4, 5, 6}, nidLists[1].StateBlockNIDs)
+	})
+}
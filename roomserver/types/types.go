@@ -266,6 +266,67 @@ type StateEntryList struct {
 	StateEntries  []StateEntry
 }
 
+// StateCompressionResult describes what happened when the state snapshots of
+// a room were compressed.
+type StateCompressionResult struct {
+	// How many state snapshots the room has.
+	Snapshots int `json:"snapshots"`
+	// How many of the snapshots were rewritten with fewer state blocks.
+	CompressedSnapshots int `json:"compressed_snapshots"`
+	// How many state blocks were removed because no snapshot uses them anymore.
+	RemovedBlocks int `json:"removed_blocks"`
+}
+
+// The kinds of problem which can be found by an integrity check of a room.
+const (
+	// An event refers to an auth event which isn't stored.
+	IntegrityMissingAuthEvent = "missing_auth_event"
+	// An event is stored, but can't be loaded.
+	IntegrityUnreadableEvent = "unreadable_event"
+	// An event, or the current state of the room, refers to a state snapshot which isn't stored.
+	IntegrityMissingStateSnapshot = "missing_state_snapshot"
+	// A state snapshot refers to a state block which isn't stored.
+	IntegrityMissingStateBlock = "missing_state_block"
+	// The state after the forward extremities can't be worked out.
+	IntegrityUnresolvableState = "unresolvable_state"
+	// The current state differs from the state resolved from the forward extremities.
+	IntegrityCurrentStateMismatch = "current_state_mismatch"
+	// The membership table differs from the membership events in the current state.
+	IntegrityMembershipMismatch = "membership_mismatch"
+)
+
+// IntegrityProblem is a single problem found by an integrity check of a room.
+type IntegrityProblem struct {
+	// One of the Integrity* constants.
+	Kind string `json:"kind"`
+	// The event which has the problem, e.g. the event that is stored for a
+	// state key tuple, or that refers to something which is missing.
+	EventID string `json:"event_id,omitempty"`
+	// The event which was expected instead, e.g. the missing auth event, or the
+	// event that should be stored for a state key tuple.
+	ExpectedEventID  string           `json:"expected_event_id,omitempty"`
+	EventType        string           `json:"type,omitempty"`
+	StateKey         *string          `json:"state_key,omitempty"`
+	StateSnapshotNID StateSnapshotNID `json:"state_snapshot_nid,omitempty"`
+	StateBlockNID    StateBlockNID    `json:"state_block_nid,omitempty"`
+	Detail           string           `json:"detail"`
+}
+
+// RoomIntegrityReport is the result of checking that the data stored for a
+// room is consistent.
+type RoomIntegrityReport struct {
+	RoomID string `json:"room_id"`
+	// How many events and state snapshots were checked.
+	Events    int                `json:"events"`
+	Snapshots int                `json:"snapshots"`
+	Problems  []IntegrityProblem `json:"problems"`
+}
+
+// Consistent returns true if no problems were found in the room.
+func (r *RoomIntegrityReport) Consistent() bool {
+	return len(r.Problems) == 0
+}
+
 // A MissingEventError is an error that happened because the roomserver was
 // missing requested events from its database.
 type MissingEventError string
@@ -29,7 +29,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/element-hq/dendrite/internal"
+	"github.com/element-hq/dendrite/internal/fedcapture"
 	"github.com/element-hq/dendrite/internal/httputil"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/gorilla/mux"
 	"github.com/kardianos/minwinsvc"
 
@@ -68,9 +70,37 @@ func CreateClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) *fclient.Cli
 	return client
 }
 
+// FederationClientOpts are the optional settings of a federation client.
+type FederationClientOpts struct {
+	ServerPolicy    *serverpolicy.Policy
+	CaptureRecorder *fedcapture.Recorder
+}
+
+// FederationClientOption is an option to CreateFederationClient.
+type FederationClientOption func(opts *FederationClientOpts)
+
+// WithServerPolicy refuses requests to servers which the server-wide federation
+// policy doesn't allow. Every server is allowed without it.
+func WithServerPolicy(serverPolicy *serverpolicy.Policy) FederationClientOption {
+	return func(opts *FederationClientOpts) {
+		opts.ServerPolicy = serverPolicy
+	}
+}
+
+// WithCaptureRecorder captures outbound federation traffic into the recorder.
+func WithCaptureRecorder(recorder *fedcapture.Recorder) FederationClientOption {
+	return func(opts *FederationClientOpts) {
+		opts.CaptureRecorder = recorder
+	}
+}
+
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
-func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) fclient.FederationClient {
+func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache, options ...FederationClientOption) fclient.FederationClient {
+	clientOpts := FederationClientOpts{}
+	for _, option := range options {
+		option(&clientOpts)
+	}
 	identities := cfg.Global.SigningIdentities()
 	if cfg.Global.DisableFederation {
 		return fclient.NewFederationClient(
@@ -87,10 +117,12 @@ func CreateFederationClient(cfg *config.Dendrite, dnsCache *fclient.DNSCache) fc
 	if cfg.Global.DNSCache.Enabled {
 		opts = append(opts, fclient.WithDNSCache(dnsCache))
 	}
-	client := fclient.NewFederationClient(
+	if transport := federationTransport(opts, clientOpts.ServerPolicy, clientOpts.CaptureRecorder); transport != nil {
+		opts = append(opts, fclient.WithTransport(transport))
+	}
+	return fclient.NewFederationClient(
 		identities, opts...,
 	)
-	return client
 }
 
 func ConfigureAdminEndpoints(processContext *process.ProcessContext, routers httputil.Routers) {
@@ -249,6 +281,26 @@ func SetupAndServeHTTP(
 	logrus.Infof("Stopped HTTP listeners")
 }
 
+// ReloadOnSIGHUP calls reload every time the process receives SIGHUP, until
+// Dendrite shuts down.
+func ReloadOnSIGHUP(processCtx *process.ProcessContext, reload func() error) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-sigs:
+			if err := reload(); err != nil {
+				logrus.WithError(err).Error("Failed to reload config")
+				continue
+			}
+			logrus.Info("Reloaded config")
+		case <-processCtx.WaitForShutdown():
+			return
+		}
+	}
+}
+
 func WaitForShutdown(processCtx *process.ProcessContext) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
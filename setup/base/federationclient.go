@@ -0,0 +1,46 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package base
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+
+	"github.com/element-hq/dendrite/internal/fedcapture"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
+)
+
+// federationTransport returns the transport for a federation client which
+// refuses requests to servers not allowed by the server policy and captures
+// traffic with the recorder, or nil if neither is needed. Requests are handed
+// on to a plain client with the given options, so that destinations are still
+// resolved in the usual way.
+func federationTransport(opts []fclient.ClientOption, serverPolicy *serverpolicy.Policy, recorder *fedcapture.Recorder) http.RoundTripper {
+	if serverPolicy == nil && recorder == nil {
+		return nil
+	}
+	inner := fclient.NewClient(append(opts, fclient.WithWellKnownSRVLookups(true))...)
+	var transport http.RoundTripper = clientTransport{client: inner}
+	if recorder != nil {
+		transport = recorder.Transport(transport)
+	}
+	if serverPolicy != nil {
+		transport = serverPolicy.Transport(transport)
+	}
+	return transport
+}
+
+// clientTransport adapts an fclient.Client to an http.RoundTripper, so that a
+// federation client can be given a wrapping transport while still using the
+// matrix:// scheme resolution of the default one.
+type clientTransport struct {
+	client *fclient.Client
+}
+
+func (c clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.client.DoHTTPRequest(req.Context(), req)
+}
@@ -297,6 +297,14 @@ func (config *Dendrite) Derive() error {
 	return nil
 }
 
+// Reload copies the options which can be changed without restarting Dendrite
+// from a freshly loaded config. Everything else in newConfig is ignored. The
+// components using these options must be updated by the caller.
+func (config *Dendrite) Reload(newConfig *Dendrite) {
+	config.FederationAPI.AllowedServers = newConfig.FederationAPI.AllowedServers
+	config.FederationAPI.DeniedServers = newConfig.FederationAPI.DeniedServers
+}
+
 type DefaultOpts struct {
 	Generate       bool
 	SingleDatabase bool
@@ -350,6 +358,7 @@ func (c *Dendrite) Wiring() {
 	c.ClientAPI.Derived = &c.Derived
 	c.AppServiceAPI.Derived = &c.Derived
 	c.ClientAPI.MSCs = &c.MSCs
+	c.SyncAPI.Retention = &c.RoomServer.Retention
 }
 
 // Error returns a string detailing how many errors were contained within a
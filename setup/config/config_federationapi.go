@@ -1,6 +1,13 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
@@ -18,6 +25,12 @@ type FederationAPI struct {
 	// The default value is 16 if not specified, which is circa 18 hours.
 	FederationMaxRetries uint32 `yaml:"send_max_retries"`
 
+	// How long we should keep retrying a server that keeps failing before we
+	// stop sending to it, even if send_max_retries hasn't been reached yet.
+	// Backoff state is persisted, so this applies across restarts. Zero
+	// (the default) means that only send_max_retries applies.
+	MaxRetryPeriod time.Duration `yaml:"max_retry_period"`
+
 	// P2P Feature: Whether relaying to specific nodes should be enabled.
 	// Defaults to false.
 	// Note: Enabling relays introduces a huge startup delay, if you are not using
@@ -47,9 +60,38 @@ type FederationAPI struct {
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
 
+	// Server keys to trust for specific servers. Keys are never fetched for
+	// these servers, and only the pinned keys are accepted from them.
+	PinnedServerKeys []PinnedServerKeys `yaml:"pinned_server_keys"`
+
 	// Deny/Allow lists used for restricting request scopes.
 	DenyNetworkCIDRs  []string `yaml:"deny_networks"`
 	AllowNetworkCIDRs []string `yaml:"allow_networks"`
+
+	// Server-wide lists of server names that we will or won't federate with,
+	// independent of room ACLs. Entries may contain the * and ? wildcards. If
+	// AllowedServers is not empty, only matching servers are federated with.
+	// DeniedServers takes precedence over AllowedServers. Both lists are
+	// reloaded from the config file when Dendrite receives SIGHUP.
+	AllowedServers []string `yaml:"allowed_servers"`
+	DeniedServers  []string `yaml:"denied_servers"`
+
+	// Destinations whose queue depth and transaction durations are also
+	// exported as metrics of their own. The metrics of all destinations are
+	// only exported in aggregate otherwise, as there would be a series for
+	// every server that we have ever talked to.
+	MetricsDestinations []string `yaml:"metrics_destinations"`
+
+	// Per-origin limits on inbound federation requests.
+	RateLimiting FederationRateLimiting `yaml:"rate_limiting"`
+
+	// Capturing of federation traffic for debugging.
+	Capture FederationCapture `yaml:"capture"`
+
+	// Whether to join rooms over federation with partial state (MSC3706).
+	// The remote server omits most membership events from the join response,
+	// and the full room state is fetched in the background afterwards.
+	PartialStateJoins bool `yaml:"partial_state_joins"`
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
@@ -71,6 +113,8 @@ func (c *FederationAPI) Defaults(opts DefaultOpts) {
 	c.AllowNetworkCIDRs = []string{
 		"0.0.0.0/0",
 	}
+	c.RateLimiting.Defaults()
+	c.Capture.Defaults()
 	if opts.Generate {
 		c.KeyPerspectives = KeyPerspectives{
 			{
@@ -97,6 +141,105 @@ func (c *FederationAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.RateLimiting.Verify(configErrs)
+	c.Capture.Verify(configErrs)
+	for _, pinned := range c.PinnedServerKeys {
+		pinned.verify(configErrs)
+	}
+	if c.MaxRetryPeriod < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.max_retry_period': %s", c.MaxRetryPeriod))
+	}
+	if _, err := serverpolicy.New(c.AllowedServers, c.DeniedServers); err != nil {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.%s'", err))
+	}
+}
+
+type FederationRateLimiting struct {
+	// Is inbound federation rate limiting enabled or disabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The budget for each remote server sending transactions to /send.
+	Send FederationRateLimit `yaml:"send"`
+
+	// The budget for each remote server requesting room history, i.e.
+	// /backfill, /get_missing_events, /state, /state_ids and /event_auth.
+	History FederationRateLimit `yaml:"history"`
+
+	// A list of server names that are exempt from rate limiting.
+	ExemptServers []string `yaml:"exempt_servers"`
+}
+
+type FederationRateLimit struct {
+	// How many requests a remote server can make within the cooloff
+	// period before we apply rate-limiting
+	Threshold int64 `yaml:"threshold"`
+
+	// The cooloff period in milliseconds after a request before the "slot"
+	// is freed again
+	CooloffMS int64 `yaml:"cooloff_ms"`
+
+	// How many requests from a remote server can be processed at once
+	MaxConcurrent int64 `yaml:"max_concurrent"`
+}
+
+func (r *FederationRateLimiting) Defaults() {
+	r.Enabled = true
+	r.Send = FederationRateLimit{Threshold: 50, CooloffMS: 1000, MaxConcurrent: 5}
+	r.History = FederationRateLimit{Threshold: 30, CooloffMS: 1000, MaxConcurrent: 5}
+}
+
+func (r *FederationRateLimiting) Verify(configErrs *ConfigErrors) {
+	if !r.Enabled {
+		return
+	}
+	r.Send.verify(configErrs, "federation_api.rate_limiting.send")
+	r.History.verify(configErrs, "federation_api.rate_limiting.history")
+}
+
+func (r *FederationRateLimit) verify(configErrs *ConfigErrors, key string) {
+	checkGreaterThanZero := func(name string, value int64) {
+		if value <= 0 {
+			configErrs.Add(fmt.Sprintf("invalid value for config key '%s.%s': %d", key, name, value))
+		}
+	}
+	checkGreaterThanZero("threshold", r.Threshold)
+	checkGreaterThanZero("cooloff_ms", r.CooloffMS)
+	checkGreaterThanZero("max_concurrent", r.MaxConcurrent)
+}
+
+type FederationCapture struct {
+	// Is capturing enabled? Requests and responses are only recorded for the
+	// selected servers, but the capturing transport and middleware are only
+	// installed at startup if this is set.
+	Enabled bool `yaml:"enabled"`
+
+	// The server names to capture traffic to and from. This can also be
+	// changed at runtime using the admin API.
+	Servers []string `yaml:"servers"`
+
+	// How many requests and responses to keep.
+	BufferSize int `yaml:"buffer_size"`
+
+	// How much of each request and response body to keep, in bytes.
+	MaxBodyBytes int `yaml:"max_body_bytes"`
+}
+
+func (c *FederationCapture) Defaults() {
+	c.Enabled = false
+	c.BufferSize = 500
+	c.MaxBodyBytes = 64 * 1024
+}
+
+func (c *FederationCapture) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.BufferSize <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.capture.buffer_size': %d", c.BufferSize))
+	}
+	if c.MaxBodyBytes <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.capture.max_body_bytes': %d", c.MaxBodyBytes))
+	}
 }
 
 // The config for setting a proxy to use for server->server requests
@@ -133,9 +276,47 @@ type KeyPerspective struct {
 	Keys []KeyPerspectiveTrustKey `yaml:"keys"`
 }
 
+// PinnedServerKeys are the only keys that are trusted for a server.
+type PinnedServerKeys struct {
+	// The server name that the keys belong to
+	ServerName spec.ServerName `yaml:"server_name"`
+	// The keys to trust for the server
+	Keys []KeyPerspectiveTrustKey `yaml:"keys"`
+}
+
+func (p *PinnedServerKeys) verify(configErrs *ConfigErrors) {
+	if p.ServerName == "" {
+		configErrs.Add("missing config key 'federation_api.pinned_server_keys.server_name'")
+		return
+	}
+	if len(p.Keys) == 0 {
+		configErrs.Add(fmt.Sprintf("missing config key 'federation_api.pinned_server_keys.keys' for server %q", p.ServerName))
+	}
+	for _, key := range p.Keys {
+		if !strings.HasPrefix(string(key.KeyID), "ed25519:") {
+			configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.pinned_server_keys.keys.key_id' for server %q: %q", p.ServerName, key.KeyID))
+		}
+		if _, err := key.Decode(); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key 'federation_api.pinned_server_keys.keys.public_key' for server %q: %s", p.ServerName, err))
+		}
+	}
+}
+
 type KeyPerspectiveTrustKey struct {
 	// The key ID, e.g. ed25519:auto
 	KeyID gomatrixserverlib.KeyID `yaml:"key_id"`
 	// The public key in base64 unpadded format
 	PublicKey string `yaml:"public_key"`
 }
+
+// Decode returns the raw ed25519 public key.
+func (k *KeyPerspectiveTrustKey) Decode() (ed25519.PublicKey, error) {
+	rawKey, err := base64.RawStdEncoding.DecodeString(k.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rawKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes long, expected %d", len(rawKey), ed25519.PublicKeySize)
+	}
+	return rawKey, nil
+}
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
@@ -13,10 +15,26 @@ type RoomServer struct {
 	DefaultRoomVersion gomatrixserverlib.RoomVersion `yaml:"default_room_version,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// Message retention (m.room.retention) settings.
+	Retention Retention `yaml:"retention"`
+
+	// If a room has more forward extremities than this, a dummy event is sent
+	// into it to merge them. Zero disables merging.
+	MaxForwardExtremities int `yaml:"max_forward_extremities"`
+
+	// What else is done when a local user upgrades a room.
+	RoomUpgrades RoomUpgrades `yaml:"room_upgrades"`
+
+	// Which rooms local users may publish in the room directory.
+	RoomDirectory RoomDirectory `yaml:"room_directory"`
 }
 
 func (c *RoomServer) Defaults(opts DefaultOpts) {
 	c.DefaultRoomVersion = gomatrixserverlib.RoomVersionV10
+	c.MaxForwardExtremities = 10
+	c.Retention.Defaults(opts)
+	c.RoomDirectory.Defaults(opts)
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.Database.ConnectionString = "file:roomserver.db"
@@ -34,4 +52,157 @@ func (c *RoomServer) Verify(configErrs *ConfigErrors) {
 	} else if !gomatrixserverlib.StableRoomVersion(c.DefaultRoomVersion) {
 		log.Warnf("WARNING: Provided default room version %q is unstable", c.DefaultRoomVersion)
 	}
+	if c.MaxForwardExtremities < 0 {
+		configErrs.Add("invalid value for config key 'room_server.max_forward_extremities': must not be negative")
+	}
+	c.Retention.Verify(configErrs)
+	c.RoomDirectory.Verify(configErrs)
+}
+
+// RoomUpgrades controls what is done, besides creating the new room, when a
+// local user upgrades a room.
+type RoomUpgrades struct {
+	// Whether the members of the old room are invited to the new room.
+	InviteMembers bool `yaml:"invite_members"`
+	// Whether spaces containing the old room, which the upgrading user can
+	// edit, are updated to contain the new room too.
+	UpdateParentSpaces bool `yaml:"update_parent_spaces"`
+}
+
+const (
+	// PublicationPolicyAllow lets any room be published.
+	PublicationPolicyAllow = "allow"
+	// PublicationPolicyApproval queues rooms until a server admin approves them.
+	PublicationPolicyApproval = "approval"
+	// PublicationPolicyRules only lets rooms matching the publication rules be published.
+	PublicationPolicyRules = "rules"
+)
+
+// RoomDirectory controls which rooms local users may publish in the room
+// directory. Application services aren't affected.
+type RoomDirectory struct {
+	// One of "allow", "approval" or "rules".
+	PublicationPolicy string `yaml:"publication_policy"`
+	// The rules used by the "rules" policy. The first rule matching the room
+	// decides whether it may be published, and rooms matching no rule may not.
+	PublicationRules []PublicationRule `yaml:"publication_rules"`
+}
+
+// PublicationRule matches rooms by their aliases and creator. Patterns are
+// regular expressions which must match the whole alias or user ID, and a
+// pattern which is left empty matches any room.
+type PublicationRule struct {
+	// Either "allow" or "deny".
+	Action string `yaml:"action"`
+	// Matches if any of the aliases of the room match.
+	Alias string `yaml:"alias"`
+	// Matches the user ID of the room creator.
+	Creator string `yaml:"creator"`
+
+	aliasRegexp   *regexp.Regexp
+	creatorRegexp *regexp.Regexp
+}
+
+func (c *RoomDirectory) Defaults(opts DefaultOpts) {
+	c.PublicationPolicy = PublicationPolicyAllow
+}
+
+func (c *RoomDirectory) Verify(configErrs *ConfigErrors) {
+	switch c.PublicationPolicy {
+	case PublicationPolicyAllow, PublicationPolicyApproval, PublicationPolicyRules:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.room_directory.publication_policy': %q", c.PublicationPolicy))
+	}
+	for i := range c.PublicationRules {
+		rule := &c.PublicationRules[i]
+		if rule.Action != "allow" && rule.Action != "deny" {
+			configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.room_directory.publication_rules[%d].action': %q", i, rule.Action))
+		}
+		var err error
+		if rule.Alias != "" {
+			if rule.aliasRegexp, err = regexp.Compile("^(?:" + rule.Alias + ")$"); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.room_directory.publication_rules[%d].alias': %s", i, err))
+			}
+		}
+		if rule.Creator != "" {
+			if rule.creatorRegexp, err = regexp.Compile("^(?:" + rule.Creator + ")$"); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key 'room_server.room_directory.publication_rules[%d].creator': %s", i, err))
+			}
+		}
+	}
+}
+
+// Allowed returns whether a room with the given creator and aliases may be
+// published according to the publication rules.
+func (c *RoomDirectory) Allowed(creator string, aliases []string) bool {
+	for i := range c.PublicationRules {
+		if c.PublicationRules[i].matches(creator, aliases) {
+			return c.PublicationRules[i].Action == "allow"
+		}
+	}
+	return false
+}
+
+func (r *PublicationRule) matches(creator string, aliases []string) bool {
+	if r.Creator != "" && (r.creatorRegexp == nil || !r.creatorRegexp.MatchString(creator)) {
+		return false
+	}
+	if r.Alias == "" {
+		return true
+	}
+	if r.aliasRegexp == nil {
+		return false
+	}
+	for _, alias := range aliases {
+		if r.aliasRegexp.MatchString(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// Retention controls how long events are kept in rooms, according to their
+// m.room.retention state event and the server-wide settings.
+type Retention struct {
+	// Whether events are purged, and hidden from clients, once they expire.
+	Enabled bool `yaml:"enabled"`
+	// The policy for rooms which don't specify their own.
+	DefaultPolicy RetentionPolicy `yaml:"default_policy"`
+	// The bounds that the max_lifetime of rooms is clamped to, or zero
+	// for no bound.
+	AllowedLifetimeMin time.Duration `yaml:"allowed_lifetime_min"`
+	AllowedLifetimeMax time.Duration `yaml:"allowed_lifetime_max"`
+	// How often expired events are purged.
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+type RetentionPolicy struct {
+	// How long events are kept, or zero to keep them forever.
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+func (c *Retention) Defaults(opts DefaultOpts) {
+	c.Enabled = false
+	c.PurgeInterval = time.Hour * 24
+}
+
+func (c *Retention) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.DefaultPolicy.MaxLifetime < 0 {
+		configErrs.Add("invalid value for config key 'room_server.retention.default_policy.max_lifetime': must not be negative")
+	}
+	if c.AllowedLifetimeMin < 0 {
+		configErrs.Add("invalid value for config key 'room_server.retention.allowed_lifetime_min': must not be negative")
+	}
+	if c.AllowedLifetimeMax < 0 {
+		configErrs.Add("invalid value for config key 'room_server.retention.allowed_lifetime_max': must not be negative")
+	}
+	if c.AllowedLifetimeMax > 0 && c.AllowedLifetimeMin > c.AllowedLifetimeMax {
+		configErrs.Add("invalid value for config key 'room_server.retention.allowed_lifetime_min': must not be greater than 'allowed_lifetime_max'")
+	}
+	if c.PurgeInterval <= 0 {
+		configErrs.Add("invalid value for config key 'room_server.retention.purge_interval': must be positive")
+	}
 }
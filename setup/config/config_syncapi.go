@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -8,6 +13,13 @@ type SyncAPI struct {
 	RealIPHeader string `yaml:"real_ip_header"`
 
 	Fulltext Fulltext `yaml:"search"`
+
+	// How long stored filters are kept after they were last used, or
+	// zero to keep them forever.
+	FilterRetention time.Duration `yaml:"filter_retention"`
+
+	// Message retention settings, from the room server config.
+	Retention *Retention `yaml:"-"`
 }
 
 func (c *SyncAPI) Defaults(opts DefaultOpts) {
@@ -21,13 +33,38 @@ func (c *SyncAPI) Defaults(opts DefaultOpts) {
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors) {
 	c.Fulltext.Verify(configErrs)
+	if c.FilterRetention < 0 {
+		configErrs.Add("invalid value for config key 'sync_api.filter_retention': must not be negative")
+	}
+	// Cached filters aren't marked as used, and uses are only recorded hourly,
+	// so filters must expire from the cache well before they're deleted.
+	if c.FilterRetention > 0 && (c.Matrix.Cache.MaxAge <= 0 || c.FilterRetention <= c.Matrix.Cache.MaxAge+time.Hour) {
+		configErrs.Add("invalid value for config key 'sync_api.filter_retention': must be more than an hour longer than 'global.cache.max_age'")
+	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	if c.Fulltext.Enabled && c.Fulltext.Backend == FulltextBackendPostgres {
+		connectionString := c.Database.ConnectionString
+		if connectionString == "" {
+			connectionString = c.Matrix.DatabaseOptions.ConnectionString
+		}
+		if connectionString != "" && !connectionString.IsPostgres() {
+			configErrs.Add("invalid value for config key 'syncapi.search.backend': the postgres backend requires a PostgreSQL sync API database")
+		}
+	}
 }
 
+const (
+	// FulltextBackendBleve stores the search index on disk using bleve.
+	FulltextBackendBleve = "bleve"
+	// FulltextBackendPostgres uses PostgreSQL full-text search on the sync API database.
+	FulltextBackendPostgres = "postgres"
+)
+
 type Fulltext struct {
 	Enabled   bool   `yaml:"enabled"`
+	Backend   string `yaml:"backend"` // either "bleve" or "postgres"
 	IndexPath Path   `yaml:"index_path"`
 	InMemory  bool   `yaml:"in_memory"` // only useful in tests
 	Language  string `yaml:"language"`  // the language to use when analysing content
@@ -35,6 +72,7 @@ type Fulltext struct {
 
 func (f *Fulltext) Defaults(opts DefaultOpts) {
 	f.Enabled = false
+	f.Backend = FulltextBackendBleve
 	f.IndexPath = "./searchindex"
 	f.Language = "en"
 }
@@ -43,6 +81,12 @@ func (f *Fulltext) Verify(configErrs *ConfigErrors) {
 	if !f.Enabled {
 		return
 	}
-	checkNotEmpty(configErrs, "syncapi.search.index_path", string(f.IndexPath))
+	switch f.Backend {
+	case FulltextBackendBleve, "":
+		checkNotEmpty(configErrs, "syncapi.search.index_path", string(f.IndexPath))
+	case FulltextBackendPostgres:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key 'syncapi.search.backend': %q (must be %q or %q)", f.Backend, FulltextBackendBleve, FulltextBackendPostgres))
+	}
 	checkNotEmpty(configErrs, "syncapi.search.language", f.Language)
 }
@@ -314,3 +314,31 @@ func Test_SigningIdentityFor(t *testing.T) {
 		})
 	}
 }
+
+func TestReloadServerPolicy(t *testing.T) {
+	cfg, err := loadConfig("/my/config/dir", []byte(testConfig),
+		mockReadFile{
+			"/my/config/dir/matrix_key.pem": testKey,
+			"/my/config/dir/tls_cert.pem":   testCert,
+		}.readFile,
+	)
+	if err != nil {
+		t.Fatal("failed to load config:", err)
+	}
+
+	newCfg := &Dendrite{}
+	newCfg.Defaults(DefaultOpts{})
+	newCfg.FederationAPI.AllowedServers = []string{"*.example.com"}
+	newCfg.FederationAPI.DeniedServers = []string{"evil.com"}
+	newCfg.Global.ServerName = "changed"
+	cfg.Reload(newCfg)
+	if !reflect.DeepEqual(cfg.FederationAPI.AllowedServers, newCfg.FederationAPI.AllowedServers) {
+		t.Errorf("allowed_servers not reloaded: got %v", cfg.FederationAPI.AllowedServers)
+	}
+	if !reflect.DeepEqual(cfg.FederationAPI.DeniedServers, newCfg.FederationAPI.DeniedServers) {
+		t.Errorf("denied_servers not reloaded: got %v", cfg.FederationAPI.DeniedServers)
+	}
+	if cfg.Global.ServerName == newCfg.Global.ServerName {
+		t.Errorf("server_name should not be reloaded")
+	}
+}
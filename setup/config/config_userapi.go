@@ -22,6 +22,10 @@ type UserAPI struct {
 	// be joined to the rooms listed under this option.
 	AutoJoinRooms []string `yaml:"auto_join_rooms"`
 
+	// Whether local users in a room which is upgraded automatically join
+	// the new room.
+	AutoJoinUpgradedRooms bool `yaml:"auto_join_upgraded_rooms"`
+
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
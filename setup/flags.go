@@ -12,6 +12,7 @@ import (
 	"os"
 
 	"github.com/element-hq/dendrite/internal"
+	"github.com/element-hq/dendrite/internal/serverpolicy"
 	"github.com/element-hq/dendrite/setup/config"
 	"github.com/sirupsen/logrus"
 )
@@ -47,3 +48,17 @@ func ParseFlags(monolith bool) *config.Dendrite {
 
 	return cfg
 }
+
+// ReloadConfig re-reads the config file given on the command line and applies
+// the options that can be changed at runtime to cfg and the server policy.
+func ReloadConfig(cfg *config.Dendrite, serverPolicy *serverpolicy.Policy) error {
+	newCfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if err = serverPolicy.Update(newCfg.FederationAPI.AllowedServers, newCfg.FederationAPI.DeniedServers); err != nil {
+		return err
+	}
+	cfg.Reload(newCfg)
+	return nil
+}
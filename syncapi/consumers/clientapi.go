@@ -21,6 +21,7 @@ import (
 
 	"github.com/element-hq/dendrite/internal/eventutil"
 	"github.com/element-hq/dendrite/internal/fulltext"
+	"github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/setup/jetstream"
 	"github.com/element-hq/dendrite/setup/process"
@@ -39,6 +40,7 @@ type OutputClientDataConsumer struct {
 	topic        string
 	topicReIndex string
 	db           storage.Database
+	rsAPI        api.SyncRoomserverAPI
 	stream       streams.StreamProvider
 	notifier     *notifier.Notifier
 	serverName   spec.ServerName
@@ -53,9 +55,10 @@ func NewOutputClientDataConsumer(
 	js nats.JetStreamContext,
 	nats *nats.Conn,
 	store storage.Database,
+	rsAPI api.SyncRoomserverAPI,
 	notifier *notifier.Notifier,
 	stream streams.StreamProvider,
-	fts *fulltext.Search,
+	fts fulltext.Indexer,
 ) *OutputClientDataConsumer {
 	return &OutputClientDataConsumer{
 		ctx:          process.Context(),
@@ -65,6 +68,7 @@ func NewOutputClientDataConsumer(
 		durable:      cfg.Matrix.JetStream.Durable("SyncAPIAccountDataConsumer"),
 		nats:         nats,
 		db:           store,
+		rsAPI:        rsAPI,
 		notifier:     notifier,
 		stream:       stream,
 		serverName:   cfg.Matrix.ServerName,
@@ -124,6 +128,10 @@ func (s *OutputClientDataConsumer) Start() error {
 				if strings.TrimSpace(e.Content) == "" {
 					continue
 				}
+				if e.Sender, err = ftsSender(ctx, s.rsAPI, &ev); err != nil {
+					logrus.WithError(err).WithField("event_id", ev.EventID()).Error("unable to get sender of event to index")
+					continue
+				}
 				elements = append(elements, e)
 			}
 			if err = s.fts.Index(elements...); err != nil {
@@ -61,7 +61,7 @@ func NewOutputRoomEventConsumer(
 	pduStream streams.StreamProvider,
 	inviteStream streams.StreamProvider,
 	rsAPI api.SyncRoomserverAPI,
-	fts *fulltext.Search,
+	fts fulltext.Indexer,
 	asProducer *producers.AppserviceEventProducer,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
@@ -132,12 +132,20 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 		s.onRetirePeek(s.ctx, *output.RetirePeek)
 	case api.OutputTypeRedactedEvent:
 		err = s.onRedactEvent(s.ctx, *output.RedactedEvent)
+	case api.OutputTypeResyncedState:
+		err = s.onResyncedState(s.ctx, *output.ResyncedState)
 	case api.OutputTypePurgeRoom:
 		err = s.onPurgeRoom(s.ctx, *output.PurgeRoom)
 		if err != nil {
 			logrus.WithField("room_id", output.PurgeRoom.RoomID).WithError(err).Error("Failed to purge room from sync API")
 			return true // non-fatal, as otherwise we end up in a loop of trying to purge the room
 		}
+	case api.OutputTypePurgeHistory:
+		err = s.onPurgeHistory(s.ctx, *output.PurgeHistory)
+		if err != nil {
+			logrus.WithField("room_id", output.PurgeHistory.RoomID).WithError(err).Error("Failed to purge history from sync API")
+			return true // non-fatal, the events are already gone from the roomserver
+		}
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -529,6 +537,75 @@ func (s *OutputRoomEventConsumer) onPurgeRoom(
 	}
 }
 
+func (s *OutputRoomEventConsumer) onPurgeHistory(
+	ctx context.Context, req api.OutputPurgeHistory,
+) error {
+	if err := s.db.PurgeHistory(ctx, req.RoomID, req.EventIDs); err != nil {
+		return err
+	}
+	if s.cfg.Fulltext.Enabled {
+		for _, eventID := range req.EventIDs {
+			if err := s.fts.Delete(eventID); err != nil {
+				return fmt.Errorf("failed to delete entry from fulltext index: %w", err)
+			}
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id": req.RoomID,
+		"events":  len(req.EventIDs),
+	}).Info("Purged history from sync API")
+	return nil
+}
+
+// onResyncedState applies the changes to the current state of a room that
+// were made when the full state of a partial state room (MSC3706) was fetched.
+func (s *OutputRoomEventConsumer) onResyncedState(
+	ctx context.Context, msg api.OutputResyncedState,
+) error {
+	if len(msg.AddsStateEventIDs) == 0 && len(msg.RemovesStateEventIDs) == 0 {
+		return nil
+	}
+	eventsRes := &api.QueryEventsByIDResponse{}
+	if len(msg.AddsStateEventIDs) > 0 {
+		eventsReq := &api.QueryEventsByIDRequest{
+			RoomID:   msg.RoomID,
+			EventIDs: msg.AddsStateEventIDs,
+		}
+		if err := s.rsAPI.QueryEventsByID(ctx, eventsReq, eventsRes); err != nil {
+			return fmt.Errorf("s.rsAPI.QueryEventsByID: %w", err)
+		}
+	}
+	addsStateEvents := make([]*rstypes.HeaderedEvent, 0, len(eventsRes.Events))
+	for _, event := range eventsRes.Events {
+		event, err := s.updateStateEvent(event)
+		if err != nil {
+			return err
+		}
+		userID, err := s.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID())
+		if err != nil {
+			return err
+		}
+		if userID != nil {
+			event.UserID = *userID
+		}
+		addsStateEvents = append(addsStateEvents, event)
+	}
+	pduPos, err := s.db.AddRoomState(ctx, msg.RoomID, addsStateEvents, msg.RemovesStateEventIDs)
+	if err != nil {
+		return fmt.Errorf("s.db.AddRoomState: %w", err)
+	}
+	// Pick up the members that were added so that they are woken up
+	// for new events in the room.
+	if err = s.notifier.LoadRooms(ctx, s.db, []string{msg.RoomID}); err != nil {
+		return err
+	}
+	if len(addsStateEvents) > 0 {
+		s.pduStream.Advance(pduPos)
+		s.notifier.OnNewEvent(addsStateEvents[len(addsStateEvents)-1], msg.RoomID, nil, types.StreamingToken{PDUPosition: pduPos})
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) updateStateEvent(event *rstypes.HeaderedEvent) (*rstypes.HeaderedEvent, error) {
 	event.StateKeyResolved = event.StateKey()
 	if event.StateKey() == nil {
@@ -582,6 +659,20 @@ func (s *OutputRoomEventConsumer) updateStateEvent(event *rstypes.HeaderedEvent)
 	return event, err
 }
 
+// ftsSender returns the user ID of the sender of the event, which is what search
+// filters and groupings by sender match against, falling back to the sender ID
+// if the user ID isn't known.
+func ftsSender(ctx context.Context, rsAPI api.SyncRoomserverAPI, ev *rstypes.HeaderedEvent) (string, error) {
+	userID, err := rsAPI.QueryUserIDForSender(ctx, ev.RoomID(), ev.SenderID())
+	if err != nil {
+		return "", err
+	}
+	if userID == nil {
+		return string(ev.SenderID()), nil
+	}
+	return userID.String(), nil
+}
+
 func (s *OutputRoomEventConsumer) writeFTS(ev *rstypes.HeaderedEvent, pduPosition types.StreamPosition) error {
 	if !s.cfg.Fulltext.Enabled {
 		return nil
@@ -612,6 +703,11 @@ func (s *OutputRoomEventConsumer) writeFTS(ev *rstypes.HeaderedEvent, pduPositio
 		return nil
 	}
 	if e.Content != "" {
+		sender, err := ftsSender(s.ctx, s.rsAPI, ev)
+		if err != nil {
+			return err
+		}
+		e.Sender = sender
 		log.Tracef("Indexing element: %+v", e)
 		if err := s.fts.Index(e); err != nil {
 			return err
@@ -0,0 +1,51 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
+	"github.com/element-hq/dendrite/syncapi/storage"
+)
+
+// ApplyRetentionFilter removes the events which have outlived the retention
+// policy of the room, so that clients don't see them even before the
+// roomserver gets around to purging them. State events are always kept.
+func ApplyRetentionFilter(
+	ctx context.Context,
+	syncDB storage.DatabaseTransaction,
+	cfg *config.Retention,
+	roomID string,
+	events []*types.HeaderedEvent,
+) ([]*types.HeaderedEvent, error) {
+	if cfg == nil || !cfg.Enabled || len(events) == 0 {
+		return events, nil
+	}
+	retentionEvent, err := syncDB.GetStateEvent(ctx, roomID, api.MRoomRetention, "")
+	if err != nil {
+		return nil, err
+	}
+	lifetime := api.RetentionMaxLifetime(cfg, retentionEvent)
+	if lifetime == 0 {
+		return events, nil
+	}
+
+	expiredBefore := spec.AsTimestamp(time.Now().Add(-lifetime))
+	filtered := make([]*types.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.StateKey() == nil && ev.OriginServerTS() < expiredBefore {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered, nil
+}
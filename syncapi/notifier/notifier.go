@@ -8,6 +8,7 @@ package notifier
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -299,6 +300,21 @@ func (n *Notifier) IsSharedUser(userA, userB string) bool {
 	return false
 }
 
+// MutualRooms returns the IDs of all rooms that both userA and userB are joined to,
+// sorted lexicographically so that the result can be paginated.
+func (n *Notifier) MutualRooms(userA, userB string) []string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	roomIDs := []string{}
+	for roomID, users := range n.roomIDToJoinedUsers {
+		if users.isIn(userA) && users.isIn(userB) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
 // GetListener returns a UserStreamListener that can be used to wait for
 // updates for a user. Must be closed.
 // notify for anything before sincePos
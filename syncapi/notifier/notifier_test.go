@@ -10,6 +10,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -333,6 +334,36 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	time.Sleep(1 * time.Millisecond)
 }
 
+func TestMutualRooms(t *testing.T) {
+	n := NewNotifier(&TestRoomServer{})
+	n.setUsersJoinedToRooms(map[string][]string{
+		"!c:localhost": {alice, bob},
+		"!a:localhost": {alice, bob},
+		"!b:localhost": {alice},
+		"!d:localhost": {bob},
+		roomID:         {alice, bob},
+	})
+
+	got := n.MutualRooms(alice, bob)
+	want := []string{"!a:localhost", "!c:localhost", roomID}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("MutualRooms got %v want %v", got, want)
+	}
+	if got = n.MutualRooms(bob, alice); !reflect.DeepEqual(got, want) {
+		t.Fatalf("MutualRooms is not symmetric: got %v want %v", got, want)
+	}
+
+	// Bob leaving a room they share removes it from the mutual rooms.
+	n.OnNewEvent(&bobLeaveEvent, "", nil, syncPositionAfter)
+	want = []string{"!a:localhost", "!c:localhost"}
+	if got = n.MutualRooms(alice, bob); !reflect.DeepEqual(got, want) {
+		t.Fatalf("MutualRooms after leave got %v want %v", got, want)
+	}
+	if got = n.MutualRooms(alice, "@charlie:localhost"); len(got) != 0 {
+		t.Fatalf("MutualRooms with unknown user got %v want none", got)
+	}
+}
+
 func waitForEvents(n *Notifier, req types.SyncRequest) (types.StreamingToken, error) {
 	listener := n.GetListener(req)
 	defer listener.Close()
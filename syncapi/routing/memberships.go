@@ -10,6 +10,7 @@ import (
 	"math"
 	"net/http"
 
+	"github.com/element-hq/dendrite/internal/httputil"
 	"github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/syncapi/storage"
 	"github.com/element-hq/dendrite/syncapi/synctypes"
@@ -39,6 +40,12 @@ func GetMemberships(
 			JSON: spec.InvalidParam("Device UserID is invalid"),
 		}
 	}
+	// The member list is incomplete until a room that was joined with partial
+	// state (MSC3706) has full state.
+	if errRes := httputil.WaitForFullState(req.Context(), rsAPI, roomID); errRes != nil {
+		return *errRes
+	}
+
 	queryReq := api.QueryMembershipForUserRequest{
 		RoomID: roomID,
 		UserID: *userID,
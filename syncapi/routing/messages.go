@@ -361,9 +361,15 @@ func (r *messagesReq) retrieveEvents(ctx context.Context, rsAPI api.SyncRoomserv
 		return []synctypes.ClientEvent{}, *r.from, emptyToken, nil
 	}
 
+	// Hide events which have expired but haven't been purged yet
+	retainedEvents, err := internal.ApplyRetentionFilter(r.ctx, r.snapshot, r.cfg.Retention, r.roomID, events)
+	if err != nil {
+		return []synctypes.ClientEvent{}, *r.from, *r.to, err
+	}
+
 	// Apply room history visibility filter
 	startTime := time.Now()
-	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(r.ctx, r.snapshot, r.rsAPI, events, nil, r.deviceUserID, "messages")
+	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(r.ctx, r.snapshot, r.rsAPI, retainedEvents, nil, r.deviceUserID, "messages")
 	if err != nil {
 		return []synctypes.ClientEvent{}, *r.from, *r.to, nil
 	}
@@ -0,0 +1,74 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package routing
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/util"
+
+	"github.com/element-hq/dendrite/syncapi/notifier"
+	userapi "github.com/element-hq/dendrite/userapi/api"
+)
+
+// mutualRoomsBatchSize is the maximum number of rooms returned per page.
+const mutualRoomsBatchSize = 100
+
+type mutualRoomsResponse struct {
+	Joined         []string `json:"joined"`
+	NextBatchToken string   `json:"next_batch_token,omitempty"`
+}
+
+// GetMutualRooms returns the rooms the requesting user shares with another user, as per MSC2666.
+//
+// Implements /_matrix/client/unstable/uk.half-shot.msc2666/user/mutual_rooms
+func GetMutualRooms(req *http.Request, device *userapi.Device, n *notifier.Notifier) util.JSONResponse {
+	query := req.URL.Query()
+	otherUserIDs := query["user_id"]
+	if len(otherUserIDs) != 1 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("exactly one user_id must be provided"),
+		}
+	}
+	otherUserID := otherUserIDs[0]
+	if _, err := spec.NewUserID(otherUserID, true); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("user_id is not a valid user ID"),
+		}
+	}
+	if otherUserID == device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusUnprocessableEntity,
+			JSON: spec.Unknown("you cannot request a list of mutual rooms with yourself"),
+		}
+	}
+
+	roomIDs := n.MutualRooms(device.UserID, otherUserID)
+
+	// The batch token is the ID of the first room of the next page. Room IDs are
+	// returned sorted, so if that room is no longer shared we resume from the room
+	// that would have followed it.
+	if batchToken := query.Get("batch_token"); batchToken != "" {
+		roomIDs = roomIDs[sort.SearchStrings(roomIDs, batchToken):]
+	}
+
+	res := mutualRoomsResponse{
+		Joined: roomIDs,
+	}
+	if len(roomIDs) > mutualRoomsBatchSize {
+		res.Joined = roomIDs[:mutualRoomsBatchSize]
+		res.NextBatchToken = roomIDs[mutualRoomsBatchSize]
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
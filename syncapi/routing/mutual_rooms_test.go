@@ -0,0 +1,88 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/element-hq/dendrite/syncapi/notifier"
+	"github.com/element-hq/dendrite/syncapi/types"
+	"github.com/element-hq/dendrite/test"
+	userapi "github.com/element-hq/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMutualRooms(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	aliceDevice := &userapi.Device{UserID: alice.ID}
+
+	n := notifier.NewNotifier(&FakeSyncRoomserverAPI{})
+	n.SetCurrentPosition(types.StreamingToken{})
+
+	// Alice shares more rooms with Bob than fit on one page, and a room with
+	// Charlie only.
+	var shared []string
+	for i := 0; i < mutualRoomsBatchSize+20; i++ {
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(bob.ID))
+		for _, ev := range room.Events() {
+			n.OnNewEvent(ev, "", nil, types.StreamingToken{})
+		}
+		shared = append(shared, room.ID)
+	}
+	sort.Strings(shared)
+	other := test.NewRoom(t, alice)
+	other.CreateAndInsert(t, charlie, spec.MRoomMember, map[string]interface{}{"membership": spec.Join}, test.WithStateKey(charlie.ID))
+	for _, ev := range other.Events() {
+		n.OnNewEvent(ev, "", nil, types.StreamingToken{})
+	}
+
+	getMutualRooms := func(userID, batchToken string, wantCode int) map[string]interface{} {
+		t.Helper()
+		query := url.Values{"user_id": {userID}}
+		if batchToken != "" {
+			query.Set("batch_token", batchToken)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+		res := GetMutualRooms(req, aliceDevice, n)
+		if res.Code != wantCode {
+			t.Fatalf("expected http status %d, got %d: %+v", wantCode, res.Code, res.JSON)
+		}
+		body, err := json.Marshal(res.JSON)
+		assert.NoError(t, err)
+		var got map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &got))
+		return got
+	}
+	joined := func(res map[string]interface{}) []string {
+		roomIDs := []string{}
+		for _, roomID := range res["joined"].([]interface{}) {
+			roomIDs = append(roomIDs, roomID.(string))
+		}
+		return roomIDs
+	}
+
+	getMutualRooms(alice.ID, "", http.StatusUnprocessableEntity)
+	getMutualRooms("bob", "", http.StatusBadRequest)
+
+	// The first page is full and points at the first room of the second.
+	res := getMutualRooms(bob.ID, "", http.StatusOK)
+	assert.Equal(t, shared[:mutualRoomsBatchSize], joined(res))
+	assert.Equal(t, shared[mutualRoomsBatchSize], res["next_batch_token"])
+	assert.NotContains(t, res, "count")
+
+	// The second page has the rest and no further token.
+	res = getMutualRooms(bob.ID, res["next_batch_token"].(string), http.StatusOK)
+	assert.Equal(t, shared[mutualRoomsBatchSize:], joined(res))
+	assert.NotContains(t, res, "next_batch_token")
+
+	res = getMutualRooms(charlie.ID, "", http.StatusOK)
+	assert.Equal(t, []string{other.ID}, joined(res))
+	assert.NotContains(t, res, "next_batch_token")
+}
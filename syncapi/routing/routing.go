@@ -172,6 +172,12 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	csMux.Handle("/unstable/uk.half-shot.msc2666/user/mutual_rooms",
+		httputil.MakeAuthAPI("mutual_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetMutualRooms(req, device, srp.Notifier)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/rooms/{roomID}/members",
 		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
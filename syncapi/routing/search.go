@@ -8,12 +8,14 @@ package routing
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"sort"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/blevesearch/bleve/v2/search"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 	"github.com/matrix-org/util"
@@ -44,19 +46,35 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		return *resErr
 	}
 
-	nextBatch := 0
+	var batch searchBatch
 	if from != nil && *from != "" {
-		nextBatch, err = strconv.Atoi(*from)
+		batch, err = parseSearchBatch(*from)
 		if err != nil {
 			return util.JSONResponse{
-				Code: http.StatusInternalServerError,
-				JSON: spec.InternalServerError{},
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid next_batch"),
 			}
 		}
 	}
 
-	if searchReq.SearchCategories.RoomEvents.Filter.Limit == 0 {
-		searchReq.SearchCategories.RoomEvents.Filter.Limit = 5
+	groupKeys := make([]string, 0, len(searchReq.SearchCategories.RoomEvents.Groupings.GroupBy))
+	for _, groupBy := range searchReq.SearchCategories.RoomEvents.Groupings.GroupBy {
+		if groupBy.Key != searchGroupRoomID && groupBy.Key != searchGroupSender {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("group_by key must be one of room_id or sender"),
+			}
+		}
+		groupKeys = append(groupKeys, groupBy.Key)
+	}
+	// Results have always been grouped by room, so keep doing so if no groupings are requested
+	if len(groupKeys) == 0 {
+		groupKeys = append(groupKeys, searchGroupRoomID)
+	}
+
+	filter := searchReq.SearchCategories.RoomEvents.Filter
+	if filter.Limit == 0 {
+		filter.Limit = 5
 	}
 
 	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
@@ -87,15 +105,27 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 	for _, roomID := range joinedRooms {
 		joinedRoomsMap[roomID] = struct{}{}
 	}
+	if filter.Rooms == nil {
+		filter.Rooms = &joinedRooms
+	}
+	// A next_batch from a group only returns results from that group
+	if batch.groupKey == searchGroupRoomID {
+		filter.Rooms = &[]string{batch.groupValue}
+	}
+	notRooms := make(map[string]struct{})
+	if filter.NotRooms != nil {
+		for _, roomID := range *filter.NotRooms {
+			notRooms[roomID] = struct{}{}
+		}
+	}
 	rooms := []string{}
-	if searchReq.SearchCategories.RoomEvents.Filter.Rooms != nil {
-		for _, roomID := range *searchReq.SearchCategories.RoomEvents.Filter.Rooms {
-			if _, ok := joinedRoomsMap[roomID]; ok {
-				rooms = append(rooms, roomID)
-			}
+	for _, roomID := range *filter.Rooms {
+		if _, ok := notRooms[roomID]; ok {
+			continue
+		}
+		if _, ok := joinedRoomsMap[roomID]; ok {
+			rooms = append(rooms, roomID)
 		}
-	} else {
-		rooms = joinedRooms
 	}
 
 	if len(rooms) == 0 {
@@ -105,24 +135,49 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
-	orderByTime := searchReq.SearchCategories.RoomEvents.OrderBy == "recent"
+	query := fulltext.SearchQuery{
+		Term:             searchReq.SearchCategories.RoomEvents.SearchTerm,
+		RoomIDs:          rooms,
+		Keys:             searchKeys(searchReq.SearchCategories.RoomEvents.Keys, &filter),
+		Limit:            filter.Limit,
+		After:            batch.after,
+		OrderByStreamPos: searchReq.SearchCategories.RoomEvents.OrderBy == "recent",
+	}
+	if filter.Senders != nil {
+		query.Senders = *filter.Senders
+	}
+	if filter.NotSenders != nil {
+		query.NotSenders = *filter.NotSenders
+	}
+	if batch.groupKey == searchGroupSender {
+		query.Senders = []string{batch.groupValue}
+	}
 
-	result, err := fts.Search(
-		searchReq.SearchCategories.RoomEvents.SearchTerm,
-		rooms,
-		searchReq.SearchCategories.RoomEvents.Keys,
-		searchReq.SearchCategories.RoomEvents.Filter.Limit,
-		nextBatch,
-		orderByTime,
-	)
-	if err != nil {
-		logrus.WithError(err).Error("failed to search fulltext")
-		return util.JSONResponse{
-			Code: http.StatusInternalServerError,
-			JSON: spec.InternalServerError{},
+	result := &fulltext.SearchResult{Hits: []fulltext.SearchHit{}}
+	// If the filter excludes all searchable keys or senders, there's nothing to search.
+	if len(query.Keys) > 0 && (filter.Senders == nil || len(query.Senders) > 0) {
+		// Ask for one more result to know whether there is another page, and
+		// on the first page for the size of each group to know whether the
+		// groups continue.
+		pageQuery := query
+		pageQuery.Limit = query.Limit + 1
+		pageQuery.CountGroups = batch.groupKey == "" && batch.after == nil
+		result, err = fts.Search(pageQuery)
+		if errors.Is(err, fulltext.ErrSenderFilterUnsupported) {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(err.Error()),
+			}
+		}
+		if err != nil {
+			logrus.WithError(err).Error("failed to search fulltext")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
 		}
+		logrus.Debugf("Search took %s", result.Took)
 	}
-	logrus.Debugf("Search took %s", result.Took)
 
 	// From was specified but empty, return no results, only the count
 	if from != nil && *from == "" {
@@ -139,22 +194,25 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
-	results := []Result{}
+	hits := result.Hits
+	hasMore := len(hits) > query.Limit
+	if hasMore {
+		hits = hits[:query.Limit]
+	}
 
-	wantEvents := make([]string, 0, len(result.Hits))
-	eventScore := make(map[string]*search.DocumentMatch)
+	results := []Result{}
 
-	for _, hit := range result.Hits {
+	wantEvents := make([]string, 0, len(hits))
+	for _, hit := range hits {
 		wantEvents = append(wantEvents, hit.ID)
-		eventScore[hit.ID] = hit
 	}
 
 	// Filter on m.room.message, as otherwise we also get events like m.reaction
 	// which "breaks" displaying results in Element Web.
-	types := []string{"m.room.message"}
+	contextTypes := []string{"m.room.message"}
 	roomFilter := &synctypes.RoomEventFilter{
 		Rooms: &rooms,
-		Types: &types,
+		Types: &contextTypes,
 	}
 
 	evs, err := syncDB.Events(ctx, wantEvents)
@@ -166,18 +224,21 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
-	groups := make(map[string]RoomResult)
-	knownUsersProfiles := make(map[string]ProfileInfoResponse)
-
-	// Sort the events by depth, as the returned values aren't ordered
-	if orderByTime {
-		sort.Slice(evs, func(i, j int) bool {
-			return evs[i].Depth() > evs[j].Depth()
-		})
+	// The returned events aren't ordered, so return them in the order of the hits
+	eventsByID := make(map[string]*types.HeaderedEvent, len(evs))
+	for _, event := range evs {
+		eventsByID[event.EventID()] = event
 	}
 
+	groups := newSearchGroups(groupKeys)
+	knownUsersProfiles := make(map[string]ProfileInfoResponse)
+
 	stateForRooms := make(map[string][]synctypes.ClientEvent)
-	for _, event := range evs {
+	for _, hit := range hits {
+		event, ok := eventsByID[hit.ID]
+		if !ok {
+			continue
+		}
 		eventsBefore, eventsAfter, err := contextEvents(ctx, snapshot, event, roomFilter, searchReq)
 		if err != nil {
 			logrus.WithError(err).Error("failed to get context events")
@@ -242,12 +303,10 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 				}),
 				ProfileInfo: profileInfos,
 			},
-			Rank:   eventScore[event.EventID()].Score,
+			Rank:   hit.Score,
 			Result: *clientEvent,
 		})
-		roomGroup := groups[event.RoomID().String()]
-		roomGroup.Results = append(roomGroup.Results, event.EventID())
-		groups[event.RoomID().String()] = roomGroup
+		groups.add(hit, event.EventID())
 		if _, ok := stateForRooms[event.RoomID().String()]; searchReq.SearchCategories.RoomEvents.IncludeState && !ok {
 			stateFilter := synctypes.DefaultStateFilter()
 			state, err := snapshot.CurrentState(ctx, event.RoomID().String(), &stateFilter, nil)
@@ -265,23 +324,62 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 	}
 
 	var nextBatchResult *string = nil
-	if int(result.Total) > nextBatch+len(results) {
-		nb := strconv.Itoa(len(results) + nextBatch)
+	if hasMore {
+		nb := searchBatch{
+			after:      hits[len(hits)-1].Cursor(),
+			groupKey:   batch.groupKey,
+			groupValue: batch.groupValue,
+		}.String()
 		nextBatchResult = &nb
-	} else if int(result.Total) == nextBatch+len(results) {
+	} else {
 		// Sytest expects a next_batch even if we don't actually have any more results
 		nb := ""
 		nextBatchResult = &nb
 	}
 
+	// Each group continues after its last result on this page
+	for key, group := range groups.groups {
+		counts := result.RoomCounts
+		if key == searchGroupSender {
+			counts = result.SenderCounts
+		}
+		for value, groupResult := range group {
+			var groupHasMore bool
+			switch {
+			case batch.groupKey != "":
+				// A page of a single group only knows whether that group continues.
+				groupHasMore = hasMore && key == batch.groupKey && value == batch.groupValue
+			case batch.after == nil:
+				// The first results of the group are all on the first page.
+				groupHasMore = counts[value] > uint64(len(groupResult.Results))
+			default:
+				// Results of the group on previous pages aren't known, so look
+				// for a result after the last one on this page instead.
+				groupHasMore, err = searchGroupHasMore(fts, query, key, value, groups.last[key][value])
+				if err != nil {
+					logrus.WithError(err).Error("failed to search fulltext")
+					return util.JSONResponse{
+						Code: http.StatusInternalServerError,
+						JSON: spec.InternalServerError{},
+					}
+				}
+			}
+			if groupHasMore {
+				nb := searchBatch{after: groups.last[key][value], groupKey: key, groupValue: value}.String()
+				groupResult.NextBatch = &nb
+				group[value] = groupResult
+			}
+		}
+	}
+
 	res := SearchResponse{
 		SearchCategories: SearchCategoriesResponse{
 			RoomEvents: RoomEventsResponse{
 				Count:      int(result.Total),
-				Groups:     Groups{RoomID: groups},
+				Groups:     Groups{RoomID: groups.groups[searchGroupRoomID], Sender: groups.groups[searchGroupSender]},
 				Results:    results,
 				NextBatch:  nextBatchResult,
-				Highlights: fts.GetHighlights(result),
+				Highlights: fts.GetHighlights(&fulltext.SearchResult{Hits: hits}),
 				State:      stateForRooms,
 			},
 		},
@@ -324,6 +422,170 @@ func contextEvents(
 	return eventsBefore, eventsAfter, err
 }
 
+// The keys search results can be grouped by.
+const (
+	searchGroupRoomID = "room_id"
+	searchGroupSender = "sender"
+)
+
+// searchBatch is a pagination token for search results, which continue after
+// the last result of the previous page. Tokens returned for a group only return
+// results from that group.
+type searchBatch struct {
+	after      *fulltext.SearchCursor
+	groupKey   string
+	groupValue string
+}
+
+// parseSearchBatch parses a token in the form "position[,score]", optionally
+// followed by ":key:value".
+func parseSearchBatch(s string) (searchBatch, error) {
+	parts := strings.SplitN(s, ":", 3)
+	position, score, hasScore := strings.Cut(parts[0], ",")
+	streamPosition, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		return searchBatch{}, err
+	}
+	if streamPosition < 0 {
+		return searchBatch{}, fmt.Errorf("negative stream position %d", streamPosition)
+	}
+	batch := searchBatch{after: &fulltext.SearchCursor{StreamPosition: streamPosition}}
+	if hasScore {
+		if batch.after.Score, err = strconv.ParseFloat(score, 64); err != nil {
+			return searchBatch{}, err
+		}
+	}
+	if len(parts) == 1 {
+		return batch, nil
+	}
+	if len(parts) != 3 || (parts[1] != searchGroupRoomID && parts[1] != searchGroupSender) {
+		return searchBatch{}, fmt.Errorf("invalid group in %q", s)
+	}
+	batch.groupKey, batch.groupValue = parts[1], parts[2]
+	return batch, nil
+}
+
+func (b searchBatch) String() string {
+	s := strconv.FormatInt(b.after.StreamPosition, 10)
+	if b.after.Score != 0 {
+		s += "," + strconv.FormatFloat(b.after.Score, 'g', -1, 64)
+	}
+	if b.groupKey == "" {
+		return s
+	}
+	return fmt.Sprintf("%s:%s:%s", s, b.groupKey, b.groupValue)
+}
+
+// searchGroups collects the results of the current page by the requested group keys.
+type searchGroups struct {
+	groups map[string]map[string]RoomResult
+	// Where each group continues, after its last result on this page
+	last map[string]map[string]*fulltext.SearchCursor
+}
+
+func newSearchGroups(keys []string) *searchGroups {
+	g := &searchGroups{
+		groups: make(map[string]map[string]RoomResult, len(keys)),
+		last:   make(map[string]map[string]*fulltext.SearchCursor, len(keys)),
+	}
+	for _, key := range keys {
+		g.groups[key] = make(map[string]RoomResult)
+		g.last[key] = make(map[string]*fulltext.SearchCursor)
+	}
+	return g
+}
+
+// add adds a result to its groups. Groups are ordered by their first result.
+func (g *searchGroups) add(hit fulltext.SearchHit, eventID string) {
+	for key, value := range map[string]string{searchGroupRoomID: hit.RoomID, searchGroupSender: hit.Sender} {
+		group, ok := g.groups[key]
+		if !ok {
+			continue
+		}
+		result, ok := group[value]
+		if !ok {
+			result.Order = len(group)
+		}
+		result.Results = append(result.Results, eventID)
+		group[value] = result
+		g.last[key][value] = hit.Cursor()
+	}
+}
+
+// searchGroupHasMore returns whether the query has a result in the group after
+// the given cursor.
+func searchGroupHasMore(fts fulltext.Indexer, query fulltext.SearchQuery, key, value string, after *fulltext.SearchCursor) (bool, error) {
+	switch key {
+	case searchGroupRoomID:
+		query.RoomIDs = []string{value}
+	case searchGroupSender:
+		query.Senders = []string{value}
+	}
+	query.After = after
+	query.Limit = 1
+	query.CountGroups = false
+	result, err := fts.Search(query)
+	if errors.Is(err, fulltext.ErrSenderFilterUnsupported) {
+		// The group can't be paginated until the index is rebuilt.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(result.Hits) > 0, nil
+}
+
+// searchKeys returns the content keys to search, restricted to those of the event
+// types allowed by the filter.
+func searchKeys(keys []string, filter *synctypes.RoomEventFilter) []string {
+	if len(keys) == 0 {
+		keys = []string{"content.body", "content.name", "content.topic"}
+	}
+	var types, notTypes *regexp.Regexp
+	if filter.Types != nil {
+		types = eventTypesRegexp(*filter.Types)
+	}
+	if filter.NotTypes != nil {
+		notTypes = eventTypesRegexp(*filter.NotTypes)
+	}
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		var eventType string
+		switch key {
+		case "content.body":
+			eventType = "m.room.message"
+		case "content.name":
+			eventType = spec.MRoomName
+		case "content.topic":
+			eventType = spec.MRoomTopic
+		default:
+			continue
+		}
+		if types != nil && !types.MatchString(eventType) {
+			continue
+		}
+		if notTypes != nil && notTypes.MatchString(eventType) {
+			continue
+		}
+		res = append(res, key)
+	}
+	return res
+}
+
+// eventTypesRegexp returns a regexp matching any of the event type patterns,
+// which may contain '*' wildcards.
+func eventTypesRegexp(patterns []string) *regexp.Regexp {
+	exprs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		exprs = append(exprs, strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*"))
+	}
+	// An empty list of patterns matches nothing.
+	if len(exprs) == 0 {
+		return regexp.MustCompile(`$.^`)
+	}
+	return regexp.MustCompile("^(?:" + strings.Join(exprs, "|") + ")$")
+}
+
 type EventContext struct {
 	AfterLimit     int  `json:"after_limit,omitempty"`
 	BeforeLimit    int  `json:"before_limit,omitempty"`
@@ -366,7 +628,8 @@ type RoomResult struct {
 }
 
 type Groups struct {
-	RoomID map[string]RoomResult `json:"room_id"`
+	RoomID map[string]RoomResult `json:"room_id,omitempty"`
+	Sender map[string]RoomResult `json:"sender,omitempty"`
 }
 
 type Result struct {
@@ -12,6 +12,7 @@ import (
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	rsapi "github.com/element-hq/dendrite/roomserver/api"
 	rstypes "github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/syncapi/storage"
 	"github.com/element-hq/dendrite/syncapi/synctypes"
 	"github.com/element-hq/dendrite/syncapi/types"
@@ -31,14 +32,21 @@ func (f *FakeSyncRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID
 
 func TestSearch(t *testing.T) {
 	alice := test.NewUser(t)
+	bob := test.NewUser(t)
 	aliceDevice := userapi.Device{UserID: alice.ID}
 	room := test.NewRoom(t, alice)
 	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "context before"})
 	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello world3!"})
 	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "context after"})
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+	room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "greetings from bob"})
 
 	roomsFilter := []string{room.ID}
 	roomsFilterUnknown := []string{"!unknown"}
+	sendersFilter := []string{bob.ID}
+	sendersFilterAlice := []string{alice.ID}
+	typesFilterWildcard := []string{"m.room.*"}
+	typesFilterName := []string{spec.MRoomName}
 
 	emptyFromString := ""
 	fromStringValid := "1"
@@ -50,6 +58,7 @@ func TestSearch(t *testing.T) {
 		searchReq         SearchRequest
 		device            *userapi.Device
 		wantResponseCount int
+		wantGroupedBy     []string
 		from              *string
 	}{
 		{
@@ -196,6 +205,110 @@ func TestSearch(t *testing.T) {
 			device: &aliceDevice,
 			from:   &fromStringInvalid,
 		},
+		{
+			name:   "filter on sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "greetings",
+						Filter: synctypes.RoomEventFilter{
+							Senders: &sendersFilter,
+						},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+		},
+		{
+			name:   "filter on other sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "greetings",
+						Filter: synctypes.RoomEventFilter{
+							Senders: &sendersFilterAlice,
+						},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "filter on not sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "greetings",
+						Filter: synctypes.RoomEventFilter{
+							NotSenders: &sendersFilter,
+						},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "filter on types with wildcard",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Filter: synctypes.RoomEventFilter{
+							Types: &typesFilterWildcard,
+						},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+		},
+		{
+			name:   "filter on types without messages",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Filter: synctypes.RoomEventFilter{
+							Types: &typesFilterName,
+						},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
+		{
+			name:   "group by room and sender",
+			wantOK: true,
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Groupings:  Groupings{GroupBy: []GroupBy{{Key: "room_id"}, {Key: "sender"}}},
+					},
+				},
+			},
+			device:            &aliceDevice,
+			wantResponseCount: 1,
+			wantGroupedBy:     []string{"room_id", "sender"},
+		},
+		{
+			name: "group by unknown key",
+			searchReq: SearchRequest{
+				SearchCategories: SearchCategories{
+					RoomEvents: RoomEvents{
+						SearchTerm: "hello",
+						Groupings:  Groupings{GroupBy: []GroupBy{{Key: "unknown"}}},
+					},
+				},
+			},
+			device: &aliceDevice,
+		},
 		{
 			name:   "order by stream position",
 			wantOK: true,
@@ -212,10 +325,6 @@ func TestSearch(t *testing.T) {
 		defer closeDB()
 
 		// create requisites
-		fts, err := fulltext.New(processCtx, cfg.SyncAPI.Fulltext)
-		assert.NoError(t, err)
-		assert.NotNil(t, fts)
-
 		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
 		db, err := storage.NewSyncServerDatasource(processCtx.Context(), cm, &cfg.SyncAPI.Database)
 		assert.NoError(t, err)
@@ -236,41 +345,231 @@ func TestSearch(t *testing.T) {
 			if x.Type() != "m.room.message" {
 				continue
 			}
-			elements = append(elements, fulltext.IndexElement{
+			element := fulltext.IndexElement{
 				EventID:        x.EventID(),
 				RoomID:         x.RoomID().String(),
+				Sender:         string(x.SenderID()),
 				Content:        string(x.Content()),
-				ContentType:    x.Type(),
 				StreamPosition: int64(sp),
+			}
+			element.SetContentType(x.Type())
+			elements = append(elements, element)
+		}
+
+		// The postgres search backend requires a postgres sync API database.
+		backends := []string{config.FulltextBackendBleve}
+		if dbType == test.DBTypePostgres {
+			backends = append(backends, config.FulltextBackendPostgres)
+		}
+		for _, backend := range backends {
+			t.Run(backend, func(t *testing.T) {
+				var fts fulltext.Indexer
+				if backend == config.FulltextBackendPostgres {
+					sqlDB, _, dbErr := cm.Connection(&cfg.SyncAPI.Database)
+					assert.NoError(t, dbErr)
+					fts, err = fulltext.NewPostgres(processCtx, cfg.SyncAPI.Fulltext, sqlDB)
+				} else {
+					fts, err = fulltext.New(processCtx, cfg.SyncAPI.Fulltext)
+				}
+				assert.NoError(t, err)
+				assert.NotNil(t, fts)
+
+				// Index the events
+				err = fts.Index(elements...)
+				assert.NoError(t, err)
+
+				// run the tests
+				for _, tc := range testCases {
+					t.Run(tc.name, func(t *testing.T) {
+						reqBody := &bytes.Buffer{}
+						err = json.NewEncoder(reqBody).Encode(tc.searchReq)
+						assert.NoError(t, err)
+						req := httptest.NewRequest(http.MethodPost, "/", reqBody)
+
+						res := Search(req, tc.device, db, fts, tc.from, &FakeSyncRoomserverAPI{})
+						if !tc.wantOK && !res.Is2xx() {
+							return
+						}
+						resp, ok := res.JSON.(SearchResponse)
+						if !ok && !tc.wantOK {
+							t.Fatalf("not a SearchResponse: %T: %s", res.JSON, res.JSON)
+						}
+						assert.Equal(t, tc.wantResponseCount, resp.SearchCategories.RoomEvents.Count)
+
+						// if we requested state, it should not be empty
+						if tc.searchReq.SearchCategories.RoomEvents.IncludeState {
+							assert.NotEmpty(t, resp.SearchCategories.RoomEvents.State)
+						}
+
+						groups := resp.SearchCategories.RoomEvents.Groups
+						for _, key := range tc.wantGroupedBy {
+							switch key {
+							case "room_id":
+								assert.Len(t, groups.RoomID[room.ID].Results, tc.wantResponseCount)
+							case "sender":
+								assert.Len(t, groups.Sender[alice.ID].Results, tc.wantResponseCount)
+							}
+						}
+						if len(tc.wantGroupedBy) == 0 {
+							assert.Empty(t, groups.Sender)
+						}
+					})
+				}
 			})
 		}
-		// Index the events
-		err = fts.Index(elements...)
+	})
+}
+
+func TestSearchPagination(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceDevice := userapi.Device{UserID: alice.ID}
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+	for i := 0; i < 7; i++ {
+		sender := alice
+		if i%2 == 0 {
+			sender = bob
+		}
+		room.CreateAndInsert(t, sender, "m.room.message", map[string]interface{}{"body": "hello there"})
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, closeDB := testrig.CreateConfig(t, dbType)
+		defer closeDB()
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		db, err := storage.NewSyncServerDatasource(processCtx.Context(), cm, &cfg.SyncAPI.Database)
+		assert.NoError(t, err)
+		fts, err := fulltext.New(processCtx, cfg.SyncAPI.Fulltext)
 		assert.NoError(t, err)
 
-		// run the tests
-		for _, tc := range testCases {
-			t.Run(tc.name, func(t *testing.T) {
-				reqBody := &bytes.Buffer{}
-				err = json.NewEncoder(reqBody).Encode(tc.searchReq)
-				assert.NoError(t, err)
-				req := httptest.NewRequest(http.MethodPost, "/", reqBody)
+		for _, x := range room.Events() {
+			var stateEvents []*rstypes.HeaderedEvent
+			var stateEventIDs []string
+			if x.StateKey() != nil {
+				stateEvents = append(stateEvents, x)
+				stateEventIDs = append(stateEventIDs, x.EventID())
+			}
+			x.StateKeyResolved = x.StateKey()
+			sp, err := db.WriteEvent(processCtx.Context(), x, stateEvents, stateEventIDs, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared)
+			assert.NoError(t, err)
+			if x.Type() != "m.room.message" {
+				continue
+			}
+			element := fulltext.IndexElement{
+				EventID:        x.EventID(),
+				RoomID:         x.RoomID().String(),
+				Sender:         string(x.SenderID()),
+				Content:        string(x.Content()),
+				StreamPosition: int64(sp),
+			}
+			element.SetContentType(x.Type())
+			assert.NoError(t, fts.Index(element))
+		}
 
-				res := Search(req, tc.device, db, fts, tc.from, &FakeSyncRoomserverAPI{})
-				if !tc.wantOK && !res.Is2xx() {
-					return
+		search := func(orderBy string, groupBy []GroupBy, from *string) RoomEventsResponse {
+			t.Helper()
+			reqBody := &bytes.Buffer{}
+			assert.NoError(t, json.NewEncoder(reqBody).Encode(SearchRequest{
+				SearchCategories: SearchCategories{RoomEvents: RoomEvents{
+					SearchTerm: "hello",
+					OrderBy:    orderBy,
+					Filter:     synctypes.RoomEventFilter{Limit: 3},
+					Groupings:  Groupings{GroupBy: groupBy},
+				}},
+			}))
+			res := Search(httptest.NewRequest(http.MethodPost, "/", reqBody), &aliceDevice, db, fts, from, &FakeSyncRoomserverAPI{})
+			if !res.Is2xx() {
+				t.Fatalf("search failed: %d %+v", res.Code, res.JSON)
+			}
+			return res.JSON.(SearchResponse).SearchCategories.RoomEvents
+		}
+
+		for _, orderBy := range []string{"rank", "recent"} {
+			t.Run(orderBy, func(t *testing.T) {
+				// Every result is returned exactly once over all pages.
+				seen := map[string]bool{}
+				var from *string
+				for {
+					res := search(orderBy, nil, from)
+					assert.Equal(t, 7, res.Count)
+					for _, r := range res.Results {
+						assert.False(t, seen[r.Result.EventID], "result %s returned twice", r.Result.EventID)
+						seen[r.Result.EventID] = true
+					}
+					if res.NextBatch == nil || *res.NextBatch == "" {
+						break
+					}
+					from = res.NextBatch
 				}
-				resp, ok := res.JSON.(SearchResponse)
-				if !ok && !tc.wantOK {
-					t.Fatalf("not a SearchResponse: %T: %s", res.JSON, res.JSON)
+				assert.Len(t, seen, 7)
+
+				// The token of a group on any page returns more results of that group.
+				from = nil
+				for {
+					res := search(orderBy, []GroupBy{{Key: searchGroupSender}}, from)
+					for sender, group := range res.Groups.Sender {
+						if group.NextBatch != nil {
+							groupRes := search(orderBy, []GroupBy{{Key: searchGroupSender}}, group.NextBatch)
+							assert.NotEmpty(t, groupRes.Groups.Sender[sender].Results, "empty page for group %s", sender)
+						}
+					}
+					if res.NextBatch == nil || *res.NextBatch == "" {
+						break
+					}
+					from = res.NextBatch
 				}
-				assert.Equal(t, tc.wantResponseCount, resp.SearchCategories.RoomEvents.Count)
 
-				// if we requested state, it should not be empty
-				if tc.searchReq.SearchCategories.RoomEvents.IncludeState {
-					assert.NotEmpty(t, resp.SearchCategories.RoomEvents.State)
+				// Paging through Bob's group only returns his results.
+				seen = map[string]bool{}
+				res := search(orderBy, []GroupBy{{Key: searchGroupSender}}, nil)
+				group := res.Groups.Sender[bob.ID]
+				for group.NextBatch != nil {
+					for _, eventID := range group.Results {
+						seen[eventID] = true
+					}
+					res = search(orderBy, []GroupBy{{Key: searchGroupSender}}, group.NextBatch)
+					for _, r := range res.Results {
+						assert.Equal(t, bob.ID, r.Result.Sender)
+					}
+					group = res.Groups.Sender[bob.ID]
 				}
+				for _, eventID := range group.Results {
+					seen[eventID] = true
+				}
+				assert.Len(t, seen, 4)
 			})
 		}
 	})
 }
+
+func TestSearchBatch(t *testing.T) {
+	testCases := []struct {
+		token   string
+		want    searchBatch
+		wantErr bool
+	}{
+		{token: "10", want: searchBatch{after: &fulltext.SearchCursor{StreamPosition: 10}}},
+		{token: "10,0.25", want: searchBatch{after: &fulltext.SearchCursor{StreamPosition: 10, Score: 0.25}}},
+		{token: "5:room_id:!room:test", want: searchBatch{after: &fulltext.SearchCursor{StreamPosition: 5}, groupKey: "room_id", groupValue: "!room:test"}},
+		{token: "5,1.5:sender:@alice:test", want: searchBatch{after: &fulltext.SearchCursor{StreamPosition: 5, Score: 1.5}, groupKey: "sender", groupValue: "@alice:test"}},
+		{token: "5:unknown:value", wantErr: true},
+		{token: "5:room_id", wantErr: true},
+		{token: "-1", wantErr: true},
+		{token: "5,notAScore", wantErr: true},
+		{token: "iCantBeParsed", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.token, func(t *testing.T) {
+			got, err := parseSearchBatch(tc.token)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.token, got.String())
+		})
+	}
+}
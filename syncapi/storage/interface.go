@@ -127,11 +127,17 @@ type Database interface {
 		addStateEventIDs []string, removeStateEventIDs []string, transactionID *api.TransactionID, excludeFromSync bool,
 		historyVisibility gomatrixserverlib.HistoryVisibility,
 	) (types.StreamPosition, error)
+	// AddRoomState updates the current state of a room without a timeline event, e.g. when the
+	// full state of a room that was joined with partial state arrives. Each added event is given
+	// a new stream position, the latest of which is returned.
+	AddRoomState(ctx context.Context, roomID string, addedEvents []*rstypes.HeaderedEvent, removedEventIDs []string) (types.StreamPosition, error)
 	// PurgeRoomState completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoomState(ctx context.Context, roomID string) error
 	// PurgeRoom entirely eliminates a room from the sync API, timeline, state and all.
 	PurgeRoom(ctx context.Context, roomID string) error
+	// PurgeHistory removes the given events from the room's timeline in the sync API.
+	PurgeHistory(ctx context.Context, roomID string, eventIDs []string) error
 	// UpsertAccountData keeps track of new or updated account data, by saving the type
 	// of the new/updated data, and the user ID and room ID the data is related to (empty)
 	// room ID means the data isn't specific to any room)
@@ -161,13 +167,16 @@ type Database interface {
 	// from position, preventing the send-to-device table from growing indefinitely.
 	CleanSendToDeviceUpdates(ctx context.Context, userID, deviceID string, before types.StreamPosition) (err error)
 	// GetFilter looks up the filter associated with a given local user and filter ID
-	// and populates the target filter. Otherwise returns an error if no such filter exists
-	// or if there was an error talking to the database.
+	// and populates the target filter, marking the filter as used. Otherwise returns an
+	// error if no such filter exists or if there was an error talking to the database.
 	GetFilter(ctx context.Context, target *synctypes.Filter, localpart string, filterID string) error
 	// PutFilter puts the passed filter into the database.
 	// Returns the filterID as a string. Otherwise returns an error if something
 	// goes wrong.
 	PutFilter(ctx context.Context, localpart string, filter *synctypes.Filter) (string, error)
+	// DeleteUnusedFilters deletes filters which haven't been used since the given time,
+	// returning the number of deleted filters.
+	DeleteUnusedFilters(ctx context.Context, unusedSince spec.Timestamp) (int64, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *rstypes.HeaderedEvent, querier api.QuerySenderIDAPI) error
 	// StoreReceipt stores new receipt events
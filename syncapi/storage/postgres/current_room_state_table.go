@@ -272,12 +272,12 @@ func (s *currentRoomStateStatements) SelectCurrentState(
 	senders, notSenders := getSendersStateFilterFilter(stateFilter)
 	// We're going to query members later, so remove them from this request
 	if stateFilter.LazyLoadMembers && !stateFilter.IncludeRedundantMembers {
-		notTypes := &[]string{spec.MRoomMember}
+		// Copy the types, as the filter may be shared with other requests
+		notTypes := []string{spec.MRoomMember}
 		if stateFilter.NotTypes != nil {
-			*stateFilter.NotTypes = append(*stateFilter.NotTypes, spec.MRoomMember)
-		} else {
-			stateFilter.NotTypes = notTypes
+			notTypes = append(notTypes, *stateFilter.NotTypes...)
 		}
+		stateFilter.NotTypes = &notTypes
 	}
 	rows, err := stmt.QueryContext(ctx, roomID,
 		pq.StringArray(senders),
@@ -0,0 +1,27 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddSearchVectorColumn adds the columns used by the postgres fulltext search backend.
+// The columns are populated by the search backend itself, as the text search configuration
+// depends on the configured language and the sender's user ID is resolved by the sync API.
+func UpAddSearchVectorColumn(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_output_room_events ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+		ALTER TABLE syncapi_output_room_events ADD COLUMN IF NOT EXISTS search_sender TEXT;
+		CREATE INDEX IF NOT EXISTS syncapi_output_room_events_search_vector_idx ON syncapi_output_room_events USING GIN (search_vector);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
@@ -12,9 +12,11 @@ import (
 	"encoding/json"
 
 	"github.com/element-hq/dendrite/internal/sqlutil"
+	"github.com/element-hq/dendrite/syncapi/storage/postgres/deltas"
 	"github.com/element-hq/dendrite/syncapi/storage/tables"
 	"github.com/element-hq/dendrite/syncapi/synctypes"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
 const filterSchema = `
@@ -26,6 +28,8 @@ CREATE TABLE IF NOT EXISTS syncapi_filter (
 	id SERIAL UNIQUE,
 	-- The localpart of the Matrix user ID associated to this filter
 	localpart TEXT NOT NULL,
+	-- When the filter was last created or used, in milliseconds since the epoch
+	last_used_ts BIGINT NOT NULL DEFAULT 0,
 
 	PRIMARY KEY(id, localpart)
 );
@@ -34,7 +38,7 @@ CREATE INDEX IF NOT EXISTS syncapi_filter_localpart ON syncapi_filter(localpart)
 `
 
 const selectFilterSQL = "" +
-	"SELECT filter FROM syncapi_filter WHERE localpart = $1 AND id = $2"
+	"SELECT filter, last_used_ts FROM syncapi_filter WHERE localpart = $1 AND id = $2"
 
 const selectFilterIDByContentSQL = "" +
 	"SELECT id FROM syncapi_filter WHERE localpart = $1 AND filter = $2"
@@ -42,10 +46,18 @@ const selectFilterIDByContentSQL = "" +
 const insertFilterSQL = "" +
 	"INSERT INTO syncapi_filter (filter, id, localpart) VALUES ($1, DEFAULT, $2) RETURNING id"
 
+const updateFilterLastUsedSQL = "" +
+	"UPDATE syncapi_filter SET last_used_ts = $1 WHERE localpart = $2 AND id = $3"
+
+const deleteFiltersUnusedSinceSQL = "" +
+	"DELETE FROM syncapi_filter WHERE last_used_ts < $1"
+
 type filterStatements struct {
-	selectFilterStmt            *sql.Stmt
-	selectFilterIDByContentStmt *sql.Stmt
-	insertFilterStmt            *sql.Stmt
+	selectFilterStmt             *sql.Stmt
+	selectFilterIDByContentStmt  *sql.Stmt
+	insertFilterStmt             *sql.Stmt
+	updateFilterLastUsedStmt     *sql.Stmt
+	deleteFiltersUnusedSinceStmt *sql.Stmt
 }
 
 func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
@@ -53,29 +65,39 @@ func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "syncapi: add last used column (filter)",
+		Up:      deltas.UpAddFilterLastUsedColumn,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	s := &filterStatements{}
 	return s, sqlutil.StatementList{
 		{&s.selectFilterStmt, selectFilterSQL},
 		{&s.selectFilterIDByContentStmt, selectFilterIDByContentSQL},
 		{&s.insertFilterStmt, insertFilterSQL},
+		{&s.updateFilterLastUsedStmt, updateFilterLastUsedSQL},
+		{&s.deleteFiltersUnusedSinceStmt, deleteFiltersUnusedSinceSQL},
 	}.Prepare(db)
 }
 
 func (s *filterStatements) SelectFilter(
 	ctx context.Context, txn *sql.Tx, target *synctypes.Filter, localpart string, filterID string,
-) error {
+) (lastUsed spec.Timestamp, err error) {
 	// Retrieve filter from database (stored as canonical JSON)
 	var filterData []byte
-	err := sqlutil.TxStmt(txn, s.selectFilterStmt).QueryRowContext(ctx, localpart, filterID).Scan(&filterData)
+	err = sqlutil.TxStmt(txn, s.selectFilterStmt).QueryRowContext(ctx, localpart, filterID).Scan(&filterData, &lastUsed)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Unmarshal JSON into Filter struct
 	if err = json.Unmarshal(filterData, &target); err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return lastUsed, nil
 }
 
 func (s *filterStatements) InsertFilter(
@@ -116,3 +138,20 @@ func (s *filterStatements) InsertFilter(
 		Scan(&filterID)
 	return
 }
+
+func (s *filterStatements) UpdateFilterLastUsed(
+	ctx context.Context, txn *sql.Tx, localpart, filterID string, ts spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateFilterLastUsedStmt).ExecContext(ctx, ts, localpart, filterID)
+	return err
+}
+
+func (s *filterStatements) DeleteFiltersUnusedSince(
+	ctx context.Context, txn *sql.Tx, ts spec.Timestamp,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteFiltersUnusedSinceStmt).ExecContext(ctx, ts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
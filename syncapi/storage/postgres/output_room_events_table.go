@@ -63,7 +63,11 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events (
   -- were emitted.
   exclude_from_sync BOOL DEFAULT FALSE,
   -- The history visibility before this event (1 - world_readable; 2 - shared; 3 - invited; 4 - joined)
-  history_visibility SMALLINT NOT NULL DEFAULT 2
+  history_visibility SMALLINT NOT NULL DEFAULT 2,
+  -- The full-text search vector of the event content, only used by the postgres search backend.
+  search_vector TSVECTOR,
+  -- The user ID of the sender of the event, only used by the postgres search backend.
+  search_sender TEXT
 );
 
 CREATE INDEX IF NOT EXISTS syncapi_output_room_events_type_idx ON syncapi_output_room_events (type);
@@ -181,6 +185,9 @@ const selectContextAfterEventSQL = "" +
 const purgeEventsSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const purgeEventsByIDSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND event_id = ANY($2)"
+
 const selectSearchSQL = "SELECT id, event_id, headered_event_json FROM syncapi_output_room_events WHERE id > $1 AND type = ANY($2) ORDER BY id ASC LIMIT $3"
 
 type outputRoomEventsStatements struct {
@@ -198,6 +205,7 @@ type outputRoomEventsStatements struct {
 	selectContextBeforeEventStmt   *sql.Stmt
 	selectContextAfterEventStmt    *sql.Stmt
 	purgeEventsStmt                *sql.Stmt
+	purgeEventsByIDStmt            *sql.Stmt
 	selectSearchStmt               *sql.Stmt
 }
 
@@ -232,6 +240,10 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 			Version: migrationName,
 			Up:      deltas.UpRenameOutputRoomEventsIndex,
 		},
+		sqlutil.Migration{
+			Version: "syncapi: add search vector column (output_room_events)",
+			Up:      deltas.UpAddSearchVectorColumn,
+		},
 	)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -253,6 +265,7 @@ func NewPostgresEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectContextBeforeEventStmt, selectContextBeforeEventSQL},
 		{&s.selectContextAfterEventStmt, selectContextAfterEventSQL},
 		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeEventsByIDStmt, purgeEventsByIDSQL},
 		{&s.selectSearchStmt, selectSearchSQL},
 	}.Prepare(db)
 }
@@ -702,6 +715,13 @@ func (s *outputRoomEventsStatements) PurgeEvents(
 	return err
 }
 
+func (s *outputRoomEventsStatements) PurgeEventsByID(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeEventsByIDStmt).ExecContext(ctx, roomID, pq.StringArray(eventIDs))
+	return err
+}
+
 func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
 	rows, err := sqlutil.TxStmt(txn, s.selectSearchStmt).QueryContext(ctx, afterID, pq.StringArray(types), limit)
 	if err != nil {
@@ -14,6 +14,7 @@ import (
 	rstypes "github.com/element-hq/dendrite/roomserver/types"
 	"github.com/element-hq/dendrite/syncapi/storage/tables"
 	"github.com/element-hq/dendrite/syncapi/types"
+	"github.com/lib/pq"
 )
 
 const outputRoomEventsTopologySchema = `
@@ -65,6 +66,9 @@ const selectStreamToTopologicalPositionDescSQL = "" +
 const purgeEventsTopologySQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const purgeEventsTopologyByIDSQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1 AND event_id = ANY($2)"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt                 *sql.Stmt
 	selectEventIDsInRangeASCStmt              *sql.Stmt
@@ -73,6 +77,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectStreamToTopologicalPositionAscStmt  *sql.Stmt
 	selectStreamToTopologicalPositionDescStmt *sql.Stmt
 	purgeEventsTopologyStmt                   *sql.Stmt
+	purgeEventsTopologyByIDStmt               *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -89,6 +94,7 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 		{&s.selectStreamToTopologicalPositionAscStmt, selectStreamToTopologicalPositionAscSQL},
 		{&s.selectStreamToTopologicalPositionDescStmt, selectStreamToTopologicalPositionDescSQL},
 		{&s.purgeEventsTopologyStmt, purgeEventsTopologySQL},
+		{&s.purgeEventsTopologyByIDStmt, purgeEventsTopologyByIDSQL},
 	}.Prepare(db)
 }
 
@@ -179,3 +185,10 @@ func (s *outputRoomEventsTopologyStatements) PurgeEventsTopology(
 	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) PurgeEventsTopologyByID(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyByIDStmt).ExecContext(ctx, roomID, pq.StringArray(eventIDs))
+	return err
+}
@@ -11,6 +11,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/tidwall/gjson"
 
@@ -291,6 +292,51 @@ func (d *Database) WriteEvent(
 	return pduPosition, returnErr
 }
 
+// AddRoomState updates the current state of a room without a timeline event,
+// e.g. when the full state of a room that was joined with partial state
+// arrives. Each added event is written at a new stream position, excluded from
+// the timeline as with old state events, so that incremental syncs pick up the
+// state change. The events are given the current history visibility of the
+// room. Returns the latest stream position that was written.
+func (d *Database) AddRoomState(
+	ctx context.Context, roomID string, addedEvents []*rstypes.HeaderedEvent, removedEventIDs []string,
+) (pduPosition types.StreamPosition, returnErr error) {
+	returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		historyVisibility := gomatrixserverlib.HistoryVisibilityShared
+		hisVisEvent, err := d.CurrentRoomState.SelectStateEvent(ctx, txn, roomID, spec.MRoomHistoryVisibility, "")
+		if err != nil {
+			return fmt.Errorf("d.CurrentRoomState.SelectStateEvent: %w", err)
+		}
+		if hisVisEvent != nil {
+			if hisVis, hisVisErr := hisVisEvent.HistoryVisibility(); hisVisErr == nil {
+				historyVisibility = hisVis
+			}
+		}
+		if err = d.updateRoomState(ctx, txn, removedEventIDs, nil, 0, 0); err != nil {
+			return err
+		}
+		for _, event := range addedEvents {
+			event.Visibility = historyVisibility
+			pos, err := d.OutputEvents.InsertEvent(
+				ctx, txn, event, []string{event.EventID()}, nil, nil, true, historyVisibility,
+			)
+			if err != nil {
+				return fmt.Errorf("d.OutputEvents.InsertEvent: %w", err)
+			}
+			topoPosition, err := d.Topology.InsertEventInTopology(ctx, txn, event, pos)
+			if err != nil {
+				return fmt.Errorf("d.Topology.InsertEventInTopology: %w", err)
+			}
+			if err = d.updateRoomState(ctx, txn, nil, []*rstypes.HeaderedEvent{event}, pos, topoPosition); err != nil {
+				return err
+			}
+			pduPosition = pos
+		}
+		return nil
+	})
+	return pduPosition, returnErr
+}
+
 // This function should always be called within a sqlutil.Writer for safety in SQLite.
 func (d *Database) updateRoomState(
 	ctx context.Context, txn *sql.Tx,
@@ -331,10 +377,25 @@ func (d *Database) updateRoomState(
 	return nil
 }
 
+// filterLastUsedInterval is how often the last use of a filter is recorded.
+const filterLastUsedInterval = time.Hour
+
 func (d *Database) GetFilter(
 	ctx context.Context, target *synctypes.Filter, localpart string, filterID string,
 ) error {
-	return d.Filter.SelectFilter(ctx, nil, target, localpart, filterID)
+	lastUsed, err := d.Filter.SelectFilter(ctx, nil, target, localpart, filterID)
+	if err != nil {
+		return err
+	}
+	// Unused filters are cleaned up hourly at most, so only write when the
+	// last use is older than that rather than on every lookup.
+	now := time.Now()
+	if now.Sub(lastUsed.Time()) < filterLastUsedInterval {
+		return nil
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Filter.UpdateFilterLastUsed(ctx, txn, localpart, filterID, spec.AsTimestamp(now))
+	})
 }
 
 func (d *Database) PutFilter(
@@ -344,11 +405,23 @@ func (d *Database) PutFilter(
 	var err error
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		filterID, err = d.Filter.InsertFilter(ctx, txn, filter, localpart)
-		return err
+		if err != nil {
+			return err
+		}
+		// The filter may already have existed, so always mark it as used
+		return d.Filter.UpdateFilterLastUsed(ctx, txn, localpart, filterID, spec.AsTimestamp(time.Now()))
 	})
 	return filterID, err
 }
 
+func (d *Database) DeleteUnusedFilters(ctx context.Context, unusedSince spec.Timestamp) (count int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		count, err = d.Filter.DeleteFiltersUnusedSince(ctx, txn, unusedSince)
+		return err
+	})
+	return count, err
+}
+
 func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *rstypes.HeaderedEvent, querier api.QuerySenderIDAPI) error {
 	redactedEvents, err := d.Events(ctx, []string{redactedEventID})
 	if err != nil {
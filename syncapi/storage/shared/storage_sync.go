@@ -695,6 +695,23 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+func (d *Database) PurgeHistory(ctx context.Context, roomID string, eventIDs []string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.OutputEvents.PurgeEventsByID(ctx, txn, roomID, eventIDs); err != nil {
+			return fmt.Errorf("failed to purge events: %w", err)
+		}
+		if err := d.Topology.PurgeEventsTopologyByID(ctx, txn, roomID, eventIDs); err != nil {
+			return fmt.Errorf("failed to purge events topology: %w", err)
+		}
+		for _, eventID := range eventIDs {
+			if err := d.Relations.DeleteRelation(ctx, txn, roomID, eventID); err != nil {
+				return fmt.Errorf("failed to purge relations: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
 func (d *Database) PurgeRoomState(
 	ctx context.Context, roomID string,
 ) error {
@@ -0,0 +1,35 @@
+// Copyright 2024 New Vector Ltd.
+//
+// SPDX-License-Identifier: AGPL-3.0-only OR LicenseRef-Element-Commercial
+// Please see LICENSE files in the repository root for full details.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// UpAddFilterLastUsedColumn adds the last used timestamp to filters. Existing
+// filters are marked as used now, so they aren't cleaned up straight away.
+func UpAddFilterLastUsedColumn(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if exists", so check if the column exists. If the query doesn't return an error, it already exists.
+	rows, err := tx.QueryContext(ctx, "SELECT last_used_ts FROM syncapi_filter LIMIT 1")
+	if err == nil {
+		_ = rows.Close()
+	} else {
+		_, err = tx.ExecContext(ctx, "ALTER TABLE syncapi_filter ADD COLUMN last_used_ts BIGINT NOT NULL DEFAULT 0")
+		if err != nil {
+			return fmt.Errorf("failed to execute upgrade: %w", err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE syncapi_filter SET last_used_ts = $1 WHERE last_used_ts = 0", spec.AsTimestamp(time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
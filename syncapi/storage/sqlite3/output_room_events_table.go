@@ -635,6 +635,17 @@ func (s *outputRoomEventsStatements) PurgeEvents(
 	return err
 }
 
+func (s *outputRoomEventsStatements) PurgeEventsByID(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	params := make([]interface{}, len(eventIDs))
+	for i := range eventIDs {
+		params[i] = eventIDs[i]
+	}
+	query := "DELETE FROM syncapi_output_room_events WHERE event_id IN ($1)"
+	return sqlutil.RunLimitedVariablesExec(ctx, query, txn, params, sqlutil.SQLite3MaxVariables)
+}
+
 func (s *outputRoomEventsStatements) ReIndex(ctx context.Context, txn *sql.Tx, limit, afterID int64, types []string) (map[int64]rstypes.HeaderedEvent, error) {
 	params := make([]interface{}, len(types)+1)
 	params[0] = afterID
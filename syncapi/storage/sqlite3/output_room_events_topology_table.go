@@ -181,3 +181,14 @@ func (s *outputRoomEventsTopologyStatements) PurgeEventsTopology(
 	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) PurgeEventsTopologyByID(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string,
+) error {
+	params := make([]interface{}, len(eventIDs))
+	for i := range eventIDs {
+		params[i] = eventIDs[i]
+	}
+	query := "DELETE FROM syncapi_output_room_events_topology WHERE event_id IN ($1)"
+	return sqlutil.RunLimitedVariablesExec(ctx, query, txn, params, sqlutil.SQLite3MaxVariables)
+}
@@ -3,11 +3,13 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	"github.com/element-hq/dendrite/roomserver/api"
@@ -1066,3 +1068,62 @@ func TestRedaction(t *testing.T) {
 		}
 	})
 }
+
+func TestPurgeHistory(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	oldEvent := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "old"})
+	newEvent := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "new"})
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		MustWriteEvents(t, db, room.Events())
+
+		if err := db.PurgeHistory(context.Background(), room.ID, []string{oldEvent.EventID()}); err != nil {
+			t.Fatal(err)
+		}
+
+		evs, err := db.Events(context.Background(), []string{oldEvent.EventID(), newEvent.EventID()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(evs) != 1 || evs[0].EventID() != newEvent.EventID() {
+			t.Fatalf("expected only the new event to remain, got %d events", len(evs))
+		}
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			if _, _, err = snapshot.PositionInTopology(context.Background(), oldEvent.EventID()); err == nil {
+				t.Fatal("expected purged event to be removed from the topology")
+			}
+			if _, _, err = snapshot.PositionInTopology(context.Background(), newEvent.EventID()); err != nil {
+				t.Fatalf("expected remaining event to be in the topology: %s", err)
+			}
+		})
+	})
+}
+
+func TestDeleteUnusedFilters(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		defer close()
+
+		filter := synctypes.DefaultFilter()
+		filterID, err := db.PutFilter(ctx, "alice", &filter)
+		assert.NoError(t, err)
+
+		// The filter was just created, so it is not removed
+		count, err := db.DeleteUnusedFilters(ctx, spec.AsTimestamp(time.Now().Add(-time.Minute)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+
+		// Loading the filter marks it as used
+		got := synctypes.DefaultFilter()
+		assert.NoError(t, db.GetFilter(ctx, &got, "alice", filterID))
+
+		count, err = db.DeleteUnusedFilters(ctx, spec.AsTimestamp(time.Now().Add(time.Minute)))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+
+		got = synctypes.DefaultFilter()
+		assert.ErrorIs(t, db.GetFilter(ctx, &got, "alice", filterID), sql.ErrNoRows)
+	})
+}
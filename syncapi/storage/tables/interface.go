@@ -72,6 +72,8 @@ type Events interface {
 	SelectContextAfterEvent(ctx context.Context, txn *sql.Tx, id int, roomID string, filter *synctypes.RoomEventFilter) (int, []*rstypes.HeaderedEvent, error)
 
 	PurgeEvents(ctx context.Context, txn *sql.Tx, roomID string) error
+	// PurgeEventsByID removes the given events from the room.
+	PurgeEventsByID(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string) error
 	ReIndex(ctx context.Context, txn *sql.Tx, limit, offset int64, types []string) (map[int64]rstypes.HeaderedEvent, error)
 }
 
@@ -91,6 +93,8 @@ type Topology interface {
 	// SelectStreamToTopologicalPosition converts a stream position to a topological position by finding the nearest topological position in the room.
 	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition, forward bool) (topoPos types.StreamPosition, err error)
 	PurgeEventsTopology(ctx context.Context, txn *sql.Tx, roomID string) error
+	// PurgeEventsTopologyByID removes the given events from the room's topology.
+	PurgeEventsTopologyByID(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string) error
 }
 
 type CurrentRoomState interface {
@@ -172,8 +176,12 @@ type SendToDevice interface {
 }
 
 type Filter interface {
-	SelectFilter(ctx context.Context, txn *sql.Tx, target *synctypes.Filter, localpart string, filterID string) error
+	// SelectFilter loads the filter into target and returns when it was last used.
+	SelectFilter(ctx context.Context, txn *sql.Tx, target *synctypes.Filter, localpart string, filterID string) (lastUsed spec.Timestamp, err error)
 	InsertFilter(ctx context.Context, txn *sql.Tx, filter *synctypes.Filter, localpart string) (filterID string, err error)
+	UpdateFilterLastUsed(ctx context.Context, txn *sql.Tx, localpart, filterID string, ts spec.Timestamp) error
+	// DeleteFiltersUnusedSince deletes filters not used since the given time and returns the number of deleted filters.
+	DeleteFiltersUnusedSince(ctx context.Context, txn *sql.Tx, ts spec.Timestamp) (int64, error)
 }
 
 type Receipts interface {
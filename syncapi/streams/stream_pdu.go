@@ -9,6 +9,7 @@ import (
 	"github.com/element-hq/dendrite/internal/caching"
 	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
 	rstypes "github.com/element-hq/dendrite/roomserver/types"
+	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/syncapi/internal"
 	"github.com/element-hq/dendrite/syncapi/storage"
 	"github.com/element-hq/dendrite/syncapi/synctypes"
@@ -37,6 +38,7 @@ type PDUStreamProvider struct {
 	lazyLoadCache caching.LazyLoadCache
 	rsAPI         roomserverAPI.SyncRoomserverAPI
 	notifier      *notifier.Notifier
+	retention     *config.Retention
 }
 
 func (p *PDUStreamProvider) Setup(
@@ -377,6 +379,12 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		}
 	}
 
+	// Hide events which have expired but haven't been purged yet
+	recentEvents, err = internal.ApplyRetentionFilter(ctx, snapshot, p.retention, delta.RoomID, recentEvents)
+	if err != nil {
+		return r.From, fmt.Errorf("ApplyRetentionFilter: %w", err)
+	}
+
 	// Applies the history visibility rules
 	events, err := applyHistoryVisibilityFilter(ctx, snapshot, p.rsAPI, delta.RoomID, device.UserID, recentEvents)
 	if err != nil {
@@ -586,6 +594,10 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	// transaction IDs for complete syncs, but we do it anyway because Sytest demands it for:
 	// "Can sync a room with a message with a transaction id" - which does a complete sync to check.
 	recentEvents := snapshot.StreamEventsToEvents(ctx, device, recentStreamEvents, p.rsAPI)
+	recentEvents, err = internal.ApplyRetentionFilter(ctx, snapshot, p.retention, roomID, recentEvents)
+	if err != nil {
+		return jr, err
+	}
 
 	events := recentEvents
 	// Only apply history visibility checks if the response is for joined rooms
@@ -6,6 +6,7 @@ import (
 	"github.com/element-hq/dendrite/internal/caching"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	rsapi "github.com/element-hq/dendrite/roomserver/api"
+	"github.com/element-hq/dendrite/setup/config"
 	"github.com/element-hq/dendrite/syncapi/notifier"
 	"github.com/element-hq/dendrite/syncapi/storage"
 	"github.com/element-hq/dendrite/syncapi/types"
@@ -28,6 +29,7 @@ func NewSyncStreamProviders(
 	d storage.Database, userAPI userapi.SyncUserAPI,
 	rsAPI rsapi.SyncRoomserverAPI,
 	eduCache *caching.EDUCache, lazyLoadCache caching.LazyLoadCache, notifier *notifier.Notifier,
+	retention *config.Retention,
 ) *Streams {
 	streams := &Streams{
 		PDUStreamProvider: &PDUStreamProvider{
@@ -35,6 +37,7 @@ func NewSyncStreamProviders(
 			lazyLoadCache:         lazyLoadCache,
 			rsAPI:                 rsAPI,
 			notifier:              notifier,
+			retention:             retention,
 		},
 		TypingStreamProvider: &TypingStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
@@ -22,6 +22,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
+	"github.com/element-hq/dendrite/internal/caching"
 	"github.com/element-hq/dendrite/internal/sqlutil"
 	roomserverAPI "github.com/element-hq/dendrite/roomserver/api"
 	"github.com/element-hq/dendrite/setup/config"
@@ -35,16 +36,17 @@ import (
 
 // RequestPool manages HTTP long-poll connections for /sync
 type RequestPool struct {
-	db       storage.Database
-	cfg      *config.SyncAPI
-	userAPI  userapi.SyncUserAPI
-	rsAPI    roomserverAPI.SyncRoomserverAPI
-	lastseen *sync.Map
-	presence *sync.Map
-	streams  *streams.Streams
-	Notifier *notifier.Notifier
-	producer PresencePublisher
-	consumer PresenceConsumer
+	db          storage.Database
+	filterCache caching.SyncFilterCache
+	cfg         *config.SyncAPI
+	userAPI     userapi.SyncUserAPI
+	rsAPI       roomserverAPI.SyncRoomserverAPI
+	lastseen    *sync.Map
+	presence    *sync.Map
+	streams     *streams.Streams
+	Notifier    *notifier.Notifier
+	producer    PresencePublisher
+	consumer    PresenceConsumer
 }
 
 type PresencePublisher interface {
@@ -57,7 +59,7 @@ type PresenceConsumer interface {
 
 // NewRequestPool makes a new RequestPool
 func NewRequestPool(
-	db storage.Database, cfg *config.SyncAPI,
+	db storage.Database, filterCache caching.SyncFilterCache, cfg *config.SyncAPI,
 	userAPI userapi.SyncUserAPI,
 	rsAPI roomserverAPI.SyncRoomserverAPI,
 	streams *streams.Streams, notifier *notifier.Notifier,
@@ -69,16 +71,17 @@ func NewRequestPool(
 		)
 	}
 	rp := &RequestPool{
-		db:       db,
-		cfg:      cfg,
-		userAPI:  userAPI,
-		rsAPI:    rsAPI,
-		lastseen: &sync.Map{},
-		presence: &sync.Map{},
-		streams:  streams,
-		Notifier: notifier,
-		producer: producer,
-		consumer: consumer,
+		db:          db,
+		filterCache: filterCache,
+		cfg:         cfg,
+		userAPI:     userAPI,
+		rsAPI:       rsAPI,
+		lastseen:    &sync.Map{},
+		presence:    &sync.Map{},
+		streams:     streams,
+		Notifier:    notifier,
+		producer:    producer,
+		consumer:    consumer,
 	}
 	go rp.cleanLastSeen()
 	go rp.cleanPresence(db, time.Minute*5)
@@ -277,7 +280,7 @@ var waitingSyncRequests = prometheus.NewGauge(
 // until a response is ready, or it times out.
 func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	// Extract values from request
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.filterCache)
 	if err != nil {
 		if err == types.ErrMalformedSyncToken {
 			return util.JSONResponse{
@@ -584,7 +587,7 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 			JSON: spec.InvalidParam("bad 'to' value"),
 		}
 	}
-	syncReq, err := newSyncRequest(req, *device, rp.db)
+	syncReq, err := newSyncRequest(req, *device, rp.db, rp.filterCache)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("newSyncRequest failed")
 		return util.JSONResponse{
@@ -8,6 +8,9 @@ package syncapi
 
 import (
 	"context"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
 
 	"github.com/element-hq/dendrite/internal/fulltext"
 	"github.com/element-hq/dendrite/internal/httputil"
@@ -41,7 +44,7 @@ func AddPublicRoutes(
 	natsInstance *jetstream.NATSInstance,
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
-	caches caching.LazyLoadCache,
+	caches caching.SyncAPICaches,
 	enableMetrics bool,
 ) {
 	js, natsClient := natsInstance.Prepare(processContext, &dendriteCfg.Global.JetStream)
@@ -53,15 +56,15 @@ func AddPublicRoutes(
 
 	eduCache := caching.NewTypingCache()
 	notifier := notifier.NewNotifier(rsAPI)
-	streams := streams.NewSyncStreamProviders(syncDB, userAPI, rsAPI, eduCache, caches, notifier)
+	streams := streams.NewSyncStreamProviders(syncDB, userAPI, rsAPI, eduCache, caches, notifier, dendriteCfg.SyncAPI.Retention)
 	notifier.SetCurrentPosition(streams.Latest(context.Background()))
 	if err = notifier.Load(context.Background(), syncDB); err != nil {
 		logrus.WithError(err).Panicf("failed to load notifier ")
 	}
 
-	var fts *fulltext.Search
+	var fts fulltext.Indexer
 	if dendriteCfg.SyncAPI.Fulltext.Enabled {
-		fts, err = fulltext.New(processContext, dendriteCfg.SyncAPI.Fulltext)
+		fts, err = newFulltextIndexer(processContext, dendriteCfg, cm)
 		if err != nil {
 			logrus.WithError(err).Panicf("failed to create full text")
 		}
@@ -77,7 +80,7 @@ func AddPublicRoutes(
 		userAPI,
 	)
 
-	requestPool := sync.NewRequestPool(syncDB, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
+	requestPool := sync.NewRequestPool(syncDB, caches, &dendriteCfg.SyncAPI, userAPI, rsAPI, streams, notifier, federationPresenceProducer, presenceConsumer, enableMetrics)
 
 	if err = presenceConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start presence consumer")
@@ -108,7 +111,7 @@ func AddPublicRoutes(
 	}
 
 	clientConsumer := consumers.NewOutputClientDataConsumer(
-		processContext, &dendriteCfg.SyncAPI, js, natsClient, syncDB, notifier,
+		processContext, &dendriteCfg.SyncAPI, js, natsClient, syncDB, rsAPI, notifier,
 		streams.AccountDataStreamProvider, fts,
 	)
 	if err = clientConsumer.Start(); err != nil {
@@ -150,4 +153,48 @@ func AddPublicRoutes(
 		rsAPI, &dendriteCfg.SyncAPI, caches, fts,
 		rateLimits,
 	)
+
+	if retention := dendriteCfg.SyncAPI.FilterRetention; retention > 0 {
+		go cleanUnusedFilters(processContext, syncDB, retention)
+	}
+}
+
+// cleanUnusedFilters deletes filters not used within the retention period,
+// shortly after startup and then hourly, until the process shuts down.
+func cleanUnusedFilters(processContext *process.ProcessContext, syncDB storage.Database, retention time.Duration) {
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	select {
+	case <-processContext.Context().Done():
+		return
+	case <-timer.C:
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		count, err := syncDB.DeleteUnusedFilters(processContext.Context(), spec.AsTimestamp(time.Now().Add(-retention)))
+		if err != nil {
+			logrus.WithError(err).Error("Failed to clean unused filters")
+		} else if count > 0 {
+			logrus.Infof("Cleaned %d unused filters", count)
+		}
+		select {
+		case <-processContext.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newFulltextIndexer creates the fulltext search backend selected in the config.
+func newFulltextIndexer(processContext *process.ProcessContext, dendriteCfg *config.Dendrite, cm *sqlutil.Connections) (fulltext.Indexer, error) {
+	cfg := dendriteCfg.SyncAPI.Fulltext
+	if cfg.Backend == config.FulltextBackendPostgres {
+		db, _, err := cm.Connection(&dendriteCfg.SyncAPI.Database)
+		if err != nil {
+			return nil, err
+		}
+		return fulltext.NewPostgres(processContext, cfg, db)
+	}
+	return fulltext.New(processContext, cfg)
 }
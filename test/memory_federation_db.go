@@ -29,6 +29,7 @@ type InMemoryFederationDatabase struct {
 	pendingEDUServers  map[spec.ServerName]struct{}
 	blacklistedServers map[spec.ServerName]struct{}
 	assumedOffline     map[spec.ServerName]struct{}
+	backoff            map[spec.ServerName]types.ServerBackoff
 	pendingPDUs        map[*receipt.Receipt]*rstypes.HeaderedEvent
 	pendingEDUs        map[*receipt.Receipt]*gomatrixserverlib.EDU
 	associatedPDUs     map[spec.ServerName]map[*receipt.Receipt]struct{}
@@ -42,6 +43,7 @@ func NewInMemoryFederationDatabase() *InMemoryFederationDatabase {
 		pendingEDUServers:  make(map[spec.ServerName]struct{}),
 		blacklistedServers: make(map[spec.ServerName]struct{}),
 		assumedOffline:     make(map[spec.ServerName]struct{}),
+		backoff:            make(map[spec.ServerName]types.ServerBackoff),
 		pendingPDUs:        make(map[*receipt.Receipt]*rstypes.HeaderedEvent),
 		pendingEDUs:        make(map[*receipt.Receipt]*gomatrixserverlib.EDU),
 		associatedPDUs:     make(map[spec.ServerName]map[*receipt.Receipt]struct{}),
@@ -236,6 +238,29 @@ func (d *InMemoryFederationDatabase) GetPendingEDUCount(
 	return count, nil
 }
 
+func (d *InMemoryFederationDatabase) GetPendingCounts(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (int64, int64, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	return int64(len(d.associatedPDUs[serverName])), int64(len(d.associatedEDUs[serverName])), nil
+}
+
+func (d *InMemoryFederationDatabase) PurgePendingForServer(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (int64, int64, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	pdus, edus := int64(len(d.associatedPDUs[serverName])), int64(len(d.associatedEDUs[serverName]))
+	delete(d.associatedPDUs, serverName)
+	delete(d.associatedEDUs, serverName)
+	return pdus, edus, nil
+}
+
 func (d *InMemoryFederationDatabase) GetPendingPDUServerNames(
 	ctx context.Context,
 ) ([]spec.ServerName, error) {
@@ -336,6 +361,43 @@ func (d *InMemoryFederationDatabase) RemoveAllServersAssumedOffine(
 	return nil
 }
 
+func (d *InMemoryFederationDatabase) SetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+	backoff types.ServerBackoff,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	d.backoff[serverName] = backoff
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) RemoveServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) error {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	delete(d.backoff, serverName)
+	return nil
+}
+
+func (d *InMemoryFederationDatabase) GetServerBackoff(
+	ctx context.Context,
+	serverName spec.ServerName,
+) (*types.ServerBackoff, error) {
+	d.dbMutex.Lock()
+	defer d.dbMutex.Unlock()
+
+	backoff, ok := d.backoff[serverName]
+	if !ok {
+		return nil, nil
+	}
+	return &backoff, nil
+}
+
 func (d *InMemoryFederationDatabase) IsServerAssumedOffline(
 	ctx context.Context,
 	serverName spec.ServerName,
@@ -432,6 +494,18 @@ func (d *InMemoryFederationDatabase) StoreKeys(ctx context.Context, results map[
 	return nil
 }
 
+func (d *InMemoryFederationDatabase) GetServerKeys(ctx context.Context, serverName spec.ServerName) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	return nil, nil
+}
+
+func (d *InMemoryFederationDatabase) DeleteServerKeys(ctx context.Context, serverName spec.ServerName, keyID gomatrixserverlib.KeyID) (int64, error) {
+	return 0, nil
+}
+
+func (d *InMemoryFederationDatabase) ExpireServerKey(ctx context.Context, request gomatrixserverlib.PublicKeyLookupRequest, expiredTS spec.Timestamp) error {
+	return nil
+}
+
 func (d *InMemoryFederationDatabase) UpdateRoom(ctx context.Context, roomID string, addHosts []types.JoinedHost, removeHosts []string, purgeRoomFirst bool) (joinedHosts []types.JoinedHost, err error) {
 	return nil, nil
 }
@@ -43,6 +43,7 @@ func CreateConfig(t *testing.T, dbType test.DBType) (*config.Dendrite, *process.
 		// use a distinct prefix else concurrent postgres/sqlite runs will clash since NATS will use
 		// the file system event with InMemory=true :(
 		cfg.Global.JetStream.TopicPrefix = fmt.Sprintf("Test_%d_", dbType)
+		cfg.Global.JetStream.StoragePath = config.Path(t.TempDir())
 		cfg.SyncAPI.Fulltext.InMemory = true
 
 		connStr, closeDb := test.PrepareDBConnectionString(t, dbType)
@@ -71,6 +72,7 @@ func CreateConfig(t *testing.T, dbType test.DBType) (*config.Dendrite, *process.
 
 		// Use a temp dir provided by go for tests, this will be cleanup by a call to t.CleanUp()
 		tempDir := t.TempDir()
+		cfg.Global.JetStream.StoragePath = config.Path(tempDir)
 		cfg.FederationAPI.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "federationapi.db"))
 		cfg.KeyServer.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "keyserver.db"))
 		cfg.MSCs.Database.ConnectionString = config.DataSource(filepath.Join("file://", tempDir, "mscs.db"))
@@ -206,7 +206,7 @@ func (s *OutputRoomEventConsumer) storeMessageStats(ctx context.Context, eventTy
 	}
 }
 
-func (s *OutputRoomEventConsumer) handleRoomUpgrade(ctx context.Context, oldRoomID, newRoomID string, localMembers []*localMembership, roomSize int) error {
+func (s *OutputRoomEventConsumer) handleRoomUpgrade(ctx context.Context, oldRoomID, newRoomID string, via spec.ServerName, localMembers []*localMembership, roomSize int) error {
 	for _, membership := range localMembers {
 		// Copy any existing push rules from old -> new room
 		changed, err := s.copyPushrules(ctx, oldRoomID, newRoomID, membership.Localpart, membership.Domain)
@@ -236,23 +236,132 @@ func (s *OutputRoomEventConsumer) handleRoomUpgrade(ctx context.Context, oldRoom
 			}
 		}
 
-		// copy existing m.tag entries, if any
-		changed, err = s.copyTags(ctx, oldRoomID, newRoomID, membership.Localpart, membership.Domain)
+		// copy existing room account data, e.g. m.tag, if any
+		copied, err := s.copyRoomAccountData(ctx, oldRoomID, newRoomID, membership.Localpart, membership.Domain)
 		if err != nil {
 			return err
 		}
-		// Inform the SyncAPI about the updated m.tag
-		if changed {
+		// Inform the SyncAPI about the copied room account data
+		for _, dataType := range copied {
 			if err = s.syncProducer.SendAccountData(membership.Localpart, eventutil.AccountData{
-				Type: "m.tag",
+				RoomID: newRoomID,
+				Type:   dataType,
 			}); err != nil {
 				return err
 			}
 		}
 	}
+
+	if s.cfg.AutoJoinUpgradedRooms && newRoomID != "" {
+		go s.joinReplacementRoom(oldRoomID, newRoomID, via, localMembers)
+	}
 	return nil
 }
 
+// joinReplacementRoomAttempts is how many times joinReplacementRoom tries to
+// join a member who isn't allowed into the replacement room (yet).
+const joinReplacementRoomAttempts = 5
+
+// joinReplacementRoom joins the local members of an upgraded room to the
+// replacement room. Joins over federation can take a while, so this is done
+// in the background rather than holding up the consumer.
+func (s *OutputRoomEventConsumer) joinReplacementRoom(oldRoomID, newRoomID string, via spec.ServerName, localMembers []*localMembership) {
+	logger := log.WithFields(log.Fields{
+		"old_room_id": oldRoomID,
+		"room_id":     newRoomID,
+	})
+	isReplacement, known, err := s.isReplacementRoom(oldRoomID, newRoomID)
+	if err != nil {
+		logger.WithError(err).Error("UserAPI: failed to check replacement room")
+		return
+	}
+	if known && !isReplacement {
+		logger.Warn("UserAPI: not joining replacement room which doesn't follow on from the old room")
+		return
+	}
+
+	var serverNames []spec.ServerName
+	if via != "" {
+		serverNames = []spec.ServerName{via}
+	}
+	// If the room was upgraded on another server then we don't know about the
+	// replacement room until the first member has joined it, so it can only
+	// be checked then.
+	verified := known
+	for _, membership := range localMembers {
+		logger := logger.WithField("user_id", membership.UserID)
+		if !s.joinMemberToReplacementRoom(logger, newRoomID, serverNames, membership) || verified {
+			continue
+		}
+		isReplacement, known, err = s.isReplacementRoom(oldRoomID, newRoomID)
+		if err == nil && known && isReplacement {
+			verified = true
+			continue
+		}
+		logger.WithError(err).Warn("UserAPI: leaving replacement room which doesn't follow on from the old room")
+		userID, err := spec.NewUserID(membership.UserID, true)
+		if err != nil {
+			logger.WithError(err).Error("UserAPI: invalid user ID")
+			return
+		}
+		if err = s.rsAPI.PerformLeave(s.ctx, &rsapi.PerformLeaveRequest{
+			RoomID: newRoomID,
+			Leaver: *userID,
+		}, &rsapi.PerformLeaveResponse{}); err != nil {
+			logger.WithError(err).Error("UserAPI: failed to leave replacement room")
+		}
+		return
+	}
+}
+
+// joinMemberToReplacementRoom joins a local member to the replacement room,
+// returning whether the member joined it.
+func (s *OutputRoomEventConsumer) joinMemberToReplacementRoom(logger *log.Entry, newRoomID string, serverNames []spec.ServerName, membership *localMembership) bool {
+	// The upgrading server sends the invites to an invite only replacement
+	// room in the background, so the member may not have been invited yet.
+	for attempt := 1; ; attempt++ {
+		_, _, err := s.rsAPI.PerformJoin(s.ctx, &rsapi.PerformJoinRequest{
+			RoomIDOrAlias: newRoomID,
+			UserID:        membership.UserID,
+			ServerNames:   serverNames,
+		})
+		if err == nil {
+			return true
+		}
+		var notAllowed rsapi.ErrNotAllowed
+		if !errors.As(err, &notAllowed) || attempt == joinReplacementRoomAttempts {
+			logger.WithError(err).Warn("UserAPI: failed to join replacement room")
+			return false
+		}
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// isReplacementRoom checks that the room a tombstone points at was created as
+// the successor of the tombstoned room, so that anyone able to send a tombstone
+// can't move local members into an arbitrary room. Returns whether we know the
+// create event of the replacement room at all, as we don't until a local user
+// has joined it if it was created on another server.
+func (s *OutputRoomEventConsumer) isReplacementRoom(oldRoomID, newRoomID string) (isReplacement, known bool, err error) {
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCreate, StateKey: ""}
+	res := &rsapi.QueryCurrentStateResponse{}
+	if err = s.rsAPI.QueryCurrentState(s.ctx, &rsapi.QueryCurrentStateRequest{
+		RoomID:      newRoomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{createTuple},
+	}, res); err != nil {
+		return false, false, err
+	}
+	createEvent, ok := res.StateEvents[createTuple]
+	if !ok || createEvent == nil {
+		return false, false, nil
+	}
+	return gjson.GetBytes(createEvent.Content(), "predecessor.room_id").Str == oldRoomID, true, nil
+}
+
 func (s *OutputRoomEventConsumer) copyPushrules(ctx context.Context, oldRoomID, newRoomID, localpart string, serverName spec.ServerName) (hasChanges bool, err error) {
 	pushRules, err := s.db.QueryPushRules(ctx, localpart, serverName)
 	if err != nil {
@@ -325,18 +434,25 @@ func (s *OutputRoomEventConsumer) updateMDirect(ctx context.Context, oldRoomID,
 	return false, nil
 }
 
-func (s *OutputRoomEventConsumer) copyTags(ctx context.Context, oldRoomID, newRoomID, localpart string, serverName spec.ServerName) (hasChanges bool, err error) {
-	tag, err := s.db.GetAccountDataByType(ctx, localpart, serverName, oldRoomID, "m.tag")
+// copyRoomAccountData copies the room account data of oldRoomID, like m.tag,
+// to newRoomID. Returns the types which were copied.
+func (s *OutputRoomEventConsumer) copyRoomAccountData(ctx context.Context, oldRoomID, newRoomID, localpart string, serverName spec.ServerName) (copied []string, err error) {
+	_, rooms, err := s.db.GetAccountData(ctx, localpart, serverName)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return false, err
-	}
-	if tag == nil {
-		return false, nil
+		return nil, err
 	}
-	if err := s.db.SaveAccountData(ctx, localpart, serverName, newRoomID, "m.tag", tag); err != nil {
-		return false, err
+	for dataType, content := range rooms[oldRoomID] {
+		// The read marker points at an event in the old room, so makes
+		// no sense in the new one.
+		if dataType == "m.fully_read" {
+			continue
+		}
+		if err = s.db.SaveAccountData(ctx, localpart, serverName, newRoomID, dataType, content); err != nil {
+			return copied, err
+		}
+		copied = append(copied, dataType)
 	}
-	return true, nil
+	return copied, nil
 }
 
 func (s *OutputRoomEventConsumer) processMessage(ctx context.Context, event *rstypes.HeaderedEvent, streamPos uint64) error {
@@ -367,7 +483,12 @@ func (s *OutputRoomEventConsumer) processMessage(ctx context.Context, event *rst
 		// Handle room upgrades
 		oldRoomID := event.RoomID().String()
 		newRoomID := gjson.GetBytes(event.Content(), "replacement_room").Str
-		if err = s.handleRoomUpgrade(ctx, oldRoomID, newRoomID, members, roomSize); err != nil {
+		// The server which upgraded the room is joined to the new room.
+		var via spec.ServerName
+		if sender, queryErr := s.rsAPI.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID()); queryErr == nil && sender != nil {
+			via = sender.Domain()
+		}
+		if err = s.handleRoomUpgrade(ctx, oldRoomID, newRoomID, via, members, roomSize); err != nil {
 			// while inconvenient, this shouldn't stop us from sending push notifications
 			log.WithError(err).Errorf("UserAPI: failed to handle room upgrade for users")
 		}
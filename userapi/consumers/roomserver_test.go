@@ -141,6 +141,98 @@ func Test_evaluatePushRules(t *testing.T) {
 	})
 }
 
+type fakeCreateEventRoomserverAPI struct {
+	rsapi.UserRoomserverAPI
+	createEvents map[string]*types.HeaderedEvent
+	// The create events of rooms which we only learn about by joining them.
+	remoteCreateEvents map[string]*types.HeaderedEvent
+	joined, left       []string
+}
+
+func (f *fakeCreateEventRoomserverAPI) QueryCurrentState(ctx context.Context, req *rsapi.QueryCurrentStateRequest, res *rsapi.QueryCurrentStateResponse) error {
+	res.StateEvents = map[gomatrixserverlib.StateKeyTuple]*types.HeaderedEvent{}
+	if ev, ok := f.createEvents[req.RoomID]; ok {
+		res.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomCreate, StateKey: ""}] = ev
+	}
+	return nil
+}
+
+func (f *fakeCreateEventRoomserverAPI) PerformJoin(ctx context.Context, req *rsapi.PerformJoinRequest) (string, spec.ServerName, error) {
+	if ev, ok := f.remoteCreateEvents[req.RoomIDOrAlias]; ok {
+		f.createEvents[req.RoomIDOrAlias] = ev
+	}
+	f.joined = append(f.joined, req.UserID)
+	return req.RoomIDOrAlias, "", nil
+}
+
+func (f *fakeCreateEventRoomserverAPI) PerformLeave(ctx context.Context, req *rsapi.PerformLeaveRequest, res *rsapi.PerformLeaveResponse) error {
+	f.left = append(f.left, req.Leaver.String())
+	return nil
+}
+
+func TestIsReplacementRoom(t *testing.T) {
+	consumer := OutputRoomEventConsumer{
+		ctx: context.Background(),
+		rsAPI: &fakeCreateEventRoomserverAPI{createEvents: map[string]*types.HeaderedEvent{
+			"!new:test":   mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!new:test","content":{"predecessor":{"room_id":"!old:test"}}}`),
+			"!other:test": mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!other:test","content":{}}`),
+		}},
+	}
+
+	testCases := []struct {
+		name          string
+		newRoomID     string
+		wantKnown     bool
+		wantIsReplace bool
+	}{
+		{name: "predecessor matches", newRoomID: "!new:test", wantKnown: true, wantIsReplace: true},
+		{name: "no predecessor", newRoomID: "!other:test", wantKnown: true, wantIsReplace: false},
+		{name: "unknown room", newRoomID: "!unknown:test", wantKnown: false, wantIsReplace: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			isReplacement, known, err := consumer.isReplacementRoom("!old:test", tc.newRoomID)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantKnown, known)
+			assert.Equal(t, tc.wantIsReplace, isReplacement)
+		})
+	}
+}
+
+func TestJoinReplacementRoom(t *testing.T) {
+	members := []*localMembership{{UserID: "@alice:test"}, {UserID: "@bob:test"}}
+
+	testCases := []struct {
+		name       string
+		newRoomID  string
+		wantJoined []string
+		wantLeft   []string
+	}{
+		{name: "known replacement room", newRoomID: "!new:test", wantJoined: []string{"@alice:test", "@bob:test"}},
+		{name: "known other room", newRoomID: "!other:test"},
+		{name: "remote replacement room", newRoomID: "!remote-new:test", wantJoined: []string{"@alice:test", "@bob:test"}},
+		{name: "remote other room", newRoomID: "!remote-other:test", wantJoined: []string{"@alice:test"}, wantLeft: []string{"@alice:test"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rsAPI := &fakeCreateEventRoomserverAPI{
+				createEvents: map[string]*types.HeaderedEvent{
+					"!new:test":   mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!new:test","content":{"predecessor":{"room_id":"!old:test"}}}`),
+					"!other:test": mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!other:test","content":{}}`),
+				},
+				remoteCreateEvents: map[string]*types.HeaderedEvent{
+					"!remote-new:test":   mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!remote-new:test","content":{"predecessor":{"room_id":"!old:test"}}}`),
+					"!remote-other:test": mustCreateEvent(t, `{"type":"m.room.create","state_key":"","room_id":"!remote-other:test","content":{}}`),
+				},
+			}
+			consumer := OutputRoomEventConsumer{ctx: context.Background(), rsAPI: rsAPI}
+			consumer.joinReplacementRoom("!old:test", tc.newRoomID, "remote", members)
+			assert.Equal(t, tc.wantJoined, rsAPI.joined)
+			assert.Equal(t, tc.wantLeft, rsAPI.left)
+		})
+	}
+}
+
 func TestLocalRoomMembers(t *testing.T) {
 	alice := test.NewUser(t)
 	_, sk, err := ed25519.GenerateKey(nil)